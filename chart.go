@@ -12,12 +12,16 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package helm2cue
 
 import (
 	"bytes"
+	"cmp"
 	"fmt"
+	"io/fs"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"slices"
@@ -66,7 +70,7 @@ type ChartOptions struct {
 	// definitions are handled. When false (the default), identical
 	// duplicate definitions are silently deduplicated but conflicting
 	// definitions cause an error. When true, the last definition wins
-	// (with a warning to stderr).
+	// (with a warning).
 	AllowDuplicateHelpers bool
 
 	// Experiments enables CUE language experiment-aware output.
@@ -74,11 +78,60 @@ type ChartOptions struct {
 	// and leverages try clauses with optional reference markers.
 	Experiments bool
 
-	// Logf, if non-nil, receives warnings and the summary line that
-	// would otherwise be printed to stderr.
+	// MaxHelperDepth is the depth to which recursive helpers are
+	// unrolled. If zero, DefaultMaxHelperDepth is used.
+	MaxHelperDepth int
+
+	// Funcs holds template functions to convert in addition to, or in
+	// place of, those of HelmConfig, such as those read by LoadFuncs.
+	Funcs map[string]PipelineFunc
+
+	// Logf, if non-nil, receives each warning and error of the
+	// ChartResult as it would be printed, followed by a summary line.
 	Logf func(format string, args ...any)
 }
 
+// ChartResult describes the CUE module generated by ConvertChartFS
+// or written by ConvertChart.
+type ChartResult struct {
+	// Files holds the contents of the module's files, keyed by
+	// slash-separated path relative to the module root, such as
+	// "cue.mod/module.cue" and "values.cue".
+	Files map[string][]byte
+
+	// Name is the chart name from Chart.yaml.
+	Name string
+
+	// Templates lists the template files that were converted, relative
+	// to the chart's templates directory. Templates that could not be
+	// converted are reported in Warnings.
+	Templates []string
+
+	// TotalTemplates is the number of template files in the chart.
+	TotalTemplates int
+
+	// Helpers lists the names of the helpers emitted in helpers.cue,
+	// in sorted order.
+	Helpers []string
+
+	// ValuesSchema is the #values schema written to values.cue.
+	ValuesSchema []byte
+
+	// Warnings lists non-fatal issues, such as templates that were
+	// skipped and helpers used in conflicting ways.
+	Warnings []string
+
+	// Errors lists inconsistencies in the values schema, or between
+	// it and values.yaml. ConvertChart fails if there are any.
+	Errors []string
+
+	// Diagnostics describes the warnings and then the errors, with
+	// their codes and positions. When no template converts, ConvertChart
+	// returns a ChartResult with only Name, TotalTemplates, Warnings and
+	// Diagnostics alongside its error.
+	Diagnostics []Diagnostic
+}
+
 // formatCUEWarnings expands a CUE error list into individual warning
 // strings, one per error, prefixed with the given context string.
 func formatCUEWarnings(prefix string, err error) []string {
@@ -91,18 +144,64 @@ func formatCUEWarnings(prefix string, err error) []string {
 }
 
 // ConvertChart converts a Helm chart directory to a CUE module in outDir.
-func ConvertChart(chartDir, outDir string, opts ChartOptions) error {
+// When the values schema is inconsistent, the module is still written
+// and the returned ChartResult describes it alongside the error.
+func ConvertChart(chartDir, outDir string, opts ChartOptions) (*ChartResult, error) {
+	res, err := ConvertChartFS(osDirFS(chartDir), opts)
+	if res == nil {
+		return nil, err
+	}
+	if err := writeModuleFiles(outDir, res.Files); err != nil {
+		return nil, err
+	}
+	return res, err
+}
+
+// osDirFS is like os.DirFS, but its errors name files by their full
+// path rather than relative to the directory.
+type osDirFS string
+
+func (dir osDirFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	f, err := os.Open(filepath.Join(string(dir), filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// writeModuleFiles writes the files of a generated module to dir.
+func writeModuleFiles(dir string, files map[string][]byte) error {
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fmt.Errorf("creating output directory: %w", err)
+		}
+		if err := os.WriteFile(path, files[name], 0o644); err != nil {
+			return fmt.Errorf("writing %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ConvertChartFS converts the Helm chart at the root of fsys to a CUE
+// module, returned in ChartResult.Files rather than written to disk.
+// When the values schema is inconsistent, the ChartResult is returned
+// alongside the error.
+func ConvertChartFS(fsys fs.FS, opts ChartOptions) (*ChartResult, error) {
 	// 1. Parse Chart.yaml.
-	metaData, err := os.ReadFile(filepath.Join(chartDir, "Chart.yaml"))
+	metaData, err := fs.ReadFile(fsys, "Chart.yaml")
 	if err != nil {
-		return fmt.Errorf("reading Chart.yaml: %w", err)
+		return nil, fmt.Errorf("reading Chart.yaml: %w", err)
 	}
 	var meta chartMetadata
 	if err := yaml.Unmarshal(metaData, &meta); err != nil {
-		return fmt.Errorf("parsing Chart.yaml: %w", err)
+		return nil, fmt.Errorf("parsing Chart.yaml: %w", err)
 	}
 	if meta.Name == "" {
-		return fmt.Errorf("chart.yaml: missing name")
+		return nil, fmt.Errorf("chart.yaml: missing name")
 	}
 
 	pkgName := sanitizePackageName(meta.Name)
@@ -110,96 +209,138 @@ func ConvertChart(chartDir, outDir string, opts ChartOptions) error {
 	// 2. Collect helpers: templates/**/*.tpl + charts/*/templates/**/*.tpl
 	var helperData [][]byte
 	var tplFiles []string
-	filepath.WalkDir(filepath.Join(chartDir, "templates"), func(path string, d os.DirEntry, err error) error {
+	fs.WalkDir(fsys, "templates", func(p string, d fs.DirEntry, err error) error {
 		if err != nil || d.IsDir() {
 			return nil
 		}
-		if filepath.Ext(path) == ".tpl" {
-			tplFiles = append(tplFiles, path)
+		if path.Ext(p) == ".tpl" {
+			tplFiles = append(tplFiles, p)
 		}
 		return nil
 	})
 	// Subchart helpers.
-	subchartsDir := filepath.Join(chartDir, "charts")
-	if entries, err := os.ReadDir(subchartsDir); err == nil {
+	if entries, err := fs.ReadDir(fsys, "charts"); err == nil {
 		for _, e := range entries {
 			if !e.IsDir() {
 				continue
 			}
-			filepath.WalkDir(filepath.Join(subchartsDir, e.Name(), "templates"), func(path string, d os.DirEntry, err error) error {
+			fs.WalkDir(fsys, path.Join("charts", e.Name(), "templates"), func(p string, d fs.DirEntry, err error) error {
 				if err != nil || d.IsDir() {
 					return nil
 				}
-				if filepath.Ext(path) == ".tpl" {
-					tplFiles = append(tplFiles, path)
+				if path.Ext(p) == ".tpl" {
+					tplFiles = append(tplFiles, p)
 				}
 				return nil
 			})
 		}
 	}
-	slices.Sort(tplFiles)
+	// Helm parses the deepest templates first, and those at one depth
+	// in reverse lexical order. A definition parsed later replaces an
+	// earlier one, as it does when given later to the converter.
+	slices.SortFunc(tplFiles, func(a, b string) int {
+		if c := cmp.Compare(strings.Count(b, "/"), strings.Count(a, "/")); c != 0 {
+			return c
+		}
+		return strings.Compare(b, a)
+	})
 	for _, f := range tplFiles {
-		data, err := os.ReadFile(f)
+		data, err := fs.ReadFile(fsys, f)
 		if err != nil {
-			return fmt.Errorf("reading helper %s: %w", f, err)
+			return nil, fmt.Errorf("reading helper %s: %w", f, err)
 		}
 		helperData = append(helperData, data)
 	}
 
+	cfg := HelmConfig()
+	cfg.Experiments = opts.Experiments
+	cfg.MaxHelperDepth = opts.MaxHelperDepth
+	maps.Copy(cfg.Funcs, opts.Funcs)
+
 	// 3. Parse all helpers once.
-	treeSet, helperFileNames, err := parseHelpers(helperData, opts.AllowDuplicateHelpers)
+	treeSet, helperFileNames, convDiags, err := parseHelpers(cfg, helperData, opts.AllowDuplicateHelpers)
 	if err != nil {
-		return fmt.Errorf("parsing helpers: %w", err)
+		return nil, fmt.Errorf("parsing helpers: %w", err)
+	}
+
+	// Diagnostics from the converter name templates by their parse
+	// names; these map them to chart files.
+	diagFiles := make(map[string]string)
+	diagLineOffsets := make(map[string]int)
+	for i, f := range tplFiles {
+		diagFiles[fmt.Sprintf("helper%d", i)] = f
+	}
+	var warnings []string
+	for _, d := range convDiags {
+		warnings = append(warnings, d.Message)
 	}
 
 	// 4. Collect templates: templates/**/*.yaml, templates/**/*.yml (skip .tpl, NOTES.txt).
-	templatesDir := filepath.Join(chartDir, "templates")
 	var templateFiles []string
-	filepath.WalkDir(templatesDir, func(path string, d os.DirEntry, err error) error {
+	fs.WalkDir(fsys, "templates", func(p string, d fs.DirEntry, err error) error {
 		if err != nil || d.IsDir() {
 			return nil
 		}
-		ext := filepath.Ext(path)
+		ext := path.Ext(p)
 		if ext != ".yaml" && ext != ".yml" {
 			return nil
 		}
-		if filepath.Base(path) == "NOTES.txt" {
+		if path.Base(p) == "NOTES.txt" {
 			return nil
 		}
-		templateFiles = append(templateFiles, path)
+		templateFiles = append(templateFiles, p)
 		return nil
 	})
 	slices.Sort(templateFiles)
 
-	cfg := HelmConfig()
-	cfg.Experiments = opts.Experiments
+	// Read values.yaml early: tpl arguments with template string
+	// defaults are converted with the templates, and it is used later
+	// for non-scalar inference, validation and copying.
+	valuesData, valuesErr := fs.ReadFile(fsys, "values.yaml")
+	if valuesErr == nil {
+		cfg.Values = valuesData
+	}
+
+	// Register every template file under its Helm name, as in
+	// {{ include (print $.Template.BasePath "/configmap.yaml") . }}.
+	templateNames := make(map[string]string)
+	for _, tmplPath := range templateFiles {
+		relPath := strings.TrimPrefix(tmplPath, "templates/")
+		templateNames[meta.Name+"/templates/"+relPath] = templateFieldName(relPath)
+	}
 
 	// 5. Convert each template.
 	var results []templateResult
-	var warnings []string
+	var diags []Diagnostic
 	totalFiles := 0
+	inputNames := make(map[string]bool)
 
 	for _, tmplPath := range templateFiles {
 		// Use path relative to templates/ for display and field naming,
 		// so subdirectory templates get unique names (e.g. alertmanager/service.yaml
 		// becomes alertmanager_service, distinct from prometheus/service.yaml).
-		relPath, _ := filepath.Rel(templatesDir, tmplPath)
-		if relPath == "" {
-			relPath = filepath.Base(tmplPath)
-		}
+		relPath := strings.TrimPrefix(tmplPath, "templates/")
 
 		totalFiles++
-		content, err := os.ReadFile(tmplPath)
+		content, err := fs.ReadFile(fsys, tmplPath)
 		if err != nil {
 			warnings = append(warnings, fmt.Sprintf("skipping %s: %v", relPath, err))
+			diags = append(diags, Diagnostic{
+				Severity: SeverityWarning,
+				Code:     CodeReadError,
+				File:     tmplPath,
+				Message:  skippedMessage(err.Error()),
+			})
 			continue
 		}
 
 		fieldName := templateFieldName(relPath)
-		docs := splitTemplateDocuments(content, treeSet)
+		docs := splitTemplateDocuments(cfg, content, treeSet)
 		if docs == nil {
-			docs = splitYAMLDocuments(content)
+			left, _ := cfg.delims()
+			docs = splitYAMLDocuments(content, left)
 		}
+		offsets := docLineOffsets(content, docs)
 
 		// Convert each document fragment.
 		var docResults []*convertResult
@@ -210,11 +351,14 @@ func ConvertChart(chartDir, outDir string, opts ChartOptions) error {
 				docFieldName = fmt.Sprintf("%s_%d", fieldName, i)
 			}
 			templateName := "chart_" + docFieldName
+			diagFiles[templateName] = tmplPath
+			diagLineOffsets[templateName] = offsets[i]
 
-			r, err := convertStructured(cfg, doc, templateName, treeSet, helperFileNames)
+			r, err := convertStructured(cfg, doc, templateName, treeSet, helperFileNames, inputNames, templateNames)
 			if err != nil {
 				warnings = append(warnings, formatCUEWarnings(
 					fmt.Sprintf("skipping %s (doc %d)", relPath, i), err)...)
+				convDiags = append(convDiags, newDiagnostic(cfg, SeverityWarning, skippedMessage(err.Error()), err))
 				allOK = false
 				break
 			}
@@ -222,6 +366,10 @@ func ConvertChart(chartDir, outDir string, opts ChartOptions) error {
 			if err := validateTemplateBody(r); err != nil {
 				warnings = append(warnings, formatCUEWarnings(
 					fmt.Sprintf("skipping %s (doc %d)", relPath, i), err)...)
+				for _, d := range cueDiagnostics(SeverityWarning, CodeInvalidCUE, tmplPath, err) {
+					d.Message = skippedMessage(d.Message)
+					diags = append(diags, d)
+				}
 				allOK = false
 				break
 			}
@@ -234,12 +382,19 @@ func ConvertChart(chartDir, outDir string, opts ChartOptions) error {
 
 		// Merge all docs for this template file into a single
 		// list-based result.
-		merged := mergeChartDocResults(docResults)
+		merged := mergeChartDocResults(relPath, docResults)
 		results = append(results, templateResult{fieldName, relPath, merged})
 	}
 
 	if len(results) == 0 {
-		return fmt.Errorf("no templates converted successfully")
+		resolveDiagnosticFiles(convDiags, diagFiles, diagLineOffsets)
+		res := &ChartResult{
+			Name:           meta.Name,
+			TotalTemplates: totalFiles,
+			Warnings:       slices.Compact(slices.Sorted(slices.Values(warnings))),
+			Diagnostics:    sortDiagnostics(append(diags, convDiags...)),
+		}
+		return res, fmt.Errorf("no templates converted successfully")
 	}
 
 	// 6. Merge across all results.
@@ -250,13 +405,26 @@ func ConvertChart(chartDir, outDir string, opts ChartOptions) error {
 	mergedNonScalarRefs := make(map[string][][]string)
 	needsNonzero := false
 	mergedUsedHelpers := make(map[string]HelperDef)
+	mergedUsedInputs := make(map[string]inputField)
 	hasDynamicInclude := false
 
 	// Merge helpers across all results. Each per-template converter may
-	// have converted different deferred helpers depending on which
-	// templates include them. Take the first conversion of each helper.
-	mergedHelpers := make(map[string]ast.Expr)
-	mergedHelperOutputType := make(map[string]helperTypeInfo)
+	// have converted different deferred helpers, with different types,
+	// depending on which templates include them and how.
+	var sources []string
+	var templateResults []*convertResult
+	for _, tr := range results {
+		sources = append(sources, tr.filename)
+		templateResults = append(templateResults, tr.result)
+	}
+	rh := reconcileHelpers(sources, templateResults)
+	mergedHelpers := rh.helpers
+	mergedHelperOutputType := rh.outputType
+	mergedHelperForms := rh.forms
+	convDiags = append(convDiags, rh.warnings...)
+	for _, d := range rh.warnings {
+		warnings = append(warnings, d.Message)
+	}
 	firstResult := results[0].result
 
 	for _, tr := range results {
@@ -282,20 +450,19 @@ func ConvertChart(chartDir, outDir string, opts ChartOptions) error {
 		for k, v := range r.usedHelpers {
 			mergedUsedHelpers[k] = v
 		}
+		for k, v := range r.usedInputs {
+			mergedUsedInputs[k] = v
+		}
 		if r.hasDynamicInclude {
 			hasDynamicInclude = true
 		}
-		// Merge helpers: take the first conversion of each.
-		for cueName, expr := range r.helpers {
-			if _, exists := mergedHelpers[cueName]; !exists {
-				mergedHelpers[cueName] = expr
-				if t, ok := r.helperOutputType[cueName]; ok {
-					mergedHelperOutputType[cueName] = t
-				}
-			}
+		convDiags = append(convDiags, r.warnings...)
+		for _, d := range r.warnings {
+			warnings = append(warnings, d.Message)
 		}
-		warnings = append(warnings, r.warnings...)
 	}
+	resolveDiagnosticFiles(convDiags, diagFiles, diagLineOffsets)
+	diags = sortDiagnostics(append(diags, convDiags...))
 
 	// Deduplicate warnings (same helper may fail in multiple templates).
 	warnings = slices.Compact(slices.Sorted(slices.Values(warnings)))
@@ -314,6 +481,7 @@ func ConvertChart(chartDir, outDir string, opts ChartOptions) error {
 		}
 		c := &converter{
 			config:                      cfg,
+			values:                      decodeValues(cfg.Values),
 			usedContextObjects:          make(map[string]bool),
 			fieldRefs:                   make(map[string][][]string),
 			requiredRefs:                make(map[string][][]string),
@@ -321,10 +489,14 @@ func ConvertChart(chartDir, outDir string, opts ChartOptions) error {
 			nonScalarRefs:               make(map[string][][]string),
 			imports:                     make(map[string]bool),
 			usedHelpers:                 make(map[string]HelperDef),
+			usedInputs:                  make(map[string]inputField),
+			inputNames:                  inputNames,
 			treeSet:                     treeSet,
 			helperExprs:                 firstResult.helperExprs,
 			helperCUE:                   mergedHelpers,
 			helperNodes:                 make(map[string][]parse.Node),
+			helperConverting:            make(map[string]bool),
+			helperForms:                 mergedHelperForms,
 			helperOutputType:            mergedHelperOutputType,
 			helperArgFieldRefs:          make(map[string][][]string),
 			helperArgFieldRequiredRefs:  make(map[string][][]string),
@@ -338,6 +510,7 @@ func ConvertChart(chartDir, outDir string, opts ChartOptions) error {
 			undefinedHelpers:            make(map[string]string),
 			localVars:                   make(map[string]ast.Expr),
 			comments:                    make(map[ast.Expr]string),
+			emitted:                     make(map[ast.Node]parse.Node),
 			currentHelperCUEName:        cueName,
 		}
 		c.helperNodes[cueName] = tree.Root.Nodes
@@ -354,6 +527,9 @@ func ConvertChart(chartDir, outDir string, opts ChartOptions) error {
 			mergedHelpers[cueName] = cueExpr
 			c.storeHelperArgInfo(cueName, argInfo)
 		}
+		c.formatOutputNumbers()
+		c.visitHelper(cueName, tree.Root.Nodes)
+		c.visitHelperValue(cueName)
 		// Propagate state from fallback converter back to merged results.
 		if c.hasConditions || c.hasDefault || len(c.topLevelGuards) > 0 {
 			needsNonzero = true
@@ -361,32 +537,49 @@ func ConvertChart(chartDir, outDir string, opts ChartOptions) error {
 		for k, v := range c.usedHelpers {
 			mergedUsedHelpers[k] = v
 		}
+		for k, v := range c.usedInputs {
+			mergedUsedInputs[k] = v
+		}
+	}
+
+	// An include of a template file resolves to its output. With a
+	// dynamic include any of them may be included.
+	convertedFields := make(map[string]bool)
+	for _, tr := range results {
+		convertedFields[tr.fieldName] = true
+	}
+	// The include of a template that did not convert is left open (_).
+	for name, field := range templateNames {
+		cueName := firstResult.helperExprs[name]
+		_, included := mergedHelpers[cueName]
+		switch {
+		case !convertedFields[field]:
+			delete(mergedHelpers, cueName)
+		case hasDynamicInclude && !included:
+			mergedHelpers[cueName] = templateFileExpr(field)
+		}
+		if included || hasDynamicInclude {
+			firstResult.helperOrder = append(firstResult.helperOrder, name)
+		}
 	}
+	slices.Sort(firstResult.helperOrder)
 
 	// Replace firstResult's helpers with the merged set.
 	firstResult.helpers = mergedHelpers
 	firstResult.helperOutputType = mergedHelperOutputType
+	firstResult.helperForms = mergedHelperForms
+	firstResult.helperCopies = rh.copies
 
-	// 7. Create output directory structure.
-	if err := os.MkdirAll(filepath.Join(outDir, "cue.mod"), 0o755); err != nil {
-		return fmt.Errorf("creating output directory: %w", err)
-	}
-
-	// Write cue.mod/module.cue.
+	// 7. Generate the module files, starting with cue.mod/module.cue.
+	files := make(map[string][]byte)
 	moduleCUE := generatedHeader + fmt.Sprintf("module: \"helm.local/%s\"\nlanguage: {\n\tversion: \"v0.16.0\"\n}\n", meta.Name)
-	if err := os.WriteFile(filepath.Join(outDir, "cue.mod", "module.cue"), []byte(moduleCUE), 0o644); err != nil {
-		return fmt.Errorf("writing module.cue: %w", err)
-	}
+	files["cue.mod/module.cue"] = []byte(moduleCUE)
 
-	// Write helpers.cue.
-	if err := writeHelpersCUE(outDir, pkgName, firstResult, needsNonzero, mergedUsedHelpers, hasDynamicInclude, cfg.Experiments); err != nil {
-		return err
+	// helpers.cue.
+	if files["helpers.cue"], err = helpersCUE(pkgName, firstResult, needsNonzero, mergedUsedHelpers, hasDynamicInclude, cfg.Experiments, cfg.MaxHelperDepth); err != nil {
+		return nil, err
 	}
 
-	// Read values.yaml early for non-scalar inference and later validation/copying.
-	valuesPath := filepath.Join(chartDir, "values.yaml")
-	valuesData, valuesErr := os.ReadFile(valuesPath)
-
 	// Infer non-scalar types from values.yaml: fields with list values
 	// should not be typed as scalars even when templates only use them
 	// in truthiness checks. Only add paths that match existing field
@@ -419,72 +612,95 @@ func ConvertChart(chartDir, outDir string, opts ChartOptions) error {
 	if err := validateSchema(schemaCUE, cfg.ContextObjects); err != nil {
 		valWarnings = append(valWarnings, formatCUEWarnings(
 			"values schema inconsistency", err)...)
+		diags = append(diags, cueDiagnostics(SeverityError, CodeSchemaConflict, "", err)...)
 	}
 
 	if valuesErr == nil {
 		if err := validateValuesAgainstSchema(schemaCUE, valuesData, cfg.ContextObjects); err != nil {
 			valWarnings = append(valWarnings, formatCUEWarnings(
 				"values.yaml does not satisfy inferred schema", err)...)
+			diags = append(diags, cueDiagnostics(SeverityError, CodeSchemaMismatch, "values.yaml", err)...)
 		}
 	}
 
-	// Write values.cue.
-	if err := writeValuesCUE(outDir, pkgName, schemaCUE, cfg.Experiments); err != nil {
-		return err
+	// values.cue.
+	if files["values.cue"], err = valuesCUE(pkgName, schemaCUE, cfg.Experiments); err != nil {
+		return nil, err
 	}
 
-	// Write data.cue (embeds values.yaml and release.yaml via @extern(embed)).
-	if err := writeDataCUE(outDir, pkgName, cfg.Experiments); err != nil {
-		return err
+	// data.cue (embeds values.yaml and release.yaml via @extern(embed)).
+	if files["data.cue"], err = dataCUE(pkgName, cfg.Experiments); err != nil {
+		return nil, err
 	}
 
-	// Write context.cue.
-	if err := writeContextCUE(outDir, pkgName, meta, mergedContextObjects, cfg.Experiments); err != nil {
-		return err
+	// context.cue and inputs.cue, if anything uses them.
+	contextFile, err := contextCUE(pkgName, meta, mergedContextObjects, cfg.Experiments)
+	if err != nil {
+		return nil, err
+	}
+	if contextFile != nil {
+		files["context.cue"] = contextFile
+	}
+	inputsFile, err := inputsCUE(pkgName, mergedUsedInputs, cfg.Experiments)
+	if err != nil {
+		return nil, err
+	}
+	if inputsFile != nil {
+		files["inputs.cue"] = inputsFile
 	}
 
-	// Write per-template .cue files.
+	// Per-template .cue files.
 	for _, tr := range results {
-		if err := writeTemplateCUE(outDir, pkgName, tr.fieldName, tr.result, cfg.Experiments); err != nil {
-			return err
+		data, err := templateCUE(pkgName, tr.fieldName, tr.result, cfg.Experiments)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			files[tr.fieldName+".cue"] = data
 		}
 	}
 
-	// Write results.cue (aggregates all templates into a list for yaml.MarshalStream).
-	if err := writeResultsCUE(outDir, pkgName, results, cfg.Experiments); err != nil {
-		return err
+	// results.cue (aggregates all templates into a list for yaml.MarshalStream).
+	if files["results.cue"], err = resultsCUE(pkgName, results, cfg.Experiments); err != nil {
+		return nil, err
 	}
 
-	// 8. Copy values.yaml and write empty release.yaml placeholder.
+	// 8. Copy values.yaml and add an empty release.yaml placeholder.
 	if valuesErr == nil {
-		if err := os.WriteFile(filepath.Join(outDir, "values.yaml"), valuesData, 0o644); err != nil {
-			return fmt.Errorf("copying values.yaml: %w", err)
-		}
-	}
-	if err := os.WriteFile(filepath.Join(outDir, "release.yaml"), []byte{}, 0o644); err != nil {
-		return fmt.Errorf("writing release.yaml: %w", err)
+		files["values.yaml"] = valuesData
 	}
+	files["release.yaml"] = []byte{}
 
-	// 9. Print summary to stderr (or opts.Logf if set).
-	logf := opts.Logf
-	if logf == nil {
-		logf = func(format string, args ...any) {
-			fmt.Fprintf(os.Stderr, format, args...)
-		}
+	res := &ChartResult{
+		Files:          files,
+		Name:           meta.Name,
+		TotalTemplates: totalFiles,
+		Helpers:        convertedHelpers(firstResult),
+		ValuesSchema:   schemaCUE,
+		Warnings:       warnings,
+		Errors:         valWarnings,
+		Diagnostics:    diags,
 	}
-	for _, w := range warnings {
-		logf("warning: %s\n", w)
+	for _, tr := range results {
+		res.Templates = append(res.Templates, tr.filename)
 	}
-	for _, w := range valWarnings {
-		logf("error: %s\n", w)
+
+	// 9. Report the warnings and a summary.
+	if logf := opts.Logf; logf != nil {
+		for _, w := range warnings {
+			logf("warning: %s\n", w)
+		}
+		for _, w := range valWarnings {
+			logf("error: %s\n", w)
+		}
+		logf("converted %d/%d templates from %s\n",
+			len(results), totalFiles, meta.Name)
 	}
-	logf("converted %d/%d templates from %s\n",
-		len(results), totalFiles, meta.Name)
 
 	if len(valWarnings) > 0 {
-		return fmt.Errorf("values schema validation failed")
+		return res, fmt.Errorf("values schema validation failed")
 	}
-	return nil
+	return res, nil
 }
 
 var (
@@ -492,23 +708,23 @@ var (
 	yamlLeadingRe = regexp.MustCompile(`(?m)^(\s*#[^\n]*|\s*)\n`)
 )
 
+// skippedMessage returns the message of a diagnostic for a problem,
+// described by msg, that caused a template to be skipped.
+func skippedMessage(msg string) string {
+	return "template skipped: " + msg
+}
+
 // splitYAMLDocuments splits raw template bytes on YAML document
 // separator lines (^---) and strips leading blank lines and YAML
-// comment lines from each fragment. Empty fragments (from a leading
-// ---) are dropped. Single-document files return one fragment.
-func splitYAMLDocuments(content []byte) [][]byte {
+// comment lines from each fragment. A comment line holding an action,
+// which starts with the delimiter left, is kept, as its action may
+// check the values. Empty fragments (from a leading ---) are dropped.
+// Single-document files return one fragment.
+func splitYAMLDocuments(content []byte, left string) [][]byte {
 	parts := yamlDocSep.Split(string(content), -1)
 	var docs [][]byte
 	for _, p := range parts {
-		// Strip leading blank/comment lines.
-		s := p
-		for {
-			loc := yamlLeadingRe.FindStringIndex(s)
-			if loc == nil || loc[0] != 0 {
-				break
-			}
-			s = s[loc[1]:]
-		}
+		s := trimLeadingLines(p, left)
 		s = strings.TrimRight(s, "\n\t ")
 		if s == "" {
 			continue
@@ -518,17 +734,17 @@ func splitYAMLDocuments(content []byte) [][]byte {
 	return docs
 }
 
-// writeCUEFile formats CUE source and writes it to path.
-func writeCUEFile(path string, data []byte) error {
+// formatCUEFile formats the CUE source of the named module file.
+func formatCUEFile(name string, data []byte) ([]byte, error) {
 	formatted, err := format.Source(data)
 	if err != nil {
-		return fmt.Errorf("formatting %s: %w", filepath.Base(path), err)
+		return nil, fmt.Errorf("formatting %s: %w", name, err)
 	}
-	return os.WriteFile(path, formatted, 0o644)
+	return formatted, nil
 }
 
-// writeHelpersCUE writes helpers.cue with helper definitions.
-func writeHelpersCUE(outDir, pkgName string, r *convertResult, needsNonzero bool, usedHelpers map[string]HelperDef, hasDynamicInclude, experiments bool) error {
+// helpersCUE returns helpers.cue with helper definitions.
+func helpersCUE(pkgName string, r *convertResult, needsNonzero bool, usedHelpers map[string]HelperDef, hasDynamicInclude, experiments bool, maxHelperDepth int) ([]byte, error) {
 	allImports := make(map[string]bool)
 	if needsNonzero {
 		allImports["struct"] = true
@@ -549,7 +765,7 @@ func writeHelpersCUE(outDir, pkgName string, r *convertResult, needsNonzero bool
 	if needsNonzero {
 		defDecls, err := parseHelperDefDecls(nonzeroDef, []string{"struct"}, false)
 		if err != nil {
-			return fmt.Errorf("parsing nonzero def: %w", err)
+			return nil, fmt.Errorf("parsing nonzero def: %w", err)
 		}
 		if helperDefCount > 0 {
 			allDecls = appendSectionDecls(allDecls, defDecls)
@@ -568,7 +784,7 @@ func writeHelpersCUE(outDir, pkgName string, r *convertResult, needsNonzero bool
 		h := usedHelpers[name]
 		defDecls, err := parseHelperDefDecls(h.Def, h.Imports, false)
 		if err != nil {
-			return fmt.Errorf("parsing helper def %s: %w", h.Name, err)
+			return nil, fmt.Errorf("parsing helper def %s: %w", h.Name, err)
 		}
 		if helperDefCount > 0 {
 			allDecls = appendSectionDecls(allDecls, defDecls)
@@ -579,18 +795,7 @@ func writeHelpersCUE(outDir, pkgName string, r *convertResult, needsNonzero bool
 	}
 
 	// Helper expressions (template name → CUE expression).
-	var helperDecls []ast.Decl
-	for _, name := range r.helperOrder {
-		cueName := r.helperExprs[name]
-		value := ast.Expr(ast.NewIdent("_"))
-		if cueExpr, ok := r.helpers[cueName]; ok {
-			value = cueExpr
-		}
-		helperDecls = append(helperDecls, &ast.Field{
-			Label: ast.NewIdent(cueName),
-			Value: value,
-		})
-	}
+	helperDecls := helperFieldDecls(r, maxHelperDepth)
 
 	if len(r.undefinedHelpers) > 0 {
 		var undefs []string
@@ -644,9 +849,9 @@ func writeHelpersCUE(outDir, pkgName string, r *convertResult, needsNonzero bool
 	}
 	formatted, err := formatResolvedFile(f, allImports)
 	if err != nil {
-		return fmt.Errorf("formatting helpers.cue: %w", err)
+		return nil, fmt.Errorf("formatting helpers.cue: %w", err)
 	}
-	return os.WriteFile(filepath.Join(outDir, "helpers.cue"), append([]byte(fileHeader(experiments)), formatted...), 0o644)
+	return append([]byte(fileHeader(experiments)), formatted...), nil
 }
 
 // buildValuesSchemaCUE generates the #values schema block (without a package
@@ -687,13 +892,13 @@ func buildValuesSchemaCUE(refs [][]string, requiredRefs [][]string, rangeRefs []
 	return append(b, '\n')
 }
 
-// writeValuesCUE writes values.cue with the #values schema.
-func writeValuesCUE(outDir, pkgName string, schemaCUE []byte, experiments bool) error {
+// valuesCUE returns values.cue with the #values schema.
+func valuesCUE(pkgName string, schemaCUE []byte, experiments bool) ([]byte, error) {
 	var buf bytes.Buffer
 	buf.WriteString(fileHeader(experiments))
 	fmt.Fprintf(&buf, "package %s\n\n", pkgName)
 	buf.Write(schemaCUE)
-	return writeCUEFile(filepath.Join(outDir, "values.cue"), buf.Bytes())
+	return formatCUEFile("values.cue", buf.Bytes())
 }
 
 // prependContextStubs prepends stub definitions for context objects
@@ -750,9 +955,9 @@ func validateValuesAgainstSchema(schemaCUE, valuesYAML []byte, contextObjects ma
 	return unified.Validate(cue.Concrete(true))
 }
 
-// writeDataCUE writes data.cue which uses @extern(embed) to embed
+// dataCUE returns data.cue which uses @extern(embed) to embed
 // values.yaml and release.yaml, with @tag(release_name) for CLI injection.
-func writeDataCUE(outDir, pkgName string, experiments bool) error {
+func dataCUE(pkgName string, experiments bool) ([]byte, error) {
 	var buf bytes.Buffer
 	buf.WriteString(fileHeader(experiments))
 	buf.WriteString("@extern(embed)\n\n")
@@ -763,13 +968,13 @@ func writeDataCUE(outDir, pkgName string, experiments bool) error {
 	buf.WriteString("\tName: _ @tag(release_name)\n")
 	buf.WriteString("}\n")
 
-	return writeCUEFile(filepath.Join(outDir, "data.cue"), buf.Bytes())
+	return formatCUEFile("data.cue", buf.Bytes())
 }
 
-// writeResultsCUE writes results.cue which aggregates all template outputs
+// resultsCUE returns results.cue which aggregates all template outputs
 // into a single list. Each template produces a list, so results concatenates
 // them using list.FlattenN.
-func writeResultsCUE(outDir, pkgName string, results []templateResult, experiments bool) error {
+func resultsCUE(pkgName string, results []templateResult, experiments bool) ([]byte, error) {
 	// Build list literal with field name idents.
 	listLit := &ast.ListLit{}
 	for _, tr := range results {
@@ -798,17 +1003,17 @@ func writeResultsCUE(outDir, pkgName string, results []templateResult, experimen
 		},
 	}
 	if err := astutil.Sanitize(f); err != nil {
-		return fmt.Errorf("sanitize results.cue: %w", err)
+		return nil, fmt.Errorf("sanitize results.cue: %w", err)
 	}
 	formatted, err := format.Node(f, format.Simplify())
 	if err != nil {
-		return fmt.Errorf("formatting results.cue: %w", err)
+		return nil, fmt.Errorf("formatting results.cue: %w", err)
 	}
-	return os.WriteFile(filepath.Join(outDir, "results.cue"), append([]byte(fileHeader(experiments)), formatted...), 0o644)
+	return append([]byte(fileHeader(experiments)), formatted...), nil
 }
 
-// writeContextCUE writes context.cue with definitions for used context objects.
-func writeContextCUE(outDir, pkgName string, meta chartMetadata, usedContextObjects map[string]bool, experiments bool) error {
+// contextCUE returns context.cue with definitions for used context objects.
+func contextCUE(pkgName string, meta chartMetadata, usedContextObjects map[string]bool, experiments bool) ([]byte, error) {
 	// Only write context objects that are actually used (excluding Values, which has its own file).
 	var needed []string
 	for obj := range usedContextObjects {
@@ -820,7 +1025,7 @@ func writeContextCUE(outDir, pkgName string, meta chartMetadata, usedContextObje
 	slices.Sort(needed)
 
 	if len(needed) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	var buf bytes.Buffer
@@ -858,14 +1063,39 @@ func writeContextCUE(outDir, pkgName string, meta chartMetadata, usedContextObje
 		case "Template":
 			buf.WriteString("#template: {\n")
 			buf.WriteString("\tName: *\"template\" | string\n")
-			buf.WriteString("\tBasePath: *\"templates\" | string\n")
+			fmt.Fprintf(&buf, "\tBasePath: *%s | string\n", strconv.Quote(meta.Name+"/templates"))
 			buf.WriteString("}\n")
 		case "Files":
 			buf.WriteString("#files: _\n")
 		}
 	}
 
-	return writeCUEFile(filepath.Join(outDir, "context.cue"), buf.Bytes())
+	return formatCUEFile("context.cue", buf.Bytes())
+}
+
+// inputsCUE returns inputs.cue with the #inputs definition holding
+// values lifted out of non-deterministic template functions. When
+// certificates or keys are among them, inputs.cue also embeds the PEM
+// files written by helm2cue gen-certs.
+func inputsCUE(pkgName string, usedInputs map[string]inputField, experiments bool) ([]byte, error) {
+	if len(usedInputs) == 0 {
+		return nil, nil
+	}
+	f := &ast.File{
+		Decls: append([]ast.Decl{&ast.Package{Name: ast.NewIdent(pkgName)}}, inputsDecls(usedInputs)...),
+	}
+	formatted, err := formatResolvedFile(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("formatting inputs.cue: %w", err)
+	}
+	if certs := certFileDecls(usedInputs); certs != "" {
+		src := "@extern(embed)\n\n" + string(formatted) + "\n" + certs
+		formatted, err = format.Source([]byte(src))
+		if err != nil {
+			return nil, fmt.Errorf("formatting inputs.cue: %w", err)
+		}
+	}
+	return append([]byte(fileHeader(experiments)), formatted...), nil
 }
 
 // inferNonScalarFromValues parses values.yaml and returns paths to
@@ -897,12 +1127,12 @@ func inferNonScalarFromValues(valuesData []byte) (listPaths, structPaths [][]str
 	return listPaths, structPaths
 }
 
-// writeTemplateCUE writes a per-template .cue file. The body is already
+// templateCUE returns a per-template .cue file. The body is already
 // wrapped as a list by mergeChartDocResults, so we emit it directly as
 // fieldName: [body].
-func writeTemplateCUE(outDir, pkgName, fieldName string, r *convertResult, experiments bool) error {
+func templateCUE(pkgName, fieldName string, r *convertResult, experiments bool) ([]byte, error) {
 	if len(r.body) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	// The body from mergeChartDocResults is a single embed containing
@@ -921,9 +1151,9 @@ func writeTemplateCUE(outDir, pkgName, fieldName string, r *convertResult, exper
 	}
 	formatted, err := formatResolvedFile(f, r.imports)
 	if err != nil {
-		return fmt.Errorf("formatting %s.cue: %w", fieldName, err)
+		return nil, fmt.Errorf("formatting %s.cue: %w", fieldName, err)
 	}
-	return os.WriteFile(filepath.Join(outDir, fieldName+".cue"), append([]byte(fileHeader(experiments)), formatted...), 0o644)
+	return append([]byte(fileHeader(experiments)), formatted...), nil
 }
 
 // validateTemplateBody checks that a template body is syntactically valid CUE.
@@ -982,8 +1212,9 @@ type blockWrapper struct {
 //
 // If the whole-file parse fails, it returns nil (caller should fall
 // back to splitYAMLDocuments). If no --- separator is found, it
-// returns nil.
-func splitTemplateDocuments(content []byte, treeSet map[string]*parse.Tree) [][]byte {
+// returns nil. The file is parsed, and the wrappers written, with the
+// delimiters of cfg.
+func splitTemplateDocuments(cfg *Config, content []byte, treeSet map[string]*parse.Tree) [][]byte {
 	// Quick check: any --- at all?
 	if !yamlDocSep.Match(content) {
 		return nil
@@ -997,7 +1228,8 @@ func splitTemplateDocuments(content []byte, treeSet map[string]*parse.Tree) [][]
 	for k, v := range treeSet {
 		tsCopy[k] = v
 	}
-	if _, err := tmpl.Parse(string(content), "{{", "}}", tsCopy); err != nil {
+	left, right := cfg.delims()
+	if _, err := tmpl.Parse(string(content), left, right, tsCopy); err != nil {
 		return nil
 	}
 	root := tmpl.Root
@@ -1006,7 +1238,7 @@ func splitTemplateDocuments(content []byte, treeSet map[string]*parse.Tree) [][]
 	}
 
 	// Walk the AST to find --- separators and their block context.
-	var info docSplitInfo
+	info := docSplitInfo{left: left, right: right}
 	info.varDefs = make(map[string]string)
 	walkDocBoundaries(root.Nodes, nil, &info)
 
@@ -1015,7 +1247,7 @@ func splitTemplateDocuments(content []byte, treeSet map[string]*parse.Tree) [][]
 	}
 
 	// Split the raw content on --- lines.
-	rawDocs := splitYAMLDocuments(content)
+	rawDocs := splitYAMLDocuments(content, left)
 	if len(rawDocs) <= 1 {
 		return rawDocs
 	}
@@ -1045,7 +1277,7 @@ func splitTemplateDocuments(content []byte, treeSet map[string]*parse.Tree) [][]
 		for j := len(info.boundaries[0].wrappers) - 1; j >= 0; j-- {
 			buf.WriteString(info.boundaries[0].wrappers[j].close)
 		}
-		result[0] = stripLeadingClean(buf.Bytes())
+		result[0] = stripLeadingClean(buf.Bytes(), left)
 	} else {
 		result[0] = rawDocs[0]
 	}
@@ -1079,7 +1311,7 @@ func splitTemplateDocuments(content []byte, treeSet map[string]*parse.Tree) [][]
 			}
 		}
 
-		result[i] = stripLeadingClean(buf.Bytes())
+		result[i] = stripLeadingClean(buf.Bytes(), left)
 	}
 
 	return result
@@ -1087,15 +1319,8 @@ func splitTemplateDocuments(content []byte, treeSet map[string]*parse.Tree) [][]
 
 // stripLeadingClean strips leading blank/comment lines and trailing
 // whitespace, like splitYAMLDocuments does for each fragment.
-func stripLeadingClean(data []byte) []byte {
-	s := string(data)
-	for {
-		loc := yamlLeadingRe.FindStringIndex(s)
-		if loc == nil || loc[0] != 0 {
-			break
-		}
-		s = s[loc[1]:]
-	}
+func stripLeadingClean(data []byte, left string) []byte {
+	s := trimLeadingLines(string(data), left)
 	s = strings.TrimRight(s, "\n\t ")
 	if s == "" {
 		return data
@@ -1103,6 +1328,19 @@ func stripLeadingClean(data []byte) []byte {
 	return []byte(s + "\n")
 }
 
+// trimLeadingLines strips the leading blank lines and YAML comment
+// lines of s, up to a comment line holding an action that starts with
+// the delimiter left.
+func trimLeadingLines(s, left string) string {
+	for {
+		loc := yamlLeadingRe.FindStringIndex(s)
+		if loc == nil || loc[0] != 0 || strings.Contains(s[:loc[1]], left) {
+			return s
+		}
+		s = s[loc[1]:]
+	}
+}
+
 // docBoundary records the block context and variable definitions at a
 // single --- separator.
 type docBoundary struct {
@@ -1114,6 +1352,13 @@ type docBoundary struct {
 type docSplitInfo struct {
 	boundaries []docBoundary
 	varDefs    map[string]string // accumulated $var definitions
+	left       string            // action delimiters of the file
+	right      string
+}
+
+// action returns the text of the action holding s, such as {{end}}.
+func (info *docSplitInfo) action(s string) string {
+	return info.left + s + info.right
 }
 
 // walkDocBoundaries walks a list of AST nodes looking for TextNodes
@@ -1149,7 +1394,7 @@ func walkDocBoundaries(nodes []parse.Node, wrappers []blockWrapper, info *docSpl
 				for _, v := range n.Pipe.Decl {
 					varName := v.Ident[0] // e.g. "$var"
 					// Reconstruct the declaration action text.
-					info.varDefs[varName] = "{{" + n.Pipe.String() + "}}"
+					info.varDefs[varName] = info.action(n.Pipe.String())
 				}
 			}
 
@@ -1180,8 +1425,8 @@ func walkBranchForBoundaries(br *parse.BranchNode, nodeType parse.NodeType, wrap
 		keyword = "with"
 	}
 
-	open := "{{" + keyword + " " + br.Pipe.String() + "}}\n"
-	close := "{{end}}\n"
+	open := info.action(keyword+" "+br.Pipe.String()) + "\n"
+	close := info.action("end") + "\n"
 	w := blockWrapper{open: open, close: close, isRange: nodeType == parse.NodeRange}
 
 	if br.List != nil {
@@ -1193,7 +1438,7 @@ func walkBranchForBoundaries(br *parse.BranchNode, nodeType parse.NodeType, wrap
 		// {{if A}}{{else if B}}... chain so that the entire
 		// construct is represented by a single wrapper with one
 		// {{end}}.
-		openPrefix := "{{" + keyword + " " + br.Pipe.String() + "}}"
+		openPrefix := info.action(keyword + " " + br.Pipe.String())
 		walkElseChain(br.ElseList, openPrefix, wrappers, info)
 	}
 }
@@ -1206,8 +1451,8 @@ func walkElseChain(elseList *parse.ListNode, openPrefix string, wrappers []block
 	// {{else if}} sugar: ElseList contains a single IfNode.
 	if len(elseList.Nodes) == 1 {
 		if innerIf, ok := elseList.Nodes[0].(*parse.IfNode); ok {
-			combined := openPrefix + "{{else if " + innerIf.Pipe.String() + "}}"
-			w := blockWrapper{open: combined + "\n", close: "{{end}}\n"}
+			combined := openPrefix + info.action("else if "+innerIf.Pipe.String())
+			w := blockWrapper{open: combined + "\n", close: info.action("end") + "\n"}
 
 			if innerIf.List != nil {
 				innerWrappers := append(slices.Clone(wrappers), w)
@@ -1222,8 +1467,8 @@ func walkElseChain(elseList *parse.ListNode, openPrefix string, wrappers []block
 
 	// Plain {{else}}.
 	w := blockWrapper{
-		open:  openPrefix + "{{else}}\n",
-		close: "{{end}}\n",
+		open:  openPrefix + info.action("else") + "\n",
+		close: info.action("end") + "\n",
 	}
 	innerWrappers := append(slices.Clone(wrappers), w)
 	walkDocBoundaries(elseList.Nodes, innerWrappers, info)
@@ -1232,11 +1477,13 @@ func walkElseChain(elseList *parse.ListNode, openPrefix string, wrappers []block
 // mergeChartDocResults merges per-document convertResults from a single
 // template file into a single result whose body is a CUE list expression.
 // Cross-document if guards become conditional list elements. Cross-document
-// range blocks become list.FlattenN([for ... {[...]}], -1).
-func mergeChartDocResults(results []*convertResult) *convertResult {
+// range blocks become list.FlattenN([for ... {[...]}], -1). The filename
+// names the template in diagnostics.
+func mergeChartDocResults(filename string, results []*convertResult) *convertResult {
 	merged := &convertResult{
 		imports:            make(map[string]bool),
 		usedHelpers:        make(map[string]HelperDef),
+		usedInputs:         make(map[string]inputField),
 		usedContextObjects: make(map[string]bool),
 		fieldRefs:          make(map[string][][]string),
 		requiredRefs:       make(map[string][][]string),
@@ -1254,6 +1501,9 @@ func mergeChartDocResults(results []*convertResult) *convertResult {
 		for k, v := range r.usedHelpers {
 			merged.usedHelpers[k] = v
 		}
+		for k, v := range r.usedInputs {
+			merged.usedInputs[k] = v
+		}
 		for k := range r.usedContextObjects {
 			merged.usedContextObjects[k] = true
 		}
@@ -1273,29 +1523,29 @@ func mergeChartDocResults(results []*convertResult) *convertResult {
 			merged.hasDynamicInclude = true
 		}
 
-		// Merge helper info. Helper order/exprs/undefined are the same
-		// across all results (same treeSet). Helper CUE expressions and
-		// output types may differ when deferred helpers are converted
-		// by different templates with different contexts. Merge by
-		// taking the first conversion of each helper.
+		// Helper order/exprs/undefined are the same across all
+		// results (same treeSet).
 		if i == 0 {
-			merged.helpers = make(map[string]ast.Expr)
-			merged.helperOutputType = make(map[string]helperTypeInfo)
 			merged.helperOrder = r.helperOrder
 			merged.helperExprs = r.helperExprs
 			merged.undefinedHelpers = r.undefinedHelpers
 		}
-		for cueName, expr := range r.helpers {
-			if _, exists := merged.helpers[cueName]; !exists {
-				merged.helpers[cueName] = expr
-				if t, ok := r.helperOutputType[cueName]; ok {
-					merged.helperOutputType[cueName] = t
-				}
-			}
-		}
 		merged.warnings = append(merged.warnings, r.warnings...)
 	}
 
+	// Deferred helpers may be converted by different documents with
+	// different contexts; reconcile them before the bodies are merged.
+	var sources []string
+	for i := range results {
+		sources = append(sources, fmt.Sprintf("%s (doc %d)", filename, i))
+	}
+	rh := reconcileHelpers(sources, results)
+	merged.helpers = rh.helpers
+	merged.helperOutputType = rh.outputType
+	merged.helperForms = rh.forms
+	merged.helperCopies = rh.copies
+	merged.warnings = append(merged.warnings, rh.warnings...)
+
 	// Build list body.
 	var listValue ast.Expr
 
@@ -12,18 +12,23 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package helm2cue
 
 import (
 	"bytes"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"strings"
 	"testing"
+	"testing/fstest"
 
 	"github.com/rogpeppe/go-internal/diff"
 	"gopkg.in/yaml.v3"
@@ -110,7 +115,7 @@ func TestReadmeExample(t *testing.T) {
 	// Build helm2cue binary.
 	tmpDir := t.TempDir()
 	binPath := filepath.Join(tmpDir, "helm2cue")
-	buildCmd := exec.Command("go", "build", "-o", binPath, ".")
+	buildCmd := exec.Command("go", "build", "-o", binPath, "./cmd/helm2cue")
 	if out, err := buildCmd.CombinedOutput(); err != nil {
 		t.Fatalf("go build: %v\n%s", err, out)
 	}
@@ -338,3 +343,228 @@ func yamlStreamSemanticEqual(a, b []byte) error {
 	}
 	return nil
 }
+
+// TestConvertChartResult verifies that ConvertChart describes the
+// module it writes: converted and skipped templates, helpers, the
+// values schema and warnings.
+func TestConvertChartResult(t *testing.T) {
+	chartDir := t.TempDir()
+	files := map[string]string{
+		"Chart.yaml":  "apiVersion: v2\nname: demo\nversion: 0.1.0\n",
+		"values.yaml": "name: web\n",
+		"templates/_helpers.tpl": `{{- define "demo.name" -}}{{ .Values.name }}{{- end -}}
+`,
+		"templates/configmap.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ include "demo.name" . }}
+`,
+		"templates/secret.yaml": `apiVersion: v1
+kind: Secret
+metadata:
+  name: {{ (lookup "v1" "Secret" "default" "x").metadata.name }}
+`,
+	}
+	for name, data := range files {
+		path := filepath.Join(chartDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := ConvertChart(chartDir, t.TempDir(), ChartOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Name != "demo" {
+		t.Errorf("Name = %q, want %q", res.Name, "demo")
+	}
+	if got, want := res.Templates, []string{"configmap.yaml"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Templates = %q, want %q", got, want)
+	}
+	if res.TotalTemplates != 2 {
+		t.Errorf("TotalTemplates = %d, want 2", res.TotalTemplates)
+	}
+	if got, want := res.Helpers, []string{"demo.name"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Helpers = %q, want %q", got, want)
+	}
+	if !strings.Contains(string(res.ValuesSchema), "name!:") {
+		t.Errorf("ValuesSchema does not require name:\n%s", res.ValuesSchema)
+	}
+	if len(res.Warnings) != 1 || !strings.HasPrefix(res.Warnings[0], "skipping secret.yaml") {
+		t.Errorf("Warnings = %q, want one for secret.yaml", res.Warnings)
+	}
+	if len(res.Errors) > 0 {
+		t.Errorf("unexpected errors: %q", res.Errors)
+	}
+}
+
+// TestConvertChartFS verifies that a chart can be converted from an
+// in-memory file system to an in-memory module.
+func TestConvertChartFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"Chart.yaml":  {Data: []byte("apiVersion: v2\nname: demo\nversion: 0.1.0\n")},
+		"values.yaml": {Data: []byte("name: web\n")},
+		"templates/configmap.yaml": {Data: []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}
+data:
+  name: {{ .Values.name }}
+`)},
+		"templates/NOTES.txt": {Data: []byte("Installed {{ .Release.Name }}.\n")},
+	}
+	res, err := ConvertChartFS(fsys, ChartOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"configmap.cue",
+		"context.cue",
+		"cue.mod/module.cue",
+		"data.cue",
+		"helpers.cue",
+		"release.yaml",
+		"results.cue",
+		"values.cue",
+		"values.yaml",
+	}
+	if got := slices.Sorted(maps.Keys(res.Files)); !reflect.DeepEqual(got, want) {
+		t.Errorf("Files = %q, want %q", got, want)
+	}
+	if got := string(res.Files["values.yaml"]); got != "name: web\n" {
+		t.Errorf("values.yaml = %q, want a copy of the chart's", got)
+	}
+	if !bytes.Contains(res.Files["values.cue"], res.ValuesSchema) {
+		t.Errorf("values.cue does not contain ValuesSchema:\n%s", res.Files["values.cue"])
+	}
+}
+
+func TestConvertChartDiagnostics(t *testing.T) {
+	fsys := fstest.MapFS{
+		"Chart.yaml": {Data: []byte("apiVersion: v2\nname: demo\nversion: 0.1.0\n")},
+		"templates/configmap.yaml": {Data: []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}
+`)},
+		"templates/secret.yaml": {Data: []byte(`apiVersion: v1
+kind: ConfigMap
+---
+apiVersion: v1
+kind: Secret
+data:
+  password: {{ derivePassword 1 "long" "pw" "user" "example.com" }}
+`)},
+	}
+	res, err := ConvertChartFS(fsys, ChartOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Diagnostics) != 1 {
+		t.Fatalf("Diagnostics = %v, want one", res.Diagnostics)
+	}
+	want := Diagnostic{
+		Severity:  SeverityWarning,
+		Code:      CodeUnsupportedFunc,
+		File:      "templates/secret.yaml",
+		Line:      7,
+		Column:    16,
+		Construct: `{{derivePassword 1 "long" "pw" "user" "example.com"}}`,
+		Message:   "template skipped: unsupported pipeline function: derivePassword",
+		Hint:      codeHints[CodeUnsupportedFunc],
+	}
+	if got := res.Diagnostics[0]; got != want {
+		t.Errorf("Diagnostic = %+v, want %+v", got, want)
+	}
+	if want := []string{"skipping secret.yaml (doc 1): unsupported pipeline function: derivePassword"}; !reflect.DeepEqual(res.Warnings, want) {
+		t.Errorf("Warnings = %q, want %q", res.Warnings, want)
+	}
+}
+
+// TestDocLineOffsets verifies that the line offsets of documents
+// account for blank lines at their start.
+func TestDocLineOffsets(t *testing.T) {
+	content := []byte("a: 1\n---\n\nb: 2\n---\nc: 3\n")
+	docs := [][]byte{
+		[]byte("a: 1\n"),
+		[]byte("\nb: 2\n"),
+		[]byte("c: 3\n"),
+	}
+	if got, want := docLineOffsets(content, docs), []int{0, 2, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("docLineOffsets = %v, want %v", got, want)
+	}
+}
+
+// TestGenCertsRegeneratedCA verifies that when a CA has to be
+// regenerated, the certificates it signs are regenerated too, so that
+// they verify against the new CA.
+func TestGenCertsRegeneratedCA(t *testing.T) {
+	chartDir := t.TempDir()
+	files := map[string]string{
+		"Chart.yaml":  "apiVersion: v2\nname: demo\nversion: 0.1.0\n",
+		"values.yaml": "",
+		"templates/secret.yaml": `{{- $ca := genCA "demo-ca" 365 }}
+{{- $cert := genSignedCert "svc" nil (list "svc.default.svc") 365 $ca }}
+apiVersion: v1
+kind: Secret
+data:
+  tls.crt: {{ $cert.Cert | b64enc }}
+  ca.crt: {{ $ca.Cert | b64enc }}
+`,
+	}
+	for name, data := range files {
+		path := filepath.Join(chartDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outDir := t.TempDir()
+	if _, err := ConvertChart(chartDir, outDir, ChartOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	opts := GenCertsOptions{Logf: t.Logf}
+	if err := GenCerts(outDir, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Losing only the CA files regenerates the CA, and with it the
+	// certificate it signed.
+	certsDir := filepath.Join(outDir, "certs")
+	for _, name := range []string{"ca.crt", "ca.key"} {
+		if err := os.Remove(filepath.Join(certsDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := GenCerts(outDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	ca := readCert(t, filepath.Join(certsDir, "ca.crt"))
+	leaf := readCert(t, filepath.Join(certsDir, "cert.crt"))
+	if err := leaf.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("certificate does not verify against the regenerated CA: %v", err)
+	}
+}
+
+func readCert(t *testing.T, path string) *x509.Certificate {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("no PEM data in %s", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
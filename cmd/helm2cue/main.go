@@ -0,0 +1,565 @@
+// Copyright 2026 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command helm2cue converts Helm charts and Go text/template files to
+// CUE. See the helm2cue package for the conversion itself.
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/cue-exp/helm2cue"
+	"golang.org/x/tools/txtar"
+)
+
+const usageText = `usage: helm2cue <command> [arguments]
+
+Commands:
+    chart            convert a Helm chart directory to a CUE module
+    consul-template  convert a consul-template template file to CUE
+    gen-certs        generate the certificates and keys a converted chart needs
+    gomplate         convert a gomplate template file to CUE
+    gosrc            convert the templates embedded in Go packages to CUE
+    jinja            convert a Jinja2 template or Ansible defaults file to CUE
+    levant           convert a levant Nomad job template file to CUE
+    template         convert a Go text/template file to CUE
+    version          print helm2cue version information
+
+Run "helm2cue help" for more information.
+`
+
+func main() {
+	os.Exit(main1())
+}
+
+func main1() int {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usageText)
+		return 1
+	}
+
+	switch os.Args[1] {
+	case "chart":
+		return cmdChart(os.Args[2:])
+	case "consul-template":
+		return cmdConsulTemplate(os.Args[2:])
+	case "gen-certs":
+		return cmdGenCerts(os.Args[2:])
+	case "gomplate":
+		return cmdGomplate(os.Args[2:])
+	case "gosrc":
+		return cmdGoSrc(os.Args[2:])
+	case "jinja":
+		return cmdJinja(os.Args[2:])
+	case "levant":
+		return cmdLevant(os.Args[2:])
+	case "template":
+		return cmdTemplate(os.Args[2:])
+	case "version":
+		cmdVersion()
+		return 0
+	case "help", "-h", "--help":
+		fmt.Print(usageText)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "helm2cue: unknown command %q\n", os.Args[1])
+		fmt.Fprint(os.Stderr, usageText)
+		return 1
+	}
+}
+
+func cmdChart(args []string) int {
+	fs := flag.NewFlagSet("chart", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	allowDup := fs.Bool("allow-duplicate-helpers", false, "allow conflicting helper definitions (last wins)")
+	experiments := fs.Bool("experiments", false, "enable CUE language experiments (try, explicitopen)")
+	maxHelperDepth := fs.Int("max-helper-depth", helm2cue.DefaultMaxHelperDepth, "depth to which recursive helpers are unrolled")
+	jsonOut := fs.Bool("json", false, "print diagnostics as JSON, one object per line")
+	funcsFile := fs.String("funcs", "", "YAML or CUE `file` mapping template functions to CUE")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "usage: helm2cue chart [-allow-duplicate-helpers] [-experiments] [-funcs file] [-json] [-max-helper-depth n] <chart-dir> <output-dir>\n")
+		return 1
+	}
+	funcs, err := loadFuncs(*funcsFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "helm2cue: %v\n", err)
+		return 1
+	}
+	opts := helm2cue.ChartOptions{
+		AllowDuplicateHelpers: *allowDup,
+		Experiments:           *experiments,
+		MaxHelperDepth:        *maxHelperDepth,
+		Funcs:                 funcs,
+	}
+	res, err := helm2cue.ConvertChart(fs.Arg(0), fs.Arg(1), opts)
+	if res != nil {
+		printDiagnostics(res.Diagnostics, *jsonOut)
+		if len(res.Templates) > 0 && !*jsonOut {
+			fmt.Fprintf(os.Stderr, "converted %d/%d templates from %s\n",
+				len(res.Templates), res.TotalTemplates, res.Name)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "helm2cue: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// loadFuncs reads the function-mapping file of the -funcs flag, if
+// one is given.
+func loadFuncs(filename string) (map[string]helm2cue.PipelineFunc, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return helm2cue.LoadFuncs(filename, data)
+}
+
+// printDiagnostics prints diags to stderr, as text with any hints
+// indented below, or as JSON objects one per line.
+func printDiagnostics(diags []helm2cue.Diagnostic, jsonOut bool) {
+	enc := json.NewEncoder(os.Stderr)
+	for _, d := range diags {
+		if jsonOut {
+			enc.Encode(d)
+			continue
+		}
+		fmt.Fprintln(os.Stderr, d)
+		if d.Hint != "" {
+			fmt.Fprintf(os.Stderr, "\thint: %s\n", d.Hint)
+		}
+	}
+}
+
+func cmdGenCerts(args []string) int {
+	fs := flag.NewFlagSet("gen-certs", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	force := fs.Bool("force", false, "regenerate files that already exist")
+	var tags tagFlags
+	fs.Var(&tags, "t", "set a CUE tag (key=value) when evaluating #certs; may be repeated")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: helm2cue gen-certs [-force] [-t key=value]... <cue-module-dir>\n")
+		return 1
+	}
+	opts := helm2cue.GenCertsOptions{
+		Tags:  tags,
+		Force: *force,
+	}
+	if err := helm2cue.GenCerts(fs.Arg(0), opts); err != nil {
+		fmt.Fprintf(os.Stderr, "helm2cue: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// tagFlags collects repeated -t flags.
+type tagFlags []string
+
+func (t *tagFlags) String() string { return strings.Join(*t, ",") }
+
+func (t *tagFlags) Set(s string) error {
+	*t = append(*t, s)
+	return nil
+}
+
+func cmdTemplate(args []string) int {
+	fs := flag.NewFlagSet("template", flag.ContinueOnError)
+	return convertTemplate(fs, helm2cue.TemplateConfig(), args, templateCommand{})
+}
+
+func cmdConsulTemplate(args []string) int {
+	fs := flag.NewFlagSet("consul-template", flag.ContinueOnError)
+	return convertTemplate(fs, helm2cue.ConsulTemplateConfig(), args, templateCommand{})
+}
+
+func cmdLevant(args []string) int {
+	fs := flag.NewFlagSet("levant", flag.ContinueOnError)
+	return convertTemplate(fs, helm2cue.LevantConfig(), args, templateCommand{})
+}
+
+func cmdGomplate(args []string) int {
+	fs := flag.NewFlagSet("gomplate", flag.ContinueOnError)
+	datasources := make(datasourceFlags)
+	fs.Var(datasources, "d", "embed the datasource `name=file` in the output; may be repeated")
+	pkgName := fs.String("package", "gomplate", "the CUE package `name` of the output with -d")
+	return convertTemplate(fs, helm2cue.GomplateConfig(), args, templateCommand{
+		finish: func(out []byte) ([]byte, error) {
+			if len(datasources) == 0 {
+				return out, nil
+			}
+			return helm2cue.EmbedDatasources(out, *pkgName, datasources)
+		},
+	})
+}
+
+func cmdJinja(args []string) int {
+	fs := flag.NewFlagSet("jinja", flag.ContinueOnError)
+	defaults := fs.Bool("defaults", false, "convert an Ansible defaults file to the defaults of #values")
+	return convertTemplate(fs, helm2cue.JinjaConfig(), args, templateCommand{
+		// The template comes first, followed by the files of the
+		// macros it imports.
+		isHelper: func(i int, _ string) bool { return i > 0 },
+		convert: func(cfg *helm2cue.Config, input []byte, helpers ...[]byte) (*helm2cue.Result, error) {
+			if !*defaults {
+				return helm2cue.ConvertJinja(cfg, input, helpers...)
+			}
+			if len(helpers) > 0 {
+				return nil, fmt.Errorf("-defaults takes a single file")
+			}
+			return helm2cue.ConvertAnsibleDefaults(cfg, input)
+		},
+	})
+}
+
+func cmdGoSrc(args []string) int {
+	fs := flag.NewFlagSet("gosrc", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	jsonOut := fs.Bool("json", false, "print diagnostics as JSON, one object per line")
+	funcsFile := fs.String("funcs", "", "YAML or CUE `file` mapping template functions to CUE")
+	outDir := fs.String("o", "", "write the CUE of each template to a file in `dir`")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	funcs, err := loadFuncs(*funcsFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "helm2cue: %v\n", err)
+		return 1
+	}
+	patterns := fs.Args()
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+	templates, err := helm2cue.FindGoTemplates(".", patterns...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "helm2cue: %v\n", err)
+		return 1
+	}
+
+	var archive txtar.Archive
+	used := make(map[string]bool)
+	for _, t := range templates {
+		if t.Unresolved != "" {
+			printDiagnostics([]helm2cue.Diagnostic{{
+				Severity: helm2cue.SeverityError,
+				Code:     helm2cue.CodeUnsupportedConstruct,
+				File:     t.Pos.Filename,
+				Line:     t.Pos.Line,
+				Column:   t.Pos.Column,
+				Message:  "template skipped: " + t.Unresolved,
+				Hint:     "set up the template set, and select its files, with constants in the function that parses it",
+			}}, *jsonOut)
+			continue
+		}
+		cfg, unknown := t.Config()
+		maps.Copy(cfg.Funcs, funcs)
+		var diags []helm2cue.Diagnostic
+		if t.HTML {
+			diags = append(diags, helm2cue.Diagnostic{
+				Severity: helm2cue.SeverityWarning,
+				Code:     helm2cue.CodeUnsupportedConstruct,
+				File:     t.Pos.Filename,
+				Line:     t.Pos.Line,
+				Column:   t.Pos.Column,
+				Message:  fmt.Sprintf("template %q is parsed with html/template, whose escaping of values is not converted", t.Name),
+				Hint:     "check the output for values that hold characters that HTML escapes",
+			})
+		}
+		for _, name := range unknown {
+			if _, ok := funcs[name]; ok {
+				continue
+			}
+			diags = append(diags, helm2cue.Diagnostic{
+				Severity: helm2cue.SeverityWarning,
+				Code:     helm2cue.CodeUnsupportedFunc,
+				File:     t.Pos.Filename,
+				Line:     t.Pos.Line,
+				Column:   t.Pos.Column,
+				Message:  fmt.Sprintf("function %s registered for template %q has no conversion", name, t.Name),
+				Hint:     "add a conversion for the function with -funcs",
+			})
+		}
+		res, err := helm2cue.ConvertTemplate(cfg, t.Text, t.Helpers...)
+		if res != nil {
+			for _, d := range res.Diagnostics {
+				diags = append(diags, goTemplateDiagnostic(&t, d))
+			}
+		}
+		printDiagnostics(diags, *jsonOut)
+		if err != nil {
+			if res == nil || len(res.Diagnostics) == 0 {
+				fmt.Fprintf(os.Stderr, "helm2cue: %s: %v\n", t.Pos, err)
+			}
+			continue
+		}
+		archive.Files = append(archive.Files, txtar.File{
+			Name: goTemplateFile(t.Name, used),
+			Data: res.CUE,
+		})
+	}
+	if !*jsonOut {
+		fmt.Fprintf(os.Stderr, "converted %d/%d templates\n", len(archive.Files), len(templates))
+	}
+
+	if *outDir == "" {
+		os.Stdout.Write(txtar.Format(&archive))
+	} else {
+		if err := os.MkdirAll(*outDir, 0o777); err != nil {
+			fmt.Fprintf(os.Stderr, "helm2cue: %v\n", err)
+			return 1
+		}
+		for _, f := range archive.Files {
+			if err := os.WriteFile(filepath.Join(*outDir, f.Name), f.Data, 0o666); err != nil {
+				fmt.Fprintf(os.Stderr, "helm2cue: %v\n", err)
+				return 1
+			}
+		}
+	}
+	if len(archive.Files) < len(templates) {
+		return 1
+	}
+	return 0
+}
+
+// goTemplateDiagnostic returns d, a diagnostic of converting t,
+// positioned in the file that holds the text of t if its lines are
+// those of the file, and otherwise at the call that parses t.
+func goTemplateDiagnostic(t *helm2cue.GoTemplate, d helm2cue.Diagnostic) helm2cue.Diagnostic {
+	if d.File == "" && d.Line > 0 && t.Line > 0 {
+		d.File = t.File
+		d.Line += t.Line - 1
+		return d
+	}
+	d.File, d.Line, d.Column = t.Pos.Filename, t.Pos.Line, t.Pos.Column
+	return d
+}
+
+// goTemplateFile returns the name of the CUE file for the template
+// called name, one not already used.
+func goTemplateFile(name string, used map[string]bool) string {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	base = cmp.Or(strings.ReplaceAll(base, "/", "_"), "template")
+	file := base + ".cue"
+	for i := 2; used[file]; i++ {
+		file = fmt.Sprintf("%s_%d.cue", base, i)
+	}
+	used[file] = true
+	return file
+}
+
+// datasourceFlags collects repeated -d flags, keyed by datasource
+// name. As with gomplate, a file given without a name is named after
+// the file, without its extension.
+type datasourceFlags map[string]string
+
+func (d datasourceFlags) String() string {
+	var parts []string
+	for name, file := range d {
+		parts = append(parts, name+"="+file)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (d datasourceFlags) Set(s string) error {
+	name, file, ok := strings.Cut(s, "=")
+	if !ok {
+		file = s
+		name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	if name == "" || file == "" {
+		return fmt.Errorf("invalid datasource %q", s)
+	}
+	d[name] = file
+	return nil
+}
+
+// templateCommand describes how a command converts its template.
+type templateCommand struct {
+	// convert converts the template with its helpers. If nil, it is
+	// helm2cue.ConvertTemplate.
+	convert func(cfg *helm2cue.Config, input []byte, helpers ...[]byte) (*helm2cue.Result, error)
+
+	// isHelper reports whether arg, the ith file argument, is a helper
+	// file rather than the template. If nil, helpers are .tpl files.
+	isHelper func(i int, arg string) bool
+
+	// finish, if non-nil, is applied to the CUE before it is written
+	// to standard output.
+	finish func([]byte) ([]byte, error)
+}
+
+// convertTemplate converts the template file, or standard input, and
+// helper files given by args with cfg, as described by cmd, parsing the
+// -json and -funcs flags into fs.
+func convertTemplate(fs *flag.FlagSet, cfg *helm2cue.Config, args []string, cmd templateCommand) int {
+	fs.SetOutput(os.Stderr)
+	jsonOut := fs.Bool("json", false, "print diagnostics as JSON, one object per line")
+	funcsFile := fs.String("funcs", "", "YAML or CUE `file` mapping template functions to CUE")
+	fileArgs, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 1
+	}
+	funcs, err := loadFuncs(*funcsFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "helm2cue: %v\n", err)
+		return 1
+	}
+	maps.Copy(cfg.Funcs, funcs)
+
+	var helpers [][]byte
+	var helperFiles []string
+	var templateFile string
+	isHelper := cmd.isHelper
+	if isHelper == nil {
+		isHelper = func(_ int, arg string) bool { return strings.HasSuffix(arg, ".tpl") }
+	}
+	for i, arg := range fileArgs {
+		if isHelper(i, arg) {
+			h, err := os.ReadFile(arg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "helm2cue: %v\n", err)
+				return 1
+			}
+			helpers = append(helpers, h)
+			helperFiles = append(helperFiles, arg)
+		} else {
+			if templateFile != "" {
+				fmt.Fprintf(os.Stderr, "helm2cue: multiple template files specified\n")
+				return 1
+			}
+			templateFile = arg
+		}
+	}
+
+	var input []byte
+	if templateFile != "" {
+		input, err = os.ReadFile(templateFile)
+	} else {
+		input, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "helm2cue: %v\n", err)
+		return 1
+	}
+
+	convert := cmd.convert
+	if convert == nil {
+		convert = helm2cue.ConvertTemplate
+	}
+	res, err := convert(cfg, input, helpers...)
+	if res != nil {
+		// Name the files of diagnostics as given on the command line.
+		for i, d := range res.Diagnostics {
+			switch {
+			case d.File == "" && d.Line > 0:
+				res.Diagnostics[i].File = cmp.Or(templateFile, "<stdin>")
+			case strings.HasPrefix(d.File, "helper"):
+				if n, err := strconv.Atoi(strings.TrimPrefix(d.File, "helper")); err == nil && n < len(helperFiles) {
+					res.Diagnostics[i].File = helperFiles[n]
+				}
+			}
+		}
+		if err == nil || *jsonOut {
+			printDiagnostics(res.Diagnostics, *jsonOut)
+		}
+	}
+	if err != nil {
+		switch {
+		case !*jsonOut:
+			fmt.Fprintf(os.Stderr, "helm2cue: %v\n", err)
+		case res == nil || len(res.Diagnostics) == 0:
+			// Report the error as JSON too, so that -json
+			// always describes a failure.
+			printDiagnostics([]helm2cue.Diagnostic{{
+				Severity: helm2cue.SeverityError,
+				Code:     helm2cue.CodeUnsupportedConstruct,
+				File:     cmp.Or(templateFile, "<stdin>"),
+				Message:  err.Error(),
+			}}, true)
+		}
+		return 1
+	}
+
+	out := res.CUE
+	if cmd.finish != nil {
+		if out, err = cmd.finish(out); err != nil {
+			fmt.Fprintf(os.Stderr, "helm2cue: %v\n", err)
+			return 1
+		}
+	}
+	os.Stdout.Write(out)
+	return 0
+}
+
+// parseInterspersed parses the flags of fs in args, which may follow
+// the positional arguments, as in "helm2cue template input.yaml -json",
+// and returns the positional arguments. Arguments after "--" are all
+// positional.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) < len(args) && args[len(args)-len(rest)-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+func cmdVersion() {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		fmt.Println("helm2cue: version information unavailable")
+		return
+	}
+
+	version := bi.Main.Version
+	if version == "" {
+		version = "(devel)"
+	}
+	fmt.Printf("helm2cue version %s\n\n", version)
+	fmt.Printf("go version %s\n", bi.GoVersion)
+	for _, s := range bi.Settings {
+		if s.Value == "" {
+			continue
+		}
+		fmt.Printf("%16s %s\n", s.Key, s.Value)
+	}
+}
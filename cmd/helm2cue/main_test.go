@@ -15,7 +15,9 @@
 package main
 
 import (
-	"io/fs"
+	"flag"
+	"fmt"
+	"os"
 	"os/exec"
 	"strings"
 	"testing"
@@ -23,15 +25,41 @@ import (
 	"github.com/rogpeppe/go-internal/testscript"
 )
 
-func TestCLI(t *testing.T) {
-	// Glob through testdataFS to track these files as read.
-	// testscript reads them directly from the directory.
-	if _, err := fs.Glob(testdataFS, "cli/*.txtar"); err != nil {
-		t.Fatal(err)
+var update = flag.Bool("update", false, "update testscript files in testdata")
+
+// runCue provides a "cue" command for testscript CLI tests.
+// It reads the GOTEST_CUE_PATH env var (set by Setup) to find
+// the cue binary resolved from "go tool -n cue".
+func runCue() int {
+	cuePath := os.Getenv("GOTEST_CUE_PATH")
+	if cuePath == "" {
+		fmt.Fprintln(os.Stderr, "GOTEST_CUE_PATH not set")
+		return 1
 	}
+	cmd := exec.Command(cuePath, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
 
+func TestMain(m *testing.M) {
+	testscript.Main(m, map[string]func(){
+		"helm2cue": func() { os.Exit(main1()) },
+		"cue":      func() { os.Exit(runCue()) },
+	})
+}
+
+func TestCLI(t *testing.T) {
 	// Resolve the cue binary path once via "go tool -n cue".
-	// This must run from the module root (where go.mod lives);
+	// This must run inside the module (where go.mod is found);
 	// inside testscript the cwd is the work dir with no go.mod.
 	cuePath, err := exec.Command("go", "tool", "-n", "cue").Output()
 	if err != nil {
@@ -39,7 +67,7 @@ func TestCLI(t *testing.T) {
 	}
 
 	testscript.Run(t, testscript.Params{
-		Dir:           "testdata/cli",
+		Dir:           "testdata/script",
 		UpdateScripts: *update,
 		Setup: func(e *testscript.Env) error {
 			e.Setenv("GOTEST_CUE_PATH", strings.TrimSpace(string(cuePath)))
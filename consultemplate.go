@@ -0,0 +1,280 @@
+// Copyright 2026 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm2cue
+
+import (
+	"fmt"
+	"maps"
+	"text/template/parse"
+
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/token"
+)
+
+// snapshotDef types #snapshot, the Consul, Vault and local data that a
+// consul-template template reads. Its fields are keyed by the argument
+// of the function that reads them: the key path of key, the query of
+// service, such as web or primary.web@dc1, the path of secret, the
+// variable name of env and the path of file.
+const snapshotDef = `#snapshot: {
+	kv?: [string]: string
+	services?: [string]: [...#consulService]
+	secrets?: [string]: #vaultSecret
+	env?: [string]: string
+	files?: [string]: string
+}
+#consulService: {
+	Node?:        string
+	NodeAddress?: string
+	Address?:     string
+	ID?:          string
+	Name?:        string
+	Port?:        int
+	Tags?: [...string]
+	ServiceMeta?: [string]: string
+	...
+}
+#vaultSecret: {
+	LeaseID?:       string
+	LeaseDuration?: int
+	Renewable?:     bool
+	Data?: {...}
+	...
+}
+`
+
+// snapshotHelpers declares the schema of #snapshot wherever a function
+// reading from it is used.
+var snapshotHelpers = []HelperDef{{Name: "#snapshot", Def: snapshotDef}}
+
+// ConsulTemplateConfig returns a Config for converting consul-template
+// templates, including the template stanzas of Nomad job specs. The
+// data that key, keyOrDefault, keyExists, service, secret, env and
+// file read becomes the fields of #snapshot, so that the result
+// evaluates offline against a snapshot of Consul and Vault data: for
+// example, key "app/port" becomes #snapshot.kv["app/port"]. The
+// functions of consul-template that have CUE equivalents, such as
+// toUpper and toJSON, are also converted.
+func ConsulTemplateConfig() *Config {
+	helm := HelmConfig().Funcs
+	return &Config{
+		ContextObjects: map[string]string{
+			"Snapshot": "#snapshot",
+		},
+		Funcs: map[string]PipelineFunc{
+			"key":          {ConvertContext: convertSnapshotKey, Helpers: snapshotHelpers},
+			"keyOrDefault": {ConvertContext: convertSnapshotKey, Helpers: snapshotHelpers},
+			"keyExists":    {ConvertContext: convertSnapshotKey, Helpers: snapshotHelpers},
+			"service":      {ConvertContext: convertSnapshotData, Helpers: snapshotHelpers},
+			"secret":       {ConvertContext: convertSnapshotData, Helpers: snapshotHelpers},
+			"env":          {ConvertContext: convertSnapshotEnv, Helpers: snapshotHelpers},
+			"file":         {ConvertContext: convertSnapshotFile, Helpers: snapshotHelpers},
+
+			"base64Decode": helm["b64dec"],
+			"base64Encode": helm["b64enc"],
+			"indent":       helm["indent"],
+			"join":         helm["join"],
+			"parseInt":     helm["atoi"],
+			"parseJSON":    helm["fromJson"],
+			"parseYAML":    helm["fromYaml"],
+			"replaceAll":   helm["replace"],
+			"split":        helm["splitList"],
+			"toJSON":       helm["toJson"],
+			"toJSONPretty": helm["toPrettyJson"],
+			"toLower":      helm["lower"],
+			"toTitle":      helm["title"],
+			"toUpper":      helm["upper"],
+			"toYAML":       helm["toYaml"],
+			"trimSpace":    helm["trim"],
+		},
+		CoreFuncs: map[string]bool{
+			"printf": true,
+			"print":  true,
+			"eq":     true,
+			"ne":     true,
+			"lt":     true,
+			"gt":     true,
+			"le":     true,
+			"ge":     true,
+			"and":    true,
+			"or":     true,
+			"index":  true,
+		},
+	}
+}
+
+// LevantConfig returns a Config for converting Nomad job specs rendered
+// by levant, which uses [[ and ]] as delimiters. The root context holds
+// levant's variables, which become the fields of #values. Levant's
+// consulKey, consulKeyOrDefault, consulKeyExists and fileContents read
+// #snapshot as consul-template's key, keyOrDefault, keyExists and file
+// do, and its env reads #snapshot.env; the Sprig functions that levant
+// also provides are converted as for Helm. Template stanzas in the job
+// spec use {{ and }}, so are left as text.
+func LevantConfig() *Config {
+	cfg := HelmConfig()
+	consul := ConsulTemplateConfig()
+	cfg.ContextObjects = map[string]string{
+		"Values":   "#values",
+		"Snapshot": "#snapshot",
+	}
+	cfg.FieldRemap = nil
+	cfg.Float64Objects = nil
+	cfg.RootObject = "Values"
+	cfg.RootExpr = "#values"
+	cfg.LeftDelim, cfg.RightDelim = "[[", "]]"
+	for _, name := range []string{"key", "keyOrDefault", "keyExists", "env", "file"} {
+		cfg.Funcs[name] = consul.Funcs[name]
+	}
+	maps.Copy(cfg.Funcs, map[string]PipelineFunc{
+		"parseBool": {
+			Imports: []string{"strconv"},
+			Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+				return importCall("strconv", "ParseBool", expr)
+			},
+		},
+		"parseFloat": {
+			Imports: []string{"strconv"},
+			Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+				return importCall("strconv", "ParseFloat", expr, cueInt(64))
+			},
+		},
+		"parseInt":  cfg.Funcs["atoi"],
+		"parseJSON": cfg.Funcs["fromJson"],
+		"toLower":   cfg.Funcs["lower"],
+		"toUpper":   cfg.Funcs["upper"],
+	})
+	cfg.FuncAliases = map[string]string{
+		"consulKey":          "key",
+		"consulKeyExists":    "keyExists",
+		"consulKeyOrDefault": "keyOrDefault",
+		"fileContents":       "file",
+	}
+	return cfg
+}
+
+// convertSnapshotKey converts consul-template's key path, keyOrDefault
+// path default and keyExists path, which read the Consul KV store, to
+// references to #snapshot.kv. As key blocks until the key exists, its
+// key is required; the others' are optional.
+func convertSnapshotKey(ctx *FuncContext, args []FuncArg) (ast.Expr, error) {
+	nargs := 1
+	if ctx.Name() == "keyOrDefault" {
+		nargs = 2
+	}
+	if len(args) != nargs {
+		return nil, fmt.Errorf("%s requires %d argument(s), got %d", ctx.Name(), nargs, len(args))
+	}
+	path, err := snapshotArg(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+	ref := snapshotRefArg(path, "kv")
+	switch ctx.Name() {
+	case "keyOrDefault":
+		expr, _, err := ctx.OptionalExpr(ref)
+		if err != nil {
+			return nil, err
+		}
+		defaultVal, _, err := ctx.Expr(args[1])
+		if err != nil {
+			return nil, err
+		}
+		// Unlike Sprig's default, keyOrDefault keeps a key whose
+		// value is empty.
+		return existsDefaultExpr(expr, defaultVal), nil
+	case "keyExists":
+		expr, _, err := ctx.OptionalExpr(ref)
+		if err != nil {
+			return nil, err
+		}
+		return &ast.BinaryExpr{X: expr, Op: token.NEQ, Y: &ast.BottomLit{}}, nil
+	}
+	expr, _, err := ctx.Expr(ref)
+	return expr, err
+}
+
+// convertSnapshotData converts consul-template's service query and
+// secret path to the entry of #snapshot.services or #snapshot.secrets
+// for the query or path.
+func convertSnapshotData(ctx *FuncContext, args []FuncArg) (ast.Expr, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s requires 1 argument, got %d", ctx.Name(), len(args))
+	}
+	name, err := snapshotArg(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+	field := "services"
+	if ctx.Name() == "secret" {
+		field = "secrets"
+	}
+	expr, ref, err := ctx.Expr(snapshotRefArg(name, field))
+	if err != nil {
+		return nil, err
+	}
+	if ref != nil {
+		ctx.MarkNonScalar(*ref)
+	}
+	return expr, nil
+}
+
+// convertSnapshotEnv converts consul-template's env name to the entry
+// of #snapshot.env for the variable, which, like the environment,
+// defaults to the empty string.
+func convertSnapshotEnv(ctx *FuncContext, args []FuncArg) (ast.Expr, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s requires 1 argument, got %d", ctx.Name(), len(args))
+	}
+	name, err := snapshotArg(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+	expr, _, err := ctx.OptionalExpr(snapshotRefArg(name, "env"))
+	if err != nil {
+		return nil, err
+	}
+	return ctx.c.defaultExpr(expr, cueString("")), nil
+}
+
+// convertSnapshotFile converts consul-template's file path to the
+// entry of #snapshot.files for the path.
+func convertSnapshotFile(ctx *FuncContext, args []FuncArg) (ast.Expr, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s requires 1 argument, got %d", ctx.Name(), len(args))
+	}
+	path, err := snapshotArg(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+	expr, _, err := ctx.Expr(snapshotRefArg(path, "files"))
+	return expr, err
+}
+
+// snapshotArg returns the string literal arg, the key of the #snapshot
+// entry that a function reads.
+func snapshotArg(ctx *FuncContext, arg FuncArg) (*parse.StringNode, error) {
+	s, ok := arg.Node().(*parse.StringNode)
+	if !ok {
+		return nil, fmt.Errorf("%s: the argument must be a string literal", ctx.Name())
+	}
+	return s, nil
+}
+
+// snapshotRefArg returns an argument referring to the entry of the
+// field of #snapshot keyed by the string s.
+func snapshotRefArg(s *parse.StringNode, field string) FuncArg {
+	return contextRefArg(s, "Snapshot", field, s.Text)
+}
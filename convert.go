@@ -12,17 +12,20 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package helm2cue
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"os"
+	"maps"
 	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template/parse"
+	"unicode/utf8"
 
 	"cuelang.org/go/cue/ast"
 	"cuelang.org/go/cue/ast/astutil"
@@ -31,6 +34,7 @@ import (
 	"cuelang.org/go/cue/parser"
 	"cuelang.org/go/cue/token"
 	cueyaml "cuelang.org/go/encoding/yaml"
+	"gopkg.in/yaml.v3"
 )
 
 // PipelineFunc describes how to convert a template pipeline function to CUE.
@@ -48,6 +52,14 @@ type PipelineFunc struct {
 	// If nil, the function is a no-op (expr passes through unchanged).
 	Convert func(expr ast.Expr, args []ast.Expr) ast.Expr
 
+	// ConvertContext, if set, converts the function in place of
+	// Convert, Passthrough, NonScalar and Cosmetic. It is used in every
+	// position the function can appear (values, conditions, range and
+	// with pipelines) and receives all arguments unconverted, with any
+	// piped value last. Through ctx it has the same access to the
+	// conversion as the built-in functions; see FuncContext.
+	ConvertContext func(ctx *FuncContext, args []FuncArg) (ast.Expr, error)
+
 	// Passthrough means the function also acts as a no-op when used in
 	// first-command position with a single argument: {{ func expr }}.
 	// The converter evaluates the argument and returns it directly.
@@ -80,13 +92,27 @@ type Config struct {
 	ContextObjects map[string]string
 
 	// Funcs maps template function names to pipeline handlers.
-	// Core-handled functions should not be in this map. These include
-	// Go text/template builtins (printf, print) and Sprig/Helm
+	// Core-handled functions are not in this map. These include Go
+	// text/template builtins (printf, print, and, or) and Sprig/Helm
 	// functions with special semantics (default, include, required,
 	// ternary, list, dict, get, hasKey, coalesce, max, min, empty,
-	// merge). Use CoreFuncs to control which of these are enabled.
+	// merge). Use CoreFuncs to control which of these are enabled. A
+	// function added here with the name of a core function replaces
+	// it.
 	Funcs map[string]PipelineFunc
 
+	// FuncAliases maps template function names to the names of the
+	// functions they are converted as, core-handled or in Funcs. For
+	// example, {"coll.Dict": "dict"} converts gomplate's coll.Dict as
+	// Sprig's dict. The name an alias maps to is not itself resolved
+	// as an alias.
+	//
+	// Names in Funcs and FuncAliases may be namespaced with a dot, as
+	// in strings.ToUpper. text/template parses such a name as a field
+	// of a function strings, which is converted as the function
+	// strings.ToUpper when that name is in Funcs or FuncAliases.
+	FuncAliases map[string]string
+
 	// CoreFuncs controls which core-handled functions are enabled.
 	// If nil, all core-handled functions are available (backward
 	// compatible for existing callers). If non-nil, only functions
@@ -104,17 +130,76 @@ type Config struct {
 	// level produces an error.
 	RootExpr string
 
+	// RootObject, if set, names the context object that holds the
+	// fields of the root context, for templates executed with a map of
+	// variables, such as levant's. With RootObject "Values", the
+	// template's {{ .job_name }} and {{ $.job_name }} are converted as
+	// {{ .Values.job_name }}. Fields that are context objects are
+	// unaffected, as is dot in a define, which is its argument.
+	RootObject string
+
 	// Experiments enables CUE language experiment-aware output.
 	// When true, generated CUE uses @experiment(try,explicitopen)
 	// and leverages try clauses with optional reference markers (?)
 	// instead of _nonzero-based patterns.
 	Experiments bool
+
+	// Values is the YAML of the default values, such as a chart's
+	// values.yaml. When a tpl template argument is a values path whose
+	// default here is a template string, that string is converted
+	// along with the template that uses it. Values whose default is a
+	// string are not formatted as float64 numbers (see
+	// Float64Objects).
+	Values []byte
+
+	// Float64Objects lists the context objects whose numbers are
+	// float64, as Helm decodes values.yaml, rather than int where
+	// they are whole. Interpolating such a number into text formats
+	// it as text/template prints a float64: 1e+06 rather than
+	// 1000000, and 1 rather than 1.0.
+	Float64Objects []string
+
+	// StringMapObjects lists the context objects that are maps of
+	// strings, such as gomplate's .Env. A field of one that is not
+	// set is the empty string, as a missing key of a Go map is, so
+	// its schema defaults it to "" rather than requiring it.
+	StringMapObjects []string
+
+	// MaxHelperDepth is the depth to which helpers that include
+	// themselves, directly or through other helpers, are unrolled.
+	// Data nested deeper than this fails at evaluation time. If zero,
+	// DefaultMaxHelperDepth is used.
+	MaxHelperDepth int
+
+	// Visitor, if non-nil, holds callbacks that rewrite the CUE
+	// emitted for documents, fields, helpers and ranges.
+	Visitor *Visitor
+
+	// LeftDelim and RightDelim are the action delimiters of the
+	// templates and helpers, as set by text/template's Delims, such
+	// as [[ and ]] for Nomad job specs rendered by levant. If empty,
+	// they are {{ and }}.
+	LeftDelim  string
+	RightDelim string
+}
+
+// delims returns the action delimiters of cfg.
+func (cfg *Config) delims() (left, right string) {
+	left, right = cfg.LeftDelim, cfg.RightDelim
+	if left == "" {
+		left = "{{"
+	}
+	if right == "" {
+		right = "}}"
+	}
+	return left, right
 }
 
 // TemplateConfig returns a Config for converting pure Go text/template
 // files (no Helm or Sprig functions). Only Go's built-in template
-// functions (printf, print) are enabled as core functions; Sprig
-// functions like default, include, and ternary are rejected.
+// functions (printf, print, comparisons, and, or) are enabled as core
+// functions; Sprig functions like default, include, and ternary are
+// rejected.
 func TemplateConfig() *Config {
 	return &Config{
 		ContextObjects: map[string]string{
@@ -131,6 +216,8 @@ func TemplateConfig() *Config {
 			"gt":     true,
 			"le":     true,
 			"ge":     true,
+			"and":    true,
+			"or":     true,
 		},
 	}
 }
@@ -216,6 +303,69 @@ const omitDef = `_omit: {
 }
 `
 
+// pickDef is the CUE definition for returning a dict with only the
+// specified keys, matching Sprig's pick function.
+const pickDef = `_pick: {
+	#arg!:  _
+	#pick!: _
+
+	for k, v in #arg if list.Contains(#pick, k) {
+		(k): v
+	}
+}
+`
+
+// pluckDef is the CUE definition for collecting the values of a key
+// across a list of dicts, matching Sprig's pluck function. Dicts
+// without the key are skipped.
+const pluckDef = `_pluck: {
+	#key!:   string
+	#dicts!: [...]
+	out: [for d in #dicts if d[#key] != _|_ {d[#key]}]
+}
+`
+
+// valuesDef is the CUE definition for extracting the values of a dict
+// in sorted key order, so that the result lines up with keys and with
+// Go's sorted map iteration in range.
+const valuesDef = `_values: {
+	#arg!: {...}
+	out: [for k in list.SortStrings([for k, _ in #arg {k}]) {#arg[k]}]
+}
+`
+
+// sortedFieldsDef is the CUE definition for ranging over a value in
+// text/template order: a struct is rebuilt with its fields in sorted
+// key order, and a list is passed through unchanged. Lists are tested
+// first because a list default such as *[...] | _ also unifies with a
+// struct. The argument is named #src rather than #arg so that call
+// sites inside helper bodies can pass #arg without the inner field
+// shadowing it.
+const sortedFieldsDef = `_sortedFields: {
+	#src!: _
+	out: [
+		if (#src & [...]) != _|_ {#src},
+		if (#src & {...}) != _|_ {
+			{for k in list.SortStrings([for k, _ in #src {k}]) {(k): #src[k]}}
+		},
+		#src,
+	][0]
+}
+`
+
+// fmtValueDef is the CUE definition for printing a value that may be
+// a float64 number as text/template does: in the shortest form that
+// round-trips, with an exponent from 1e+06 on, as strconv's 'g'
+// format gives. Other values are interpolated as they are.
+const fmtValueDef = `_fmtValue: {
+	#in!: _
+	out: [
+		if (#in & number) != _|_ {strconv.FormatFloat(#in, 103, -1, 64)},
+		"\(#in)",
+	][0]
+}
+`
+
 // mergeDef is the CUE definition for shallow key-level merge of two
 // structs where the first argument wins, matching Sprig's merge.
 const mergeDef = `_merge: {
@@ -306,6 +456,10 @@ type pendingResolution struct {
 	value    ast.Expr
 	comment  string
 	indent   int // YAML indent of the key
+
+	// lineEnded reports whether text ending the line of the value has
+	// been seen, so that later text cannot continue the value.
+	lineEnded bool
 }
 
 // rangeContext tracks what dot (.) refers to inside a with or range block.
@@ -348,6 +502,7 @@ type converter struct {
 	suppressRequired            bool                             // true during condition processing
 	guardedPaths                map[string]bool                  // field paths guarded by enclosing if-conditions (helmObj + "\x00" + path)
 	rangeVarStack               []rangeContext                   // stack of dot-rebinding contexts for nested range/with
+	plainRangeVars              map[string]bool                  // range value names, true if no range binding them iterates over float64 numbers (see noteRangeValues)
 	helperArgRefs               [][]string                       // field paths accessed on #arg in helper bodies
 	helperArgRequiredRefs       [][]string                       // required (value-accessed) field paths on #arg
 	helperArgRangeRefs          [][]string                       // range refs on #arg in helper bodies
@@ -361,20 +516,31 @@ type converter struct {
 	helperDirectRangeRefs       map[string]map[string][][]string // CUE name → helmObj → direct context range refs
 	helperDirectNonScalarRefs   map[string]map[string][][]string // CUE name → helmObj → direct context nonScalar refs
 	helperIncludes              map[string][]string              // CUE name → CUE names of helpers it includes
+	templateFiles               map[string]string                // Helm name of a chart template file → its CUE field
 	currentHelperCUEName        string                           // set during deferred helper conversion
 	currentActionPipe           *parse.PipeNode                  // set during actionToCUE for deferred helper context
+	node                        parse.Node                       // innermost template node being converted, to position hook warnings
+	lastNode                    parse.Node                       // template node most recently converted, for fields emitted after it
+	emitted                     map[ast.Node]parse.Node          // field or range comprehension → its template node, for Config.Visitor
 	inCondition                 bool                             // set during condition evaluation for helper type inference
-	warnings                    []string                         // non-fatal issues collected during conversion
+	textOutput                  bool                             // set when all output is parts of a string, as in text helpers
+	warnings                    []Diagnostic                     // non-fatal issues collected during conversion
 	localVars                   map[string]ast.Expr              // $varName → CUE expression
+	localVarFields              map[string]localVarField         // $varName → field it was set to
+	scopes                      []varScope                       // enclosing if, with and range bodies, innermost last
+	values                      func() any                       // Config.Values, decoded on first use; nil without values
 	topLevelGuards              []ast.Expr                       // CUE conditions wrapping entire output
 	topLevelRange               []ast.Clause                     // range clauses for top-level range
 	topLevelRangeBody           []ast.Decl                       // body inside the range
 	topLevelRangeIsList         bool                             // true when range body emits YAML list items
 	imports                     map[string]bool
-	hasConditions               bool                 // true if any if blocks or top-level guards exist
-	hasDefault                  bool                 // true if any default expressions exist
-	usedHelpers                 map[string]HelperDef // collected during conversion
-	rootExprAST                 ast.Expr             // parsed config.RootExpr, cached
+	hasConditions               bool                  // true if any if blocks or top-level guards exist
+	hasDefault                  bool                  // true if any default expressions exist
+	usedHelpers                 map[string]HelperDef  // collected during conversion
+	usedInputs                  map[string]inputField // non-hermetic values lifted into #inputs
+	inputNames                  map[string]bool       // #inputs names reserved across all templates of a conversion
+	inputHint                   string                // variable being assigned, used to name inputs
+	rootExprAST                 ast.Expr              // parsed config.RootExpr, cached
 
 	// AST construction state.
 	rootDecls             []ast.Decl // top-level declarations built during conversion
@@ -395,6 +561,14 @@ type converter struct {
 	pendingActionComment string
 	nextActionYamlIndent int // YAML indent hint from trailing whitespace line
 
+	// commentLine accumulates a YAML comment line that continues past
+	// its text, as in "# managed by {{ .Values.tool }}", with its
+	// actions as written, until the line ends.
+	commentLine *strings.Builder
+	// commentChecks holds the fail calls of the actions of
+	// commentLine, emitted after it.
+	commentChecks []ast.Expr
+
 	// Deferred list item: bare "- " followed by an action, waiting
 	// to see if more content follows on the same line.
 	pendingListItemExpr    ast.Expr
@@ -432,6 +606,7 @@ type converter struct {
 	quotedScalarKey         string   // the field key
 	quotedScalarQuote       byte     // '\'' or '"'
 	quotedScalarPartialLine bool     // last part is incomplete (action mid-line)
+	quotedScalarErr         error    // an invalid escape in the last quoted value
 
 	stripListDash     bool           // strip "- " prefix from next list item line
 	rangeDeepListBody bool           // range body has list items only visible via deepTextContent
@@ -442,6 +617,8 @@ type converter struct {
 	helperExprs       map[string]string         // template name → CUE hidden field name
 	helperCUE         map[string]ast.Expr       // CUE field name → CUE expression
 	helperNodes       map[string][]parse.Node   // CUE field name → original body nodes
+	helperConverting  map[string]bool           // CUE field names whose conversion is in progress
+	helperForms       map[string]string         // CUE field name → CUE name of its other-typed form (see helperForm)
 	helperOutputType  map[string]helperTypeInfo // CUE field name → type info (set on first include)
 	helperOrder       []string                  // deterministic emission order
 	undefinedHelpers  map[string]string         // original template name → CUE name (referenced but not defined)
@@ -483,6 +660,29 @@ func importCall(pkg, fn string, args ...ast.Expr) *ast.CallExpr {
 	}
 }
 
+// isImportCall reports whether expr is a call pkg.Fn(...) built by
+// importCall.
+func isImportCall(expr ast.Expr, pkg, fn string) bool {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	x, ok := sel.X.(*ast.Ident)
+	if !ok || x.Node == nil {
+		return false
+	}
+	spec, ok := x.Node.(*ast.ImportSpec)
+	if !ok || spec.Path.Value != strconv.Quote(pkg) {
+		return false
+	}
+	name, ok := sel.Sel.(*ast.Ident)
+	return ok && name.Name == fn
+}
+
 // importSel builds pkg.Field (a selector, not a call).
 func importSel(pkg, field string) *ast.SelectorExpr {
 	return &ast.SelectorExpr{
@@ -506,6 +706,10 @@ func selExpr(x ast.Expr, sel string) *ast.SelectorExpr {
 	var label ast.Label
 	if strings.HasPrefix(sel, "\"") {
 		label = &ast.BasicLit{Kind: token.STRING, Value: sel}
+	} else if !identRe.MatchString(strings.TrimPrefix(sel, "#")) {
+		// A key that is not an identifier, such as the Consul key
+		// app/port.
+		label = &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(sel)}
 	} else {
 		label = ast.NewIdent(sel)
 	}
@@ -575,6 +779,27 @@ func (c *converter) defaultExpr(expr, defaultVal ast.Expr) ast.Expr {
 	}
 }
 
+// existsDefaultExpr builds [if expr != _|_ {expr}, defaultVal][0]: expr
+// if it exists, even when it is empty, and otherwise defaultVal.
+func existsDefaultExpr(expr, defaultVal ast.Expr) ast.Expr {
+	return &ast.IndexExpr{
+		X: &ast.ListLit{
+			Elts: []ast.Expr{
+				&ast.Comprehension{
+					Clauses: []ast.Clause{
+						&ast.IfClause{Condition: binOp(token.NEQ, expr, &ast.BottomLit{})},
+					},
+					Value: &ast.StructLit{Elts: []ast.Decl{
+						&ast.EmbedDecl{Expr: expr},
+					}},
+				},
+				defaultVal,
+			},
+		},
+		Index: cueInt(0),
+	}
+}
+
 // deferredTryDefault carries the components for a try/fallback comprehension.
 // It satisfies ast.Expr (via embedded *ast.Ident) so it can flow through the
 // normal expression return path. emitRawField recognizes it via type assertion
@@ -949,6 +1174,204 @@ func partsToExpr(parts []inlinePart) ast.Expr {
 	return &ast.Interpolation{Elts: elts}
 }
 
+// formatNumbers rewrites the interpolations in nodes so that numbers
+// that may be float64 print as text/template prints them (see
+// Config.Float64Objects). Rewritten elements are no longer references,
+// so nodes shared between results are rewritten once.
+func (c *converter) formatNumbers(nodes ...ast.Node) {
+	if len(c.config.Float64Objects) == 0 {
+		return
+	}
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+		ast.Walk(n, func(n ast.Node) bool {
+			interp, ok := n.(*ast.Interpolation)
+			if !ok {
+				return true
+			}
+			for i, elt := range interp.Elts {
+				if !c.isFloat64Expr(elt) {
+					continue
+				}
+				c.usedHelpers["_fmtValue"] = HelperDef{
+					Name:    "_fmtValue",
+					Def:     fmtValueDef,
+					Imports: []string{"strconv"},
+				}
+				interp.Elts[i] = helperOutExpr("_fmtValue",
+					&ast.Field{Label: ast.NewIdent("#in"), Value: elt},
+				)
+			}
+			return true
+		}, nil)
+	}
+}
+
+// formatOutputNumbers applies formatNumbers to everything converted:
+// the body, a top-level range body and the helpers.
+func (c *converter) formatOutputNumbers() {
+	var nodes []ast.Node
+	for _, d := range c.rootDecls {
+		nodes = append(nodes, d)
+	}
+	for _, d := range c.topLevelRangeBody {
+		nodes = append(nodes, d)
+	}
+	for _, e := range c.helperCUE {
+		nodes = append(nodes, e)
+	}
+	c.formatNumbers(nodes...)
+}
+
+// isFloat64Expr reports whether e may evaluate to a float64 number:
+// a reference into Config.Float64Objects, a helper argument or a range
+// variable, which may hold one, or the result of a function that returns a
+// float64. The results of integer arithmetic print the same either
+// way and are left alone. Which references hold numbers is only known
+// when the output is evaluated, so they are formatted then.
+func (c *converter) isFloat64Expr(e ast.Expr) bool {
+	if isFloat, ok := isFloat64Result(e); ok {
+		return isFloat
+	}
+	root := e
+	for {
+		if sel, ok := root.(*ast.SelectorExpr); ok {
+			root = sel.X
+		} else if idx, ok := root.(*ast.IndexExpr); ok {
+			root = idx.X
+		} else {
+			break
+		}
+	}
+	id, ok := root.(*ast.Ident)
+	if !ok {
+		return false
+	}
+	if id.Name == "#arg" || id.Name == "_args" {
+		return true
+	}
+	for _, prefix := range []string{"_range", "_val"} {
+		if n, ok := strings.CutPrefix(id.Name, prefix); ok {
+			_, err := strconv.Atoi(n)
+			return err == nil && !c.plainRangeVars[id.Name]
+		}
+	}
+	for _, obj := range c.config.Float64Objects {
+		if c.config.ContextObjects[obj] == id.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// isFloat64Ref reports whether e is a reference into the values, when
+// they are one of Config.Float64Objects: a number it evaluates to is a
+// float64 in Helm.
+func (c *converter) isFloat64Ref(e ast.Expr) bool {
+	if !slices.Contains(c.config.Float64Objects, "Values") {
+		return false
+	}
+	path := selectorPath(e)
+	if len(path) == 0 {
+		return false
+	}
+	root := e
+	for range path {
+		switch x := root.(type) {
+		case *ast.SelectorExpr:
+			root = x.X
+		case *ast.IndexExpr:
+			root = x.X
+		}
+	}
+	id, ok := root.(*ast.Ident)
+	return ok && id.Name == c.config.ContextObjects["Values"]
+}
+
+// isFloat64Result reports, when ok, whether e is the result of a
+// function that returns a float64.
+func isFloat64Result(e ast.Expr) (isFloat, ok bool) {
+	switch x := e.(type) {
+	case *ast.BinaryExpr:
+		// float64 converts to number & expr, and divf to x / y.
+		id, ok := x.X.(*ast.Ident)
+		return x.Op == token.QUO || x.Op == token.AND && ok && id.Name == "number", true
+	case *ast.CallExpr:
+		return isImportCall(x, "math", "Ceil") || isImportCall(x, "math", "Floor"), true
+	case *ast.SelectorExpr:
+		if p, ok := x.X.(*ast.ParenExpr); ok {
+			b, ok := p.X.(*ast.BinaryExpr)
+			if !ok {
+				return false, true
+			}
+			id, ok := b.X.(*ast.Ident)
+			return ok && id.Name == "_round", true
+		}
+	}
+	return false, false
+}
+
+// noteRangeValues records whether the range whose values are bound to
+// name, over the values of over, is known not to iterate over float64
+// numbers: over is a list of literals or a list.Range of integers. A
+// name is known not to hold float64 numbers only if that is known for
+// every range that binds it.
+func (c *converter) noteRangeValues(name string, over ast.Expr) {
+	var known bool
+	switch x := over.(type) {
+	case *ast.CallExpr:
+		known = isImportCall(x, "list", "Range")
+	case *ast.ListLit:
+		known = len(x.Elts) > 0
+		for _, e := range x.Elts {
+			if lit, ok := e.(*ast.BasicLit); !ok || (lit.Kind != token.STRING && lit.Kind != token.INT) {
+				known = false
+			}
+		}
+	}
+	if prev, ok := c.plainRangeVars[name]; ok {
+		known = known && prev
+	}
+	if c.plainRangeVars == nil {
+		c.plainRangeVars = make(map[string]bool)
+	}
+	c.plainRangeVars[name] = known
+}
+
+// selectorPath returns the labels of e, a chain of selectors and
+// indexes with string literals, after its root, or nil if e is not
+// such a chain.
+func selectorPath(e ast.Expr) []string {
+	var path []string
+	for {
+		switch x := e.(type) {
+		case *ast.SelectorExpr:
+			name, _, err := ast.LabelName(x.Sel)
+			if err != nil {
+				return nil
+			}
+			path = append(path, name)
+			e = x.X
+		case *ast.IndexExpr:
+			lit, ok := x.Index.(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				return nil
+			}
+			name, err := strconv.Unquote(lit.Value)
+			if err != nil {
+				return nil
+			}
+			path = append(path, name)
+			e = x.X
+		default:
+			slices.Reverse(path)
+			return path
+		}
+	}
+}
+
 // flushComments attaches any pending comments to the given declaration.
 func (c *converter) flushComments(d ast.Node) {
 	if len(c.pendingComments) == 0 {
@@ -967,6 +1390,9 @@ func (c *converter) flushComments(d ast.Node) {
 // Otherwise appends to the current frame's struct or list.
 func (c *converter) appendToParent(d ast.Decl) {
 	c.flushComments(d)
+	if f, ok := d.(*ast.Field); ok {
+		c.recordEmitted(f, c.fieldNode())
+	}
 	if len(c.stack) == 0 {
 		c.rootDecls = append(c.rootDecls, d)
 		return
@@ -1069,6 +1495,7 @@ func (c *converter) emitInlineComprehension(condition ast.Expr, key string, keyL
 			label = cueKeyLabel(key)
 		}
 		bodyDecl = &ast.Field{Label: label, Value: value}
+		c.recordEmitted(bodyDecl, c.fieldNode())
 	} else if c.inListContext() {
 		bodyDecl = &ast.EmbedDecl{Expr: value}
 	} else {
@@ -1178,14 +1605,26 @@ func expandList(list *ast.ListLit) {
 // isCoreFunc reports whether the named core-handled function is enabled
 // in the current configuration. If CoreFuncs is nil all core functions
 // are enabled (backward compatible). If non-nil, only listed names are
-// allowed.
+// allowed. A core function replaced by one in Config.Funcs is not
+// enabled.
 func (c *converter) isCoreFunc(name string) bool {
+	if c.replacesCoreFunc(name) {
+		return false
+	}
 	if c.config.CoreFuncs == nil {
 		return true
 	}
 	return c.config.CoreFuncs[name]
 }
 
+// replacesCoreFunc reports whether Config.Funcs has a function with the
+// name of a core function, which it then replaces.
+func (c *converter) replacesCoreFunc(name string) bool {
+	_, core := coreFuncs[name]
+	_, ok := c.config.Funcs[name]
+	return core && ok
+}
+
 // trackFieldRef records a field reference and, unless suppressRequired
 // is set or the path is guarded by an enclosing if-condition, also
 // records it as a required (value-accessed) reference.
@@ -1338,6 +1777,30 @@ func (c *converter) collectGuardedPaths(node parse.Node, args []parse.Node, path
 		}
 	case *parse.IdentifierNode:
 		switch n.Ident {
+		case "hasKey":
+			// hasKey .Values.x "y" guards .Values.x.y.
+			if len(args) != 2 {
+				break
+			}
+			key, ok := args[1].(*parse.StringNode)
+			if !ok {
+				break
+			}
+			var helmObj string
+			var path []string
+			switch m := args[0].(type) {
+			case *parse.FieldNode:
+				_, helmObj = c.fieldToCUEInContext(m.Ident)
+				path = m.Ident[1:]
+			case *parse.VariableNode:
+				if len(m.Ident) >= 2 && m.Ident[0] == "$" {
+					_, helmObj = fieldToCUE(c.config.ContextObjects, c.config.FieldRemap, m.Ident[1:])
+					path = m.Ident[2:]
+				}
+			}
+			if helmObj != "" {
+				c.addGuardedPath(paths, helmObj, append(slices.Clone(path), key.Text))
+			}
 		case "and", "or":
 			for _, arg := range args {
 				c.collectGuardedPaths(arg, nil, paths)
@@ -1381,13 +1844,16 @@ type convertResult struct {
 	imports            map[string]bool
 	needsNonzero       bool
 	usedHelpers        map[string]HelperDef
+	usedInputs         map[string]inputField
 	helpers            map[string]ast.Expr       // CUE name → CUE expression
 	helperOutputType   map[string]helperTypeInfo // CUE name → type info
+	helperForms        map[string]string         // CUE name → CUE name of its other-typed form
+	helperCopies       map[string][]string       // CUE name → CUE names of its copies (see reconcileHelpers)
 	helperOrder        []string                  // original template names, sorted
 	helperExprs        map[string]string         // original name → CUE name
 	undefinedHelpers   map[string]string         // original name → CUE name
 	hasDynamicInclude  bool
-	warnings           []string // non-fatal issues from conversion
+	warnings           []Diagnostic // non-fatal issues from conversion
 	usedContextObjects map[string]bool
 	fieldRefs          map[string][][]string
 	requiredRefs       map[string][][]string
@@ -1402,10 +1868,16 @@ type convertResult struct {
 // parseHelpers parses helper template files into a shared tree set.
 // When multiple files define the same template name, identical bodies
 // are silently deduplicated. Conflicting bodies cause an error unless
-// allowDup is true, in which case the last definition wins.
-func parseHelpers(helpers [][]byte, allowDup bool) (map[string]*parse.Tree, map[string]bool, error) {
+// allowDup is true, in which case the last definition wins. A template
+// defined by {{ block }} is a default that any later definition
+// overrides, as with text/template; an empty definition never replaces
+// a non-empty one.
+func parseHelpers(cfg *Config, helpers [][]byte, allowDup bool) (map[string]*parse.Tree, map[string]bool, []Diagnostic, error) {
+	left, right := cfg.delims()
 	treeSet := make(map[string]*parse.Tree)
 	helperFileNames := make(map[string]bool)
+	blocks := make(map[string]bool)
+	var warnings []Diagnostic
 	for i, helper := range helpers {
 		name := fmt.Sprintf("helper%d", i)
 		helperFileNames[name] = true
@@ -1415,11 +1887,12 @@ func parseHelpers(helpers [][]byte, allowDup bool) (map[string]*parse.Tree, map[
 		iso := make(map[string]*parse.Tree)
 		ht := parse.New(name)
 		ht.Mode = parse.SkipFuncCheck | parse.ParseComments
-		if _, err := ht.Parse(string(helper), "{{", "}}", iso); err != nil {
-			return nil, nil, fmt.Errorf("parsing helper %d: %w", i, err)
+		if _, err := ht.Parse(string(helper), left, right, iso); err != nil {
+			return nil, nil, nil, fmt.Errorf("parsing helper %d: %w", i, withCode(CodeParseError, err))
 		}
 
 		// Check for duplicates against the shared tree set.
+		fileBlocks := blockNames(string(helper), left, iso)
 		for tname, newTree := range iso {
 			if tname == name {
 				// The file's own top-level tree; never a conflict.
@@ -1435,40 +1908,281 @@ func parseHelpers(helpers [][]byte, allowDup bool) (map[string]*parse.Tree, map[
 				delete(treeSet, tname)
 				continue
 			}
+			if parse.IsEmptyTree(newTree.Root) {
+				// The real parse keeps the existing body.
+				continue
+			}
+			if blocks[tname] || fileBlocks[tname] {
+				// A block is overridden by, or itself overrides,
+				// the other definition: the later one wins.
+				delete(treeSet, tname)
+				continue
+			}
 			if !allowDup {
-				return nil, nil, fmt.Errorf("conflicting definitions for template %q", tname)
+				return nil, nil, nil, codeErrorf(CodeHelperConflict, "conflicting definitions for template %q", tname)
 			}
 			// Last-one-wins: warn and remove the earlier definition.
-			fmt.Fprintf(os.Stderr, "warning: duplicate helper %q: using last definition\n", tname)
+			warnings = append(warnings, Diagnostic{
+				Severity: SeverityWarning,
+				Code:     CodeHelperConflict,
+				File:     name,
+				Message:  fmt.Sprintf("duplicate helper %q: using last definition", tname),
+			})
 			delete(treeSet, tname)
 		}
 
 		// Second pass: parse into the shared tree set (now conflict-free).
 		ht2 := parse.New(name)
 		ht2.Mode = parse.SkipFuncCheck | parse.ParseComments
-		if _, err := ht2.Parse(string(helper), "{{", "}}", treeSet); err != nil {
-			return nil, nil, fmt.Errorf("parsing helper %d: %w", i, err)
+		if _, err := ht2.Parse(string(helper), left, right, treeSet); err != nil {
+			return nil, nil, nil, fmt.Errorf("parsing helper %d: %w", i, withCode(CodeParseError, err))
+		}
+		for tname, newTree := range iso {
+			if tname != name && !parse.IsEmptyTree(newTree.Root) {
+				blocks[tname] = fileBlocks[tname]
+			}
 		}
 	}
-	return treeSet, helperFileNames, nil
+	return treeSet, helperFileNames, warnings, nil
+}
+
+// blockNames returns the names of the templates in trees that text
+// defines with {{ block }}, where left is the left delimiter. The parser
+// turns a block into a {{ template }} call plus a definition whose body
+// starts right after the call's action, so a call is a block when the
+// tree it names starts after it with no other action in between.
+func blockNames(text, left string, trees map[string]*parse.Tree) map[string]bool {
+	names := make(map[string]bool)
+	var walk func(nodes []parse.Node)
+	walk = func(nodes []parse.Node) {
+		for _, node := range nodes {
+			switch n := node.(type) {
+			case *parse.TemplateNode:
+				tree := trees[n.Name]
+				if tree != nil && tree.Root != nil && tree.Root.Pos > n.Pos &&
+					!strings.Contains(text[n.Pos:tree.Root.Pos], left) {
+					names[n.Name] = true
+				}
+			case *parse.IfNode:
+				walk(n.List.Nodes)
+				if n.ElseList != nil {
+					walk(n.ElseList.Nodes)
+				}
+			case *parse.RangeNode:
+				walk(n.List.Nodes)
+				if n.ElseList != nil {
+					walk(n.ElseList.Nodes)
+				}
+			case *parse.WithNode:
+				walk(n.List.Nodes)
+				if n.ElseList != nil {
+					walk(n.ElseList.Nodes)
+				}
+			}
+		}
+	}
+	for _, tree := range trees {
+		if tree.Root != nil {
+			walk(tree.Root.Nodes)
+		}
+	}
+	return names
+}
+
+// resolveFuncNames rewrites the names of the functions called in tree
+// as given by cfg.FuncAliases, replacing a namespaced name such as
+// strings.ToUpper, which text/template parses as a field of a function
+// strings, by a function of that name.
+func resolveFuncNames(cfg *Config, tree *parse.Tree) {
+	var walk func(node parse.Node)
+	walkPipe := func(pipe *parse.PipeNode) {
+		if pipe == nil {
+			return
+		}
+		for _, cmd := range pipe.Cmds {
+			for i, arg := range cmd.Args {
+				cmd.Args[i] = resolveFuncName(cfg, tree, arg)
+				walk(cmd.Args[i])
+			}
+		}
+	}
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, child := range n.Nodes {
+				walk(child)
+			}
+		case *parse.ActionNode:
+			walkPipe(n.Pipe)
+		case *parse.PipeNode:
+			walkPipe(n)
+		case *parse.ChainNode:
+			walk(n.Node)
+		case *parse.IfNode:
+			walkPipe(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walkPipe(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walkPipe(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.TemplateNode:
+			walkPipe(n.Pipe)
+		}
+	}
+	walk(tree.Root)
+}
+
+// resolveFuncName returns the identifier that node, an argument of a
+// command in tree, names as a function under cfg.FuncAliases and
+// cfg.Funcs, or node itself if it names none.
+func resolveFuncName(cfg *Config, tree *parse.Tree, node parse.Node) parse.Node {
+	var name string
+	switch n := node.(type) {
+	case *parse.IdentifierNode:
+		name = n.Ident
+	case *parse.ChainNode:
+		id, ok := n.Node.(*parse.IdentifierNode)
+		if !ok || len(n.Field) != 1 {
+			return node
+		}
+		name = id.Ident + "." + n.Field[0]
+		if _, ok := cfg.Funcs[name]; !ok {
+			if _, ok := cfg.FuncAliases[name]; !ok {
+				return node
+			}
+		}
+	default:
+		return node
+	}
+	if alias, ok := cfg.FuncAliases[name]; ok {
+		name = alias
+	}
+	if id, ok := node.(*parse.IdentifierNode); ok && id.Ident == name {
+		return node
+	}
+	return parse.NewIdentifier(name).SetTree(tree).SetPos(node.Position())
+}
+
+// resolveRootFields rewrites the references in tree to fields of the
+// root context that are not context objects, such as .job_name, as
+// references to fields of cfg.RootObject, such as .Values.job_name.
+func resolveRootFields(cfg *Config, tree *parse.Tree) {
+	if cfg.RootObject == "" {
+		return
+	}
+	isField := func(ident []string) bool {
+		_, ok := cfg.ContextObjects[ident[0]]
+		return !ok
+	}
+	var walk func(node parse.Node, rootDot bool)
+	walkPipe := func(pipe *parse.PipeNode, rootDot bool) {
+		if pipe == nil {
+			return
+		}
+		for _, cmd := range pipe.Cmds {
+			for _, arg := range cmd.Args {
+				walk(arg, rootDot)
+			}
+		}
+	}
+	walk = func(node parse.Node, rootDot bool) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, child := range n.Nodes {
+				walk(child, rootDot)
+			}
+		case *parse.ActionNode:
+			walkPipe(n.Pipe, rootDot)
+		case *parse.PipeNode:
+			walkPipe(n, rootDot)
+		case *parse.ChainNode:
+			walk(n.Node, rootDot)
+		case *parse.FieldNode:
+			if rootDot && isField(n.Ident) {
+				n.Ident = append([]string{cfg.RootObject}, n.Ident...)
+			}
+		case *parse.VariableNode:
+			if len(n.Ident) > 1 && n.Ident[0] == "$" && isField(n.Ident[1:]) {
+				n.Ident = slices.Insert(n.Ident, 1, cfg.RootObject)
+			}
+		case *parse.IfNode:
+			walkPipe(n.Pipe, rootDot)
+			walk(n.List, rootDot)
+			walk(n.ElseList, rootDot)
+		case *parse.RangeNode:
+			// Dot is the element in the body, and unchanged in the
+			// else branch.
+			walkPipe(n.Pipe, rootDot)
+			walk(n.List, false)
+			walk(n.ElseList, rootDot)
+		case *parse.WithNode:
+			walkPipe(n.Pipe, rootDot)
+			walk(n.List, false)
+			walk(n.ElseList, rootDot)
+		case *parse.TemplateNode:
+			walkPipe(n.Pipe, rootDot)
+		}
+	}
+	walk(tree.Root, true)
 }
 
 // convertStructured converts a single template to structured output.
 // It takes a shared treeSet (from parseHelpers) and the set of helper file names.
-func convertStructured(cfg *Config, input []byte, templateName string, treeSet map[string]*parse.Tree, helperFileNames map[string]bool) (*convertResult, error) {
+// inputNames is shared by all templates of one conversion so that
+// lifted inputs get distinct names. templateFiles maps the Helm names
+// of a chart's template files to the CUE fields holding their
+// converted output; an include of one of these names resolves to that
+// output encoded as a YAML stream.
+func convertStructured(cfg *Config, input []byte, templateName string, treeSet map[string]*parse.Tree, helperFileNames map[string]bool, inputNames map[string]bool, templateFiles map[string]string) (*convertResult, error) {
+	// Blocks in the template are defaults that the helpers' definitions
+	// override, as when the helpers are parsed after it by text/template.
+	// Hide those definitions while parsing so that the block's own body
+	// does not conflict with them, then restore them.
+	left, right := cfg.delims()
+	iso := make(map[string]*parse.Tree)
+	probe := parse.New(templateName)
+	probe.Mode = parse.SkipFuncCheck | parse.ParseComments
+	if _, err := probe.Parse(string(input), left, right, iso); err != nil {
+		return nil, fmt.Errorf("parsing template: %w", withCode(CodeParseError, err))
+	}
+	overridden := make(map[string]*parse.Tree)
+	for name := range blockNames(string(input), left, iso) {
+		if tree, ok := treeSet[name]; ok && !parse.IsEmptyTree(tree.Root) {
+			overridden[name] = tree
+			delete(treeSet, name)
+		}
+	}
 	tmpl := parse.New(templateName)
 	tmpl.Mode = parse.SkipFuncCheck | parse.ParseComments
-	if _, err := tmpl.Parse(string(input), "{{", "}}", treeSet); err != nil {
-		return nil, fmt.Errorf("parsing template: %w", err)
+	_, err := tmpl.Parse(string(input), left, right, treeSet)
+	maps.Copy(treeSet, overridden)
+	if err != nil {
+		return nil, fmt.Errorf("parsing template: %w", withCode(CodeParseError, err))
 	}
 
 	root := tmpl.Root
 	if root == nil {
 		return nil, fmt.Errorf("empty template")
 	}
+	for _, tree := range treeSet {
+		resolveFuncNames(cfg, tree)
+	}
+	resolveRootFields(cfg, tmpl)
 
 	c := &converter{
 		config:                      cfg,
+		values:                      decodeValues(cfg.Values),
 		usedContextObjects:          make(map[string]bool),
 		fieldRefs:                   make(map[string][][]string),
 		requiredRefs:                make(map[string][][]string),
@@ -1477,11 +2191,16 @@ func convertStructured(cfg *Config, input []byte, templateName string, treeSet m
 		localVars:                   make(map[string]ast.Expr),
 		imports:                     make(map[string]bool),
 		usedHelpers:                 make(map[string]HelperDef),
+		usedInputs:                  make(map[string]inputField),
+		inputNames:                  inputNames,
+		emitted:                     make(map[ast.Node]parse.Node),
 		comments:                    make(map[ast.Expr]string),
 		treeSet:                     treeSet,
 		helperExprs:                 make(map[string]string),
 		helperCUE:                   make(map[string]ast.Expr),
 		helperNodes:                 make(map[string][]parse.Node),
+		helperConverting:            make(map[string]bool),
+		helperForms:                 make(map[string]string),
 		helperOutputType:            make(map[string]helperTypeInfo),
 		undefinedHelpers:            make(map[string]string),
 		helperArgFieldRefs:          make(map[string][][]string),
@@ -1493,6 +2212,7 @@ func convertStructured(cfg *Config, input []byte, templateName string, treeSet m
 		helperDirectRangeRefs:       make(map[string]map[string][][]string),
 		helperDirectNonScalarRefs:   make(map[string]map[string][][]string),
 		helperIncludes:              make(map[string][]string),
+		templateFiles:               templateFiles,
 	}
 
 	if cfg.RootExpr != "" {
@@ -1509,6 +2229,11 @@ func convertStructured(cfg *Config, input []byte, templateName string, treeSet m
 		c.helperOrder = append(c.helperOrder, name)
 	}
 	slices.Sort(c.helperOrder)
+	// Template files are emitted only when included (see ConvertChart),
+	// so they are named but not ordered with the helpers.
+	for name := range templateFiles {
+		c.helperExprs[name] = helperToCUEName(name)
+	}
 
 	// Phase 0b: Record helper bodies for deferred conversion.
 	// Bodies are stored in helperNodes and converted on first
@@ -1531,6 +2256,7 @@ func convertStructured(cfg *Config, input []byte, templateName string, treeSet m
 	if err := c.processNodes(root.Nodes); err != nil {
 		return nil, err
 	}
+	c.flushCommentLine()
 	c.finalizeInline()
 	c.finalizeFlow()
 	c.flushPendingAction()
@@ -1540,12 +2266,18 @@ func convertStructured(cfg *Config, input []byte, templateName string, treeSet m
 	// Clean up the template from the tree set so it doesn't leak into subsequent calls.
 	delete(treeSet, templateName)
 
+	c.formatOutputNumbers()
+	c.visitDocument(root)
+	c.visitHelperValues()
+
 	return &convertResult{
 		imports:            c.imports,
 		needsNonzero:       c.hasConditions || c.hasDefault || len(c.topLevelGuards) > 0,
 		usedHelpers:        c.usedHelpers,
+		usedInputs:         c.usedInputs,
 		helpers:            c.helperCUE,
 		helperOutputType:   c.helperOutputType,
+		helperForms:        c.helperForms,
 		helperOrder:        c.helperOrder,
 		helperExprs:        c.helperExprs,
 		undefinedHelpers:   c.undefinedHelpers,
@@ -1589,7 +2321,7 @@ func assembleSingleFile(cfg *Config, r *convertResult) ([]byte, error) {
 	}
 	slices.Sort(declNames)
 
-	hasDecls := len(declNames) > 0
+	hasDecls := len(declNames) > 0 || len(r.usedInputs) > 0
 	hasHelpers := len(r.helperOrder) > 0 || len(r.undefinedHelpers) > 0 || r.hasDynamicInclude
 
 	if hasDecls || hasHelpers {
@@ -1611,7 +2343,12 @@ func assembleSingleFile(cfg *Config, r *convertResult) ([]byte, error) {
 				})
 			} else {
 				root := buildFieldTree(refs, reqRefs, rngRefs, nsRefs)
-				childDecls := fieldNodesToDecls(root.children)
+				var childDecls []ast.Decl
+				if slices.Contains(cfg.StringMapObjects, helmObj) {
+					childDecls = stringMapFieldDecls(root.children)
+				} else {
+					childDecls = fieldNodesToDecls(root.children)
+				}
 				childDecls = append(childDecls, &ast.Ellipsis{})
 				allDecls = append(allDecls, &ast.Field{
 					Label: ast.NewIdent(cueDef),
@@ -1620,18 +2357,12 @@ func assembleSingleFile(cfg *Config, r *convertResult) ([]byte, error) {
 			}
 		}
 
-		for _, name := range r.helperOrder {
-			cueName := r.helperExprs[name]
-			value := ast.Expr(ast.NewIdent("_"))
-			if cueExpr, ok := r.helpers[cueName]; ok {
-				value = cueExpr
-			}
-			allDecls = append(allDecls, &ast.Field{
-				Label: ast.NewIdent(cueName),
-				Value: value,
-			})
+		if len(r.usedInputs) > 0 {
+			allDecls = append(allDecls, inputsDecls(r.usedInputs)...)
 		}
 
+		allDecls = append(allDecls, helperFieldDecls(r, cfg.MaxHelperDepth)...)
+
 		if len(r.undefinedHelpers) > 0 {
 			var undefs []string
 			for _, cueName := range r.undefinedHelpers {
@@ -1701,66 +2432,706 @@ func assembleSingleFile(cfg *Config, r *convertResult) ([]byte, error) {
 		} else {
 			allDecls = append(allDecls, defDecls...)
 		}
-		helperDefCount++
+		helperDefCount++
+	}
+
+	var helperNames []string
+	for name := range r.usedHelpers {
+		helperNames = append(helperNames, name)
+	}
+	slices.Sort(helperNames)
+	for _, name := range helperNames {
+		h := r.usedHelpers[name]
+		defDecls, err := parseHelperDefDecls(h.Def, h.Imports, true)
+		if err != nil {
+			return nil, fmt.Errorf("parsing helper def %s: %w", h.Name, err)
+		}
+		if helperDefCount > 0 {
+			allDecls = appendSectionDecls(allDecls, defDecls)
+		} else {
+			allDecls = append(allDecls, defDecls...)
+		}
+		helperDefCount++
+	}
+
+	f := &ast.File{Decls: allDecls}
+	formatted, err := formatResolvedFile(f, allImports)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Experiments {
+		formatted = append([]byte("@experiment(try)\n\n"), formatted...)
+	}
+	return formatted, nil
+}
+
+// Result is the result of converting a template with ConvertTemplate.
+type Result struct {
+	// CUE is the generated CUE, as returned by Convert.
+	CUE []byte
+
+	// Helpers lists the names of the helpers ({{ define }} blocks)
+	// that were converted, in sorted order.
+	Helpers []string
+
+	// ValuesSchema is the #values schema inferred from the template's
+	// uses of .Values.
+	ValuesSchema []byte
+
+	// Warnings lists non-fatal issues found during conversion, such
+	// as a helper that is used in conflicting ways.
+	Warnings []string
+
+	// Diagnostics describes the warnings, with their positions. When
+	// ConvertTemplate fails, it also returns a Result whose
+	// Diagnostics describe the error, if it can.
+	Diagnostics []Diagnostic
+}
+
+// Convert transforms a template YAML file into CUE using the given config.
+// Optional helpers contain {{ define }} blocks (typically from _helpers.tpl files).
+// The output wraps template content in an `output` list.
+func Convert(cfg *Config, input []byte, helpers ...[]byte) ([]byte, error) {
+	res, err := ConvertTemplate(cfg, input, helpers...)
+	if err != nil {
+		return nil, err
+	}
+	return res.CUE, nil
+}
+
+// ConvertTemplate is like Convert but also returns what the conversion
+// found: the helpers it converted, the values schema and any warnings.
+func ConvertTemplate(cfg *Config, input []byte, helpers ...[]byte) (*Result, error) {
+	// Diagnostics name the template itself by the empty string and
+	// each helper by its parse name.
+	files := make(map[string]string)
+	for i := range helpers {
+		name := fmt.Sprintf("helper%d", i)
+		files[name] = name
+	}
+	lineOffsets := make(map[string]int)
+	fail := func(err error) (*Result, error) {
+		diags := []Diagnostic{newDiagnostic(cfg, SeverityError, err.Error(), err)}
+		resolveDiagnosticFiles(diags, files, lineOffsets)
+		return &Result{Diagnostics: diags}, err
+	}
+
+	treeSet, helperFileNames, _, err := parseHelpers(cfg, helpers, false)
+	if err != nil {
+		return fail(err)
+	}
+
+	// Try AST-aware splitting to handle cross-document blocks.
+	docs := splitTemplateDocuments(cfg, input, treeSet)
+	if docs == nil {
+		left, _ := cfg.delims()
+		docs = splitYAMLDocuments(input, left)
+	}
+	offsets := docLineOffsets(input, docs)
+
+	var results []*convertResult
+	inputNames := make(map[string]bool)
+	for i, doc := range docs {
+		templateName := "helm"
+		if len(docs) > 1 {
+			templateName = fmt.Sprintf("helm_document_%d", i)
+		}
+		files[templateName] = ""
+		lineOffsets[templateName] = offsets[i]
+		r, err := convertStructured(cfg, doc, templateName, treeSet, helperFileNames, inputNames, nil)
+		if err != nil {
+			if len(docs) > 1 {
+				return fail(fmt.Errorf("document %d: %w", i, err))
+			}
+			return fail(err)
+		}
+		results = append(results, r)
+	}
+
+	merged := mergeConvertResults(results)
+	out, err := assembleSingleFile(cfg, merged)
+	if err != nil {
+		return fail(withCode(CodeInvalidCUE, err))
+	}
+	res := &Result{
+		CUE:          out,
+		Helpers:      convertedHelpers(merged),
+		ValuesSchema: buildValuesSchemaCUE(merged.fieldRefs["Values"], merged.requiredRefs["Values"], merged.rangeRefs["Values"], merged.nonScalarRefs["Values"], nil),
+	}
+	resolveDiagnosticFiles(merged.warnings, files, lineOffsets)
+	res.Diagnostics = sortDiagnostics(merged.warnings)
+	for _, d := range res.Diagnostics {
+		res.Warnings = append(res.Warnings, d.Message)
+	}
+	res.Warnings = slices.Compact(slices.Sorted(slices.Values(res.Warnings)))
+	return res, nil
+}
+
+// convertedHelpers returns the names of the helpers of r that have a
+// conversion, in sorted order.
+func convertedHelpers(r *convertResult) []string {
+	var names []string
+	for _, name := range r.helperOrder {
+		if _, ok := r.helpers[r.helperExprs[name]]; ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// DefaultMaxHelperDepth is the depth to which recursive helpers are
+// unrolled when Config.MaxHelperDepth is zero.
+const DefaultMaxHelperDepth = 8
+
+// helperFieldDecls returns the hidden fields for the helpers of r in
+// order. Each helper is followed by its other-typed form, if a call
+// site needed one (see helperForm), and by the unrolled levels of
+// recursive helpers (see unrollRecursiveHelpers). A helper that was
+// never converted (because nothing includes it) is emitted as _.
+func helperFieldDecls(r *convertResult, maxDepth int) []ast.Decl {
+	origNames := make(map[string]string)
+	for _, name := range r.helperOrder {
+		origNames[r.helperExprs[name]] = name
+		if form, ok := r.helperForms[r.helperExprs[name]]; ok {
+			origNames[form] = name
+		}
+	}
+	for cueName, copies := range r.helperCopies {
+		for _, cp := range copies {
+			origNames[cp] = origNames[cueName]
+		}
+	}
+	values, levels := unrollRecursiveHelpers(r.helpers, origNames, maxDepth)
+
+	var decls []ast.Decl
+	var field func(cueName string)
+	field = func(cueName string) {
+		decls = append(decls, &ast.Field{
+			Label: ast.NewIdent(cueName),
+			Value: values[cueName],
+		})
+		for _, level := range levels[cueName] {
+			decls = append(decls, &ast.Field{
+				Label: ast.NewIdent(level),
+				Value: values[level],
+			})
+		}
+		for _, cp := range r.helperCopies[cueName] {
+			field(cp)
+		}
+	}
+	for _, name := range r.helperOrder {
+		cueName := r.helperExprs[name]
+		if _, ok := values[cueName]; !ok {
+			decls = append(decls, &ast.Field{
+				Label: ast.NewIdent(cueName),
+				Value: ast.NewIdent("_"),
+			})
+			continue
+		}
+		field(cueName)
+		if form, ok := r.helperForms[cueName]; ok {
+			field(form)
+		}
+	}
+	return decls
+}
+
+// unrollRecursiveHelpers expands helpers that include themselves,
+// directly or through other helpers. CUE cannot express such a cycle
+// as a hidden field, so each helper in a cycle is copied once per
+// level up to maxDepth, with the cycle's references in level d
+// pointing at level d+1. The last level is an error that fires only
+// when a call reaches it, i.e. when the data nests deeper than the
+// bound. It returns the helper values keyed by CUE name (including the
+// levels) and, for each recursive helper, the names of its levels in
+// order. Helpers outside any cycle are returned unchanged.
+func unrollRecursiveHelpers(helpers map[string]ast.Expr, origNames map[string]string, maxDepth int) (map[string]ast.Expr, map[string][]string) {
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxHelperDepth
+	}
+	refs := make(map[string][]string)
+	for name, expr := range helpers {
+		ast.Walk(expr, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok {
+				if _, ok := helpers[id.Name]; ok {
+					refs[name] = append(refs[name], id.Name)
+				}
+			}
+			return true
+		}, nil)
+	}
+
+	values := maps.Clone(helpers)
+	levels := make(map[string][]string)
+	for _, cycle := range helperCycles(refs) {
+		// Level d of _tree is _tree_d, with a longer separator if
+		// that would clash with another helper.
+		sep := "_"
+		levelName := func(member string, d int) string {
+			if d == 0 {
+				return member
+			}
+			return fmt.Sprintf("%s%s%d", member, sep, d)
+		}
+		for clashes(cycle, maxDepth, levelName, helpers) {
+			sep += "_"
+		}
+		for _, member := range cycle {
+			for d := range maxDepth {
+				rename := make(map[string]string)
+				for _, m := range cycle {
+					rename[m] = levelName(m, d+1)
+				}
+				values[levelName(member, d)] = renameIdents(cloneExpr(helpers[member]), rename)
+				if d > 0 {
+					levels[member] = append(levels[member], levelName(member, d))
+				}
+			}
+			last := levelName(member, maxDepth)
+			values[last] = recursionLimitExpr(origNames[member], maxDepth)
+			levels[member] = append(levels[member], last)
+		}
+	}
+	return values, levels
+}
+
+// clashes reports whether any level name of the helpers in cycle is
+// already taken by a helper.
+func clashes(cycle []string, maxDepth int, levelName func(string, int) string, helpers map[string]ast.Expr) bool {
+	for _, member := range cycle {
+		for d := 1; d <= maxDepth; d++ {
+			if _, ok := helpers[levelName(member, d)]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// helperCycles returns the strongly connected components of the helper
+// include graph that contain a cycle, each sorted by name, in sorted
+// order.
+func helperCycles(refs map[string][]string) [][]string {
+	var names []string
+	for name := range refs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	// Tarjan's algorithm.
+	index := make(map[string]int)
+	low := make(map[string]int)
+	onStack := make(map[string]bool)
+	var stack []string
+	var cycles [][]string
+	var visit func(string)
+	visit = func(v string) {
+		index[v] = len(index)
+		low[v] = index[v]
+		stack = append(stack, v)
+		onStack[v] = true
+		for _, w := range refs[v] {
+			if _, seen := index[w]; !seen {
+				visit(w)
+				low[v] = min(low[v], low[w])
+			} else if onStack[w] {
+				low[v] = min(low[v], index[w])
+			}
+		}
+		if low[v] != index[v] {
+			return
+		}
+		var scc []string
+		for {
+			w := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[w] = false
+			scc = append(scc, w)
+			if w == v {
+				break
+			}
+		}
+		if len(scc) > 1 || slices.Contains(refs[v], v) {
+			slices.Sort(scc)
+			cycles = append(cycles, scc)
+		}
+	}
+	for _, name := range names {
+		if _, seen := index[name]; !seen {
+			visit(name)
+		}
+	}
+	slices.SortFunc(cycles, func(a, b []string) int {
+		return strings.Compare(a[0], b[0])
+	})
+	return cycles
+}
+
+// recursionLimitExpr builds the last unrolled level of a recursive
+// helper: a struct that fails only once an argument is passed to it.
+func recursionLimitExpr(name string, maxDepth int) ast.Expr {
+	msg := fmt.Sprintf("helper %q: recursion deeper than %d levels", name, maxDepth)
+	return &ast.StructLit{Elts: []ast.Decl{
+		&ast.Field{
+			Label:      ast.NewIdent("#arg"),
+			Constraint: token.OPTION,
+			Value:      ast.NewIdent("_"),
+		},
+		&ast.Comprehension{
+			Clauses: []ast.Clause{&ast.IfClause{
+				Condition: binOp(token.NEQ, ast.NewIdent("#arg"), &ast.BottomLit{}),
+			}},
+			Value: &ast.StructLit{Elts: []ast.Decl{
+				&ast.EmbedDecl{Expr: &ast.CallExpr{
+					Fun:  ast.NewIdent("error"),
+					Args: []ast.Expr{cueString(msg)},
+				}},
+			}},
+		},
+	}}
+}
+
+// cloneExpr returns a deep copy of expr by formatting and re-parsing
+// it. Import-tagged identifiers keep their import.
+func cloneExpr(expr ast.Expr) ast.Expr {
+	type tagged struct {
+		ident *ast.Ident
+		name  string
+		node  ast.Node
+	}
+	var saved []tagged
+	imports := make(map[string]string)
+	ast.Walk(expr, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		imp, ok := id.Node.(*ast.ImportSpec)
+		if !ok {
+			return true
+		}
+		pkg := strings.Trim(imp.Path.Value, "\"")
+		saved = append(saved, tagged{id, id.Name, id.Node})
+		imports[importSentinel(pkg)] = pkg
+		id.Name = importSentinel(pkg)
+		id.Node = nil
+		return true
+	}, nil)
+	text := exprToText(expr)
+	for _, t := range saved {
+		t.ident.Name = t.name
+		t.ident.Node = t.node
+	}
+
+	cp := mustParseExpr(text)
+	ast.Walk(cp, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			if pkg, ok := imports[id.Name]; ok {
+				tagged := importTaggedIdent(pkg)
+				id.Name, id.Node = tagged.Name, tagged.Node
+			}
+		}
+		return true
+	}, nil)
+	return cp
+}
+
+// renameIdents renames the references in expr according to rename,
+// leaving field labels alone.
+func renameIdents(expr ast.Expr, rename map[string]string) ast.Expr {
+	labels := make(map[*ast.Ident]bool)
+	ast.Walk(expr, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Field:
+			if id, ok := n.Label.(*ast.Ident); ok {
+				labels[id] = true
+			}
+		case *ast.SelectorExpr:
+			if id, ok := n.Sel.(*ast.Ident); ok {
+				labels[id] = true
+			}
+		case *ast.Ident:
+			if to, ok := rename[n.Name]; ok && !labels[n] {
+				n.Name = to
+			}
+		}
+		return true
+	}, nil)
+	return expr
+}
+
+// reconciledHelpers is the single set of helper conversions that
+// reconcileHelpers builds from independently converted results.
+type reconciledHelpers struct {
+	helpers    map[string]ast.Expr
+	outputType map[string]helperTypeInfo
+	forms      map[string]string
+	copies     map[string][]string
+	warnings   []Diagnostic
+}
+
+// reconcileHelpers merges the helper conversions of results, each
+// converted by its own converter and named by the matching entry of
+// sources, into one set. A deferred helper's first conversion fixes the
+// type of its plain name; a result that converted it with the other
+// type has its references renamed so that they bind to the form of
+// that type instead, which every result then shares. Conversions of
+// one helper with one type that differ only in their #arg schema are
+// unified. Any other difference is reported naming the helper and the
+// two sources, and the later source is given a copy of the helper,
+// named with a numeric suffix, that holds its own conversion.
+func reconcileHelpers(sources []string, results []*convertResult) reconciledHelpers {
+	rh := reconciledHelpers{
+		helpers:    make(map[string]ast.Expr),
+		outputType: make(map[string]helperTypeInfo),
+		forms:      make(map[string]string),
+		copies:     make(map[string][]string),
+	}
+	if len(results) == 0 {
+		return rh
+	}
+	helperExprs := results[0].helperExprs
+	baseOf := make(map[string]string) // CUE name of a helper or form → CUE name of the helper
+	origNames := make(map[string]string)
+	for name, cueName := range helperExprs {
+		baseOf[cueName] = cueName
+		origNames[cueName] = name
+	}
+
+	baseType := make(map[string]string)
+	for _, r := range results {
+		for cueName, t := range r.helperOutputType {
+			if _, ok := r.helpers[cueName]; ok && origNames[cueName] != "" && baseType[cueName] == "" {
+				baseType[cueName] = t.typ
+			}
+		}
+	}
+
+	kept := make(map[string]int) // CUE name → index of the result whose conversion is kept
+	for i, r := range results {
+		rename := make(map[string]string)
+		for cueName, typ := range baseType {
+			t := r.helperOutputType[cueName]
+			if _, ok := r.helpers[cueName]; !ok || t.typ == "" || t.typ == typ {
+				continue
+			}
+			rename[cueName] = helperFormName(cueName, t.typ, helperExprs)
+			rename[helperFormName(cueName, typ, helperExprs)] = cueName
+		}
+		if len(rename) > 0 {
+			renameResultIdents(r, rename)
+		}
+		for cueName, form := range r.helperForms {
+			if _, ok := rename[cueName]; ok {
+				continue
+			}
+			baseOf[form] = cueName
+			if _, ok := rh.forms[cueName]; !ok {
+				rh.forms[cueName] = form
+			}
+		}
+		for cueName, to := range rename {
+			if baseOf[to] == to {
+				continue
+			}
+			baseOf[to] = cueName
+			if _, ok := rh.forms[cueName]; !ok {
+				rh.forms[cueName] = to
+			}
+		}
+
+		var conflicts []string
+		for name, expr := range r.helpers {
+			_, exists := kept[name]
+			if !exists {
+				kept[name] = i
+				rh.helpers[name] = expr
+				if t, ok := r.helperOutputType[name]; ok {
+					rh.outputType[name] = t
+				}
+				continue
+			}
+			prev := rh.helpers[name]
+			if exprToText(prev) == exprToText(expr) {
+				continue
+			}
+			if unified, ok := unifyHelperArgs(prev, expr); ok {
+				rh.helpers[name] = unified
+				continue
+			}
+			if base := baseOf[name]; base != name && (referencesIdent(prev, base) || referencesIdent(expr, base)) {
+				// A form that wraps its helper agrees with any
+				// other conversion of the same type.
+				continue
+			}
+			conflicts = append(conflicts, name)
+		}
+		// Copying a helper renames the references to it in this
+		// result, which can make the helpers that include it conflict
+		// in turn; those are copied too.
+		for len(conflicts) > 0 {
+			slices.Sort(conflicts)
+			var copied []string
+			for _, name := range conflicts {
+				expr := r.helpers[name]
+				cp := ""
+				for _, c := range rh.copies[name] {
+					if exprToText(rh.helpers[c]) == exprToText(expr) {
+						cp = c
+						break
+					}
+				}
+				if cp == "" {
+					cp = helperCopyName(name, rh.helpers, r.helpers, origNames)
+					rh.copies[name] = append(rh.copies[name], cp)
+					rh.helpers[cp] = expr
+					if t, ok := r.helperOutputType[name]; ok {
+						rh.outputType[cp] = t
+					}
+				}
+				renameResultIdents(r, map[string]string{name: cp})
+				copied = append(copied, cp)
+				rh.warnings = append(rh.warnings, Diagnostic{
+					Severity: SeverityWarning,
+					Code:     CodeHelperConflict,
+					Message: fmt.Sprintf("helper %q is converted differently for %s and %s; %s uses a copy of it, %s",
+						origNames[baseOf[name]], sources[kept[name]], sources[i], sources[i], cp),
+					Hint: codeHints[CodeHelperConflict],
+				})
+			}
+			conflicts = nil
+			for name, expr := range r.helpers {
+				prev, ok := rh.helpers[name]
+				if !ok || exprToText(prev) == exprToText(expr) {
+					continue
+				}
+				if slices.ContainsFunc(copied, func(cp string) bool { return referencesIdent(expr, cp) }) {
+					conflicts = append(conflicts, name)
+				}
+			}
+		}
 	}
+	slices.SortFunc(rh.warnings, compareDiagnostics)
+	return rh
+}
 
-	for _, h := range r.usedHelpers {
-		defDecls, err := parseHelperDefDecls(h.Def, h.Imports, true)
-		if err != nil {
-			return nil, fmt.Errorf("parsing helper def %s: %w", h.Name, err)
-		}
-		if helperDefCount > 0 {
-			allDecls = appendSectionDecls(allDecls, defDecls)
-		} else {
-			allDecls = append(allDecls, defDecls...)
+// helperCopyName returns the name of a new copy of the helper or form
+// name: name_2, name_3 and so on, skipping names already in use.
+func helperCopyName(name string, helpers, resultHelpers map[string]ast.Expr, origNames map[string]string) string {
+	for i := 2; ; i++ {
+		cp := fmt.Sprintf("%s_%d", name, i)
+		_, taken := helpers[cp]
+		_, taken2 := resultHelpers[cp]
+		if !taken && !taken2 && origNames[cp] == "" {
+			return cp
 		}
-		helperDefCount++
 	}
+}
 
-	f := &ast.File{Decls: allDecls}
-	formatted, err := formatResolvedFile(f, allImports)
-	if err != nil {
-		return nil, err
+// renameResultIdents renames the references in the body and helper
+// expressions of r according to rename, visiting each identifier once
+// so that a swap of two names is not undone where nodes are shared.
+func renameResultIdents(r *convertResult, rename map[string]string) {
+	var nodes []ast.Node
+	for _, d := range r.body {
+		nodes = append(nodes, d)
 	}
-	if cfg.Experiments {
-		formatted = append([]byte("@experiment(try)\n\n"), formatted...)
+	for _, d := range r.topLevelRangeBody {
+		nodes = append(nodes, d)
 	}
-	return formatted, nil
-}
-
-// Convert transforms a template YAML file into CUE using the given config.
-// Optional helpers contain {{ define }} blocks (typically from _helpers.tpl files).
-// The output wraps template content in an `output` list.
-func Convert(cfg *Config, input []byte, helpers ...[]byte) ([]byte, error) {
-	treeSet, helperFileNames, err := parseHelpers(helpers, false)
-	if err != nil {
-		return nil, err
+	for _, cl := range r.topLevelRange {
+		nodes = append(nodes, cl)
 	}
-
-	// Try AST-aware splitting to handle cross-document blocks.
-	docs := splitTemplateDocuments(input, treeSet)
-	if docs == nil {
-		docs = splitYAMLDocuments(input)
+	for _, g := range r.topLevelGuards {
+		nodes = append(nodes, g)
 	}
-
-	var results []*convertResult
-	for i, doc := range docs {
-		templateName := "helm"
-		if len(docs) > 1 {
-			templateName = fmt.Sprintf("helm_document_%d", i)
+	renamed := make(map[string]ast.Expr)
+	for cueName, expr := range r.helpers {
+		nodes = append(nodes, expr)
+		if to, ok := rename[cueName]; ok {
+			cueName = to
 		}
-		r, err := convertStructured(cfg, doc, templateName, treeSet, helperFileNames)
-		if err != nil {
-			if len(docs) > 1 {
-				return nil, fmt.Errorf("document %d: %w", i, err)
+		renamed[cueName] = expr
+	}
+	r.helpers = renamed
+	types := make(map[string]helperTypeInfo)
+	for cueName, t := range r.helperOutputType {
+		if to, ok := rename[cueName]; ok {
+			cueName = to
+		}
+		types[cueName] = t
+	}
+	r.helperOutputType = types
+
+	done := make(map[*ast.Ident]bool)
+	for _, n := range nodes {
+		ast.Walk(n, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.Field:
+				if id, ok := n.Label.(*ast.Ident); ok {
+					done[id] = true
+				}
+			case *ast.SelectorExpr:
+				if id, ok := n.Sel.(*ast.Ident); ok {
+					done[id] = true
+				}
+			case *ast.Ident:
+				if to, ok := rename[n.Name]; ok && !done[n] {
+					n.Name = to
+				}
+				done[n] = true
 			}
-			return nil, err
+			return true
+		}, nil)
+	}
+}
+
+// referencesIdent reports whether expr refers to name.
+func referencesIdent(expr ast.Expr, name string) bool {
+	found := false
+	ast.Walk(expr, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && id.Name == name {
+			found = true
 		}
-		results = append(results, r)
+		return !found
+	}, nil)
+	return found
+}
+
+// unifyHelperArgs unifies two conversions of a helper that differ only
+// in the schema of #arg, returning one whose #arg is the conjunction of
+// both.
+func unifyHelperArgs(a, b ast.Expr) (ast.Expr, bool) {
+	la, ok1 := a.(*ast.StructLit)
+	lb, ok2 := b.(*ast.StructLit)
+	if !ok1 || !ok2 || len(la.Elts) != len(lb.Elts) || len(la.Elts) == 0 {
+		return nil, false
+	}
+	fa, ok1 := la.Elts[0].(*ast.Field)
+	fb, ok2 := lb.Elts[0].(*ast.Field)
+	if !ok1 || !ok2 || !isArgField(fa) || !isArgField(fb) {
+		return nil, false
 	}
+	restA := &ast.StructLit{Elts: la.Elts[1:]}
+	restB := &ast.StructLit{Elts: lb.Elts[1:]}
+	if exprToText(restA) != exprToText(restB) {
+		return nil, false
+	}
+	elts := slices.Clone(la.Elts)
+	elts[0] = &ast.Field{
+		Label:      ast.NewIdent("#arg"),
+		Constraint: fa.Constraint,
+		Value:      binOp(token.AND, fa.Value, fb.Value),
+	}
+	return &ast.StructLit{Elts: elts}, true
+}
 
-	merged := mergeConvertResults(results)
-	return assembleSingleFile(cfg, merged)
+// isArgField reports whether f declares #arg.
+func isArgField(f *ast.Field) bool {
+	id, ok := f.Label.(*ast.Ident)
+	return ok && id.Name == "#arg"
 }
 
 // mergeConvertResults merges multiple convertResults into a single result
@@ -1769,6 +3140,7 @@ func mergeConvertResults(results []*convertResult) *convertResult {
 	merged := &convertResult{
 		imports:            make(map[string]bool),
 		usedHelpers:        make(map[string]HelperDef),
+		usedInputs:         make(map[string]inputField),
 		usedContextObjects: make(map[string]bool),
 		fieldRefs:          make(map[string][][]string),
 		requiredRefs:       make(map[string][][]string),
@@ -1786,6 +3158,9 @@ func mergeConvertResults(results []*convertResult) *convertResult {
 		for k, v := range r.usedHelpers {
 			merged.usedHelpers[k] = v
 		}
+		for k, v := range r.usedInputs {
+			merged.usedInputs[k] = v
+		}
 		for k := range r.usedContextObjects {
 			merged.usedContextObjects[k] = true
 		}
@@ -1809,13 +3184,25 @@ func mergeConvertResults(results []*convertResult) *convertResult {
 
 		// Take helper info from the first result (all share the same treeSet).
 		if i == 0 {
-			merged.helpers = r.helpers
 			merged.helperOrder = r.helperOrder
 			merged.helperExprs = r.helperExprs
 			merged.undefinedHelpers = r.undefinedHelpers
 		}
 	}
 
+	// Documents may convert a helper with different types; reconcile
+	// them before their bodies are assembled.
+	var sources []string
+	for i := range results {
+		sources = append(sources, fmt.Sprintf("document %d", i))
+	}
+	rh := reconcileHelpers(sources, results)
+	merged.helpers = rh.helpers
+	merged.helperOutputType = rh.outputType
+	merged.helperForms = rh.forms
+	merged.helperCopies = rh.copies
+	merged.warnings = append(merged.warnings, rh.warnings...)
+
 	// Build list body: output: [...]
 
 	// Check if any result has a range.
@@ -2007,7 +3394,7 @@ func (c *converter) helperRequiredType(pipe *parse.PipeNode) helperTypeInfo {
 			continue
 		}
 		if pf, ok := c.config.Funcs[id.Ident]; ok {
-			if pf.Cosmetic {
+			if pf.Cosmetic || pf.ConvertContext != nil {
 				continue
 			}
 			if pf.Passthrough {
@@ -2045,15 +3432,24 @@ func (c *converter) helperRequiredType(pipe *parse.PipeNode) helperTypeInfo {
 // before this is called.
 func (c *converter) convertDeferredHelper(cueName string, typeInfo helperTypeInfo, nodes []parse.Node) error {
 	c.helperOutputType[cueName] = typeInfo
+	c.helperConverting[cueName] = true
+	defer delete(c.helperConverting, cueName)
 
 	savedHelperName := c.currentHelperCUEName
 	c.currentHelperCUEName = cueName
 	defer func() { c.currentHelperCUEName = savedHelperName }()
 
+	var err error
 	if typeInfo.typ == "scalar" {
-		return c.convertDeferredHelperAsScalar(cueName, nodes)
+		err = c.convertDeferredHelperAsScalar(cueName, nodes)
+	} else {
+		err = c.convertDeferredHelperAsStruct(cueName, nodes)
+	}
+	if err != nil {
+		return err
 	}
-	return c.convertDeferredHelperAsStruct(cueName, nodes)
+	c.visitHelper(cueName, nodes)
+	return nil
 }
 
 // convertDeferredHelperAsScalar converts a deferred helper body as a scalar
@@ -2091,11 +3487,42 @@ func (c *converter) convertDeferredHelperAsScalar(cueName string, nodes []parse.
 	if err != nil {
 		return err
 	}
-	c.helperCUE[cueName] = cueExpr
+	c.helperCUE[cueName] = c.yamlTextExpr(cueExpr)
 	c.storeHelperArgInfo(cueName, argInfo)
 	return nil
 }
 
+// yamlTextExpr returns the text of a converted helper body that
+// consists of YAML fields, which is what Helm renders when such a
+// helper is used as a string: the fields are encoded with yaml.Marshal,
+// keeping #arg and any let clauses outside the encoded struct. Other
+// bodies are returned unchanged.
+func (c *converter) yamlTextExpr(expr ast.Expr) ast.Expr {
+	if !hasYAMLFields(expr) {
+		return expr
+	}
+	lit := expr.(*ast.StructLit)
+	var outer, inner []ast.Decl
+	for _, d := range lit.Elts {
+		switch d := d.(type) {
+		case *ast.LetClause:
+			outer = append(outer, d)
+			continue
+		case *ast.Field:
+			if isArgIdent(d.Label.(ast.Expr)) {
+				outer = append(outer, d)
+				continue
+			}
+		}
+		inner = append(inner, d)
+	}
+	text := c.marshalExpr(&ast.StructLit{Elts: inner})
+	if len(outer) == 0 {
+		return text
+	}
+	return &ast.StructLit{Elts: append(outer, &ast.EmbedDecl{Expr: text})}
+}
+
 // convertDeferredHelperAsStruct converts a deferred helper body as a struct
 // using the general converter (processNodes).
 func (c *converter) convertDeferredHelperAsStruct(cueName string, nodes []parse.Node) error {
@@ -2114,6 +3541,7 @@ func (c *converter) convertDeferredHelperAsStruct(cueName string, nodes []parse.
 func (c *converter) convertHelperBody(nodes []parse.Node) (ast.Expr, *helperArgInfo, error) {
 	sub := &converter{
 		config:                      c.config,
+		values:                      c.values,
 		usedContextObjects:          c.usedContextObjects,
 		fieldRefs:                   make(map[string][][]string),
 		requiredRefs:                make(map[string][][]string),
@@ -2121,10 +3549,14 @@ func (c *converter) convertHelperBody(nodes []parse.Node) (ast.Expr, *helperArgI
 		nonScalarRefs:               make(map[string][][]string),
 		imports:                     c.imports,
 		usedHelpers:                 c.usedHelpers,
+		usedInputs:                  c.usedInputs,
+		inputNames:                  c.inputNames,
 		treeSet:                     c.treeSet,
 		helperExprs:                 c.helperExprs,
 		helperCUE:                   c.helperCUE,
 		helperNodes:                 c.helperNodes,
+		helperConverting:            c.helperConverting,
+		helperForms:                 c.helperForms,
 		helperOutputType:            c.helperOutputType,
 		helperArgFieldRefs:          c.helperArgFieldRefs,
 		helperArgFieldRequiredRefs:  c.helperArgFieldRequiredRefs,
@@ -2135,10 +3567,12 @@ func (c *converter) convertHelperBody(nodes []parse.Node) (ast.Expr, *helperArgI
 		helperDirectRangeRefs:       c.helperDirectRangeRefs,
 		helperDirectNonScalarRefs:   c.helperDirectNonScalarRefs,
 		helperIncludes:              c.helperIncludes,
+		templateFiles:               c.templateFiles,
 		currentHelperCUEName:        c.currentHelperCUEName,
 		undefinedHelpers:            c.undefinedHelpers,
 		localVars:                   make(map[string]ast.Expr),
 		comments:                    make(map[ast.Expr]string),
+		emitted:                     c.emitted,
 	}
 
 	// Inside helper bodies, bare {{ . }} and {{ .field }} refer to
@@ -2159,6 +3593,7 @@ func (c *converter) convertHelperBody(nodes []parse.Node) (ast.Expr, *helperArgI
 	if err := sub.processNodes(nodes); err != nil {
 		return nil, nil, err
 	}
+	sub.flushCommentLine()
 	sub.finalizeInline()
 	sub.flushPendingAction()
 	sub.flushDeferred()
@@ -2187,27 +3622,26 @@ func (c *converter) convertHelperBody(nodes []parse.Node) (ast.Expr, *helperArgI
 			Clauses: sub.topLevelRange,
 			Value:   &ast.StructLit{Elts: rangeBodyDecls},
 		}
+		var body ast.Decl = comp
 		if sub.topLevelRangeIsList {
-			listExpr := &ast.ListLit{Elts: []ast.Expr{comp}}
-			// The _nonzero guard {#arg: #arg.field, _} shadows the
-			// outer #arg with the inner struct's field declaration.
-			// Use a let binding to capture #arg before the inner
-			// struct introduces its own #arg field. Check the entire
-			// list expression (including for clauses) for #arg refs.
-			if declsReferenceIdent([]ast.Decl{&ast.EmbedDecl{Expr: listExpr}}, "#arg") {
-				renameArgIdents(listExpr)
-				bodyDecls = []ast.Decl{
-					&ast.LetClause{
-						Ident: ast.NewIdent("_args"),
-						Expr:  ast.NewIdent("#arg"),
-					},
-					&ast.EmbedDecl{Expr: listExpr},
-				}
-			} else {
-				bodyDecls = []ast.Decl{&ast.EmbedDecl{Expr: listExpr}}
+			body = &ast.EmbedDecl{Expr: &ast.ListLit{Elts: []ast.Expr{comp}}}
+		}
+		// The _nonzero guard {#arg: #arg.field, _} shadows the
+		// outer #arg with the inner struct's field declaration.
+		// Use a let binding to capture #arg before the inner
+		// struct introduces its own #arg field. Check the entire
+		// body (including for clauses) for #arg refs.
+		if declsReferenceIdent([]ast.Decl{body}, "#arg") {
+			renameArgIdents(body)
+			bodyDecls = []ast.Decl{
+				&ast.LetClause{
+					Ident: ast.NewIdent("_args"),
+					Expr:  ast.NewIdent("#arg"),
+				},
+				body,
 			}
 		} else {
-			bodyDecls = []ast.Decl{comp}
+			bodyDecls = []ast.Decl{body}
 		}
 	}
 
@@ -2388,17 +3822,22 @@ func isExtendedTextHelperBody(nodes []parse.Node) bool {
 	}
 	// Check that ALL text content (recursively into control structures)
 	// has no YAML structure.
-	text := deepTextContent(nodes)
+	return !hasYAMLStructure(deepTextContent(nodes))
+}
+
+// hasYAMLStructure reports whether any line of text looks like a YAML
+// mapping key or list item.
+func hasYAMLStructure(text string) bool {
 	for _, line := range strings.Split(text, "\n") {
 		trimmed := strings.TrimSpace(line)
 		if trimmed == "" {
 			continue
 		}
 		if strings.Contains(trimmed, ": ") || strings.HasSuffix(trimmed, ":") || strings.HasPrefix(trimmed, "- ") {
-			return false
+			return true
 		}
 	}
-	return true
+	return false
 }
 
 // convertExtendedTextHelperBody converts a helper body with text, actions,
@@ -2407,6 +3846,7 @@ func isExtendedTextHelperBody(nodes []parse.Node) bool {
 func (c *converter) convertExtendedTextHelperBody(cueName string, nodes []parse.Node) (ast.Expr, *helperArgInfo, error) {
 	sub := &converter{
 		config:                      c.config,
+		values:                      c.values,
 		usedContextObjects:          c.usedContextObjects,
 		fieldRefs:                   make(map[string][][]string),
 		requiredRefs:                make(map[string][][]string),
@@ -2414,11 +3854,15 @@ func (c *converter) convertExtendedTextHelperBody(cueName string, nodes []parse.
 		nonScalarRefs:               make(map[string][][]string),
 		imports:                     c.imports,
 		usedHelpers:                 c.usedHelpers,
+		usedInputs:                  c.usedInputs,
+		inputNames:                  c.inputNames,
 		treeSet:                     c.treeSet,
 		helperExprs:                 c.helperExprs,
 		helperCUE:                   c.helperCUE,
 		helperOutputType:            c.helperOutputType,
 		helperNodes:                 c.helperNodes,
+		helperConverting:            c.helperConverting,
+		helperForms:                 c.helperForms,
 		helperArgFieldRefs:          c.helperArgFieldRefs,
 		helperArgFieldRequiredRefs:  c.helperArgFieldRequiredRefs,
 		helperArgFieldRangeRefs:     c.helperArgFieldRangeRefs,
@@ -2428,10 +3872,13 @@ func (c *converter) convertExtendedTextHelperBody(cueName string, nodes []parse.
 		helperDirectRangeRefs:       c.helperDirectRangeRefs,
 		helperDirectNonScalarRefs:   c.helperDirectNonScalarRefs,
 		helperIncludes:              c.helperIncludes,
+		templateFiles:               c.templateFiles,
 		currentHelperCUEName:        cueName,
 		undefinedHelpers:            c.undefinedHelpers,
 		localVars:                   make(map[string]ast.Expr),
 		comments:                    make(map[ast.Expr]string),
+		emitted:                     c.emitted,
+		textOutput:                  true,
 	}
 	useArg := sub.config.RootExpr == ""
 	if useArg {
@@ -2625,6 +4072,7 @@ func (c *converter) textHelperRangeToExpr(n *parse.RangeNode) (ast.Expr, error)
 
 	// Push range context for dot rebinding.
 	ctx := rangeContext{cueExpr: ast.NewIdent(valName)}
+	c.noteRangeValues(valName, overExpr)
 	c.rangeVarStack = append(c.rangeVarStack, ctx)
 
 	// Convert body to string expression.
@@ -2652,7 +4100,7 @@ func (c *converter) textHelperRangeToExpr(n *parse.RangeNode) (ast.Expr, error)
 				&ast.ForClause{
 					Key:    ast.NewIdent(keyExpr),
 					Value:  ast.NewIdent(valName),
-					Source: overExpr,
+					Source: c.sortedRangeSource(n, overExpr),
 				},
 			},
 			Value: &ast.StructLit{Elts: []ast.Decl{
@@ -2660,6 +4108,7 @@ func (c *converter) textHelperRangeToExpr(n *parse.RangeNode) (ast.Expr, error)
 			}},
 		},
 	}}
+	c.recordEmitted(listComp.Elts[0], n)
 	return importCall("strings", "Join", listComp, cueString("")), nil
 }
 
@@ -2715,6 +4164,12 @@ func escapeCUEString(s string) string {
 
 func (c *converter) handleInclude(name string, pipe *parse.PipeNode) (string, string, error) {
 	if cueName, ok := c.helperExprs[name]; ok {
+		if field, ok := c.templateFiles[name]; ok {
+			if _, converted := c.helperCUE[cueName]; !converted {
+				c.helperCUE[cueName] = templateFileExpr(field)
+			}
+			return cueName, "", nil
+		}
 		// Trigger deferred helper conversion if needed. This must
 		// happen before ref propagation so the helper's arg/direct
 		// refs are available.
@@ -2729,19 +4184,33 @@ func (c *converter) handleInclude(name string, pipe *parse.PipeNode) (string, st
 			if _, converted := c.helperCUE[cueName]; !converted {
 				// Don't convert if the type is unknown (e.g. variable
 				// assignment). A later call site with YAML context will
-				// determine the type.
-				if typeInfo.typ != "" {
+				// determine the type. Nor if the helper is already being
+				// converted further up the stack: it includes itself,
+				// directly or through other helpers, and the cycle is
+				// unrolled when helpers are emitted (see
+				// unrollRecursiveHelpers).
+				if typeInfo.typ != "" && !c.helperConverting[cueName] {
 					if err := c.convertDeferredHelper(cueName, typeInfo, nodes); err != nil {
-						c.warnings = append(c.warnings, fmt.Sprintf("helper %s: %v", cueName, err))
+						c.warnings = append(c.warnings, newDiagnostic(c.config, SeverityWarning, fmt.Sprintf("helper %s: %v", cueName, err), err))
 					}
 				}
 			} else if typeInfo.typ != "" {
 				existing := c.helperOutputType[cueName]
 				if existing.typ != typeInfo.typ {
-					if existing.strong && typeInfo.strong {
-						return "", "", fmt.Errorf("helper %q used in conflicting contexts: first as %s, now as %s; split into separate helpers or adjust call sites", name, existing.typ, typeInfo.typ)
+					form, err := c.helperForm(cueName, typeInfo, nodes)
+					switch {
+					case err == nil:
+						cueName = form
+					case existing.strong && typeInfo.strong:
+						return "", "", codeErrorf(CodeHelperConflict, "helper %q used in conflicting contexts: first as %s, now as %s (%v); split into separate helpers or adjust call sites", name, existing.typ, typeInfo.typ, err)
+					default:
+						msg := fmt.Sprintf("helper %q used as %s but was first converted as %s; output may be incorrect", name, typeInfo.typ, existing.typ)
+						err := codeErrorf(CodeHelperConflict, "%s", msg)
+						if contextPipe != nil {
+							err = atNode(contextPipe, err)
+						}
+						c.warnings = append(c.warnings, newDiagnostic(c.config, SeverityWarning, msg, err))
 					}
-					c.warnings = append(c.warnings, fmt.Sprintf("helper %q used as %s but was first converted as %s; output may be incorrect", name, typeInfo.typ, existing.typ))
 				}
 			}
 		}
@@ -2760,6 +4229,136 @@ func (c *converter) handleInclude(name string, pipe *parse.PipeNode) (string, st
 	return cueName, "", nil
 }
 
+// templateFileExpr returns the output of the template file converted
+// to field as Helm renders it for an include: the YAML stream of its
+// documents.
+func templateFileExpr(field string) ast.Expr {
+	return importCall("encoding/yaml", "MarshalStream", ast.NewIdent(field))
+}
+
+// helperForm returns the CUE name of a second form of helper cueName,
+// for call sites that need it as typeInfo.typ when it was first
+// converted as the other type. The form is created on first use and
+// emitted after the helper, named by a _text or _struct suffix:
+//
+//   - A text form of a struct helper is the helper body converted as
+//     text if it is text with actions (see isExtendedTextHelperBody),
+//     and otherwise the YAML encoding of the struct form, which is
+//     what Helm renders for a body of YAML fields.
+//   - A struct form of a text helper is the body converted as a struct.
+//
+// A body that is not YAML fields, such as plain text, has no struct
+// form, so it is an error to need one of its forms as the other type.
+func (c *converter) helperForm(cueName string, typeInfo helperTypeInfo, nodes []parse.Node) (string, error) {
+	if form, ok := c.helperForms[cueName]; ok {
+		return form, nil
+	}
+	if c.helperConverting[cueName] {
+		return "", fmt.Errorf("helper is still being converted")
+	}
+	form := helperFormName(cueName, typeInfo.typ, c.helperExprs)
+
+	// Only a body of YAML fields has both forms; the struct form of
+	// any other body is a string like its text form.
+	if typeInfo.typ == "scalar" && !hasYAMLFields(c.helperCUE[cueName]) {
+		return "", fmt.Errorf("its body is not YAML fields")
+	}
+	if typeInfo.typ == "scalar" && !isPureTextBody(nodes) && !isExtendedTextHelperBody(nodes) {
+		base := c.helperCUE[cueName]
+		var text ast.Expr
+		if helperTakesArg(base) {
+			text = &ast.StructLit{Elts: []ast.Decl{
+				&ast.Field{Label: ast.NewIdent("#arg"), Value: ast.NewIdent("_")},
+				&ast.LetClause{Ident: ast.NewIdent("_args"), Expr: ast.NewIdent("#arg")},
+				&ast.EmbedDecl{Expr: c.marshalExpr(binOp(token.AND, ast.NewIdent(cueName), &ast.StructLit{Elts: []ast.Decl{
+					&ast.Field{Label: ast.NewIdent("#arg"), Value: ast.NewIdent("_args")},
+					&ast.EmbedDecl{Expr: ast.NewIdent("_")},
+				}}))},
+			}}
+		} else {
+			text = c.marshalExpr(ast.NewIdent(cueName))
+		}
+		c.helperCUE[form] = text
+		c.helperOutputType[form] = typeInfo
+		c.copyHelperArgInfo(cueName, form)
+	} else if err := c.convertDeferredHelper(form, typeInfo, nodes); err != nil {
+		delete(c.helperCUE, form)
+		return "", err
+	} else if typeInfo.typ != "scalar" && !hasYAMLFields(c.helperCUE[form]) {
+		delete(c.helperCUE, form)
+		return "", fmt.Errorf("its body is not YAML fields")
+	}
+	c.helperForms[cueName] = form
+	return form, nil
+}
+
+// helperFormName returns the CUE name of the form of helper cueName
+// that produces typ, one that no defined helper already uses.
+func helperFormName(cueName, typ string, helperExprs map[string]string) string {
+	suffix := "_struct"
+	if typ == "scalar" {
+		suffix = "_text"
+	}
+	form := cueName + suffix
+	for slices.Contains(slices.Collect(maps.Values(helperExprs)), form) {
+		form += "_"
+	}
+	return form
+}
+
+// hasYAMLFields reports whether a converted helper body is a struct
+// with fields other than #arg, as converted from YAML fields.
+func hasYAMLFields(expr ast.Expr) bool {
+	lit, ok := expr.(*ast.StructLit)
+	return ok && slices.ContainsFunc(lit.Elts, func(d ast.Decl) bool {
+		f, ok := d.(*ast.Field)
+		return ok && !isArgIdent(f.Label.(ast.Expr))
+	})
+}
+
+// helperTakesArg reports whether a converted helper declares #arg, and
+// so is called as (_name & {#arg: x, _}).
+func helperTakesArg(expr ast.Expr) bool {
+	lit, ok := expr.(*ast.StructLit)
+	if !ok {
+		return false
+	}
+	for _, d := range lit.Elts {
+		if f, ok := d.(*ast.Field); ok {
+			if id, ok := f.Label.(*ast.Ident); ok && id.Name == "#arg" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// copyHelperArgInfo records the context references of helper from as
+// those of helper to, for a form of a helper that wraps it.
+func (c *converter) copyHelperArgInfo(from, to string) {
+	for _, m := range []map[string][][]string{
+		c.helperArgFieldRefs,
+		c.helperArgFieldRequiredRefs,
+		c.helperArgFieldRangeRefs,
+		c.helperArgFieldNonScalarRefs,
+	} {
+		if v, ok := m[from]; ok {
+			m[to] = v
+		}
+	}
+	for _, m := range []map[string]map[string][][]string{
+		c.helperDirectFieldRefs,
+		c.helperDirectRequiredRefs,
+		c.helperDirectRangeRefs,
+		c.helperDirectNonScalarRefs,
+	} {
+		if v, ok := m[from]; ok {
+			m[to] = v
+		}
+	}
+	c.helperIncludes[to] = append(c.helperIncludes[to], from)
+}
+
 // propagateHelperDirectRefs merges a helper's direct context object
 // references (e.g. .Values.X accessed in the helper body) into the
 // parent converter's field ref maps. This is called when the helper
@@ -2895,6 +4494,91 @@ func (c *converter) propagateDictHelperArgRefs(cueName string, dictMap map[strin
 	}
 }
 
+// varScope is the body of an if, with or range action. Rebinding a
+// variable declared outside the body, as unset does, only holds when
+// the body runs.
+type varScope struct {
+	outer map[string]bool // local variables visible on entry
+	conds []ast.Expr      // conditions under which the body runs; nil if unknown, as in range
+	loop  bool            // the body of a range, which may run more than once
+}
+
+func (c *converter) enterScope(loop bool) {
+	outer := make(map[string]bool, len(c.localVars))
+	for name := range c.localVars {
+		outer[name] = true
+	}
+	c.scopes = append(c.scopes, varScope{outer: outer, loop: loop})
+}
+
+func (c *converter) exitScope() {
+	c.scopes = c.scopes[:len(c.scopes)-1]
+}
+
+// inLoop reports whether a range body is being converted.
+func (c *converter) inLoop() bool {
+	return slices.ContainsFunc(c.scopes, func(s varScope) bool { return s.loop })
+}
+
+// guardScope records the conditions of the branch about to be
+// converted in the innermost scope and returns a func restoring it.
+func (c *converter) guardScope(conds []ast.Expr) func() {
+	if len(c.scopes) == 0 {
+		return func() {}
+	}
+	s := &c.scopes[len(c.scopes)-1]
+	saved := s.conds
+	s.conds = conds
+	return func() { s.conds = saved }
+}
+
+// rebindVar rebinds the local variable name to expr. Inside
+// conditional bodies that do not declare the variable, the new value
+// is selected only when all their conditions hold:
+//
+//	[if cond {expr}, old][0]
+func (c *converter) rebindVar(name string, expr ast.Expr) error {
+	var conds []ast.Expr
+	for _, s := range c.scopes {
+		if !s.outer[name] {
+			continue
+		}
+		if s.conds == nil {
+			return fmt.Errorf("cannot change %s, declared outside the enclosing range or condition", name)
+		}
+		conds = append(conds, s.conds...)
+	}
+	if len(conds) == 0 {
+		c.localVars[name] = expr
+		return nil
+	}
+	var clauses []ast.Clause
+	for _, cond := range conds {
+		clauses = append(clauses, &ast.IfClause{Condition: cond})
+	}
+	c.localVars[name] = &ast.IndexExpr{
+		X: &ast.ListLit{Elts: []ast.Expr{
+			&ast.Comprehension{
+				Clauses: clauses,
+				Value: &ast.StructLit{Elts: []ast.Decl{
+					&ast.EmbedDecl{Expr: expr},
+				}},
+			},
+			c.localVars[name],
+		}},
+		Index: cueInt(0),
+	}
+	return nil
+}
+
+// localVarField records the field a local variable was set to, as in
+// {{ $x := .Values.x }}, while localVars still holds the expression
+// converted from it.
+type localVarField struct {
+	expr  ast.Expr
+	field *parse.FieldNode
+}
+
 // convertIncludeContext converts the context argument of an include call.
 // It returns:
 //   - argExpr: CUE expression for field references (to be unified as
@@ -2907,6 +4591,18 @@ func (c *converter) convertIncludeContext(node parse.Node) (argExpr ast.Expr, he
 	case *parse.DotNode:
 		return nil, "", nil, nil, nil
 	case *parse.VariableNode:
+		// A local variable such as a range value is passed as the
+		// argument; $ is the root context, like a top-level dot. A
+		// variable set to a field passes the field, so that the
+		// helper's uses of it reach the schema.
+		if len(n.Ident) == 1 && n.Ident[0] != "$" {
+			if localExpr, ok := c.localVars[n.Ident[0]]; ok {
+				if lf, ok := c.localVarFields[n.Ident[0]]; ok && lf.expr == localExpr {
+					return c.convertIncludeContext(lf.field)
+				}
+				return localExpr, "", nil, nil, nil
+			}
+		}
 		return nil, "", nil, nil, nil
 	case *parse.FieldNode:
 		expr, ho := c.fieldToCUEInContext(n.Ident)
@@ -3116,7 +4812,7 @@ func (c *converter) finalizeInline() {
 	if c.inlineParts == nil {
 		return
 	}
-	result := partsToExpr(c.inlineParts)
+	result := partsToExpr(unquoteInlineParts(c.inlineParts))
 	key := c.inlineKey
 	keyLabel := c.inlineKeyLabel
 	suffix := c.inlineSuffix
@@ -3139,6 +4835,27 @@ func (c *converter) finalizeInline() {
 	}
 }
 
+// unquoteInlineParts strips the quotes of a double-quoted YAML scalar
+// from parts, whose text is escaped for a CUE string, as when an if or
+// range action is inside the quotes.
+func unquoteInlineParts(parts []inlinePart) []inlinePart {
+	if len(parts) == 0 {
+		return parts
+	}
+	first, last := parts[0].text, parts[len(parts)-1].text
+	if len(parts) == 1 && len(first) < 4 {
+		return parts
+	}
+	if parts[0].expr != nil || parts[len(parts)-1].expr != nil ||
+		!strings.HasPrefix(first, `\"`) || !strings.HasSuffix(last, `\"`) || strings.HasSuffix(last, `\\\"`) {
+		return parts
+	}
+	parts = slices.Clone(parts)
+	parts[0].text = strings.TrimPrefix(parts[0].text, `\"`)
+	parts[len(parts)-1].text = strings.TrimSuffix(parts[len(parts)-1].text, `\"`)
+	return parts
+}
+
 // inlineExpr wraps a CUE expression for embedding in a string interpolation.
 // If the expression is already a CUE string literal, its content is inlined
 // directly to avoid nested interpolation.
@@ -3308,6 +5025,7 @@ func (c *converter) embedRangeInBlockScalarMultiline(n *parse.RangeNode) error {
 
 	// Push range context.
 	ctx := rangeContext{cueExpr: ast.NewIdent(valName)}
+	c.noteRangeValues(valName, overExpr)
 	c.rangeVarStack = append(c.rangeVarStack, ctx)
 
 	// Convert body to string expression.
@@ -3339,7 +5057,7 @@ func (c *converter) embedRangeInBlockScalarMultiline(n *parse.RangeNode) error {
 				&ast.ForClause{
 					Key:    ast.NewIdent(keyExpr),
 					Value:  ast.NewIdent(valName),
-					Source: overExpr,
+					Source: c.sortedRangeSource(n, overExpr),
 				},
 			},
 			Value: &ast.StructLit{Elts: []ast.Decl{
@@ -3347,6 +5065,7 @@ func (c *converter) embedRangeInBlockScalarMultiline(n *parse.RangeNode) error {
 			}},
 		},
 	}}
+	c.recordEmitted(listComp.Elts[0], n)
 	joinExpr := importCall("strings", "Join", listComp, cueString("\n"))
 
 	joinText := inlineExpr(c.exprToGuardText(joinExpr))
@@ -3604,6 +5323,7 @@ func (c *converter) blockScalarRangeToExpr(n *parse.RangeNode) (ast.Expr, error)
 
 	// Push range context.
 	ctx := rangeContext{cueExpr: ast.NewIdent(valName)}
+	c.noteRangeValues(valName, overExpr)
 	c.rangeVarStack = append(c.rangeVarStack, ctx)
 
 	// Convert body to string expression.
@@ -3634,7 +5354,7 @@ func (c *converter) blockScalarRangeToExpr(n *parse.RangeNode) (ast.Expr, error)
 				&ast.ForClause{
 					Key:    ast.NewIdent(keyExpr),
 					Value:  ast.NewIdent(valName),
-					Source: overExpr,
+					Source: c.sortedRangeSource(n, overExpr),
 				},
 			},
 			Value: &ast.StructLit{Elts: []ast.Decl{
@@ -3642,6 +5362,7 @@ func (c *converter) blockScalarRangeToExpr(n *parse.RangeNode) (ast.Expr, error)
 			}},
 		},
 	}}
+	c.recordEmitted(listComp.Elts[0], n)
 	return importCall("strings", "Join", listComp, cueString("")), nil
 }
 
@@ -3749,7 +5470,7 @@ func (c *converter) finalizeBlockScalar() {
 // double quote but does not end with the matching closing quote, indicating
 // a multi-line YAML flow scalar.
 func isUnterminatedQuotedScalar(val string) bool {
-	if len(val) < 2 {
+	if len(val) == 0 {
 		return false
 	}
 	q := val[0]
@@ -3762,9 +5483,13 @@ func isUnterminatedQuotedScalar(val string) bool {
 
 // findClosingQuote returns the index (in s) of the closing quote character q,
 // or -1 if not found. For single-quoted YAML strings, ” is an escaped literal
-// quote and does not terminate the string.
+// quote and does not terminate the string; for double-quoted ones, \" is.
 func findClosingQuote(s string, q byte) int {
 	for i := 0; i < len(s); i++ {
+		if q == '"' && s[i] == '\\' {
+			i++
+			continue
+		}
 		if s[i] == q {
 			if q == '\'' && i+1 < len(s) && s[i+1] == '\'' {
 				// '' is an escaped single quote — skip both.
@@ -3777,8 +5502,39 @@ func findClosingQuote(s string, q byte) int {
 	return -1
 }
 
+// nextIsAction reports whether the next sibling node is an action.
+func (c *converter) nextIsAction() bool {
+	if len(c.remainingNodes) == 0 {
+		return false
+	}
+	_, ok := c.remainingNodes[0].(*parse.ActionNode)
+	return ok
+}
+
+// nextIsControl reports whether the next sibling node is an if, range
+// or with action, whose body a quoted scalar cannot accumulate.
+func (c *converter) nextIsControl() bool {
+	if len(c.remainingNodes) == 0 {
+		return false
+	}
+	switch c.remainingNodes[0].(type) {
+	case *parse.IfNode, *parse.RangeNode, *parse.WithNode:
+		return true
+	}
+	return false
+}
+
+// startQuotedScalar starts accumulating the quoted YAML scalar that
+// starts val, the value of key, or a list item if key is empty.
+func (c *converter) startQuotedScalar(key, val string) {
+	c.quotedScalarQuote = val[0]
+	c.quotedScalarKey = key
+	c.quotedScalarParts = []string{val[1:]} // strip opening quote
+}
+
 // finalizeQuotedScalar joins accumulated quoted scalar parts using YAML flow
-// scalar folding rules and emits the result as a field value.
+// scalar folding rules and emits the result as a field value, or as a
+// list item if it has no key.
 //
 // YAML flow scalar folding: line breaks between content lines become spaces;
 // blank lines (represented as "\n" sentinels) become literal newlines.
@@ -3792,32 +5548,144 @@ func (c *converter) finalizeQuotedScalar() {
 	c.quotedScalarKey = ""
 
 	// Apply YAML flow scalar folding.
+	double := c.quotedScalarQuote == '"'
 	var sb strings.Builder
+	escapedBreak := false
 	for i, part := range parts {
 		if part == "\n" {
 			// Blank line → literal newline.
 			sb.WriteByte('\n')
 			continue
 		}
-		if i > 0 && sb.Len() > 0 {
+		if i > 0 && sb.Len() > 0 && !escapedBreak {
 			last := sb.String()[sb.Len()-1]
 			if last != '\n' {
 				// Non-blank preceding → fold to space.
 				sb.WriteByte(' ')
 			}
 		}
+		// In a double-quoted scalar, a line ending in an escaping
+		// backslash joins the next line without a space.
+		escapedBreak = double && i < len(parts)-1 && endsInEscape(part)
+		if escapedBreak {
+			part = part[:len(part)-1]
+		}
 		sb.WriteString(part)
 	}
-	folded := sb.String()
-
-	// For single-quoted YAML, '' is an escaped single quote.
-	if c.quotedScalarQuote == '\'' {
-		folded = strings.ReplaceAll(folded, "''", "'")
+	// The parts alternate between the text of the scalar and the
+	// interpolations of actions within it, which are already CUE.
+	segments := strings.Split(sb.String(), quotedScalarInterp)
+	for i := 0; i < len(segments); i += 2 {
+		if !double {
+			// For single-quoted YAML, '' is an escaped single quote.
+			segments[i] = strings.ReplaceAll(segments[i], "''", "'")
+			continue
+		}
+		s, err := unquoteYAMLDouble(segments[i])
+		if err != nil {
+			c.quotedScalarErr = err
+			return
+		}
+		segments[i] = s
 	}
-
-	c.emitField(key, cueString(folded))
+	var value ast.Expr
+	if len(segments) == 1 {
+		value = cueString(segments[0])
+	} else {
+		for i := 0; i < len(segments); i += 2 {
+			segments[i] = escapeCUEString(segments[i])
+		}
+		value = mustParseExpr(`"` + strings.Join(segments, "") + `"`)
+	}
+	switch {
+	case key != "":
+		c.emitField(key, value)
+	case c.inListContext():
+		c.appendListExpr(value)
+	default:
+		c.emitEmbed(value)
+	}
+}
+
+// endsInEscape reports whether s ends in a backslash that escapes
+// what follows, rather than one escaped by another backslash.
+func endsInEscape(s string) bool {
+	n := len(s) - len(strings.TrimRight(s, `\`))
+	return n%2 == 1
+}
+
+// yamlEscapes maps the single-character escapes of double-quoted YAML
+// scalars to the characters they stand for.
+var yamlEscapes = map[byte]string{
+	'0':  "\x00",
+	'a':  "\a",
+	'b':  "\b",
+	't':  "\t",
+	'\t': "\t",
+	'n':  "\n",
+	'v':  "\v",
+	'f':  "\f",
+	'r':  "\r",
+	'e':  "\x1b",
+	' ':  " ",
+	'"':  `"`,
+	'/':  "/",
+	'\\': `\`,
+	'N':  "\u0085",
+	'_':  "\u00a0",
+	'L':  "\u2028",
+	'P':  "\u2029",
+}
+
+// unquoteYAMLDouble returns the text of a double-quoted YAML scalar
+// with its escape sequences, those of YAML 1.2 rather than Go, replaced.
+func unquoteYAMLDouble(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+1 == len(s) {
+			return "", fmt.Errorf("invalid escape at the end of double-quoted YAML scalar %q", s)
+		}
+		i++
+		if r, ok := yamlEscapes[s[i]]; ok {
+			sb.WriteString(r)
+			continue
+		}
+		var n int
+		switch s[i] {
+		case 'x':
+			n = 2
+		case 'u':
+			n = 4
+		case 'U':
+			n = 8
+		default:
+			return "", fmt.Errorf(`invalid escape \%c in double-quoted YAML scalar %q`, s[i], s)
+		}
+		var code uint64
+		var err error
+		if i+n < len(s) {
+			code, err = strconv.ParseUint(s[i+1:i+1+n], 16, 32)
+		}
+		if i+n >= len(s) || err != nil || !utf8.ValidRune(rune(code)) {
+			return "", fmt.Errorf(`invalid escape \%c in double-quoted YAML scalar %q`, s[i], s)
+		}
+		sb.WriteRune(rune(code))
+		i += n
+	}
+	return sb.String(), nil
 }
 
+// quotedScalarInterp delimits the interpolations of actions in the
+// accumulated parts of a quoted scalar.
+const quotedScalarInterp = "\x00"
+
 // resolveDeferredAsBlock converts a deferred key-value into a block with embedding.
 func (c *converter) resolveDeferredAsBlock(childYamlIndent int) {
 	if c.deferredKV == nil {
@@ -3849,6 +5717,65 @@ func (c *converter) resolveDeferredAsBlock(childYamlIndent int) {
 	})
 }
 
+// flushCommentLine emits the accumulated YAML comment line, if any,
+// followed by the fail calls of its actions.
+func (c *converter) flushCommentLine() {
+	if c.commentLine == nil {
+		return
+	}
+	text := strings.TrimRight(c.commentLine.String(), " \t")
+	c.commentLine = nil
+	c.emitComment(text)
+	for _, check := range c.commentChecks {
+		if c.inListContext() {
+			c.appendListExpr(check)
+		} else {
+			c.emitEmbed(check)
+		}
+	}
+	c.commentChecks = nil
+}
+
+// checkCommentAction converts n, an action on a YAML comment line that
+// calls required or fail. Its output is part of the comment, but its
+// check still applies, as it does when Helm renders the comment: a
+// value that required reads is required, and a fail call is kept.
+func (c *converter) checkCommentAction(n *parse.ActionNode) error {
+	expr, helmObj, err := c.actionToCUE(n)
+	if err != nil {
+		return err
+	}
+	if helmObj != "" {
+		c.usedContextObjects[helmObj] = true
+	}
+	if call, ok := expr.(*ast.CallExpr); ok {
+		if id, ok := call.Fun.(*ast.Ident); ok && id.Name == "error" {
+			c.commentChecks = append(c.commentChecks, expr)
+		}
+	}
+	return nil
+}
+
+// pipeCalls reports whether pipe, or a pipeline within it, calls any
+// of the functions names.
+func pipeCalls(pipe *parse.PipeNode, names ...string) bool {
+	for _, cmd := range pipe.Cmds {
+		for _, arg := range cmd.Args {
+			switch a := arg.(type) {
+			case *parse.IdentifierNode:
+				if slices.Contains(names, a.Ident) {
+					return true
+				}
+			case *parse.PipeNode:
+				if pipeCalls(a, names...) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
 // emitTextNode processes a YAML text fragment line-by-line, building AST nodes.
 func (c *converter) emitTextNode(text []byte) {
 	s := string(text)
@@ -3856,6 +5783,17 @@ func (c *converter) emitTextNode(text []byte) {
 		return
 	}
 
+	// Complete a YAML comment line that continues into this text.
+	if c.commentLine != nil {
+		line, _, ended := strings.Cut(s, "\n")
+		c.commentLine.WriteString(line)
+		if !ended {
+			return
+		}
+		c.flushCommentLine()
+		s = s[len(line):]
+	}
+
 	// Check if text starts as a continuation of a deferred list item action.
 	if c.pendingListItemExpr != nil {
 		if s[0] != '\n' {
@@ -3870,13 +5808,16 @@ func (c *converter) emitTextNode(text []byte) {
 	}
 
 	// Check if text starts as a continuation of a deferred key-value.
-	if c.deferredKV != nil && s[0] != '\n' {
+	if c.deferredKV != nil && s[0] != '\n' && !c.deferredKV.lineEnded {
 		d := c.deferredKV
 		c.deferredKV = nil
 		c.inlineKey = d.key
 		c.inlineKeyLabel = d.keyLabel
 		c.inlineParts = []inlinePart{toInlinePart(d.value)}
 	}
+	if c.deferredKV != nil && strings.Contains(s, "\n") {
+		c.deferredKV.lineEnded = true
+	}
 
 	// Handle inline continuation.
 	if c.inlineParts != nil {
@@ -4087,6 +6028,13 @@ func (c *converter) emitTextNode(text []byte) {
 		if strings.HasPrefix(trimmed, "#") {
 			commentText := strings.TrimPrefix(trimmed, "#")
 			commentText = strings.TrimPrefix(commentText, " ")
+			if isLastLine && textEndsNoNewline && len(c.remainingNodes) > 0 {
+				// Keep the space before the action that follows.
+				commentText = strings.TrimPrefix(strings.TrimLeft(content, " \t"), "#")
+				c.commentLine = &strings.Builder{}
+				c.commentLine.WriteString(strings.TrimPrefix(commentText, " "))
+				continue
+			}
 			c.emitComment(commentText)
 			continue
 		}
@@ -4133,13 +6081,10 @@ func (c *converter) emitTextNode(text []byte) {
 				c.state = statePendingKey
 				c.pendingKey = key
 				c.pendingKeyInd = yamlIndent
-			} else if isUnterminatedQuotedScalar(val) {
-				c.quotedScalarQuote = val[0]
-				c.quotedScalarKey = key
+			} else if isUnterminatedQuotedScalar(val) && !(continuesInline && c.nextIsControl()) {
 				// Use untrimmed value to preserve trailing whitespace
 				// before template actions on the same line.
-				rawVal := content[colonIdx+2:]
-				c.quotedScalarParts = []string{rawVal[1:]} // strip opening quote
+				c.startQuotedScalar(key, content[colonIdx+2:])
 			} else if continuesInline && val != "" && startsIncompleteFlow(val) {
 				c.startFlowAccum(content[colonIdx+2:], key, "\n")
 			} else if continuesInline && val != "" {
@@ -4282,8 +6227,12 @@ func (c *converter) processListItem(trimmed string, yamlIndent int, isLastLine,
 				structLit:  itemStruct,
 				isListItem: true,
 			})
-			c.inlineKey = key
-			c.inlineParts = []inlinePart{{text: escapeCUEString(val)}}
+			if c.nextIsAction() && isUnterminatedQuotedScalar(val) {
+				c.startQuotedScalar(key, content[colonIdx+2:])
+			} else {
+				c.inlineKey = key
+				c.inlineParts = []inlinePart{{text: escapeCUEString(val)}}
+			}
 		} else if val == "|-" || val == "|" || val == ">-" || val == ">" {
 			// Block scalar as value of a key inside a list item.
 			itemStruct := &ast.StructLit{}
@@ -4344,6 +6293,9 @@ func (c *converter) processListItem(trimmed string, yamlIndent int, isLastLine,
 		c.blockScalarFolded = tc[0] == '>'
 		c.blockScalarStrip = strings.HasSuffix(tc, "-")
 		c.blockScalarPartialLine = false
+	} else if continuesInline && c.nextIsAction() && isUnterminatedQuotedScalar(strings.TrimSpace(content)) {
+		// Quoted scalar list item continues into next AST node.
+		c.startQuotedScalar("", strings.TrimLeft(content, " \t"))
 	} else if continuesInline {
 		// Scalar list item continues into next AST node — start inline.
 		c.inlineKey = ""
@@ -4375,6 +6327,8 @@ func (c *converter) processRangeListItem(content string, yamlIndent int, isLastL
 		} else if continuesInline && val != "" && startsIncompleteFlow(val) {
 			// Value is an incomplete flow collection in range list item.
 			c.startFlowAccum(content[colonIdx+2:], key, "\n")
+		} else if continuesInline && c.nextIsAction() && isUnterminatedQuotedScalar(val) {
+			c.startQuotedScalar(key, content[colonIdx+2:])
 		} else if continuesInline && val != "" {
 			// Value continues into next AST node — start inline.
 			c.inlineKey = key
@@ -4392,6 +6346,9 @@ func (c *converter) processRangeListItem(content string, yamlIndent int, isLastL
 		c.state = statePendingKey
 		c.pendingKey = ""
 		c.pendingKeyInd = yamlIndent
+	} else if continuesInline && c.nextIsAction() && isUnterminatedQuotedScalar(strings.TrimSpace(content)) {
+		// Quoted scalar value continues into next AST node.
+		c.startQuotedScalar("", strings.TrimLeft(content, " \t"))
 	} else if continuesInline {
 		// Scalar value continues into next AST node — start inline.
 		c.inlineKey = ""
@@ -4518,6 +6475,7 @@ func (c *converter) processNodes(nodes []parse.Node) error {
 		}
 
 		ctx := rangeContext{cueExpr: ast.NewIdent(valName)}
+		c.noteRangeValues(valName, overExpr)
 		if helmObj != "" && fieldPath != nil {
 			ctx.helmObj = helmObj
 			ctx.basePath = fieldPath
@@ -4544,17 +6502,25 @@ func (c *converter) processNodes(nodes []parse.Node) error {
 			ast.SetRelPos(ifClause, token.Newline)
 			clauses = append(clauses, ifClause)
 		}
+		// A template's top-level range emits documents, and a
+		// helper's emits a list or struct; only the first two
+		// are ordered.
+		isList := isListBody(rangeNode.List.Nodes)
+		src := overExpr
+		if isList || c.helperArgRefs == nil {
+			src = c.sortedRangeSource(rangeNode, overExpr)
+		}
 		forClause := &ast.ForClause{
 			Key:    ast.NewIdent(keyExpr),
 			Value:  ast.NewIdent(valName),
-			Source: overExpr,
+			Source: src,
 		}
 		if hasGuard {
 			ast.SetRelPos(forClause, token.Newline)
 		}
 		clauses = append(clauses, forClause)
 		c.topLevelRange = clauses
-		c.topLevelRangeIsList = isListBody(rangeNode.List.Nodes)
+		c.topLevelRangeIsList = isList
 
 		savedRangeBody := c.inRangeBody
 		savedRangeDepth := c.rangeBodyStackDepth
@@ -4876,10 +6842,41 @@ func isInlineSafeRange(n *parse.RangeNode) bool {
 	return n.ElseList == nil || len(n.ElseList.Nodes) == 0
 }
 
-func (c *converter) processNode(node parse.Node) error {
+func (c *converter) processNode(node parse.Node) (err error) {
+	savedNode := c.node
+	c.node, c.lastNode = node, node
+	defer func() {
+		c.node = savedNode
+		err = atNode(node, err)
+	}()
+	if c.commentLine != nil {
+		switch n := node.(type) {
+		case *parse.ActionNode:
+			if len(n.Pipe.Decl) == 0 {
+				c.commentLine.WriteString(n.String())
+				if pipeCalls(n.Pipe, "required", "fail") {
+					return c.checkCommentAction(n)
+				}
+				return nil
+			}
+		case *parse.TextNode:
+		default:
+			c.flushCommentLine()
+		}
+	}
+	switch node.(type) {
+	case *parse.IfNode, *parse.WithNode, *parse.RangeNode:
+		_, loop := node.(*parse.RangeNode)
+		c.enterScope(loop)
+		defer c.exitScope()
+	}
 	switch n := node.(type) {
 	case *parse.TextNode:
 		c.emitTextNode(n.Text)
+		if err := c.quotedScalarErr; err != nil {
+			c.quotedScalarErr = nil
+			return err
+		}
 	case *parse.ActionNode:
 		if len(n.Pipe.Decl) > 0 {
 			varName := n.Pipe.Decl[0].Ident[0]
@@ -4891,6 +6888,12 @@ func (c *converter) processNode(node parse.Node) error {
 				c.usedContextObjects[helmObj] = true
 			}
 			c.localVars[varName] = expr
+			if f, ok := n.Pipe.Cmds[0].Args[0].(*parse.FieldNode); ok && len(n.Pipe.Cmds) == 1 && len(n.Pipe.Cmds[0].Args) == 1 {
+				if c.localVarFields == nil {
+					c.localVarFields = make(map[string]localVarField)
+				}
+				c.localVarFields[varName] = localVarField{expr: expr, field: f}
+			}
 			return nil
 		}
 		expr, helmObj, err := c.actionToCUE(n)
@@ -4948,6 +6951,8 @@ func (c *converter) processNode(node parse.Node) error {
 		return c.processRange(n)
 	case *parse.WithNode:
 		return c.processWith(n)
+	case *parse.BreakNode, *parse.ContinueNode:
+		return fmt.Errorf("%s: %w", node, errLoopControl)
 	case *parse.TemplateNode:
 		cueName, helmObj, err := c.handleInclude(n.Name, n.Pipe)
 		if err != nil {
@@ -4980,6 +6985,10 @@ func (c *converter) processNode(node parse.Node) error {
 		text = strings.TrimPrefix(text, "/*")
 		text = strings.TrimSuffix(text, "*/")
 		text = strings.TrimSpace(text)
+		if text == "" {
+			// An empty comment, such as one holding only newlines.
+			break
+		}
 		for _, line := range strings.Split(text, "\n") {
 			line = strings.TrimSpace(line)
 			c.emitComment(line)
@@ -5023,12 +7032,12 @@ func (c *converter) emitActionExpr(expr ast.Expr, comment string) {
 
 	// If quoted scalar accumulation is active, embed as interpolation.
 	if c.quotedScalarParts != nil {
-		exprStr := c.exprToGuardText(expr)
+		interp := quotedScalarInterp + inlineExpr(c.exprToGuardText(expr)) + quotedScalarInterp
 		if len(c.quotedScalarParts) > 0 {
 			last := len(c.quotedScalarParts) - 1
-			c.quotedScalarParts[last] += inlineExpr(exprStr)
+			c.quotedScalarParts[last] += interp
 		} else {
-			c.quotedScalarParts = append(c.quotedScalarParts, inlineExpr(exprStr))
+			c.quotedScalarParts = append(c.quotedScalarParts, interp)
 		}
 		c.quotedScalarPartialLine = true
 		return
@@ -5151,6 +7160,7 @@ func (c *converter) emitConditionalBlockNodes(condition ast.Expr, bodyIndent int
 	if len(nodes) == 0 {
 		return nil
 	}
+	defer c.guardScope([]ast.Expr{condition})()
 	// Check if the nodes have any non-empty text content.
 	if strings.TrimSpace(textContent(nodes)) == "" {
 		return nil
@@ -5554,7 +7564,7 @@ func (c *converter) processInlineIf(n *parse.IfNode) error {
 	allParts = append(allParts, prefix...)
 	allParts = append(allParts, ifParts...)
 	allParts = append(allParts, suffixParts...)
-	ifValueExpr := partsToExpr(allParts)
+	ifValueExpr := partsToExpr(unquoteInlineParts(allParts))
 
 	// Emit if comprehension.
 	c.emitInlineComprehension(condition, key, keyLabel, ifValueExpr)
@@ -5571,14 +7581,14 @@ func (c *converter) processInlineIf(n *parse.IfNode) error {
 		allParts = append(allParts, prefix...)
 		allParts = append(allParts, elseParts...)
 		allParts = append(allParts, suffixParts...)
-		elseValueExpr := partsToExpr(allParts)
+		elseValueExpr := partsToExpr(unquoteInlineParts(allParts))
 
 		c.emitInlineComprehension(negCondition, key, keyLabel, elseValueExpr)
 	} else if len(prefix) > 0 || len(suffixParts) > 0 {
 		allParts = allParts[:0]
 		allParts = append(allParts, prefix...)
 		allParts = append(allParts, suffixParts...)
-		elseValueExpr := partsToExpr(allParts)
+		elseValueExpr := partsToExpr(unquoteInlineParts(allParts))
 
 		c.emitInlineComprehension(negCondition, key, keyLabel, elseValueExpr)
 	}
@@ -5624,6 +7634,7 @@ func (c *converter) rangeToInlineExpr(n *parse.RangeNode) (ast.Expr, error) {
 
 	// Push range context so branchToInlineParts resolves {{ . }} correctly.
 	ctx := rangeContext{cueExpr: ast.NewIdent(valName)}
+	c.noteRangeValues(valName, overExpr)
 	c.rangeVarStack = append(c.rangeVarStack, ctx)
 
 	// Convert body to inline parts.
@@ -5652,7 +7663,7 @@ func (c *converter) rangeToInlineExpr(n *parse.RangeNode) (ast.Expr, error) {
 				&ast.ForClause{
 					Key:    ast.NewIdent(keyExpr),
 					Value:  ast.NewIdent(valName),
-					Source: overExpr,
+					Source: c.sortedRangeSource(n, overExpr),
 				},
 			},
 			Value: &ast.StructLit{Elts: []ast.Decl{
@@ -5660,6 +7671,7 @@ func (c *converter) rangeToInlineExpr(n *parse.RangeNode) (ast.Expr, error) {
 			}},
 		},
 	}}
+	c.recordEmitted(listComp.Elts[0], n)
 	return importCall("strings", "Join", listComp, cueString("")), nil
 }
 
@@ -5701,7 +7713,7 @@ func (c *converter) processInlineRange(n *parse.RangeNode) error {
 	allParts = append(allParts, prefix...)
 	allParts = append(allParts, suffixParts...)
 
-	valueExpr := partsToExpr(allParts)
+	valueExpr := partsToExpr(unquoteInlineParts(allParts))
 	if key != "" {
 		if keyLabel != nil {
 			c.emitRawField(keyLabel, valueExpr)
@@ -5808,9 +7820,12 @@ func (c *converter) processIf(n *parse.IfNode) error {
 
 	// Process the if body and emit as comprehension.
 	if isRangeListItem {
-		c.emitIfBranchComprehension([]ast.Expr{condition}, bodyIndent, false, true, n.List.Nodes)
+		err = c.emitIfBranchComprehension([]ast.Expr{condition}, bodyIndent, false, true, n.List.Nodes)
 	} else {
-		c.emitIfBranchComprehension([]ast.Expr{condition}, bodyIndent, inList && isList && !preOpenedListItem, preOpenedListItem, n.List.Nodes)
+		err = c.emitIfBranchComprehension([]ast.Expr{condition}, bodyIndent, inList && isList && !preOpenedListItem, preOpenedListItem, n.List.Nodes)
+	}
+	if err != nil {
+		return err
 	}
 
 	// Restore guarded paths before processing else branches — the
@@ -5837,9 +7852,12 @@ func (c *converter) processIf(n *parse.IfNode) error {
 				// Extract guarded paths for the else-if condition.
 				elseIfSaved := c.setGuardedPaths(c.extractGuardedPaths(innerIf.Pipe))
 				if isRangeListItem && elseIfIsList {
-					c.emitIfBranchComprehension(guard, elseIfBodyIndent, false, true, innerIf.List.Nodes)
+					err = c.emitIfBranchComprehension(guard, elseIfBodyIndent, false, true, innerIf.List.Nodes)
 				} else {
-					c.emitIfBranchComprehension(guard, elseIfBodyIndent, inList && elseIfIsList && !preOpenedListItem, preOpenedListItem, innerIf.List.Nodes)
+					err = c.emitIfBranchComprehension(guard, elseIfBodyIndent, inList && elseIfIsList && !preOpenedListItem, preOpenedListItem, innerIf.List.Nodes)
+				}
+				if err != nil {
+					return err
 				}
 				c.guardedPaths = elseIfSaved
 
@@ -5852,9 +7870,12 @@ func (c *converter) processIf(n *parse.IfNode) error {
 		elseIsList := isListBody(elseList.Nodes)
 		elseBodyIndent := peekBodyIndent(elseList.Nodes)
 		if isRangeListItem && elseIsList {
-			c.emitIfBranchComprehension(negChain, elseBodyIndent, false, true, elseList.Nodes)
+			err = c.emitIfBranchComprehension(negChain, elseBodyIndent, false, true, elseList.Nodes)
 		} else {
-			c.emitIfBranchComprehension(negChain, elseBodyIndent, inList && elseIsList && !preOpenedListItem, preOpenedListItem, elseList.Nodes)
+			err = c.emitIfBranchComprehension(negChain, elseBodyIndent, inList && elseIsList && !preOpenedListItem, preOpenedListItem, elseList.Nodes)
+		}
+		if err != nil {
+			return err
 		}
 		break
 	}
@@ -5865,6 +7886,7 @@ func (c *converter) processIf(n *parse.IfNode) error {
 // emitIfBranchComprehension processes a branch body (if/else-if/else)
 // and emits it as an ast.Comprehension.
 func (c *converter) emitIfBranchComprehension(conditions []ast.Expr, bodyIndent int, isList, stripDash bool, nodes []parse.Node) error {
+	defer c.guardScope(conditions)()
 	savedStackLen := len(c.stack)
 	savedState := c.state
 	c.state = stateNormal
@@ -5985,16 +8007,95 @@ func (c *converter) processWith(n *parse.WithNode) error {
 
 	inList := len(c.stack) > 0 && c.stack[len(c.stack)-1].isList
 
+	// Process body and emit as comprehension, with dot rebound.
+	restore := c.enterWith(n.Pipe, rawExpr)
+	if isRangeListItem {
+		err = c.emitIfBranchComprehension([]ast.Expr{condition}, bodyIndent, false, true, n.List.Nodes)
+	} else {
+		err = c.emitIfBranchComprehension([]ast.Expr{condition}, bodyIndent, inList && isList, false, n.List.Nodes)
+	}
+	restore()
+	if err != nil {
+		return err
+	}
+
+	// Walk the else/else-with chain (Go 1.23), flattening it into CUE
+	// multi-clause comprehensions as processIf does for else-if.
+	negChain := []ast.Expr{negCondition}
+	elseList := n.ElseList
+	decls := append([]*parse.VariableNode(nil), n.Pipe.Decl...)
+	for elseList != nil && len(elseList.Nodes) > 0 {
+		// Detect else-with sugar: ElseList is a single WithNode.
+		if len(elseList.Nodes) == 1 {
+			if innerWith, ok := elseList.Nodes[0].(*parse.WithNode); ok {
+				innerCond, innerNeg, err := c.pipeToCUECondition(innerWith.Pipe)
+				if err != nil {
+					return fmt.Errorf("else-with condition: %w", err)
+				}
+				innerRaw, err := c.withPipeToRawExpr(innerWith.Pipe)
+				if err != nil {
+					return err
+				}
+				if len(innerWith.Pipe.Decl) > 0 {
+					c.localVars[innerWith.Pipe.Decl[0].Ident[0]] = innerRaw
+					decls = append(decls, innerWith.Pipe.Decl...)
+				}
+
+				guard := append(append([]ast.Expr(nil), negChain...), innerCond)
+				elseWithIsList := isListBody(innerWith.List.Nodes)
+				elseWithBodyIndent := peekBodyIndent(innerWith.List.Nodes)
+				restore := c.enterWith(innerWith.Pipe, innerRaw)
+				if isRangeListItem && elseWithIsList {
+					err = c.emitIfBranchComprehension(guard, elseWithBodyIndent, false, true, innerWith.List.Nodes)
+				} else {
+					err = c.emitIfBranchComprehension(guard, elseWithBodyIndent, inList && elseWithIsList, false, innerWith.List.Nodes)
+				}
+				restore()
+				if err != nil {
+					return err
+				}
+
+				negChain = append(negChain, innerNeg)
+				elseList = innerWith.ElseList
+				continue
+			}
+		}
+		// Plain else: emit with all accumulated negations.
+		elseIsList := isListBody(elseList.Nodes)
+		elseBodyIndent := peekBodyIndent(elseList.Nodes)
+		if isRangeListItem && elseIsList {
+			err = c.emitIfBranchComprehension(negChain, elseBodyIndent, false, true, elseList.Nodes)
+		} else {
+			err = c.emitIfBranchComprehension(negChain, elseBodyIndent, inList && elseIsList, false, elseList.Nodes)
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	// Clean up declared variables.
+	for _, decl := range decls {
+		delete(c.localVars, decl.Ident[0])
+	}
+
+	return nil
+}
+
+// enterWith rebinds dot to rawExpr for the body of a with (or else-with)
+// branch and marks the fields its pipe tests as guarded. The returned
+// function undoes both.
+func (c *converter) enterWith(pipe *parse.PipeNode, rawExpr ast.Expr) func() {
 	// Extract guarded paths BEFORE pushing the with context onto
 	// rangeVarStack, so that field refs in the condition resolve
 	// relative to the outer (pre-with) context. Resolving after
 	// the push would prepend the with's basePath again, creating
 	// a spurious double-nested field ref. Suppress required tracking
 	// since the condition fields are guarded (optional).
-	helmObj, basePath := c.withPipeContext(n.Pipe)
+	helmObj, basePath := c.withPipeContext(pipe)
 	savedSuppress := c.suppressRequired
 	c.suppressRequired = true
-	guardedPaths := c.extractGuardedPaths(n.Pipe)
+	guardedPaths := c.extractGuardedPaths(pipe)
 	c.suppressRequired = savedSuppress
 	if helmObj != "" {
 		if guardedPaths == nil {
@@ -6011,34 +8112,10 @@ func (c *converter) processWith(n *parse.WithNode) error {
 		basePath: basePath,
 	})
 
-	// Process body and emit as comprehension.
-	if isRangeListItem {
-		c.emitIfBranchComprehension([]ast.Expr{condition}, bodyIndent, false, true, n.List.Nodes)
-	} else {
-		c.emitIfBranchComprehension([]ast.Expr{condition}, bodyIndent, inList && isList, false, n.List.Nodes)
-	}
-
-	// Restore guarded paths and pop from rangeVarStack.
-	c.guardedPaths = savedGuarded
-	c.rangeVarStack = c.rangeVarStack[:len(c.rangeVarStack)-1]
-
-	// Handle else branch.
-	if n.ElseList != nil && len(n.ElseList.Nodes) > 0 {
-		elseIsList := isListBody(n.ElseList.Nodes)
-		elseBodyIndent := peekBodyIndent(n.ElseList.Nodes)
-		if isRangeListItem && elseIsList {
-			c.emitIfBranchComprehension([]ast.Expr{negCondition}, elseBodyIndent, false, true, n.ElseList.Nodes)
-		} else {
-			c.emitIfBranchComprehension([]ast.Expr{negCondition}, elseBodyIndent, inList && elseIsList, false, n.ElseList.Nodes)
-		}
-	}
-
-	// Clean up declared variable.
-	if len(n.Pipe.Decl) > 0 {
-		delete(c.localVars, n.Pipe.Decl[0].Ident[0])
+	return func() {
+		c.guardedPaths = savedGuarded
+		c.rangeVarStack = c.rangeVarStack[:len(c.rangeVarStack)-1]
 	}
-
-	return nil
 }
 
 // withPipeToRawExpr extracts the raw CUE expression from a with pipe
@@ -6052,7 +8129,7 @@ func (c *converter) withPipeToRawExpr(pipe *parse.PipeNode) (ast.Expr, error) {
 	// Multi-arg: function call (e.g. omit .Values.x "key").
 	if len(cmd.Args) >= 2 {
 		if id, ok := cmd.Args[0].(*parse.IdentifierNode); ok {
-			if cf, ok := coreFuncs[id.Ident]; ok && c.isCoreFunc(id.Ident) {
+			if cf, ok := c.funcHandler(id.Ident); ok {
 				funcArgs := make([]funcArg, len(cmd.Args)-1)
 				for i, n := range cmd.Args[1:] {
 					funcArgs[i] = funcArg{node: n}
@@ -6127,7 +8204,7 @@ func (c *converter) withMultiCmdPipe(pipe *parse.PipeNode) (ast.Expr, error) {
 		if !ok {
 			return nil, fmt.Errorf("with: unsupported pipe shape: %s", pipe)
 		}
-		if cf, ok := coreFuncs[id.Ident]; ok && c.isCoreFunc(id.Ident) {
+		if cf, ok := c.funcHandler(id.Ident); ok {
 			piped := funcArg{expr: expr}
 			args := buildPipeArgs(cf, cmd.Args[1:], piped)
 			cfExpr, _, cfErr := cf.convert(c, args)
@@ -6136,7 +8213,7 @@ func (c *converter) withMultiCmdPipe(pipe *parse.PipeNode) (ast.Expr, error) {
 			}
 			expr = cfExpr
 		} else {
-			return nil, fmt.Errorf("with: unsupported pipe function: %s", id.Ident)
+			return nil, codeErrorf(CodeUnsupportedFunc, "with: unsupported pipe function: %s", id.Ident)
 		}
 	}
 	return expr, nil
@@ -6189,9 +8266,76 @@ func (c *converter) processBodyNodes(nodes []parse.Node) error {
 		}
 	}
 	c.remainingNodes = nil
+	// A comment line in the body ends with it.
+	c.flushCommentLine()
 	return nil
 }
 
+// sortedRangeSource wraps the source of a range over a map, so that it
+// visits the keys in sorted order as text/template does: a dict
+// literal whose keys are not already sorted, or values whose default in
+// Config.Values is a map. Other sources, such as lists and function
+// results, are already ordered.
+func (c *converter) sortedRangeSource(n *parse.RangeNode, src ast.Expr) ast.Expr {
+	inner := src
+	for {
+		p, ok := inner.(*ast.ParenExpr)
+		if !ok {
+			break
+		}
+		inner = p.X
+	}
+	if lit, ok := inner.(*ast.StructLit); ok {
+		if hasSortedFields(lit) {
+			return src
+		}
+	} else {
+		path := selectorPath(src)
+		root := src
+		for range path {
+			switch x := root.(type) {
+			case *ast.SelectorExpr:
+				root = x.X
+			case *ast.IndexExpr:
+				root = x.X
+			}
+		}
+		id, ok := root.(*ast.Ident)
+		if !ok || id.Name != c.config.ContextObjects["Values"] {
+			return src
+		}
+		if _, ok := c.valuesDefault(path).(map[string]any); !ok {
+			return src
+		}
+	}
+	c.usedHelpers["_sortedFields"] = HelperDef{
+		Name:    "_sortedFields",
+		Def:     sortedFieldsDef,
+		Imports: []string{"list"},
+	}
+	return helperOutExpr("_sortedFields",
+		&ast.Field{Label: ast.NewIdent("#src"), Value: src},
+	)
+}
+
+// hasSortedFields reports whether the fields of lit have literal
+// labels in sorted order.
+func hasSortedFields(lit *ast.StructLit) bool {
+	var names []string
+	for _, d := range lit.Elts {
+		f, ok := d.(*ast.Field)
+		if !ok {
+			return false
+		}
+		name, _, err := ast.LabelName(f.Label)
+		if err != nil {
+			return false
+		}
+		names = append(names, name)
+	}
+	return slices.IsSorted(names)
+}
+
 func (c *converter) processRange(n *parse.RangeNode) error {
 	c.finalizeInline()
 	c.finalizeFlow()
@@ -6219,6 +8363,11 @@ func (c *converter) processRange(n *parse.RangeNode) error {
 		}
 	}
 
+	bodyNodes, controls, err := splitLoopControls(n.List.Nodes)
+	if err != nil {
+		return fmt.Errorf("range: %w", err)
+	}
+
 	blockIdx := len(c.rangeVarStack)
 
 	var keyName, valName string
@@ -6233,13 +8382,17 @@ func (c *converter) processRange(n *parse.RangeNode) error {
 	} else {
 		valName = fmt.Sprintf("_range%d", blockIdx)
 	}
+	// A break needs the key to bound the iterations it lets through.
+	if keyName == "" && hasBreak(controls) {
+		keyName = fmt.Sprintf("_key%d", blockIdx)
+	}
 
-	isList := isListBody(n.List.Nodes)
+	isList := isListBody(bodyNodes)
 	// When the shallow check misses list items hidden in nested control
 	// structures (e.g. {{with}} containing "- item"), use deep text search.
 	isDeepList := false
 	if !isList {
-		deepText := deepTextContent(n.List.Nodes)
+		deepText := deepTextContent(bodyNodes)
 		for _, line := range strings.Split(deepText, "\n") {
 			if strings.TrimSpace(line) == "" {
 				continue
@@ -6253,7 +8406,7 @@ func (c *converter) processRange(n *parse.RangeNode) error {
 		}
 	}
 	isMap := len(n.Pipe.Decl) == 2 && !isList
-	bodyIndent := peekBodyIndent(n.List.Nodes)
+	bodyIndent := peekBodyIndent(bodyNodes)
 
 	// Flush deferred.
 	if c.deferredKV != nil {
@@ -6291,6 +8444,7 @@ func (c *converter) processRange(n *parse.RangeNode) error {
 	inList := len(c.stack) > 0 && c.stack[len(c.stack)-1].isList
 
 	ctx := rangeContext{cueExpr: ast.NewIdent(valName)}
+	c.noteRangeValues(valName, overExpr)
 	if isList && helmObj != "" && fieldPath != nil {
 		ctx.helmObj = helmObj
 		ctx.basePath = fieldPath
@@ -6321,15 +8475,28 @@ func (c *converter) processRange(n *parse.RangeNode) error {
 		ast.SetRelPos(ifClause, token.Newline)
 		clauses = append(clauses, ifClause)
 	}
+	// Ranges that emit list items are ordered; those that emit
+	// fields are not.
+	src := overExpr
+	if isList {
+		src = c.sortedRangeSource(n, overExpr)
+	}
 	forClause := &ast.ForClause{
 		Key:    ast.NewIdent(keyExpr),
 		Value:  ast.NewIdent(valName),
-		Source: overExpr,
+		Source: src,
 	}
-	if hasGuard {
-		ast.SetRelPos(forClause, token.Newline)
+	lets, guards, err := c.loopControlClauses(controls, blockIdx, keyExpr, valName, src)
+	if err != nil {
+		return fmt.Errorf("range: %w", err)
 	}
-	clauses = append(clauses, forClause)
+	loopClauses := append(append(lets, forClause), guards...)
+	if hasGuard || len(loopClauses) > 1 {
+		for _, cl := range loopClauses {
+			ast.SetRelPos(cl, token.Newline)
+		}
+	}
+	clauses = append(clauses, loopClauses...)
 
 	// Process body.
 	savedStackLen := len(c.stack)
@@ -6364,7 +8531,7 @@ func (c *converter) processRange(n *parse.RangeNode) error {
 	c.inRangeBody = true
 	c.rangeBodyStackDepth = len(c.stack)
 	c.rangeDeepListBody = isDeepList
-	if err := c.processBodyNodes(n.List.Nodes); err != nil {
+	if err := c.processBodyNodes(bodyNodes); err != nil {
 		return err
 	}
 	c.finalizeInline()
@@ -6392,15 +8559,10 @@ func (c *converter) processRange(n *parse.RangeNode) error {
 	// comprehension and take the last element to match Helm's
 	// "last value wins" semantics.
 
-	// Build a bare for-clause list (without the _nonzero guard) for
+	// Use the bare loop clauses (without the _nonzero guard) for
 	// accumulator comprehensions. The guard is unnecessary here: if
 	// the collection is empty the for-loop produces an empty list.
-	var bareClauses []ast.Clause
-	for _, cl := range clauses {
-		if _, ok := cl.(*ast.ForClause); ok {
-			bareClauses = append(bareClauses, cl)
-		}
-	}
+	bareClauses := loopClauses
 
 	rangeVarNames := []string{valName}
 	if keyName != "" {
@@ -6482,6 +8644,7 @@ func (c *converter) processRange(n *parse.RangeNode) error {
 			Clauses: clauses,
 			Value:   compValue,
 		}
+		c.recordEmitted(comp, n)
 		c.appendToParent(comp)
 	}
 
@@ -6508,18 +8671,307 @@ func decomposeAppend(expr, preExpr ast.Expr) (ast.Expr, bool) {
 		if list, ok := bin.Y.(*ast.ListLit); ok && len(list.Elts) == 1 {
 			return list.Elts[0], true
 		}
-	}
-	// Case 2: elem + [preExpr] (first-command form, swapped args).
-	if list, ok := bin.Y.(*ast.ListLit); ok && len(list.Elts) == 1 && list.Elts[0] == preExpr {
-		return bin.X, true
-	}
-	return nil, false
-}
+	}
+	// Case 2: elem + [preExpr] (first-command form, swapped args).
+	if list, ok := bin.Y.(*ast.ListLit); ok && len(list.Elts) == 1 && list.Elts[0] == preExpr {
+		return bin.X, true
+	}
+	return nil, false
+}
+
+// isEmptyList reports whether expr is an ast.ListLit with no elements.
+func isEmptyList(expr ast.Expr) bool {
+	list, ok := expr.(*ast.ListLit)
+	return ok && len(list.Elts) == 0
+}
+
+// errLoopControl reports a {{ break }} or {{ continue }} that cannot be
+// expressed as a guard on the enclosing range comprehension.
+var errLoopControl = errors.New("break and continue are only supported " +
+	"directly in a range body, alone or as {{ if cond }}{{ break }}{{ end }} " +
+	"or {{ if cond }}{{ continue }}{{ end }}")
+
+// loopControl is a {{ break }} or {{ continue }} of a range body, under
+// the condition pipe, or always if pipe is nil. A leading one comes
+// before any of the body's output.
+type loopControl struct {
+	pipe    *parse.PipeNode
+	isBreak bool
+	leading bool
+}
+
+// splitLoopControls removes break and continue statements from a range
+// body, returning the remaining body and the statements in order. CUE
+// comprehensions cannot stop early, so these become clauses of the
+// range comprehension (see loopControlClauses). The part of the body
+// after a conditional statement in its middle is moved into the else
+// branch of the statement's if, so that it is skipped when the
+// statement fires; a statement nested in any other construct is an
+// error.
+func splitLoopControls(nodes []parse.Node) ([]parse.Node, []loopControl, error) {
+	isBlank := func(node parse.Node) bool {
+		t, ok := node.(*parse.TextNode)
+		return ok && len(bytes.TrimSpace(t.Text)) == 0
+	}
+
+	// Nothing after an unconditional statement runs, so the body ends
+	// there, and a break then stops the range after the iteration.
+	var always []loopControl
+	for i, node := range nodes {
+		_, isBreak := node.(*parse.BreakNode)
+		_, isContinue := node.(*parse.ContinueNode)
+		if !isBreak && !isContinue {
+			continue
+		}
+		nodes = nodes[:i]
+		leading := !slices.ContainsFunc(nodes, func(n parse.Node) bool {
+			_, ok := asLoopControl(n)
+			return !ok && !isBlank(n)
+		})
+		if isBreak || leading {
+			always = []loopControl{{isBreak: isBreak, leading: leading}}
+		}
+		break
+	}
+
+	var leading, trailing []loopControl
+	removed := make(map[int]bool)
+	start := 0
+	for ; start < len(nodes); start++ {
+		if isBlank(nodes[start]) {
+			continue
+		}
+		lc, ok := asLoopControl(nodes[start])
+		if !ok {
+			break
+		}
+		lc.leading = true
+		leading = append(leading, lc)
+		removed[start] = true
+	}
+	end := len(nodes) - 1
+	for ; end >= start; end-- {
+		if isBlank(nodes[end]) {
+			continue
+		}
+		lc, ok := asLoopControl(nodes[end])
+		if !ok {
+			break
+		}
+		trailing = append([]loopControl{lc}, trailing...)
+		removed[end] = true
+	}
+	middle, midControls := nestLoopControls(nodes[start : end+1])
+	controls := slices.Concat(leading, midControls, trailing, always)
+	if len(controls) == 0 {
+		if hasLoopControl(nodes) {
+			return nil, nil, errLoopControl
+		}
+		return nodes, nil, nil
+	}
+	nodes = slices.Concat(nodes[:start], middle, nodes[end+1:])
+	for i := range removed {
+		if i > end {
+			delete(removed, i)
+			removed[i-(end+1-start)+len(middle)] = true
+		}
+	}
+
+	// Drop the statements, joining the text on either side of each.
+	var body []parse.Node
+	joinNext := false
+	for i, node := range nodes {
+		if removed[i] {
+			joinNext = true
+			continue
+		}
+		if t, ok := node.(*parse.TextNode); ok && joinNext && len(body) > 0 {
+			if prev, ok := body[len(body)-1].(*parse.TextNode); ok {
+				joined := prev.Copy().(*parse.TextNode)
+				joined.Text = append(bytes.Clone(prev.Text), t.Text...)
+				body[len(body)-1] = joined
+				continue
+			}
+		}
+		joinNext = false
+		body = append(body, node)
+	}
+	if hasLoopControl(body) {
+		return nil, nil, errLoopControl
+	}
+	return body, controls, nil
+}
+
+// nestLoopControls rewrites each conditional break or continue in nodes
+// as an if whose then branch is empty and whose else branch holds the
+// nodes after it, returning the rewritten nodes and the statements in
+// order.
+func nestLoopControls(nodes []parse.Node) ([]parse.Node, []loopControl) {
+	for i, node := range nodes {
+		lc, ok := asLoopControl(node)
+		if !ok {
+			continue
+		}
+		rest, controls := nestLoopControls(nodes[i+1:])
+		ifNode := node.(*parse.IfNode).Copy().(*parse.IfNode)
+		ifNode.ElseList = ifNode.List.CopyList()
+		ifNode.ElseList.Nodes = rest
+		ifNode.List.Nodes = nil
+		out := append(slices.Clone(nodes[:i]), ifNode)
+		return out, append([]loopControl{lc}, controls...)
+	}
+	return nodes, nil
+}
+
+// asLoopControl reports whether node is {{ if cond }}{{ break }}{{ end }}
+// or {{ if cond }}{{ continue }}{{ end }}.
+func asLoopControl(node parse.Node) (loopControl, bool) {
+	ifNode, ok := node.(*parse.IfNode)
+	if !ok || ifNode.ElseList != nil {
+		return loopControl{}, false
+	}
+	var lc loopControl
+	found := false
+	for _, n := range ifNode.List.Nodes {
+		switch n := n.(type) {
+		case *parse.BreakNode, *parse.ContinueNode:
+			if found {
+				return loopControl{}, false
+			}
+			_, isBreak := n.(*parse.BreakNode)
+			lc = loopControl{pipe: ifNode.Pipe, isBreak: isBreak}
+			found = true
+		case *parse.TextNode:
+			if len(bytes.TrimSpace(n.Text)) != 0 {
+				return loopControl{}, false
+			}
+		default:
+			return loopControl{}, false
+		}
+	}
+	return lc, found
+}
+
+// hasLoopControl reports whether nodes contain a break or continue that
+// belongs to the enclosing range rather than to a nested one.
+func hasLoopControl(nodes []parse.Node) bool {
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case *parse.BreakNode, *parse.ContinueNode:
+			return true
+		case *parse.IfNode:
+			if hasLoopControl(n.List.Nodes) || (n.ElseList != nil && hasLoopControl(n.ElseList.Nodes)) {
+				return true
+			}
+		case *parse.WithNode:
+			if hasLoopControl(n.List.Nodes) || (n.ElseList != nil && hasLoopControl(n.ElseList.Nodes)) {
+				return true
+			}
+		case *parse.RangeNode:
+			// A range's else branch runs outside its own loop.
+			if n.ElseList != nil && hasLoopControl(n.ElseList.Nodes) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// copyIdents returns expr with each identifier replaced by a copy.
+func copyIdents(expr ast.Expr) ast.Expr {
+	return astutil.Apply(expr, func(cur astutil.Cursor) bool {
+		if id, ok := cur.Node().(*ast.Ident); ok {
+			cp := *id
+			cur.Replace(&cp)
+		}
+		return true
+	}, nil).(ast.Expr)
+}
+
+// hasBreak reports whether any of controls is a break.
+func hasBreak(controls []loopControl) bool {
+	for _, lc := range controls {
+		if lc.isBreak {
+			return true
+		}
+	}
+	return false
+}
+
+// loopControlClauses converts the break and continue statements of a
+// range into clauses around its for clause. A continue becomes an if
+// clause that skips the iterations it fires on. A break bounds the range
+// to a prefix: a let clause collects the keys it fires on, and an if
+// clause admits only keys before the first of them, or up to and
+// including it when the break follows the body's output. Comparing keys
+// rather than positions keeps this correct for maps, which Go ranges
+// over in sorted key order.
+//
+//	let _break0 = [for _key0, _range0 in src if cond {_key0}]
+//	for _key0, _range0 in src
+//	if len([for _i in _break0 if _i <= _key0 {_i}]) == 0
+func (c *converter) loopControlClauses(controls []loopControl, blockIdx int, keyName, valName string, src ast.Expr) (lets, guards []ast.Clause, err error) {
+	var skips []ast.Expr // negated conditions of the continues so far
+	for _, lc := range controls {
+		var cond, neg ast.Expr = ast.NewBool(true), ast.NewBool(false)
+		if lc.pipe != nil {
+			c.hasConditions = true
+			var err error
+			cond, neg, err = c.pipeToCUECondition(lc.pipe)
+			if err != nil {
+				return nil, nil, fmt.Errorf("loop control condition: %w", err)
+			}
+		}
+		// The range variables are shared identifiers whose positions are
+		// set when the body is emitted; copy them so these clauses keep
+		// their own layout.
+		cond, neg = copyIdents(cond), copyIdents(neg)
+		if !lc.isBreak {
+			// A trailing continue skips nothing but later statements.
+			if lc.leading {
+				guards = append(guards, &ast.IfClause{Condition: neg})
+			}
+			skips = append(skips, neg)
+			continue
+		}
 
-// isEmptyList reports whether expr is an ast.ListLit with no elements.
-func isEmptyList(expr ast.Expr) bool {
-	list, ok := expr.(*ast.ListLit)
-	return ok && len(list.Elts) == 0
+		name := fmt.Sprintf("_break%d", blockIdx)
+		if len(lets) > 0 {
+			name = fmt.Sprintf("_break%d_%d", blockIdx, len(lets))
+		}
+		inner := []ast.Clause{&ast.ForClause{
+			Key:    ast.NewIdent(keyName),
+			Value:  ast.NewIdent(valName),
+			Source: src,
+		}}
+		for _, s := range skips {
+			inner = append(inner, &ast.IfClause{Condition: s})
+		}
+		inner = append(inner, &ast.IfClause{Condition: cond})
+		lets = append(lets, &ast.LetClause{
+			Ident: ast.NewIdent(name),
+			Expr: &ast.ListLit{Elts: []ast.Expr{&ast.Comprehension{
+				Clauses: inner,
+				Value:   compactStruct(&ast.EmbedDecl{Expr: ast.NewIdent(keyName)}),
+			}}},
+		})
+
+		op := token.LEQ
+		if !lc.leading {
+			op = token.LSS
+		}
+		earlier := &ast.ListLit{Elts: []ast.Expr{&ast.Comprehension{
+			Clauses: []ast.Clause{
+				&ast.ForClause{Value: ast.NewIdent("_i"), Source: ast.NewIdent(name)},
+				&ast.IfClause{Condition: binOp(op, ast.NewIdent("_i"), ast.NewIdent(keyName))},
+			},
+			Value: compactStruct(&ast.EmbedDecl{Expr: ast.NewIdent("_i")}),
+		}}}
+		guards = append(guards, &ast.IfClause{
+			Condition: binOp(token.EQL, callExpr("len", earlier), cueInt(0)),
+		})
+	}
+	return lets, guards, nil
 }
 
 func isListBody(nodes []parse.Node) bool {
@@ -6817,6 +9269,14 @@ func hasListItemContinuation(nodes []parse.Node, itemContentIndent int) bool {
 	return false
 }
 
+// rangeIntFuncs are the functions whose result, an integer, a range
+// iterates over from zero, as text/template does since Go 1.22.
+var rangeIntFuncs = map[string]bool{
+	"add": true, "add1": true, "sub": true, "mul": true, "div": true,
+	"mod": true, "int": true, "int64": true, "len": true, "max": true,
+	"min": true, "atoi": true,
+}
+
 func (c *converter) pipeToFieldExpr(pipe *parse.PipeNode) (ast.Expr, string, []string, error) {
 	// Handle "until N" — produces list.Range(0, N, 1).
 	if len(pipe.Cmds) == 1 && len(pipe.Cmds[0].Args) >= 2 {
@@ -6833,6 +9293,43 @@ func (c *converter) pipeToFieldExpr(pipe *parse.PipeNode) (ast.Expr, string, []s
 		}
 	}
 
+	// Handle "range N" over an integer (Go 1.22) — also list.Range(0, N, 1).
+	if len(pipe.Cmds) == 1 && len(pipe.Cmds[0].Args) == 1 {
+		if num, ok := pipe.Cmds[0].Args[0].(*parse.NumberNode); ok {
+			if !num.IsInt {
+				return nil, "", nil, fmt.Errorf("cannot range over %s", num.Text)
+			}
+			c.addImport("list")
+			return importCall("list", "Range", cueInt(0), cueInt(int(num.Int64)), cueInt(1)), "", nil, nil
+		}
+	}
+
+	// The result of a function returning an integer, and a variable
+	// holding an integer literal, are ranged over in the same way.
+	// Whether a value reference holds an integer is not known until
+	// the CUE is evaluated, so such a range is taken to be over a list
+	// or map.
+	last := pipe.Cmds[len(pipe.Cmds)-1]
+	if id, ok := last.Args[0].(*parse.IdentifierNode); ok && rangeIntFuncs[id.Ident] {
+		value := pipe.Copy().(*parse.PipeNode)
+		value.Decl = nil
+		n, helmObj, err := c.convertSubPipe(value)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if helmObj != "" {
+			c.usedContextObjects[helmObj] = true
+		}
+		c.addImport("list")
+		return importCall("list", "Range", cueInt(0), n, cueInt(1)), "", nil, nil
+	}
+	if v, ok := pipe.Cmds[0].Args[0].(*parse.VariableNode); ok && len(pipe.Cmds) == 1 && len(v.Ident) == 1 {
+		if lit, ok := c.localVars[v.Ident[0]].(*ast.BasicLit); ok && lit.Kind == token.INT {
+			c.addImport("list")
+			return importCall("list", "Range", cueInt(0), lit, cueInt(1)), "", nil, nil
+		}
+	}
+
 	// Determine the base field expression and any pipeline functions.
 	var expr ast.Expr
 	var helmObj string
@@ -6847,11 +9344,11 @@ func (c *converter) pipeToFieldExpr(pipe *parse.PipeNode) (ast.Expr, string, []s
 			return nil, "", nil, fmt.Errorf("unsupported pipe: %s", pipe)
 		}
 		pf, pfOK := c.config.Funcs[id.Ident]
-		cf, cfOK := coreFuncs[id.Ident]
-		if !pfOK && !(cfOK && c.isCoreFunc(id.Ident)) {
+		cf, cfOK := c.funcHandler(id.Ident)
+		if !pfOK && !cfOK {
 			return nil, "", nil, fmt.Errorf("unsupported pipe: %s", pipe)
 		}
-		if pfOK {
+		if pfOK && pf.ConvertContext == nil {
 			// Pipeline function: last argument is the input expression;
 			// any middle arguments are extra function parameters.
 			var err error
@@ -6896,11 +9393,20 @@ func (c *converter) pipeToFieldExpr(pipe *parse.PipeNode) (ast.Expr, string, []s
 		}
 		id, ok := cmd.Args[0].(*parse.IdentifierNode)
 		if !ok {
-			return nil, "", nil, fmt.Errorf("unsupported function in range pipeline: %s", cmd)
+			return nil, "", nil, codeErrorf(CodeUnsupportedFunc, "unsupported function in range pipeline: %s", cmd)
+		}
+		if cf, ok := c.contextFunc(id.Ident); ok {
+			piped := funcArg{expr: expr, obj: helmObj, field: fieldPath}
+			var err error
+			expr, _, err = cf.convert(c, buildPipeArgs(cf, cmd.Args[1:], piped))
+			if err != nil {
+				return nil, "", nil, err
+			}
+			continue
 		}
 		pf, ok := c.config.Funcs[id.Ident]
 		if !ok {
-			return nil, "", nil, fmt.Errorf("unsupported function in range pipeline: %s", id.Ident)
+			return nil, "", nil, codeErrorf(CodeUnsupportedFunc, "unsupported function in range pipeline: %s", id.Ident)
 		}
 		var err error
 		expr, err = c.applyRangePipelineFunc(pf, id.Ident, expr, helmObj, fieldPath, cmd.Args[1:])
@@ -7001,9 +9507,9 @@ func (c *converter) applyRangePipelineFunc(pf PipelineFunc, name string, expr as
 }
 
 func (c *converter) pipeToCUECondition(pipe *parse.PipeNode) (ast.Expr, ast.Expr, error) {
-	saved := c.inCondition
-	c.inCondition = true
-	defer func() { c.inCondition = saved }()
+	saved, savedNode := c.inCondition, c.node
+	c.inCondition, c.node = true, pipe
+	defer func() { c.inCondition, c.node = saved, savedNode }()
 
 	pos, err := c.conditionPipeToExpr(pipe)
 	if err != nil {
@@ -7174,11 +9680,16 @@ func (c *converter) conditionPipeToExpr(pipe *parse.PipeNode) (ast.Expr, error)
 
 	if id, ok := cmd.Args[0].(*parse.IdentifierNode); ok {
 		args := cmd.Args[1:]
+		name := id.Ident
+		if c.replacesCoreFunc(name) {
+			// Converted by Config.Funcs in the default case.
+			name = ""
+		}
 
 		// Table-driven condition functions (contains, hasPrefix, hasSuffix, etc.).
 		if cf, ok := conditionFuncs[id.Ident]; ok {
 			if !c.isCoreFunc(id.Ident) {
-				return nil, fmt.Errorf("unsupported condition function: %s (not a text/template builtin)", id.Ident)
+				return nil, codeErrorf(CodeUnsupportedFunc, "unsupported condition function: %s (not a text/template builtin)", id.Ident)
 			}
 			if len(args) != cf.nargs {
 				return nil, fmt.Errorf("%s requires %d arguments, got %d", id.Ident, cf.nargs, len(args))
@@ -7211,7 +9722,7 @@ func (c *converter) conditionPipeToExpr(pipe *parse.PipeNode) (ast.Expr, error)
 			return importCall(pkg, fn, exprs...), nil
 		}
 
-		switch id.Ident {
+		switch name {
 		case "not":
 			if len(args) != 1 {
 				return nil, fmt.Errorf("not requires 1 argument, got %d", len(args))
@@ -7275,7 +9786,7 @@ func (c *converter) conditionPipeToExpr(pipe *parse.PipeNode) (ast.Expr, error)
 			return binOp(ops[id.Ident], a, b), nil
 		case "empty":
 			if !c.isCoreFunc(id.Ident) {
-				return nil, fmt.Errorf("unsupported condition function: %s (not a text/template builtin)", id.Ident)
+				return nil, codeErrorf(CodeUnsupportedFunc, "unsupported condition function: %s (not a text/template builtin)", id.Ident)
 			}
 			if len(args) != 1 {
 				return nil, fmt.Errorf("empty requires 1 argument, got %d", len(args))
@@ -7287,7 +9798,7 @@ func (c *converter) conditionPipeToExpr(pipe *parse.PipeNode) (ast.Expr, error)
 			return negExpr(parenExpr(inner)), nil
 		case "hasKey":
 			if !c.isCoreFunc(id.Ident) {
-				return nil, fmt.Errorf("unsupported condition function: %s (not a text/template builtin)", id.Ident)
+				return nil, codeErrorf(CodeUnsupportedFunc, "unsupported condition function: %s (not a text/template builtin)", id.Ident)
 			}
 			if len(args) != 2 {
 				return nil, fmt.Errorf("hasKey requires 2 arguments, got %d", len(args))
@@ -7302,13 +9813,23 @@ func (c *converter) conditionPipeToExpr(pipe *parse.PipeNode) (ast.Expr, error)
 						append([]string(nil), f.Ident...))
 				}
 			}
-			mapExpr, err := c.conditionNodeToRawExpr(args[0])
+			// A parenthesized map argument such as (index .Values.x $k)
+			// is a value, not a condition.
+			var mapExpr ast.Expr
+			var err error
+			if p, ok := args[0].(*parse.PipeNode); ok {
+				mapExpr, _, err = c.convertSubPipe(p)
+			} else {
+				mapExpr, err = c.conditionNodeToRawExpr(args[0])
+			}
 			if err != nil {
 				return nil, fmt.Errorf("hasKey map argument: %w", err)
 			}
+			// hasKey tests presence, not truthiness: a key set to
+			// false or "" is still present.
 			keyNode, ok := args[1].(*parse.StringNode)
 			if ok {
-				return nonzeroExpr(selExpr(mapExpr, cueKey(keyNode.Text))), nil
+				return binOp(token.NEQ, selExpr(mapExpr, cueKey(keyNode.Text)), &ast.BottomLit{}), nil
 			}
 			// Dynamic key: map[key] != _|_
 			keyExpr, err := c.conditionNodeToRawExpr(args[1])
@@ -7318,7 +9839,7 @@ func (c *converter) conditionPipeToExpr(pipe *parse.PipeNode) (ast.Expr, error)
 			return binOp(token.NEQ, indexExpr(mapExpr, keyExpr), &ast.BottomLit{}), nil
 		case "coalesce":
 			if !c.isCoreFunc(id.Ident) {
-				return nil, fmt.Errorf("unsupported condition function: %s (not a text/template builtin)", id.Ident)
+				return nil, codeErrorf(CodeUnsupportedFunc, "unsupported condition function: %s (not a text/template builtin)", id.Ident)
 			}
 			if len(args) < 1 {
 				return nil, fmt.Errorf("coalesce requires at least 1 argument")
@@ -7338,7 +9859,7 @@ func (c *converter) conditionPipeToExpr(pipe *parse.PipeNode) (ast.Expr, error)
 			return result, nil
 		case "include":
 			if !c.isCoreFunc(id.Ident) {
-				return nil, fmt.Errorf("unsupported condition function: %s (not a text/template builtin)", id.Ident)
+				return nil, codeErrorf(CodeUnsupportedFunc, "unsupported condition function: %s (not a text/template builtin)", id.Ident)
 			}
 			if len(args) < 1 {
 				return nil, fmt.Errorf("include requires at least 1 argument")
@@ -7386,7 +9907,7 @@ func (c *converter) conditionPipeToExpr(pipe *parse.PipeNode) (ast.Expr, error)
 			return nonzeroExpr(inclExpr), nil
 		case "semverCompare":
 			if !c.isCoreFunc(id.Ident) {
-				return nil, fmt.Errorf("unsupported condition function: %s (not a text/template builtin)", id.Ident)
+				return nil, codeErrorf(CodeUnsupportedFunc, "unsupported condition function: %s (not a text/template builtin)", id.Ident)
 			}
 			if len(args) != 2 {
 				return nil, fmt.Errorf("semverCompare requires 2 arguments, got %d", len(args))
@@ -7412,7 +9933,7 @@ func (c *converter) conditionPipeToExpr(pipe *parse.PipeNode) (ast.Expr, error)
 			), nil
 		case "index":
 			if !c.isCoreFunc(id.Ident) {
-				return nil, fmt.Errorf("unsupported condition function: %s (not a text/template builtin)", id.Ident)
+				return nil, codeErrorf(CodeUnsupportedFunc, "unsupported condition function: %s (not a text/template builtin)", id.Ident)
 			}
 			if len(args) < 2 {
 				return nil, fmt.Errorf("index requires at least 2 arguments, got %d", len(args))
@@ -7429,7 +9950,7 @@ func (c *converter) conditionPipeToExpr(pipe *parse.PipeNode) (ast.Expr, error)
 			return nonzeroExpr(cfExpr), nil
 		case "kindIs":
 			if !c.isCoreFunc(id.Ident) {
-				return nil, fmt.Errorf("unsupported condition function: %s (not a text/template builtin)", id.Ident)
+				return nil, codeErrorf(CodeUnsupportedFunc, "unsupported condition function: %s (not a text/template builtin)", id.Ident)
 			}
 			if len(args) != 2 {
 				return nil, fmt.Errorf("kindIs requires 2 arguments, got %d", len(args))
@@ -7473,7 +9994,7 @@ func (c *converter) conditionPipeToExpr(pipe *parse.PipeNode) (ast.Expr, error)
 			return binOp(token.NEQ, parenExpr(binOp(token.AND, valExpr, typeExpr)), &ast.BottomLit{}), nil
 		case "typeIs":
 			if !c.isCoreFunc(id.Ident) {
-				return nil, fmt.Errorf("unsupported condition function: %s (not a text/template builtin)", id.Ident)
+				return nil, codeErrorf(CodeUnsupportedFunc, "unsupported condition function: %s (not a text/template builtin)", id.Ident)
 			}
 			if len(args) != 2 {
 				return nil, fmt.Errorf("typeIs requires 2 arguments, got %d", len(args))
@@ -7518,7 +10039,7 @@ func (c *converter) conditionPipeToExpr(pipe *parse.PipeNode) (ast.Expr, error)
 			return binOp(token.NEQ, parenExpr(binOp(token.AND, typeIsValExpr, typeIsTypeExpr)), &ast.BottomLit{}), nil
 		case "typeOf":
 			if !c.isCoreFunc(id.Ident) {
-				return nil, fmt.Errorf("unsupported condition function: %s (not a text/template builtin)", id.Ident)
+				return nil, codeErrorf(CodeUnsupportedFunc, "unsupported condition function: %s (not a text/template builtin)", id.Ident)
 			}
 			if len(args) != 1 {
 				return nil, fmt.Errorf("typeOf requires 1 argument, got %d", len(args))
@@ -7534,7 +10055,7 @@ func (c *converter) conditionPipeToExpr(pipe *parse.PipeNode) (ast.Expr, error)
 					&ast.EmbedDecl{Expr: ast.NewIdent("_")},
 				))), nil
 		default:
-			if cf, ok := coreFuncs[id.Ident]; ok && c.isCoreFunc(id.Ident) {
+			if cf, ok := c.funcHandler(id.Ident); ok {
 				funcArgs := make([]funcArg, len(args))
 				for i, n := range args {
 					funcArgs[i] = funcArg{node: n}
@@ -7582,7 +10103,7 @@ func (c *converter) conditionPipeToExpr(pipe *parse.PipeNode) (ast.Expr, error)
 				}
 				return pf.Convert(argExpr, nil), nil
 			}
-			return nil, fmt.Errorf("unsupported condition function: %s", id.Ident)
+			return nil, codeErrorf(CodeUnsupportedFunc, "unsupported condition function: %s", id.Ident)
 		}
 	}
 
@@ -7653,7 +10174,7 @@ func (c *converter) conditionMultiCmdPipe(pipe *parse.PipeNode) (ast.Expr, error
 		switch id.Ident {
 		case "default":
 			if !c.isCoreFunc(id.Ident) {
-				return nil, fmt.Errorf("unsupported condition function: %s (not a text/template builtin)", id.Ident)
+				return nil, codeErrorf(CodeUnsupportedFunc, "unsupported condition function: %s (not a text/template builtin)", id.Ident)
 			}
 			if len(cmd.Args) != 2 {
 				return nil, fmt.Errorf("default in condition pipeline requires 1 argument")
@@ -7670,7 +10191,14 @@ func (c *converter) conditionMultiCmdPipe(pipe *parse.PipeNode) (ast.Expr, error
 			}
 			expr = c.defaultExpr(expr, defaultValExpr)
 		default:
-			return nil, fmt.Errorf("unsupported function in condition pipeline: %s", id.Ident)
+			cf, ok := c.contextFunc(id.Ident)
+			if !ok {
+				return nil, codeErrorf(CodeUnsupportedFunc, "unsupported function in condition pipeline: %s", id.Ident)
+			}
+			expr, _, err = cf.convert(c, buildPipeArgs(cf, cmd.Args[1:], funcArg{expr: expr}))
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -7835,13 +10363,9 @@ func renameArgIdents(node ast.Node) bool {
 	ast.Walk(node, func(n ast.Node) bool {
 		// For fields, skip the label and only walk the value.
 		if f, ok := n.(*ast.Field); ok {
-			ast.Walk(f.Value, func(n2 ast.Node) bool {
-				if id, ok := n2.(*ast.Ident); ok && id.Name == "#arg" {
-					id.Name = "_args"
-					renamed = true
-				}
-				return true
-			}, nil)
+			if renameArgIdents(f.Value) {
+				renamed = true
+			}
 			return false
 		}
 		if id, ok := n.(*ast.Ident); ok && id.Name == "#arg" {
@@ -7854,6 +10378,12 @@ func renameArgIdents(node ast.Node) bool {
 }
 
 func (c *converter) actionToCUE(n *parse.ActionNode) (expr ast.Expr, helmObj string, err error) {
+	savedNode := c.node
+	c.node = n
+	defer func() {
+		c.node = savedNode
+		err = atNode(n, err)
+	}()
 	pipe := n.Pipe
 	if len(pipe.Cmds) == 0 {
 		return nil, "", fmt.Errorf("empty pipe in action: %s", n)
@@ -7866,9 +10396,19 @@ func (c *converter) actionToCUE(n *parse.ActionNode) (expr ast.Expr, helmObj str
 	c.currentActionPipe = pipe
 	defer func() { c.currentActionPipe = saved }()
 
+	// Inputs lifted from a variable assignment are named after the
+	// variable.
+	savedHint := c.inputHint
+	c.inputHint = ""
+	if len(pipe.Decl) > 0 {
+		c.inputHint = strings.TrimPrefix(pipe.Decl[0].Ident[0], "$")
+	}
+	defer func() { c.inputHint = savedHint }()
+
 	var fieldPath []string
 	var argFieldPath []string // #arg field path for nonScalar tracking in helper bodies
 	var gatedFunc string      // set when a core func is rejected by CoreFuncs
+	var unknownFunc string    // set when a function has no conversion
 
 	// Check if any subsequent command is "default" — if so, the field
 	// has a fallback and should not be marked required.
@@ -7929,17 +10469,15 @@ func (c *converter) actionToCUE(n *parse.ActionNode) (expr ast.Expr, helmObj str
 				return nil, "", fmt.Errorf("{{ . }} outside range/with not supported")
 			}
 		} else if id, ok := first.Args[0].(*parse.IdentifierNode); ok {
-			if cf, ok := coreFuncs[id.Ident]; ok {
-				if !c.isCoreFunc(id.Ident) {
-					gatedFunc = id.Ident
-				} else {
-					cfExpr, cfObj, cfErr := cf.convert(c, nil)
-					if cfErr != nil {
-						return nil, "", cfErr
-					}
-					expr = cfExpr
-					helmObj = cfObj
+			if cf, ok := c.funcHandler(id.Ident); ok {
+				cfExpr, cfObj, cfErr := cf.convert(c, nil)
+				if cfErr != nil {
+					return nil, "", cfErr
 				}
+				expr = cfExpr
+				helmObj = cfObj
+			} else if _, ok := coreFuncs[id.Ident]; ok && !c.replacesCoreFunc(id.Ident) {
+				gatedFunc = id.Ident
 			}
 		} else if ch, ok := first.Args[0].(*parse.ChainNode); ok {
 			pipe, pipeOK := ch.Node.(*parse.PipeNode)
@@ -7979,11 +10517,7 @@ func (c *converter) actionToCUE(n *parse.ActionNode) (expr ast.Expr, helmObj str
 		if !ok {
 			break
 		}
-		if cf, ok := coreFuncs[id.Ident]; ok {
-			if !c.isCoreFunc(id.Ident) {
-				gatedFunc = id.Ident
-				break
-			}
+		if cf, ok := c.funcHandler(id.Ident); ok {
 			args := make([]funcArg, len(first.Args)-1)
 			for i, n := range first.Args[1:] {
 				args[i] = funcArg{node: n}
@@ -8007,6 +10541,8 @@ func (c *converter) actionToCUE(n *parse.ActionNode) (expr ast.Expr, helmObj str
 					}
 				}
 			}
+		} else if _, ok := coreFuncs[id.Ident]; ok && !c.replacesCoreFunc(id.Ident) {
+			gatedFunc = id.Ident
 		} else if pf, ok := c.config.Funcs[id.Ident]; ok {
 			if pf.Passthrough && len(first.Args) == 2 {
 				expr, helmObj, err = c.nodeToExpr(first.Args[1])
@@ -8082,11 +10618,16 @@ func (c *converter) actionToCUE(n *parse.ActionNode) (expr ast.Expr, helmObj str
 					c.usedHelpers[h.Name] = h
 				}
 			}
+		} else {
+			unknownFunc = id.Ident
 		}
 	}
 	if expr == nil {
 		if gatedFunc != "" {
-			return nil, "", fmt.Errorf("unsupported pipeline function: %s (not a text/template builtin)", gatedFunc)
+			return nil, "", codeErrorf(CodeUnsupportedFunc, "unsupported pipeline function: %s (not a text/template builtin)", gatedFunc)
+		}
+		if unknownFunc != "" {
+			return nil, "", codeErrorf(CodeUnsupportedFunc, "unsupported pipeline function: %s", unknownFunc)
 		}
 		return nil, "", fmt.Errorf("unsupported template action: %s", n)
 	}
@@ -8110,12 +10651,9 @@ func (c *converter) actionToCUE(n *parse.ActionNode) (expr ast.Expr, helmObj str
 		}
 		id, ok := cmd.Args[0].(*parse.IdentifierNode)
 		if !ok {
-			return nil, "", fmt.Errorf("unsupported pipeline function: %s", cmd)
+			return nil, "", codeErrorf(CodeUnsupportedFunc, "unsupported pipeline function: %s", cmd)
 		}
-		if cf, ok := coreFuncs[id.Ident]; ok {
-			if !c.isCoreFunc(id.Ident) {
-				return nil, "", fmt.Errorf("unsupported pipeline function: %s (not a text/template builtin)", id.Ident)
-			}
+		if cf, ok := c.funcHandler(id.Ident); ok {
 			piped := funcArg{expr: expr, obj: helmObj, field: fieldPath}
 			args := buildPipeArgs(cf, cmd.Args[1:], piped)
 			prevObj := helmObj
@@ -8132,6 +10670,8 @@ func (c *converter) actionToCUE(n *parse.ActionNode) (expr ast.Expr, helmObj str
 			}
 			fieldPath = nil
 			nonScalar = false
+		} else if _, ok := coreFuncs[id.Ident]; ok && !c.replacesCoreFunc(id.Ident) {
+			return nil, "", codeErrorf(CodeUnsupportedFunc, "unsupported pipeline function: %s (not a text/template builtin)", id.Ident)
 		} else if pf, ok := c.config.Funcs[id.Ident]; ok {
 			if pf.NonScalar {
 				c.trackNonScalarRef(helmObj, fieldPath)
@@ -8145,6 +10685,12 @@ func (c *converter) actionToCUE(n *parse.ActionNode) (expr ast.Expr, helmObj str
 				if pf.NonScalar {
 					nonScalar = true
 				}
+				// Decoding undoes a preceding toYaml or toJson: the
+				// value is structured again, not its serialization.
+				switch id.Ident {
+				case "fromYaml", "fromJson", "fromYamlArray", "fromJsonArray":
+					nonScalar = false
+				}
 				continue
 			}
 			// Cosmetic functions (trim, nindent, indent) are pure
@@ -8182,7 +10728,7 @@ func (c *converter) actionToCUE(n *parse.ActionNode) (expr ast.Expr, helmObj str
 				c.usedHelpers[h.Name] = h
 			}
 		} else {
-			return nil, "", fmt.Errorf("unsupported pipeline function: %s", id.Ident)
+			return nil, "", codeErrorf(CodeUnsupportedFunc, "unsupported pipeline function: %s", id.Ident)
 		}
 	}
 
@@ -8230,7 +10776,8 @@ func identFromExpr(expr ast.Expr) string {
 // accumulating an inline string, block scalar, or quoted scalar, or
 // when a pending key originated from a block scalar indicator (key: |-).
 func (c *converter) isScalarContext() bool {
-	return c.inlineParts != nil ||
+	return c.textOutput ||
+		c.inlineParts != nil ||
 		c.blockScalarLines != nil ||
 		c.quotedScalarParts != nil ||
 		c.pendingKeyBlockScalar
@@ -8272,66 +10819,119 @@ func (c *converter) convertPrintf(args []parse.Node) (ast.Expr, string, error) {
 		return nil, "", fmt.Errorf("printf format must be a string literal")
 	}
 
-	format := fmtNode.Text
+	segs, err := parsePrintfFormat(fmtNode.Text)
+	if err != nil {
+		return nil, "", err
+	}
 	valueArgs := args[1:]
 
 	var helmObj string
-	var parts []inlinePart
+	argExprs := make(map[int]ast.Expr)
+	operand := func(i int) (ast.Expr, error) {
+		if e, ok := argExprs[i]; ok {
+			return e, nil
+		}
+		if i >= len(valueArgs) {
+			return nil, fmt.Errorf("printf: not enough arguments for format string")
+		}
+		e, obj, err := c.nodeToExpr(valueArgs[i])
+		if err != nil {
+			return nil, fmt.Errorf("printf argument %d: %w", i+1, err)
+		}
+		if obj != "" {
+			helmObj = obj
+		}
+		argExprs[i] = e
+		return e, nil
+	}
 
-	argIdx := 0
-	var textBuf strings.Builder
-	for i := 0; i < len(format); i++ {
-		if format[i] == '%' && i+1 < len(format) {
-			verb := format[i+1]
-			switch verb {
-			case 's', 'd', 'v':
-				if argIdx >= len(valueArgs) {
-					return nil, "", fmt.Errorf("printf: not enough arguments for format string")
-				}
-				argExpr, argObj, err := c.nodeToExpr(valueArgs[argIdx])
+	var parts []inlinePart
+	for _, seg := range segs {
+		if seg.dir == nil {
+			parts = append(parts, inlinePart{text: escapePrintfText(seg.text)})
+			continue
+		}
+		d := seg.dir
+		var width, prec ast.Expr
+		if d.widthArg >= 0 {
+			if width, err = operand(d.widthArg); err != nil {
+				return nil, "", err
+			}
+		}
+		if d.precArg >= 0 {
+			if prec, err = operand(d.precArg); err != nil {
+				return nil, "", err
+			}
+		}
+		argExpr, err := operand(d.argNum)
+		if err != nil {
+			return nil, "", err
+		}
+		// A value prints differently for integer verbs when it is a
+		// float64 number or a string, which for the values is only
+		// known when the output is evaluated.
+		var bad []ast.Expr
+		if isIntVerb(d.verb) && c.isFloat64Ref(argExpr) {
+			for _, k := range []struct{ kind, cue string }{{"float64", "number"}, {"string", "string"}} {
+				e, err := c.badVerbExpr(d, k.kind, argExpr, width, prec)
 				if err != nil {
-					return nil, "", fmt.Errorf("printf argument %d: %w", argIdx+1, err)
-				}
-				if argObj != "" {
-					helmObj = argObj
+					return nil, "", err
 				}
-				// Flush accumulated text.
-				if textBuf.Len() > 0 {
-					parts = append(parts, inlinePart{text: textBuf.String()})
-					textBuf.Reset()
+				if e == nil {
+					continue
 				}
-				parts = append(parts, toInlinePart(argExpr))
-				argIdx++
-				i++
-			case '%':
-				textBuf.WriteByte('%')
-				i++
-			default:
-				return nil, "", fmt.Errorf("printf: unsupported format verb %%%c", verb)
-			}
-		} else {
-			switch format[i] {
-			case '\\':
-				textBuf.WriteString(`\\`)
-			case '"':
-				textBuf.WriteString(`\"`)
-			case '\n':
-				textBuf.WriteString(`\n`)
-			case '\t':
-				textBuf.WriteString(`\t`)
-			default:
-				textBuf.WriteByte(format[i])
+				bad = append(bad, &ast.Comprehension{
+					Clauses: []ast.Clause{&ast.IfClause{
+						Condition: binOp(token.NEQ, parenExpr(binOp(token.AND, argExpr, ast.NewIdent(k.cue))), &ast.BottomLit{}),
+					}},
+					Value: &ast.StructLit{Elts: []ast.Decl{&ast.EmbedDecl{Expr: e}}},
+				})
 			}
 		}
-	}
-	// Flush any remaining text.
-	if textBuf.Len() > 0 {
-		parts = append(parts, inlinePart{text: textBuf.String()})
+		if d.isPlain() && len(bad) == 0 {
+			parts = append(parts, toInlinePart(argExpr))
+			continue
+		}
+		var expr ast.Expr
+		if d.isPlain() {
+			expr = partsToExpr([]inlinePart{toInlinePart(argExpr)})
+		} else if expr, err = c.printfDirectiveExpr(d, argExpr, width, prec); err != nil {
+			return nil, "", err
+		}
+		if len(bad) > 0 {
+			expr = indexExpr(&ast.ListLit{Elts: append(bad, expr)}, cueInt(0))
+		}
+		// A lone directive already yields a string; use it directly.
+		if len(segs) == 1 {
+			return expr, helmObj, nil
+		}
+		parts = append(parts, toInlinePart(expr))
 	}
 
 	return partsToExpr(parts), helmObj, nil
 }
 
+// escapePrintfText escapes literal text from a printf format string for
+// embedding in a CUE string literal.
+func escapePrintfText(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			b.WriteString(`\\`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
 // convertPrint converts a Go template `print` call (fmt.Sprint semantics:
 // concatenate args) to a CUE string interpolation expression.
 func (c *converter) convertPrint(args []parse.Node) (ast.Expr, error) {
@@ -8375,7 +10975,7 @@ func (c *converter) convertIncludeNameExpr(node parse.Node) (ast.Expr, error) {
 		expr, _, err := c.convertPrintf(cmd.Args[1:])
 		return expr, err
 	default:
-		return nil, fmt.Errorf("include: unsupported dynamic name function %q", id.Ident)
+		return nil, codeErrorf(CodeUnsupportedFunc, "include: unsupported dynamic name function %q", id.Ident)
 	}
 }
 
@@ -8448,7 +11048,7 @@ func (c *converter) nodeToExpr(node parse.Node) (ast.Expr, string, error) {
 	case *parse.IdentifierNode:
 		// Bare function name used as a value (e.g. "list" or "dict"
 		// in "default list .Values.x"). Treat as zero-arg call.
-		if cf, ok := coreFuncs[n.Ident]; ok && c.isCoreFunc(n.Ident) {
+		if cf, ok := c.funcHandler(n.Ident); ok {
 			cfExpr, cfObj, cfErr := cf.convert(c, nil)
 			if cfErr != nil {
 				return nil, "", cfErr
@@ -8494,7 +11094,7 @@ func (c *converter) convertSubPipe(pipe *parse.PipeNode) (ast.Expr, string, erro
 		// Single-arg first command: field, variable, dot, or literal.
 		// Check for zero-arg core funcs like list or dict.
 		if id, ok := first.Args[0].(*parse.IdentifierNode); ok {
-			if cf, ok := coreFuncs[id.Ident]; ok && c.isCoreFunc(id.Ident) {
+			if cf, ok := c.funcHandler(id.Ident); ok {
 				cfExpr, cfObj, cfErr := cf.convert(c, nil)
 				if cfErr != nil {
 					return nil, "", cfErr
@@ -8547,7 +11147,7 @@ func (c *converter) convertSubPipe(pipe *parse.PipeNode) (ast.Expr, string, erro
 			}
 			expr = c.defaultExpr(expr, defaultValExpr)
 		default:
-			if cf, ok := coreFuncs[id.Ident]; ok && c.isCoreFunc(id.Ident) {
+			if cf, ok := c.funcHandler(id.Ident); ok {
 				args := make([]funcArg, len(first.Args)-1)
 				for i, n := range first.Args[1:] {
 					args[i] = funcArg{node: n}
@@ -8630,7 +11230,7 @@ func (c *converter) convertSubPipe(pipe *parse.PipeNode) (ast.Expr, string, erro
 			}
 			expr = c.defaultExpr(expr, defaultValExpr)
 			nonScalar = false
-		} else if cf, ok := coreFuncs[id.Ident]; ok && c.isCoreFunc(id.Ident) {
+		} else if cf, ok := c.funcHandler(id.Ident); ok {
 			piped := funcArg{expr: expr, obj: helmObj}
 			args := buildPipeArgs(cf, cmd.Args[1:], piped)
 			prevObj := helmObj
@@ -8754,13 +11354,179 @@ func (c *converter) convertTplArg(node parse.Node) (ast.Expr, string, error) {
 	return expr, helmObj, nil
 }
 
-// convertTplContext marks all configured context objects as used,
-// since the template string evaluated by tpl could reference any of
-// them at runtime.
-func (c *converter) convertTplContext(node parse.Node) {
-	for helmObj := range c.config.ContextObjects {
+// convertTplContext converts node, the context argument of tpl. It
+// returns nil for the root context, $ or a dot that is not rebound,
+// marking all configured context objects as used, since the template
+// string evaluated by tpl could reference any of them at runtime.
+func (c *converter) convertTplContext(node parse.Node) (ast.Expr, error) {
+	root := false
+	switch n := node.(type) {
+	case *parse.DotNode:
+		root = len(c.rangeVarStack) == 0
+	case *parse.VariableNode:
+		root = len(n.Ident) == 1 && n.Ident[0] == "$"
+	}
+	if root {
+		for helmObj := range c.config.ContextObjects {
+			c.usedContextObjects[helmObj] = true
+		}
+		return nil, nil
+	}
+	expr, helmObj, err := c.nodeToExpr(node)
+	if err != nil {
+		return nil, err
+	}
+	if helmObj != "" {
 		c.usedContextObjects[helmObj] = true
 	}
+	return expr, nil
+}
+
+// decodeValues returns a function that decodes data, the YAML of
+// Config.Values, on its first call and returns the result on every
+// call, or nil if there are no values. The values are nil if they
+// cannot be decoded.
+func decodeValues(data []byte) func() any {
+	if data == nil {
+		return nil
+	}
+	return sync.OnceValue(func() any {
+		var v any
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil
+		}
+		return v
+	})
+}
+
+// valuesDefault returns the value at path in Config.Values, or nil if
+// there is none.
+func (c *converter) valuesDefault(path []string) any {
+	if c.values == nil || len(path) == 0 {
+		return nil
+	}
+	v := c.values()
+	for _, name := range path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[name]
+	}
+	return v
+}
+
+// tplDefaultText returns the default in Config.Values of the values
+// path that node, a tpl template argument, refers to, when that
+// default is a template string.
+func (c *converter) tplDefaultText(node parse.Node) (string, bool) {
+	if pn, ok := node.(*parse.PipeNode); ok && len(pn.Decl) == 0 && len(pn.Cmds) == 1 && len(pn.Cmds[0].Args) == 1 {
+		node = pn.Cmds[0].Args[0]
+	}
+	var idents []string
+	switch n := node.(type) {
+	case *parse.FieldNode:
+		idents = n.Ident
+	case *parse.VariableNode:
+		if n.Ident[0] != "$" {
+			return "", false
+		}
+		idents = n.Ident[1:]
+	}
+	if len(idents) < 2 || idents[0] != "Values" {
+		return "", false
+	}
+	left, _ := c.config.delims()
+	text, ok := c.valuesDefault(idents[1:]).(string)
+	if !ok || !strings.Contains(text, left) {
+		return "", false
+	}
+	return text, true
+}
+
+// convertTplDefault converts text, a template string passed to tpl,
+// with dot as its context, or the root context if dot is nil. Only
+// text templates are converted; one that produces YAML structure is
+// left to the runtime path. As Helm's tpl output is, the text is
+// parsed as YAML.
+func (c *converter) convertTplDefault(text string, dot ast.Expr) (ast.Expr, error) {
+	expr, err := c.convertInlineText(text, dot)
+	if err != nil {
+		return nil, err
+	}
+	return importCall("encoding/yaml", "Unmarshal", expr), nil
+}
+
+// errTplYAML reports a template string, given to a function that
+// executes it, that produces YAML structure rather than text.
+var errTplYAML = errors.New("tpl template produces YAML structure")
+
+// convertInlineText converts text, a template string given to a
+// function that executes it, to a CUE string with dot as its context,
+// or the root context if dot is nil. Only text templates are
+// converted: one that produces YAML structure is an error.
+func (c *converter) convertInlineText(text string, dot ast.Expr) (ast.Expr, error) {
+	left, right := c.config.delims()
+	tree := parse.New("tpl")
+	tree.Mode = parse.SkipFuncCheck | parse.ParseComments
+	if _, err := tree.Parse(text, left, right, make(map[string]*parse.Tree)); err != nil {
+		return nil, withCode(CodeParseError, err)
+	}
+	resolveFuncNames(c.config, tree)
+	nodes := tree.Root.Nodes
+	if hasYAMLStructure(deepTextContent(nodes)) {
+		return nil, errTplYAML
+	}
+	sub := &converter{
+		config:                      c.config,
+		values:                      c.values,
+		usedContextObjects:          c.usedContextObjects,
+		fieldRefs:                   c.fieldRefs,
+		requiredRefs:                c.requiredRefs,
+		rangeRefs:                   c.rangeRefs,
+		nonScalarRefs:               c.nonScalarRefs,
+		imports:                     c.imports,
+		usedHelpers:                 c.usedHelpers,
+		usedInputs:                  c.usedInputs,
+		inputNames:                  c.inputNames,
+		treeSet:                     c.treeSet,
+		helperExprs:                 c.helperExprs,
+		helperCUE:                   c.helperCUE,
+		helperOutputType:            c.helperOutputType,
+		helperNodes:                 c.helperNodes,
+		helperConverting:            c.helperConverting,
+		helperForms:                 c.helperForms,
+		helperArgFieldRefs:          c.helperArgFieldRefs,
+		helperArgFieldRequiredRefs:  c.helperArgFieldRequiredRefs,
+		helperArgFieldRangeRefs:     c.helperArgFieldRangeRefs,
+		helperArgFieldNonScalarRefs: c.helperArgFieldNonScalarRefs,
+		helperDirectFieldRefs:       c.helperDirectFieldRefs,
+		helperDirectRequiredRefs:    c.helperDirectRequiredRefs,
+		helperDirectRangeRefs:       c.helperDirectRangeRefs,
+		helperDirectNonScalarRefs:   c.helperDirectNonScalarRefs,
+		helperIncludes:              c.helperIncludes,
+		templateFiles:               c.templateFiles,
+		currentHelperCUEName:        c.currentHelperCUEName,
+		undefinedHelpers:            c.undefinedHelpers,
+		localVars:                   make(map[string]ast.Expr),
+		comments:                    make(map[ast.Expr]string),
+		emitted:                     c.emitted,
+		textOutput:                  true,
+	}
+	if dot != nil {
+		sub.rangeVarStack = []rangeContext{{cueExpr: dot}}
+	}
+	parts, err := sub.textHelperNodesToParts(nodes)
+	if err != nil {
+		return nil, err
+	}
+	if sub.hasConditions {
+		c.hasConditions = true
+	}
+	if sub.hasDefault {
+		c.hasDefault = true
+	}
+	return partsToExpr(parts), nil
 }
 
 // tplContextDef builds a HelperDef for _tplContext, mapping Helm
@@ -8972,8 +11738,18 @@ func parseHelperDefDecls(text string, imports []string, stripComments bool) ([]a
 	if err != nil {
 		return nil, err
 	}
+	for _, d := range decls {
+		tagImports(d, imports)
+	}
+	return decls, nil
+}
+
+// tagImports tags the identifiers in n that refer to one of imports by
+// its short name, as strings in strings.Join, so that astutil.Sanitize
+// adds the import.
+func tagImports(n ast.Node, imports []string) {
 	if len(imports) == 0 {
-		return decls, nil
+		return
 	}
 	// Build short name → full package path mapping.
 	shortToFull := make(map[string]string, len(imports))
@@ -8986,23 +11762,20 @@ func parseHelperDefDecls(text string, imports []string, stripComments bool) ([]a
 	}
 	// Walk to tag import idents: find selector expressions where X is
 	// an ident matching an import short name.
-	for _, d := range decls {
-		ast.Walk(d, func(n ast.Node) bool {
-			sel, ok := n.(*ast.SelectorExpr)
-			if !ok {
-				return true
-			}
-			ident, ok := sel.X.(*ast.Ident)
-			if !ok {
-				return true
-			}
-			if pkg, ok := shortToFull[ident.Name]; ok {
-				ident.Node = ast.NewImport(nil, pkg)
-			}
+	ast.Walk(n, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
 			return true
-		}, nil)
-	}
-	return decls, nil
+		}
+		ident, ok := sel.X.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		if pkg, ok := shortToFull[ident.Name]; ok {
+			ident.Node = ast.NewImport(nil, pkg)
+		}
+		return true
+	}, nil)
 }
 
 // resolveImportSentinels walks an *ast.File and resolves sentinel
@@ -9048,6 +11821,7 @@ func formatResolvedFile(f *ast.File, knownImports map[string]bool) ([]byte, erro
 	if err := astutil.Sanitize(f); err != nil {
 		return nil, fmt.Errorf("sanitize: %w", err)
 	}
+	sortImports(f)
 	b, err := format.Node(f, format.Simplify())
 	if err != nil {
 		return nil, err
@@ -9055,6 +11829,18 @@ func formatResolvedFile(f *ast.File, knownImports map[string]bool) ([]byte, erro
 	return compactRangeCompBodies(b)
 }
 
+// sortImports sorts the imports of f by path. astutil.Sanitize adds
+// them in the order their packages are first used.
+func sortImports(f *ast.File) {
+	for _, d := range f.Decls {
+		if id, ok := d.(*ast.ImportDecl); ok {
+			slices.SortFunc(id.Specs, func(a, b *ast.ImportSpec) int {
+				return strings.Compare(a.Path.Value, b.Path.Value)
+			})
+		}
+	}
+}
+
 // compactRangeCompBodies re-parses formatted CUE and compacts range
 // comprehension bodies that embed lists. It changes:
 //
@@ -9255,6 +12041,21 @@ func fieldNodesToDecls(nodes []*fieldNode) []ast.Decl {
 	return decls
 }
 
+// stringMapFieldDecls declares the fields of a map of strings, each
+// defaulting to "": *"" | string.
+func stringMapFieldDecls(nodes []*fieldNode) []ast.Decl {
+	var decls []ast.Decl
+	for _, n := range nodes {
+		decls = append(decls, &ast.Field{
+			Label: cueKeyLabel(n.name),
+			Value: binOp(token.OR,
+				&ast.UnaryExpr{Op: token.MUL, X: cueString("")},
+				ast.NewIdent("string")),
+		})
+	}
+	return decls
+}
+
 func buildFieldTree(refs [][]string, requiredRefs [][]string, rangeRefs [][]string, nonScalarRefs [][]string) *fieldNode {
 	root := &fieldNode{childMap: make(map[string]*fieldNode)}
 	for _, ref := range refs {
@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package helm2cue
 
 import (
 	"bytes"
@@ -28,7 +28,12 @@ import (
 	"strings"
 	"testing"
 	"text/template"
+	"text/template/parse"
 
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/cuecontext"
+	"cuelang.org/go/cue/token"
 	"github.com/rogpeppe/go-internal/diff"
 	"golang.org/x/tools/txtar"
 	"gopkg.in/yaml.v3"
@@ -156,6 +161,10 @@ func runHelmConvertTest(t *testing.T, helmPath string, ar *txtar.Archive,
 		t.Fatal("missing input.yaml section")
 	}
 
+	// The values are the chart's defaults, as ConvertChart passes them.
+	cfg := HelmConfig()
+	cfg.Values = valuesYAML
+
 	// Enforce mutual exclusivity of error, broken, and output.cue.
 	if hasBroken && hasError {
 		t.Fatal("broken and error sections are mutually exclusive")
@@ -167,7 +176,7 @@ func runHelmConvertTest(t *testing.T, helmPath string, ar *txtar.Archive,
 	// If an error section is present, verify Convert returns
 	// an error containing the expected substring.
 	if hasError {
-		_, err := Convert(HelmConfig(), input, helpers...)
+		_, err := Convert(cfg, input, helpers...)
 		if err == nil {
 			t.Fatal("expected Convert() to fail, but it succeeded")
 		}
@@ -199,7 +208,7 @@ func runHelmConvertTest(t *testing.T, helmPath string, ar *txtar.Archive,
 	// If a broken section is present, the CUE conversion is expected
 	// to fail (known bug). Verify the error matches and return early.
 	if hasBroken {
-		_, err := Convert(HelmConfig(), input, helpers...)
+		_, err := Convert(cfg, input, helpers...)
 		if err == nil {
 			t.Fatal("expected Convert() to fail (broken), but it succeeded; remove the broken section")
 		}
@@ -210,7 +219,7 @@ func runHelmConvertTest(t *testing.T, helmPath string, ar *txtar.Archive,
 		return
 	}
 
-	got, err := Convert(HelmConfig(), input, helpers...)
+	got, err := Convert(cfg, input, helpers...)
 	if err != nil {
 		t.Fatalf("Convert() error: %v", err)
 	}
@@ -228,7 +237,7 @@ func runHelmConvertTest(t *testing.T, helmPath string, ar *txtar.Archive,
 	// Run experiments conversion if opted in (has experiments_output.cue section).
 	var expGot []byte
 	if hasExpOutput {
-		expCfg := HelmConfig()
+		expCfg := cfg
 		expCfg.Experiments = true
 		var expErr error
 		expGot, expErr = Convert(expCfg, input, helpers...)
@@ -305,10 +314,13 @@ func helmTemplate(t *testing.T, helmPath string, template, values []byte, helper
 		t.Fatal(err)
 	}
 
+	// Helm parses helpers in reverse lexical order, and a definition
+	// parsed later wins, as a later helper does in the converter; so
+	// the last helper is _helpers.tpl and earlier ones sort after it.
 	for i, helper := range helpers {
-		name := fmt.Sprintf("_helpers%d.tpl", i)
-		if i == 0 {
-			name = "_helpers.tpl"
+		name := "_helpers.tpl"
+		if n := len(helpers) - 1 - i; n > 0 {
+			name = fmt.Sprintf("_helpers%02d.tpl", n)
 		}
 		if err := os.WriteFile(filepath.Join(dir, "templates", name), helper, 0o644); err != nil {
 			t.Fatal(err)
@@ -625,6 +637,584 @@ func TestTemplateConfig(t *testing.T) {
 	})
 }
 
+// TestConvertTemplateResult verifies that ConvertTemplate reports the
+// helpers it converted and the values schema alongside the CUE.
+func TestConvertTemplateResult(t *testing.T) {
+	helpers := []byte(`{{- define "name" -}}{{ .Values.name }}{{- end -}}
+{{- define "unused" -}}x{{- end -}}
+`)
+	input := []byte(`name: {{ include "name" . }}
+port: {{ required "port is required" .Values.port }}
+`)
+	res, err := ConvertTemplate(HelmConfig(), input, helpers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Convert(HelmConfig(), input, helpers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res.CUE, want) {
+		t.Errorf("CUE differs from Convert:\n%s", diff.Diff("Convert", want, "ConvertTemplate", res.CUE))
+	}
+	if got, want := res.Helpers, []string{"name"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Helpers = %q, want %q", got, want)
+	}
+	wantSchema := `#values: {
+	name!: bool | number | string | null
+	port!: bool | number | string | null
+	...
+}
+`
+	if got := string(res.ValuesSchema); got != wantSchema {
+		t.Errorf("ValuesSchema:\n%s", diff.Diff("want", []byte(wantSchema), "got", res.ValuesSchema))
+	}
+	if len(res.Warnings) > 0 {
+		t.Errorf("unexpected warnings: %q", res.Warnings)
+	}
+}
+
+// TestConvertCommentChecks verifies that required and fail calls on
+// YAML comment lines still apply: the output evaluates while the checks
+// pass, and fails with the message of a fail call that is reached.
+func TestConvertCommentChecks(t *testing.T) {
+	input := []byte(`# image {{ required "image is required" .Values.image }}
+a: 1
+{{- if .Values.strict }}
+# {{ fail "strict mode is not supported" }}
+{{- end }}
+`)
+	src, err := Convert(HelmConfig(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := evalOutput(t, src, `#values: {image: "nginx"}`), `[{"a":1}]`; got != want {
+		t.Errorf("output = %s, want %s", got, want)
+	}
+	v := cuecontext.New().CompileString(string(src) + "\n" + `#values: {image: "nginx", strict: true}`)
+	_, err = v.LookupPath(cue.ParsePath("output")).MarshalJSON()
+	if err == nil || !strings.Contains(err.Error(), "strict mode is not supported") {
+		t.Errorf("output with strict: true: error = %v, want the fail message", err)
+	}
+	if !bytes.Contains(src, []byte("image!:")) {
+		t.Errorf("CUE does not require image:\n%s", src)
+	}
+}
+
+// TestConvertNumbersFormat verifies that values are formatted as
+// Helm's float64 numbers by the type they have when the output is
+// evaluated, not by that of their defaults in Config.Values.
+func TestConvertNumbersFormat(t *testing.T) {
+	input := []byte(`size: "{{ .Values.size }}"
+port: {{ printf "%d" .Values.port | quote }}
+tags: tags({{ range .Values.tags }}{{ . }};{{ end }})
+`)
+	cfg := HelmConfig()
+	cfg.Values = []byte("size: small\nport: http\ntags: [a]\n")
+	src, err := Convert(cfg, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ values, want string }{
+		{`#values: {size: "small", port: "http", tags: ["a"]}`, `[{"size":"small","port":"%!d(string=http)","tags":"tags(a;)"}]`},
+		{`#values: {size: 1000000, port: 8080, tags: [2000000, 1.5]}`, `[{"size":"1e+06","port":"%!d(float64=8080)","tags":"tags(2e+06;1.5;)"}]`},
+	} {
+		if got := evalOutput(t, src, test.values); got != test.want {
+			t.Errorf("output with %s = %s, want %s", test.values, got, test.want)
+		}
+	}
+}
+
+// TestConvertContextFunc verifies that a PipelineFunc with a
+// ConvertContext hook is converted in value, piped and condition
+// positions, with access to field references, imports and warnings.
+func TestConvertContextFunc(t *testing.T) {
+	cfg := HelmConfig()
+	cfg.Funcs["hostname"] = PipelineFunc{
+		ConvertContext: func(ctx *FuncContext, args []FuncArg) (ast.Expr, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("hostname requires 1 argument, got %d", len(args))
+			}
+			resolve := ctx.Expr
+			if ctx.InCondition() {
+				resolve = ctx.OptionalExpr
+				ctx.Warnf("hostnames are never empty")
+			}
+			expr, ref, err := resolve(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if ref != nil && ref.Path[0] == "alt" {
+				ctx.MarkNonScalar(*ref)
+			}
+			return ctx.ImportCall("strings", "ToLower", expr), nil
+		},
+	}
+	input := []byte(`host: {{ hostname .Values.host }}
+alt: {{ .Values.alt | hostname }}
+{{- if hostname .Values.cond }}
+enabled: true
+{{- end }}
+`)
+	res, err := ConvertTemplate(cfg, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`"strings"`,
+		"host: strings.ToLower(#values.host)",
+		"alt:  strings.ToLower(#values.alt)",
+		"if (_nonzero & {#arg: strings.ToLower(#values.cond)}).out {",
+	} {
+		if !bytes.Contains(res.CUE, []byte(want)) {
+			t.Errorf("CUE does not contain %q:\n%s", want, res.CUE)
+		}
+	}
+	wantSchema := `#values: {
+	host!: bool | number | string | null
+	alt!:  _
+	cond?: bool | number | string | null
+	...
+}
+`
+	if got := string(res.ValuesSchema); got != wantSchema {
+		t.Errorf("ValuesSchema:\n%s", diff.Diff("want", []byte(wantSchema), "got", res.ValuesSchema))
+	}
+	// The reference that the hook makes optional may be left unset.
+	if got, want := evalOutput(t, res.CUE, `#values: {host: "A.example", alt: "B"}`), `[{"host":"a.example","alt":"b"}]`; got != want {
+		t.Errorf("output = %s, want %s", got, want)
+	}
+	wantDiags := []Diagnostic{{
+		Severity:  SeverityWarning,
+		Code:      CodeFuncWarning,
+		Line:      3,
+		Column:    8,
+		Construct: "hostname .Values.cond",
+		Message:   "hostname: hostnames are never empty",
+	}}
+	if !reflect.DeepEqual(res.Diagnostics, wantDiags) {
+		t.Errorf("Diagnostics = %#v, want %#v", res.Diagnostics, wantDiags)
+	}
+}
+
+// TestConvertContextFuncHelper verifies that the field references a
+// ConvertContext hook marks are tracked through FieldRemap, through
+// the function's result and on the argument of a helper.
+func TestConvertContextFuncHelper(t *testing.T) {
+	cfg := HelmConfig()
+	cfg.FieldRemap["Values"] = map[string]string{"Hosts": "hosts"}
+	cfg.Funcs["hosts"] = PipelineFunc{
+		ConvertContext: func(ctx *FuncContext, args []FuncArg) (ast.Expr, error) {
+			expr, ref, err := ctx.Expr(args[len(args)-1])
+			if err != nil {
+				return nil, err
+			}
+			if ref != nil {
+				ctx.MarkRange(*ref)
+			}
+			return ctx.ImportCall("list", "Sort", expr, ast.NewSel(ast.NewIdent("list"), "Ascending")), nil
+		},
+	}
+	cfg.Funcs["lower"] = PipelineFunc{
+		ConvertContext: func(ctx *FuncContext, args []FuncArg) (ast.Expr, error) {
+			expr, _, err := ctx.Expr(args[0])
+			return ctx.ImportCall("strings", "ToLower", expr), err
+		},
+	}
+	input := []byte(`{{- define "app.hosts" -}}
+{{- range hosts .names }}
+- name: {{ . }}
+{{- end }}
+{{- end -}}
+hosts:
+  {{- include "app.hosts" .Values | nindent 2 }}
+sorted: {{ hosts .Values.Hosts | toJson }}
+mode: {{ lower .Values.mode | toJson }}
+`)
+	res, err := ConvertTemplate(cfg, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSchema := `#values: {
+	names?: [...] | {
+		[string]: _
+	}
+	hosts!: [...] | {
+		[string]: _
+	}
+	mode!: _
+	...
+}
+`
+	if got := string(res.ValuesSchema); got != wantSchema {
+		t.Errorf("ValuesSchema:\n%s", diff.Diff("want", []byte(wantSchema), "got", res.ValuesSchema))
+	}
+	if got, want := evalOutput(t, res.CUE, `#values: {names: ["b", "a"], hosts: ["d", "c"], mode: "Fast"}`), `[{"hosts":[{"name":"a"},{"name":"b"}],"sorted":["c","d"],"mode":"fast"}]`; got != want {
+		t.Errorf("output = %s, want %s", got, want)
+	}
+}
+
+// evalOutput evaluates the output field of src, CUE produced by a
+// conversion, together with the CUE of values, and returns it as JSON.
+func evalOutput(t *testing.T, src []byte, values string) string {
+	t.Helper()
+	v := cuecontext.New().CompileString(string(src) + "\n" + values)
+	out, err := v.LookupPath(cue.ParsePath("output")).MarshalJSON()
+	if err != nil {
+		t.Fatalf("evaluating output with %s: %v\nCUE:\n%s", values, err, src)
+	}
+	return string(out)
+}
+
+// TestConvertVisitor verifies that Config.Visitor can rewrite the CUE
+// emitted for documents, fields, helpers and ranges.
+func TestConvertVisitor(t *testing.T) {
+	input := []byte(`{{- define "app.labels" -}}
+app: {{ .Values.name }}
+{{- end -}}
+metadata:
+  labels:
+    {{- include "app.labels" . | nindent 4 }}
+  name: {{ .Values.name }}
+spec:
+  ports:
+  {{- range .Values.ports }}
+  - port: {{ . }}
+  {{- end }}
+`)
+	var ranges []string
+	cfg := HelmConfig()
+	cfg.Visitor = &Visitor{
+		Document: func(root *parse.ListNode, doc *ast.StructLit) ast.Expr {
+			return &ast.BinaryExpr{X: ast.NewIdent("#Resource"), Op: token.AND, Y: doc}
+		},
+		Field: func(node parse.Node, f *ast.Field) ast.Decl {
+			if n, ok := node.(*parse.TextNode); ok {
+				line := 1 + bytes.Count(input[:n.Pos], []byte("\n"))
+				f.Attrs = append(f.Attrs, &ast.Attribute{Text: fmt.Sprintf("@line(%d)", line)})
+			}
+			return f
+		},
+		Helper: func(name string, body []parse.Node, expr ast.Expr) ast.Expr {
+			return ast.NewCall(ast.NewIdent("close"), expr)
+		},
+		Range: func(n *parse.RangeNode, comp *ast.Comprehension) *ast.Comprehension {
+			ranges = append(ranges, n.Pipe.String())
+			comp.Clauses = append(comp.Clauses, &ast.IfClause{Condition: ast.NewIdent("#enabled")})
+			return comp
+		},
+	}
+	res, err := ConvertTemplate(cfg, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"_app_labels: close({",
+		"#Resource & {",
+		"name:   #values.name @line(7)",
+		"} @line(4)",
+		"for _, _range0 in #values.ports if #enabled {",
+	} {
+		if !bytes.Contains(res.CUE, []byte(want)) {
+			t.Errorf("CUE does not contain %q:\n%s", want, res.CUE)
+		}
+	}
+	if want := []string{".Values.ports"}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("visited ranges %q, want %q", ranges, want)
+	}
+}
+
+// TestConvertVisitorHelperForms verifies that Config.Visitor.Helper is
+// called for the second form of a helper used both as fields and as
+// text, and that the unrolled levels of a recursive helper copy the
+// value it returned.
+func TestConvertVisitorHelperForms(t *testing.T) {
+	helpers := []byte(`{{- define "app.labels" -}}
+app: {{ .Values.name }}
+{{- end -}}
+{{- define "tree" -}}
+name: {{ .name }}
+{{- range .children }}
+{{ include "tree" . }}
+{{- end }}
+{{- end -}}
+`)
+	input := []byte(`metadata:
+  labels:
+    {{- include "app.labels" . | nindent 4 }}
+  annotations:
+    note: {{ printf "labels: %s" (include "app.labels" .) | quote }}
+tree:
+  {{- include "tree" .Values.root | nindent 2 }}
+`)
+	var names []string
+	cfg := HelmConfig()
+	cfg.MaxHelperDepth = 2
+	cfg.Visitor = &Visitor{
+		Helper: func(name string, body []parse.Node, expr ast.Expr) ast.Expr {
+			if len(body) == 0 {
+				t.Errorf("helper %s visited without its body", name)
+			}
+			names = append(names, name)
+			return ast.NewCall(ast.NewIdent("close"), expr)
+		},
+	}
+	res, err := ConvertTemplate(cfg, input, helpers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"_app_labels: close({",
+		"_app_labels_text: close(strings.TrimRight(",
+		"_tree: close({",
+		"_tree_1: close({",
+	} {
+		if !bytes.Contains(res.CUE, []byte(want)) {
+			t.Errorf("CUE does not contain %q:\n%s", want, res.CUE)
+		}
+	}
+	if want := []string{"app.labels", "app.labels", "tree"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("visited helpers %q, want %q", names, want)
+	}
+}
+
+// TestLoadFuncsErrors verifies that LoadFuncs reports mistakes in a
+// function-mapping file with their positions.
+func TestLoadFuncsErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"f:\n  exprr: x\n", "funcs.yaml:2:3: f: exprr: field not allowed"},
+		{"f:\n  helpers:\n    h: '{}'\n", "funcs.yaml:3:5: f: helpers.h: field not allowed"},
+		{"f:\n  nargs: -1\n", "funcs.yaml:2:10: f: nargs: invalid value -1 (out of bound >=0)"},
+		{"f: 3\n", "funcs.yaml: f: want an expression or a struct, got int"},
+		{"f: '#in + #args[0]'\n", "funcs.yaml: f: #args[0] out of range for nargs 0"},
+	}
+	for _, test := range tests {
+		_, err := LoadFuncs("funcs.yaml", []byte(test.data))
+		if err == nil || err.Error() != test.want {
+			t.Errorf("LoadFuncs(%q) error = %v, want %q", test.data, err, test.want)
+		}
+	}
+}
+
+// TestGomplateConfig verifies that GomplateConfig resolves namespaced
+// functions and their aliases, and rejects the forms it cannot convert.
+func TestGomplateConfig(t *testing.T) {
+	input := []byte(`name: {{ getenv "APP" "web" | strings.ToUpper }}
+host: {{ (ds "config").host | quote }}
+`)
+	res, err := ConvertTemplate(GomplateConfig(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`APP: *"" | string`,
+		"name: strings.ToUpper([if (_nonzero & {#arg: #env.APP}).out {",
+		`"\(#datasources.config.host)"`,
+		"#datasources: {",
+	} {
+		if !bytes.Contains(res.CUE, []byte(want)) {
+			t.Errorf("CUE does not contain %q:\n%s", want, res.CUE)
+		}
+	}
+	// getenv falls back to its default when the variable is unset.
+	if got, want := evalOutput(t, res.CUE, `#datasources: config: host: "db"`), `[{"name":"WEB","host":"db"}]`; got != want {
+		t.Errorf("output = %s, want %s", got, want)
+	}
+
+	for _, input := range []string{
+		`x: {{ datasource .Env.NAME }}`,
+		`x: {{ ds "config" "path/to/key" }}`,
+		`x: {{ tmpl.Inline .Env.T }}`,
+		`x: {{ range .Env.XS }}{{ tmpl.Inline "{{ . }}" . }}{{ end }}`,
+	} {
+		if _, err := ConvertTemplate(GomplateConfig(), []byte(input)); err == nil {
+			t.Errorf("ConvertTemplate(%q) succeeded, want error", input)
+		}
+	}
+}
+
+// TestConvertDelims verifies that Config.LeftDelim and RightDelim set
+// the delimiters of templates, including the blocks repeated in each
+// document of a multi-document template, and that Config.RootObject
+// resolves fields of the root context but not of dot in a range.
+func TestConvertDelims(t *testing.T) {
+	cfg := TemplateConfig()
+	cfg.LeftDelim, cfg.RightDelim = "[[", "]]"
+	cfg.RootObject = "Values"
+	input := []byte(`[[- if .enabled ]]
+name: [[ .name ]]
+text: "{{ .name }}"
+---
+ports:
+[[- range .ports ]]
+- [[ .port ]]
+[[- end ]]
+[[- end ]]
+`)
+	res, err := ConvertTemplate(cfg, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"name: #values.name",
+		`text: "{{ .name }}"`,
+		"for _, _range0 in #values.ports {",
+		"_range0.port",
+	} {
+		if !bytes.Contains(res.CUE, []byte(want)) {
+			t.Errorf("CUE does not contain %q:\n%s", want, res.CUE)
+		}
+	}
+	if got := bytes.Count(res.CUE, []byte("#arg: #values.enabled")); got != 2 {
+		t.Errorf("enabled tested in %d documents, want 2:\n%s", got, res.CUE)
+	}
+
+	// Constructs in diagnostics are written with the delimiters.
+	for input, want := range map[string]string{
+		"a: [[ nosuch 1 ]]\n":                          "[[nosuch 1]]",
+		"a: 1\n[[- if nosuch 1 ]]\nb: 2\n[[- end ]]\n": "[[if nosuch 1]]",
+	} {
+		res, err := ConvertTemplate(cfg, []byte(input))
+		if err == nil {
+			t.Errorf("ConvertTemplate(%q) succeeded, want an error", input)
+			continue
+		}
+		if len(res.Diagnostics) != 1 || res.Diagnostics[0].Construct != want {
+			t.Errorf("ConvertTemplate(%q) diagnostics = %#v, want construct %q", input, res.Diagnostics, want)
+		}
+	}
+}
+
+// TestConvertJinja verifies that ConvertJinja translates Jinja2
+// expressions, filters and control structures, and reports the Jinja2
+// line of constructs it cannot convert.
+func TestConvertJinja(t *testing.T) {
+	input := []byte(`mode: {{ "x" if on else "y" }}
+name: {{ name ~ '-' ~ suffix }}
+hosts: {{ hosts | join(',') }}
+addr: {{ '%s:%d' % (host, port) }}
+path: {{ path | regex_replace('^/+', '') }}
+labels: {{ base | combine(extra) | to_json }}
+`)
+	res, err := ConvertJinja(JinjaConfig(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"mode: [if (_nonzero & {#arg: #values.on}).out {",
+		`"\(#values.name)-\(#values.suffix)"`,
+		`strings.Join(#values.hosts, ",")`,
+		`"\(#values.host):\(#values.port)"`,
+		`regexp.ReplaceAll("^/+", #values.path, "")`,
+		"labels: (_mergeOverwrite & {#a: #values.base, #b: #values.extra}).out",
+	} {
+		if !bytes.Contains(res.CUE, []byte(want)) {
+			t.Errorf("CUE does not contain %q:\n%s", want, res.CUE)
+		}
+	}
+
+	// The defined test and default find whether a variable is set,
+	// rather than whether it is empty, and the filters keep Jinja's
+	// semantics.
+	input = []byte(`{% if port is defined %}
+port: {{ port }}
+{% endif %}
+name: {{ name | default('web') }}
+text: {{ body | indent(2) }}
+first: {{ body | indent(2, true) }}
+ratio: {{ n / 4 }}
+slug: {{ name | default('web') | regex_replace('^(w)(e)', '\\2\\1 $') }}
+`)
+	res, err = ConvertJinja(JinjaConfig(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		values string
+		want   string
+	}{{
+		`#values: {port: 80, name: "", body: "a\n\nb", n: 2}`,
+		`[{"port":80,"name":"","text":"a\n\n  b","first":"  a\n\n  b","ratio":0.5,"slug":""}]`,
+	}, {
+		`#values: {body: "a", n: 1}`,
+		`[{"name":"web","text":"a","first":"  a","ratio":0.25,"slug":"ew $b"}]`,
+	}} {
+		if got := evalOutput(t, res.CUE, test.values); got != test.want {
+			t.Errorf("output with %s = %s, want %s", test.values, got, test.want)
+		}
+	}
+
+	// Other delimiters leave text that looks like an action as text.
+	cfg := JinjaConfig()
+	cfg.LeftDelim, cfg.RightDelim = "[[", "]]"
+	res, err = ConvertJinja(cfg, []byte("a: \"[[ x ]]\"\nb: {{ name }}\n{% if on %}\nc: 1\n{% endif %}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := evalOutput(t, res.CUE, `#values: {name: "n", on: true}`), `[{"a":"[[ x ]]","b":"n","c":1}]`; got != want {
+		t.Errorf("output with delimiters [[ ]] = %s, want %s", got, want)
+	}
+
+	tests := []struct {
+		input string
+		code  string
+		line  int
+	}{
+		{"a: 1\n{% include 'x.j2' %}\n", CodeUnsupportedConstruct, 2},
+		{"a: {{ x | indent(n) }}\n", CodeUnsupportedConstruct, 1},
+		{"a: {{ (x ~ y) | default('z') }}\n", CodeUnsupportedConstruct, 1},
+		{"a: {{ x | regex_replace('a', y) }}\n", CodeUnsupportedConstruct, 1},
+		{"a: 1\nb: 2\nc: 3\nd: {{ y ) }}\n", CodeParseError, 4},
+		{"a: 1\n{% if x %}\nb: 2\n", CodeParseError, 2},
+		{"a: {{ x | bogus }}\n", CodeUnsupportedFunc, 1},
+	}
+	for _, test := range tests {
+		res, err := ConvertJinja(JinjaConfig(), []byte(test.input))
+		if err == nil || res == nil || len(res.Diagnostics) != 1 {
+			t.Errorf("ConvertJinja(%q) = %v, %v, want one diagnostic", test.input, res, err)
+			continue
+		}
+		d := res.Diagnostics[0]
+		if d.Code != test.code || d.Line != test.line {
+			t.Errorf("ConvertJinja(%q) diagnostic = %v (line %d), want code %s at line %d", test.input, d, d.Line, test.code, test.line)
+		}
+	}
+}
+
+// TestGoTemplateConfig verifies that GoTemplate.Config enables the
+// Sprig and core functions a template registers, all of Sprig's for a
+// Sprig function map but not those Helm adds, and reports the others.
+func TestGoTemplateConfig(t *testing.T) {
+	tmpl := &GoTemplate{Funcs: []string{"default", "lookup", "mine", "upper"}}
+	cfg, unknown := tmpl.Config()
+	if want := []string{"lookup", "mine"}; !reflect.DeepEqual(unknown, want) {
+		t.Errorf("unknown = %q, want %q", unknown, want)
+	}
+	if _, ok := cfg.Funcs["upper"]; !ok || !cfg.CoreFuncs["default"] {
+		t.Errorf("upper or default not enabled")
+	}
+	if _, ok := cfg.Funcs["trim"]; ok {
+		t.Errorf("trim enabled but not registered")
+	}
+
+	cfg, unknown = (&GoTemplate{Sprig: true, LeftDelim: "[["}).Config()
+	if len(unknown) > 0 {
+		t.Errorf("unknown = %q, want none", unknown)
+	}
+	if _, ok := cfg.Funcs["trim"]; !ok || !cfg.CoreFuncs["hasKey"] || !cfg.CoreFuncs["contains"] {
+		t.Errorf("Sprig functions not enabled")
+	}
+	if _, ok := cfg.Funcs["toYaml"]; ok || cfg.CoreFuncs["include"] {
+		t.Errorf("Helm functions enabled for Sprig")
+	}
+	if cfg.LeftDelim != "[[" || cfg.RootObject != "Values" {
+		t.Errorf("LeftDelim, RootObject = %q, %q, want [[, Values", cfg.LeftDelim, cfg.RootObject)
+	}
+}
+
 // TestHelmContextFixtures verifies that helmContextFixtures has an entry
 // for every context object in HelmConfig except #values.
 func TestHelmContextFixtures(t *testing.T) {
@@ -12,10 +12,12 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package helm2cue
 
 import (
+	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"text/template/parse"
 
@@ -56,34 +58,52 @@ var coreFuncs map[string]coreFunc
 
 func init() {
 	coreFuncs = map[string]coreFunc{
-		"default":        {nargs: 2, convert: convertDefault},
-		"printf":         {nargs: -1, convert: convertPrintf},
-		"print":          {nargs: -1, convert: convertPrint},
-		"required":       {nargs: 2, convert: convertRequired},
-		"fail":           {nargs: 1, convert: convertFail},
-		"include":        {nargs: -1, convert: convertInclude},
-		"ternary":        {nargs: 3, convert: convertTernary},
-		"list":           {nargs: -1, convert: convertList},
-		"dict":           {nargs: -1, convert: convertDict},
-		"get":            {nargs: 2, convert: convertGet},
-		"coalesce":       {nargs: -1, convert: convertCoalesce},
-		"max":            {nargs: -1, convert: convertMax},
-		"min":            {nargs: -1, convert: convertMin},
-		"tpl":            {nargs: 2, pipedFirst: true, convert: convertTpl},
-		"index":          {nargs: -1, convert: convertIndex},
-		"merge":          {nargs: -1, convert: convertMerge},
-		"mergeOverwrite": {nargs: -1, convert: convertMergeOverwrite},
-		"dig":            {nargs: -1, convert: convertDig},
-		"omit":           {nargs: -1, convert: convertOmit},
-		"typeIs":         {nargs: 2, convert: convertTypeIs},
-		"deepCopy":       {nargs: 1, convert: convertDeepCopy},
-		"eq":             {nargs: 2, convert: makeConvertCmp(token.EQL)},
-		"ne":             {nargs: 2, convert: makeConvertCmp(token.NEQ)},
-		"lt":             {nargs: 2, convert: makeConvertCmp(token.LSS)},
-		"gt":             {nargs: 2, convert: makeConvertCmp(token.GTR)},
-		"le":             {nargs: 2, convert: makeConvertCmp(token.LEQ)},
-		"ge":             {nargs: 2, convert: makeConvertCmp(token.GEQ)},
-		"concat":         {nargs: -1, convert: convertConcat},
+		"default":           {nargs: 2, convert: convertDefault},
+		"printf":            {nargs: -1, convert: convertPrintf},
+		"print":             {nargs: -1, convert: convertPrint},
+		"required":          {nargs: 2, convert: convertRequired},
+		"fail":              {nargs: 1, convert: convertFail},
+		"include":           {nargs: -1, convert: convertInclude},
+		"ternary":           {nargs: 3, convert: convertTernary},
+		"list":              {nargs: -1, convert: convertList},
+		"dict":              {nargs: -1, convert: convertDict},
+		"get":               {nargs: 2, convert: convertGet},
+		"coalesce":          {nargs: -1, convert: convertCoalesce},
+		"and":               {nargs: -1, convert: convertAnd},
+		"or":                {nargs: -1, convert: convertOr},
+		"max":               {nargs: -1, convert: convertMax},
+		"min":               {nargs: -1, convert: convertMin},
+		"tpl":               {nargs: 2, pipedFirst: true, convert: convertTpl},
+		"index":             {nargs: -1, convert: convertIndex},
+		"merge":             {nargs: -1, convert: convertMerge},
+		"mergeOverwrite":    {nargs: -1, convert: convertMergeOverwrite},
+		"dig":               {nargs: -1, convert: convertDig},
+		"omit":              {nargs: -1, convert: convertOmit},
+		"pick":              {nargs: -1, convert: convertPick},
+		"pluck":             {nargs: -1, convert: convertPluck},
+		"unset":             {nargs: 2, convert: convertUnset},
+		"typeIs":            {nargs: 2, convert: convertTypeIs},
+		"deepCopy":          {nargs: 1, convert: convertDeepCopy},
+		"eq":                {nargs: 2, convert: makeConvertCmp(token.EQL)},
+		"ne":                {nargs: 2, convert: makeConvertCmp(token.NEQ)},
+		"lt":                {nargs: 2, convert: makeConvertCmp(token.LSS)},
+		"gt":                {nargs: 2, convert: makeConvertCmp(token.GTR)},
+		"le":                {nargs: 2, convert: makeConvertCmp(token.LEQ)},
+		"ge":                {nargs: 2, convert: makeConvertCmp(token.GEQ)},
+		"concat":            {nargs: -1, convert: convertConcat},
+		"now":               {nargs: 0, convert: convertNow},
+		"randAlphaNum":      {nargs: 1, convert: convertRandString("randAlphaNum")},
+		"randAlpha":         {nargs: 1, convert: convertRandString("randAlpha")},
+		"randNumeric":       {nargs: 1, convert: convertRandString("randNumeric")},
+		"randAscii":         {nargs: 1, convert: convertRandString("randAscii")},
+		"uuidv4":            {nargs: 0, convert: convertUUIDv4},
+		"htpasswd":          {nargs: 2, convert: convertHtpasswd},
+		"dateInZone":        {nargs: 3, convert: convertDateInZone},
+		"htmlDateInZone":    {nargs: 2, convert: convertHTMLDateInZone},
+		"genCA":             {nargs: 2, convert: convertGenCert("genCA")},
+		"genSelfSignedCert": {nargs: 4, convert: convertGenCert("genSelfSignedCert")},
+		"genSignedCert":     {nargs: 5, convert: convertGenCert("genSignedCert")},
+		"genPrivateKey":     {nargs: 1, convert: convertGenPrivateKey},
 	}
 }
 
@@ -335,7 +355,15 @@ func convertTernary(c *converter, args []funcArg) (ast.Expr, string, error) {
 	if len(args) != 3 {
 		return nil, "", fmt.Errorf("ternary requires 3 arguments, got %d", len(args))
 	}
+	// The condition guards the true value, as an if guards its body.
+	var guards map[string]bool
+	if args[2].node != nil {
+		guards = make(map[string]bool)
+		c.collectGuardedPaths(args[2].node, nil, guards)
+	}
+	saved := c.setGuardedPaths(guards)
 	trueVal, trueObj, err := c.resolveExpr(args[0])
+	c.guardedPaths = saved
 	if err != nil {
 		return nil, "", fmt.Errorf("ternary true value: %w", err)
 	}
@@ -397,6 +425,7 @@ func convertDict(c *converter, args []funcArg) (ast.Expr, string, error) {
 	}
 	var helmObj string
 	var fields []ast.Decl
+	keys := make(map[*ast.Field]string)
 	for i := 0; i < len(args); i += 2 {
 		// Key must be a string literal node.
 		keyArg := args[i]
@@ -414,11 +443,22 @@ func convertDict(c *converter, args []funcArg) (ast.Expr, string, error) {
 		if valObj != "" {
 			helmObj = valObj
 		}
-		fields = append(fields, &ast.Field{
+		// A repeated key overwrites the earlier value, as in Go.
+		fields = slices.DeleteFunc(fields, func(d ast.Decl) bool {
+			return keys[d.(*ast.Field)] == keyNode.Text
+		})
+		f := &ast.Field{
 			Label: cueKeyLabel(keyNode.Text),
 			Value: valExpr,
-		})
-	}
+		}
+		keys[f] = keyNode.Text
+		fields = append(fields, f)
+	}
+	// Emit fields in sorted key order: Go maps have no order of their
+	// own, and both range and toYaml visit them sorted by key.
+	slices.SortStableFunc(fields, func(a, b ast.Decl) int {
+		return strings.Compare(keys[a.(*ast.Field)], keys[b.(*ast.Field)])
+	})
 	return &ast.StructLit{Elts: fields}, helmObj, nil
 }
 
@@ -525,6 +565,72 @@ func convertCoalesce(c *converter, args []funcArg) (ast.Expr, string, error) {
 	return indexExpr(&ast.ListLit{Elts: elems}, cueInt(0)), helmObj, nil
 }
 
+// convertAnd converts and in a value position, where it returns its
+// first empty argument, or its last.
+func convertAnd(c *converter, args []funcArg) (ast.Expr, string, error) {
+	return convertAndOr(c, "and", args)
+}
+
+// convertOr converts or in a value position, where it returns its first
+// non-empty argument, or its last.
+func convertOr(c *converter, args []funcArg) (ast.Expr, string, error) {
+	return convertAndOr(c, "or", args)
+}
+
+// convertAndOr selects among the arguments of and or or with
+// _nonzero guards. Like Go's, the selection short-circuits: the list
+// is indexed, so arguments after the one chosen are not evaluated, and
+// none of them is required to be set.
+func convertAndOr(c *converter, name string, args []funcArg) (ast.Expr, string, error) {
+	if len(args) < 1 {
+		return nil, "", fmt.Errorf("%s requires at least 1 argument", name)
+	}
+	c.hasConditions = true
+	saved := c.suppressRequired
+	c.suppressRequired = true
+	defer func() { c.suppressRequired = saved }()
+	var helmObj string
+	var elems []ast.Expr
+	for i, a := range args {
+		e, obj, err := c.resolveExpr(a)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s argument: %w", name, err)
+		}
+		if obj != "" {
+			helmObj = obj
+		}
+		// A reference returned as the last argument, or as an empty
+		// argument of and, may be unset. It is then null, as in Helm.
+		orNull := func(e ast.Expr) ast.Expr {
+			if obj == "" {
+				return e
+			}
+			return parenExpr(&ast.BinaryExpr{
+				X:  &ast.UnaryExpr{Op: token.MUL, X: e},
+				Op: token.OR,
+				Y:  ast.NewIdent("null"),
+			})
+		}
+		if i == len(args)-1 {
+			elems = append(elems, orNull(e))
+			break
+		}
+		condExpr, err := c.resolveCondition(a)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s condition: %w", name, err)
+		}
+		if name == "and" {
+			condExpr = negExpr(parenExpr(condExpr))
+			e = orNull(e)
+		}
+		elems = append(elems, &ast.Comprehension{
+			Clauses: []ast.Clause{&ast.IfClause{Condition: condExpr}},
+			Value:   &ast.StructLit{Elts: []ast.Decl{&ast.EmbedDecl{Expr: e}}},
+		})
+	}
+	return indexExpr(&ast.ListLit{Elts: elems}, cueInt(0)), helmObj, nil
+}
+
 func convertMax(c *converter, args []funcArg) (ast.Expr, string, error) {
 	if len(args) < 2 {
 		return nil, "", fmt.Errorf("max requires at least 2 arguments, got %d", len(args))
@@ -577,21 +683,61 @@ func convertTpl(c *converter, args []funcArg) (ast.Expr, string, error) {
 		tmplObj = tmplArg.obj
 	}
 
+	// The template runs with the context argument as dot. The root
+	// context is _tplContext, which maps each context object, as Helm
+	// passes it; any other context, such as dot in a range, is passed
+	// as it is.
+	var dot ast.Expr
 	if ctxArg.node != nil {
-		c.convertTplContext(ctxArg.node)
+		var err error
+		if dot, err = c.convertTplContext(ctxArg.node); err != nil {
+			return nil, "", fmt.Errorf("tpl context argument: %w", err)
+		}
 	} else {
 		// Pre-resolved context from pipeline — still mark all context objects.
 		for helmObj := range c.config.ContextObjects {
 			c.usedContextObjects[helmObj] = true
 		}
 	}
+	data := dot
+	if data == nil {
+		h := c.tplContextDef()
+		c.usedHelpers[h.Name] = h
+		data = ast.NewIdent("_tplContext")
+	}
 
 	c.addImport("encoding/yaml")
 	c.addImport("text/template")
-	h := c.tplContextDef()
-	c.usedHelpers[h.Name] = h
-	expr := importCall("encoding/yaml", "Unmarshal",
-		importCall("text/template", "Execute", tmplExpr, ast.NewIdent("_tplContext")))
+	var expr ast.Expr = importCall("encoding/yaml", "Unmarshal",
+		importCall("text/template", "Execute", tmplExpr, data))
+
+	// A values path whose default is a template string is converted
+	// now, so that Helm and Sprig functions in it are supported. The
+	// runtime path is kept for values that override the default, and
+	// for templates that produce YAML structure.
+	if tmplArg.node != nil {
+		if text, ok := c.tplDefaultText(tmplArg.node); ok {
+			def, err := c.convertTplDefault(text, dot)
+			switch {
+			case errors.Is(err, errTplYAML):
+			case err != nil:
+				return nil, "", fmt.Errorf("tpl default of %s: %w", tmplArg.node, err)
+			default:
+				expr = &ast.IndexExpr{
+					X: &ast.ListLit{Elts: []ast.Expr{
+						&ast.Comprehension{
+							Clauses: []ast.Clause{&ast.IfClause{
+								Condition: binOp(token.EQL, cloneExpr(tmplExpr), cueString(text)),
+							}},
+							Value: &ast.StructLit{Elts: []ast.Decl{&ast.EmbedDecl{Expr: def}}},
+						},
+						expr,
+					}},
+					Index: cueInt(0),
+				}
+			}
+		}
+	}
 	var helmObj string
 	if tmplObj != "" {
 		helmObj = tmplObj
@@ -650,16 +796,67 @@ func convertDig(c *converter, args []funcArg) (ast.Expr, string, error) {
 }
 
 func convertOmit(c *converter, args []funcArg) (ast.Expr, string, error) {
+	return convertKeyFilter(c, args, "omit", "_omit", omitDef)
+}
+
+// convertPick handles Sprig's pick function: pick $dict "k1" "k2" ...
+// returns a dict containing only the listed keys.
+func convertPick(c *converter, args []funcArg) (ast.Expr, string, error) {
+	return convertKeyFilter(c, args, "pick", "_pick", pickDef)
+}
+
+// convertUnset handles Sprig's unset function: unset $dict "key".
+// CUE values are immutable, so the result is the dict with the key
+// omitted. When the dict is a local variable, the variable is rebound
+// to the result so that later references observe the removal, as
+// with the in-place mutation in Go.
+func convertUnset(c *converter, args []funcArg) (ast.Expr, string, error) {
+	// unset changes the map in place. Only maps held in local variables
+	// can follow the change; the values and other context objects are
+	// fixed inputs in CUE.
+	var name string
+	switch n := args[0].node.(type) {
+	case nil:
+		if args[0].obj != "" {
+			return nil, "", fmt.Errorf("unset of .%s: only maps held in local variables can be changed", args[0].obj)
+		}
+	case *parse.FieldNode, *parse.ChainNode, *parse.DotNode:
+		return nil, "", fmt.Errorf("unset of %s: only maps held in local variables can be changed", n)
+	case *parse.VariableNode:
+		if len(n.Ident) != 1 || n.Ident[0] == "$" {
+			return nil, "", fmt.Errorf("unset of %s: only maps held in local variables can be changed", n)
+		}
+		name = n.Ident[0]
+		if lf, ok := c.localVarFields[name]; ok && lf.expr == c.localVars[name] {
+			return nil, "", fmt.Errorf("unset of %s: it holds %s, which cannot be changed", n, lf.field)
+		}
+	}
+	expr, helmObj, err := convertKeyFilter(c, args, "unset", "_omit", omitDef)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, ok := c.localVars[name]; ok {
+		if err := c.rebindVar(name, expr); err != nil {
+			return nil, "", fmt.Errorf("unset: %w", err)
+		}
+	}
+	return expr, helmObj, nil
+}
+
+// convertKeyFilter converts a dict function whose first argument is
+// the map and whose remaining arguments are keys, into a helper
+// unification (helper & {#arg: map, #<fn>: [keys]}).
+func convertKeyFilter(c *converter, args []funcArg, fn, helperName, helperDef string) (ast.Expr, string, error) {
 	if len(args) < 2 {
-		return nil, "", fmt.Errorf("omit requires at least 2 arguments, got %d", len(args))
+		return nil, "", fmt.Errorf("%s requires at least 2 arguments, got %d", fn, len(args))
 	}
-	// First arg is the map, remaining are keys to omit.
+	// First arg is the map, remaining are the keys.
 	mapArg := args[0]
 	keyArgs := args[1:]
 
 	mapExpr, helmObj, err := c.resolveExpr(mapArg)
 	if err != nil {
-		return nil, "", fmt.Errorf("omit map argument: %w", err)
+		return nil, "", fmt.Errorf("%s map argument: %w", fn, err)
 	}
 	if helmObj != "" {
 		refs := c.fieldRefs[helmObj]
@@ -672,23 +869,58 @@ func convertOmit(c *converter, args []funcArg) (ast.Expr, string, error) {
 	for _, ka := range keyArgs {
 		keyExpr, err := c.resolveLiteral(ka)
 		if err != nil {
-			return nil, "", fmt.Errorf("omit key argument: %w", err)
+			return nil, "", fmt.Errorf("%s key argument: %w", fn, err)
 		}
 		keyElts = append(keyElts, keyExpr)
 	}
 	keyList := &ast.ListLit{Elts: keyElts}
 
 	c.addImport("list")
-	c.usedHelpers["_omit"] = HelperDef{
-		Name: "_omit", Def: omitDef, Imports: []string{"list"},
+	c.usedHelpers[helperName] = HelperDef{
+		Name: helperName, Def: helperDef, Imports: []string{"list"},
 	}
-	expr := parenExpr(binOp(token.AND, ast.NewIdent("_omit"), compactStruct(
+	keyLabel := "#" + strings.TrimPrefix(helperName, "_")
+	expr := parenExpr(binOp(token.AND, ast.NewIdent(helperName), compactStruct(
 		&ast.Field{Label: ast.NewIdent("#arg"), Value: mapExpr},
-		&ast.Field{Label: ast.NewIdent("#omit"), Value: keyList},
+		&ast.Field{Label: ast.NewIdent(keyLabel), Value: keyList},
 	)))
 	return expr, helmObj, nil
 }
 
+// convertPluck handles Sprig's pluck function: pluck "key" $d1 $d2 ...
+// returns the list of values for key from each dict that has it.
+func convertPluck(c *converter, args []funcArg) (ast.Expr, string, error) {
+	if len(args) < 2 {
+		return nil, "", fmt.Errorf("pluck requires at least 2 arguments, got %d", len(args))
+	}
+	keyExpr, err := c.resolveLiteral(args[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("pluck key argument: %w", err)
+	}
+	var helmObj string
+	var dicts []ast.Expr
+	for i, a := range args[1:] {
+		e, obj, err := c.resolveExpr(a)
+		if err != nil {
+			return nil, "", fmt.Errorf("pluck dict argument %d: %w", i, err)
+		}
+		if obj != "" {
+			helmObj = obj
+			refs := c.fieldRefs[obj]
+			if len(refs) > 0 {
+				c.trackNonScalarRef(obj, refs[len(refs)-1])
+			}
+		}
+		dicts = append(dicts, e)
+	}
+	c.usedHelpers["_pluck"] = HelperDef{Name: "_pluck", Def: pluckDef}
+	expr := helperOutExpr("_pluck",
+		&ast.Field{Label: ast.NewIdent("#key"), Value: keyExpr},
+		&ast.Field{Label: ast.NewIdent("#dicts"), Value: &ast.ListLit{Elts: dicts}},
+	)
+	return expr, helmObj, nil
+}
+
 // convertMerge handles Sprig's merge function: merge dst src1 src2 ...
 // The destination (first arg) wins over sources. We chain pairwise
 // _merge helpers for each source argument.
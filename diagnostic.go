@@ -0,0 +1,345 @@
+// Copyright 2026 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm2cue
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template/parse"
+
+	cueerrors "cuelang.org/go/cue/errors"
+)
+
+// Severity is the severity of a Diagnostic.
+type Severity string
+
+const (
+	// SeverityWarning is a problem that conversion worked around, for
+	// example by skipping a template.
+	SeverityWarning Severity = "warning"
+
+	// SeverityError is a problem that makes conversion fail.
+	SeverityError Severity = "error"
+)
+
+// Diagnostic codes. They are stable, so that tools can aggregate
+// diagnostics across conversions.
+const (
+	// CodeParseError is a template that text/template cannot parse.
+	CodeParseError = "parse-error"
+
+	// CodeUnsupportedFunc is a template function with no conversion.
+	CodeUnsupportedFunc = "unsupported-func"
+
+	// CodeUnsupportedConstruct is any other template construct the
+	// converter does not handle.
+	CodeUnsupportedConstruct = "unsupported-construct"
+
+	// CodeHelperConflict is a helper that is defined or used in ways
+	// that cannot all be converted.
+	CodeHelperConflict = "helper-conflict"
+
+	// CodeInvalidCUE is a converted template whose CUE does not
+	// compile.
+	CodeInvalidCUE = "invalid-cue"
+
+	// CodeSchemaConflict is a values schema that templates constrain
+	// inconsistently.
+	CodeSchemaConflict = "schema-conflict"
+
+	// CodeSchemaMismatch is a values.yaml that does not satisfy the
+	// values schema inferred from the templates.
+	CodeSchemaMismatch = "schema-mismatch"
+
+	// CodeReadError is a chart file that cannot be read.
+	CodeReadError = "read-error"
+
+	// CodeFuncWarning is a warning reported by a PipelineFunc's
+	// ConvertContext hook.
+	CodeFuncWarning = "func-warning"
+)
+
+// codeHints holds the hint for each diagnostic code that has one.
+var codeHints = map[string]string{
+	CodeUnsupportedFunc:      "add a conversion for the function to Config.Funcs, or avoid it in the template",
+	CodeUnsupportedConstruct: "see the README's conversion mapping for the supported forms",
+	CodeHelperConflict:       "split the helper into one helper per use, or make its call sites agree",
+	CodeInvalidCUE:           "this is a converter bug; please report it with the template",
+	CodeSchemaConflict:       "templates use this value as different kinds of data",
+	CodeSchemaMismatch:       "values.yaml does not match how the templates use this value",
+}
+
+// Diagnostic describes a problem found while converting a template or
+// chart.
+type Diagnostic struct {
+	Severity Severity `json:"severity"`
+	Code     string   `json:"code"`
+
+	// File is the file the problem is in. For charts it is relative
+	// to the chart directory, as in templates/deployment.yaml. For
+	// ConvertTemplate it is empty for the template itself and helperN
+	// for the Nth helper argument.
+	File string `json:"file,omitempty"`
+
+	// Line and Column give the 1-based position in File of the
+	// offending construct, if known.
+	Line   int `json:"line,omitempty"`
+	Column int `json:"column,omitempty"`
+
+	// Construct is the template text of the offending construct, such
+	// as {{ lookup "v1" "Secret" "ns" "name" }}.
+	Construct string `json:"construct,omitempty"`
+
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// String formats d as file:line:column: severity: message [code].
+func (d Diagnostic) String() string {
+	var b strings.Builder
+	if d.File != "" {
+		b.WriteString(d.File)
+		if d.Line > 0 {
+			fmt.Fprintf(&b, ":%d", d.Line)
+			if d.Column > 0 {
+				fmt.Fprintf(&b, ":%d", d.Column)
+			}
+		}
+		b.WriteString(": ")
+	}
+	fmt.Fprintf(&b, "%s: %s [%s]", d.Severity, d.Message, d.Code)
+	return b.String()
+}
+
+// compareDiagnostics orders diagnostics by file, position and message.
+func compareDiagnostics(a, b Diagnostic) int {
+	return cmp.Or(
+		cmp.Compare(a.File, b.File),
+		cmp.Compare(a.Line, b.Line),
+		cmp.Compare(a.Column, b.Column),
+		cmp.Compare(a.Message, b.Message),
+		cmp.Compare(a.Code, b.Code),
+	)
+}
+
+// sortDiagnostics sorts diags with compareDiagnostics and removes
+// duplicates, as when a helper fails in the same way for several
+// templates.
+func sortDiagnostics(diags []Diagnostic) []Diagnostic {
+	slices.SortFunc(diags, compareDiagnostics)
+	return slices.Compact(diags)
+}
+
+// nodeError is an error converting a template node. It records the
+// innermost node being converted when the error arose, so that its
+// position can be reported.
+type nodeError struct {
+	node parse.Node
+	err  error
+}
+
+func (e *nodeError) Error() string { return e.err.Error() }
+func (e *nodeError) Unwrap() error { return e.err }
+
+// atNode attributes err to node, unless it is nil or already
+// attributed to a node nested inside it.
+func atNode(node parse.Node, err error) error {
+	var ne *nodeError
+	if err == nil || errors.As(err, &ne) {
+		return err
+	}
+	return &nodeError{node: node, err: err}
+}
+
+// parseErrorRe matches the position in a text/template parse error.
+var parseErrorRe = regexp.MustCompile(`^template: ([^:]+):(\d+):`)
+
+// newDiagnostic returns a diagnostic with the given message for err,
+// taking its code and position from err, for a template converted with
+// cfg. The File of the result is the parse name of the template; see
+// resolveDiagnosticFiles.
+func newDiagnostic(cfg *Config, sev Severity, message string, err error) Diagnostic {
+	d := Diagnostic{
+		Severity: sev,
+		Code:     diagnosticCode(err),
+		Message:  message,
+	}
+	d.Hint = codeHints[d.Code]
+	var ne *nodeError
+	if errors.As(err, &ne) {
+		d.setNode(cfg, ne.node)
+	} else if m := parseErrorRe.FindStringSubmatch(err.Error()); m != nil {
+		d.File = m[1]
+		d.Line, _ = strconv.Atoi(m[2])
+	}
+	return d
+}
+
+// setNode sets the position and construct of d to those of node, in a
+// template converted with cfg. The File is the parse name of node's
+// template.
+func (d *Diagnostic) setNode(cfg *Config, node parse.Node) {
+	location, _ := (&parse.Tree{}).ErrorContext(node)
+	// location is name:line:byte, the byte offset 0-based.
+	if i := strings.LastIndex(location, ":"); i >= 0 {
+		col, _ := strconv.Atoi(location[i+1:])
+		location = location[:i]
+		if j := strings.LastIndex(location, ":"); j >= 0 {
+			d.Line, _ = strconv.Atoi(location[j+1:])
+			d.File = location[:j]
+			d.Column = col + 1
+		}
+	}
+	left, right := cfg.delims()
+	d.Construct = nodeConstruct(node, left, right)
+}
+
+// codeError is an error with the diagnostic code it is reported with.
+type codeError struct {
+	code string
+	err  error
+}
+
+func (e *codeError) Error() string { return e.err.Error() }
+func (e *codeError) Unwrap() error { return e.err }
+
+// withCode returns err with the diagnostic code code.
+func withCode(code string, err error) error {
+	return &codeError{code: code, err: err}
+}
+
+// codeErrorf is like fmt.Errorf, returning an error with the
+// diagnostic code code.
+func codeErrorf(code, format string, args ...any) error {
+	return withCode(code, fmt.Errorf(format, args...))
+}
+
+// diagnosticCode classifies a conversion error by the code of the
+// outermost codeError in its chain. Errors without one are
+// unsupported constructs.
+func diagnosticCode(err error) string {
+	var ce *codeError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	return CodeUnsupportedConstruct
+}
+
+// nodeConstruct returns the template text of node, with only the
+// opening action of control structures, written with the delimiters
+// left and right.
+func nodeConstruct(node parse.Node, left, right string) string {
+	var s string
+	switch n := node.(type) {
+	case *parse.IfNode:
+		s = left + "if " + n.Pipe.String() + right
+	case *parse.RangeNode:
+		s = left + "range " + n.Pipe.String() + right
+	case *parse.WithNode:
+		s = left + "with " + n.Pipe.String() + right
+	case *parse.TextNode:
+		return ""
+	default:
+		// The parse package writes actions with the default
+		// delimiters.
+		s = node.String()
+		if inner, ok := strings.CutPrefix(s, "{{"); ok {
+			if inner, ok := strings.CutSuffix(inner, "}}"); ok {
+				s = left + inner + right
+			}
+		}
+	}
+	const maxLen = 100
+	if len(s) > maxLen {
+		s = s[:maxLen] + "..."
+	}
+	return s
+}
+
+// cueDiagnostics returns a diagnostic for each error in a CUE error
+// list, in file unless the error is positioned in values.yaml.
+func cueDiagnostics(sev Severity, code, file string, err error) []Diagnostic {
+	var diags []Diagnostic
+	for _, e := range cueerrors.Errors(err) {
+		d := Diagnostic{
+			Severity: sev,
+			Code:     code,
+			File:     file,
+			Message:  e.Error(),
+			Hint:     codeHints[code],
+		}
+		for _, pos := range cueerrors.Positions(e) {
+			if pos.Filename() == "values.yaml" {
+				d.File = "values.yaml"
+				d.Line = pos.Line()
+				d.Column = pos.Column()
+				break
+			}
+		}
+		diags = append(diags, d)
+	}
+	return diags
+}
+
+// resolveDiagnosticFiles replaces the template parse names in the File
+// of diags, as set by newDiagnostic, with file names, adding the line
+// offset of a document's parse name to its lines. A position in a
+// template that is not in files, such as a tpl argument, is dropped.
+func resolveDiagnosticFiles(diags []Diagnostic, files map[string]string, lineOffsets map[string]int) {
+	for i := range diags {
+		d := &diags[i]
+		f, ok := files[d.File]
+		switch {
+		case !ok && d.Line > 0:
+			d.File, d.Line, d.Column = "", 0, 0
+		case ok:
+			if d.Line > 0 {
+				d.Line += lineOffsets[d.File]
+			}
+			d.File = f
+		}
+	}
+}
+
+// docLineOffsets returns, for each document of content, the number of
+// lines of content before it. A document is found by its first line
+// that is not blank; one that cannot be found has offset 0.
+func docLineOffsets(content []byte, docs [][]byte) []int {
+	offsets := make([]int, len(docs))
+	from := 0
+	for i, doc := range docs {
+		lines := strings.Split(string(doc), "\n")
+		k := slices.IndexFunc(lines, func(line string) bool {
+			return strings.TrimSpace(line) != ""
+		})
+		if k < 0 {
+			continue
+		}
+		first := lines[k]
+		j := strings.Index(string(content[from:]), first)
+		if j < 0 {
+			continue
+		}
+		// Line k+1 of the document is the line after those before j.
+		offsets[i] = max(strings.Count(string(content[:from+j]), "\n")-k, 0)
+		from += j + len(first)
+	}
+	return offsets
+}
@@ -211,31 +211,49 @@
 // position tracking can be imprecise in complex templates).
 //
 // When a helper is used in multiple call sites with different inferred
-// types:
+// types, the helper is converted in the first type it is needed in and
+// handleInclude binds later call sites that need the other type to a
+// second form of it (helperForm), emitted next to the helper:
 //
-//   - Strong–strong conflict: the converter reports an error (the
-//     template is skipped). This catches genuine incompatibilities,
-//     e.g. a helper piped to both join and quote:
+//	labels:
+//	  {{- include "app.labels" . | nindent 4 }}           {{/* struct */}}
+//	checksum: {{ include "app.labels" . | sha256sum }}   {{/* scalar, strong */}}
 //
-//     items: {{ include "my.items" . | join "," }}  {{/* struct, strong */}}
-//     label: {{ include "my.items" . | quote }}     {{/* scalar, strong */}}
+// becomes
 //
-//     These two uses are fundamentally incompatible — the helper
-//     cannot be both a struct (for join) and a scalar (for quote) in
-//     CUE. The converter errors with "conflicting contexts".
+//	_app_labels: {app: #values.name}
+//	_app_labels_text: strings.TrimRight(yaml.Marshal(_app_labels), "\n")
 //
-//   - Weak conflict (at least one side is position-inferred): the
-//     converter emits a warning and proceeds with first-encounter-wins.
-//     This avoids false positives from imprecise position tracking while
-//     still surfacing the ambiguity for the user. For example, a helper
-//     first seen at mapping level (struct, weak) then seen in a "key:
-//     value" context (scalar, weak) uses the struct conversion from the
-//     first encounter and warns about the discrepancy.
+// A text form is the body converted as text when it is text with
+// actions, and otherwise the YAML encoding of the struct form, which
+// is what Helm renders for a body of YAML fields. A struct form is the
+// body converted as a struct. Only if the second form cannot be
+// converted does a conflict remain: strong–strong conflicts are then
+// reported as "conflicting contexts" errors, and conflicts with a weak
+// side as warnings, keeping the first conversion.
 //
 // The first-encounter-wins strategy means helper conversion order
 // matters. Helpers are converted on first include during the Phase 1
 // AST walk, which follows template source order. A later call site
-// with a different (weak) type does not trigger reconversion.
+// with a different type binds to a second form rather than triggering
+// reconversion, so the helper's own name holds the first type.
+//
+// # Reconciling helpers across templates
+//
+// Each template of a chart, and each document of a multi-document
+// template, is converted by its own converter, so one helper may be
+// converted several times with different types. reconcileHelpers merges
+// these conversions. The first conversion of a helper fixes the type of
+// its own name; in a template that converted it with the other type,
+// the two names are swapped (renameResultIdents), so its call sites
+// bind to the form of the type they need and its own conversion becomes
+// that form, shared by every template. Conversions of one type that
+// differ only in the #arg schema are unified into their conjunction.
+// Any other difference is a genuine conflict between call sites and is
+// reported as a warning naming the helper and both templates. The later
+// template then gets its own copy of the helper (_name_2, and so on),
+// holding its own conversion; helpers that include the copied helper
+// are copied in turn, since their references to it now differ.
 //
 // # Scalar conversion tiers
 //
@@ -282,21 +300,33 @@
 // Struct conversion (convertDeferredHelperAsStruct) always uses the
 // general converter (convertHelperBody / processNodes).
 //
+// # Recursive helpers
+//
+// A helper that includes itself, directly or through other helpers,
+// cannot be a single CUE hidden field: the reference would be a
+// structural cycle. While a helper is being converted it is marked in
+// helperConverting, so an include of it from its own body records the
+// reference without converting it again. When helpers are emitted,
+// unrollRecursiveHelpers finds the cycles among their references and
+// copies each helper in a cycle once per level, up to
+// Config.MaxHelperDepth:
+//
+//	_tree:   {... _tree_1 & {#arg: v, _} ...}
+//	_tree_1: {... _tree_2 & {#arg: v, _} ...}
+//	...
+//	_tree_8: {#arg?: _, if #arg != _|_ {error("...")}}
+//
+// The last level fails only when a call reaches it, so data that nests
+// no deeper than the bound evaluates as Helm renders it.
+//
 // # Known limitations and areas for improvement
 //
 // First-encounter-wins for weak signals: the conversion result depends
 // on source order of include call sites. A helper first encountered in
-// a struct-looking position will be converted as struct even if a later
-// call site uses it as scalar. Reordering templates in a chart could
-// change the output. More critically, a strong signal in a later-
-// processed template is lost if a weak signal from an earlier template
-// already triggered conversion.
-//
-// Same helper, genuinely dual-use: some charts use the same helper as
-// both structured output and scalar text in different templates. The
-// converter cannot split a single helper into two CUE definitions.
-// Users must refactor such helpers into separate definitions or accept
-// the warning.
+// a struct-looking position will be converted as struct, and a later
+// call site that uses it as scalar binds to its text form. Reordering
+// templates in a chart could change which form holds the helper's own
+// name, though not what any call site evaluates to.
 //
 // Position tracking precision: the YAML position heuristic
 // (isScalarContext) depends on the converter's state machine accurately
@@ -358,4 +388,4 @@
 // the practical impact is smaller.
 //
 // See https://github.com/cue-exp/helm2cue/issues/109 for tracking.
-package main
+package helm2cue
@@ -25,7 +25,7 @@ deployment: [
 					containers: [
 						{
 							name:  _simple_app_name
-							image: "\(#values.image.repository):\(#values.image.tag)"
+							image: "\((_fmtValue & {#in: #values.image.repository}).out):\((_fmtValue & {#in: #values.image.tag}).out)"
 							imagePullPolicy: [if (_nonzero & {#arg: #values.image.pullPolicy}).out {
 								#values.image.pullPolicy
 							}, "IfNotPresent"][0]
@@ -3,8 +3,9 @@
 package simple_app
 
 import (
-	"struct"
+	"strconv"
 	"strings"
+	"struct"
 )
 
 // _nonzero tests whether a value is "truthy" (non-zero,
@@ -25,6 +26,14 @@ _nonzero: {
 	}, false][0]
 }
 
+_fmtValue: {
+	#in!: _
+	out: [
+		if (#in & number) != _|_ {strconv.FormatFloat(#in, 103, -1, 64)},
+		"\(#in)",
+	][0]
+}
+
 // _trunc truncates a string to N runes, matching Helm's
 // trunc semantics where shorter strings pass through.
 // A natural candidate for a CUE standard library builtin.
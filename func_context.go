@@ -0,0 +1,232 @@
+// Copyright 2026 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm2cue
+
+import (
+	"fmt"
+	"text/template/parse"
+
+	"cuelang.org/go/cue/ast"
+)
+
+// FuncContext is the conversion state available to a
+// PipelineFunc.ConvertContext hook.
+type FuncContext struct {
+	c    *converter
+	name string
+	recv int    // index of the receiver, the last argument
+	obj  string // context object of the receiver, once converted
+}
+
+// FuncArg is an argument of a function converted by a ConvertContext
+// hook: a template node, or the already converted value piped into
+// the function.
+type FuncArg struct {
+	a funcArg
+	i int
+}
+
+// Node returns the template node of the argument, or nil if it is a
+// piped value.
+func (a FuncArg) Node() parse.Node {
+	return a.a.node
+}
+
+// FieldRef is a reference to a field of a template context object.
+// For example, .Values.image.tag is
+// FieldRef{Object: "Values", Path: []string{"image", "tag"}}.
+// In a helper body, a reference to a field of the helper's argument,
+// such as .image.tag, has an empty Object.
+type FieldRef struct {
+	Object string
+	Path   []string
+}
+
+// Name returns the name of the function being converted.
+func (ctx *FuncContext) Name() string {
+	return ctx.name
+}
+
+// InCondition reports whether the function is part of the condition of
+// an if or with, rather than a value.
+func (ctx *FuncContext) InCondition() bool {
+	return ctx.c.inCondition
+}
+
+// Expr converts a to a CUE expression. If a is a field reference, it is
+// recorded in the values schema as for {{ .Values.x }}: required, unless
+// a condition guards it. The reference is returned, or nil for other
+// arguments.
+func (ctx *FuncContext) Expr(a FuncArg) (ast.Expr, *FieldRef, error) {
+	c := ctx.c
+	expr, obj, path, err := c.resolveField(a.a)
+	if err != nil {
+		return nil, nil, err
+	}
+	if a.i == ctx.recv {
+		ctx.obj = obj
+	}
+	if obj == "" {
+		if c.helperArgRefs == nil || !exprStartsWithArg(expr) {
+			return expr, nil, nil
+		}
+		path := selectorPath(expr)
+		if isArgIdent(expr) {
+			path = []string{}
+		}
+		if path == nil {
+			return expr, nil, nil
+		}
+		return expr, &FieldRef{Path: path}, nil
+	}
+	if path == nil {
+		return expr, nil, nil
+	}
+	c.usedContextObjects[obj] = true
+	return expr, &FieldRef{Object: obj, Path: path}, nil
+}
+
+// OptionalExpr is like Expr, but does not make a field reference
+// required, as default does for its value.
+func (ctx *FuncContext) OptionalExpr(a FuncArg) (ast.Expr, *FieldRef, error) {
+	saved := ctx.c.suppressRequired
+	ctx.c.suppressRequired = true
+	defer func() { ctx.c.suppressRequired = saved }()
+	return ctx.Expr(a)
+}
+
+// Literal returns a as a CUE literal if it is a constant, such as a
+// string or number.
+func (ctx *FuncContext) Literal(a FuncArg) (ast.Expr, bool) {
+	if a.a.node == nil {
+		return nil, false
+	}
+	lit, err := nodeToCUELiteral(a.a.node)
+	return lit, err == nil
+}
+
+// MarkRequired records ref as required in the values schema, even
+// where a condition guards it.
+func (ctx *FuncContext) MarkRequired(ref FieldRef) {
+	c := ctx.c
+	if ref.Object == "" {
+		if c.helperArgRefs != nil {
+			c.helperArgRefs = append(c.helperArgRefs, ref.Path)
+			c.helperArgRequiredRefs = append(c.helperArgRequiredRefs, ref.Path)
+		}
+		return
+	}
+	path := c.remapFieldPath(ref.Object, ref.Path)
+	c.usedContextObjects[ref.Object] = true
+	c.fieldRefs[ref.Object] = append(c.fieldRefs[ref.Object], path)
+	c.requiredRefs[ref.Object] = append(c.requiredRefs[ref.Object], path)
+}
+
+// MarkNonScalar records that ref may be a struct or list, so that the
+// values schema does not constrain it to a scalar.
+func (ctx *FuncContext) MarkNonScalar(ref FieldRef) {
+	c := ctx.c
+	if ref.Object == "" {
+		if c.helperArgRefs != nil {
+			c.helperArgNonScalarRefs = append(c.helperArgNonScalarRefs, ref.Path)
+		}
+		return
+	}
+	c.trackNonScalarRef(ref.Object, c.remapFieldPath(ref.Object, ref.Path))
+}
+
+// MarkRange records that ref is ranged over, so that the values schema
+// types it as a list or struct.
+func (ctx *FuncContext) MarkRange(ref FieldRef) {
+	c := ctx.c
+	if ref.Object == "" {
+		if c.helperArgRefs != nil {
+			c.helperArgRangeRefs = append(c.helperArgRangeRefs, ref.Path)
+		}
+		return
+	}
+	c.usedContextObjects[ref.Object] = true
+	c.rangeRefs[ref.Object] = append(c.rangeRefs[ref.Object], c.remapFieldPath(ref.Object, ref.Path))
+}
+
+// ImportCall returns a call of the function fn in the CUE package pkg,
+// such as strings.ToLower, and adds pkg to the imports of the output.
+func (ctx *FuncContext) ImportCall(pkg, fn string, args ...ast.Expr) ast.Expr {
+	ctx.c.addImport(pkg)
+	return importCall(pkg, fn, args...)
+}
+
+// AddHelper emits the helper definition h with the output.
+func (ctx *FuncContext) AddHelper(h HelperDef) {
+	ctx.c.usedHelpers[h.Name] = h
+}
+
+// Warnf reports a warning positioned at the template construct being
+// converted, with code CodeFuncWarning.
+func (ctx *FuncContext) Warnf(format string, args ...any) {
+	d := Diagnostic{
+		Severity: SeverityWarning,
+		Code:     CodeFuncWarning,
+		Message:  ctx.name + ": " + fmt.Sprintf(format, args...),
+	}
+	if ctx.c.node != nil {
+		d.setNode(ctx.c.config, ctx.c.node)
+	}
+	ctx.c.warnings = append(ctx.c.warnings, d)
+}
+
+// contextFunc returns a handler for the function name in Config.Funcs
+// if it has a ConvertContext hook.
+func (c *converter) contextFunc(name string) (coreFunc, bool) {
+	pf, ok := c.config.Funcs[name]
+	if !ok || pf.ConvertContext == nil {
+		return coreFunc{}, false
+	}
+	return coreFunc{
+		nargs: -1,
+		convert: func(c *converter, args []funcArg) (ast.Expr, string, error) {
+			fargs := make([]FuncArg, len(args))
+			for i, a := range args {
+				fargs[i] = FuncArg{a, i}
+			}
+			ctx := &FuncContext{c: c, name: name, recv: len(args) - 1}
+			expr, err := pf.ConvertContext(ctx, fargs)
+			if err != nil {
+				return nil, "", err
+			}
+			if expr == nil {
+				return nil, "", fmt.Errorf("function %q has no CUE equivalent and cannot be converted", name)
+			}
+			for _, pkg := range pf.Imports {
+				c.addImport(pkg)
+			}
+			for _, h := range pf.Helpers {
+				c.usedHelpers[h.Name] = h
+			}
+			return expr, ctx.obj, nil
+		},
+	}, true
+}
+
+// funcHandler returns the handler for name if it is a core function
+// enabled by Config.CoreFuncs or a function with a ConvertContext hook.
+// A function in Config.Funcs takes precedence over a core function of
+// the same name (see isCoreFunc).
+func (c *converter) funcHandler(name string) (coreFunc, bool) {
+	if cf, ok := coreFuncs[name]; ok && c.isCoreFunc(name) {
+		return cf, true
+	}
+	return c.contextFunc(name)
+}
@@ -0,0 +1,259 @@
+// Copyright 2026 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm2cue
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/ast/astutil"
+	"cuelang.org/go/cue/cuecontext"
+	cueerrors "cuelang.org/go/cue/errors"
+	"cuelang.org/go/cue/parser"
+	"cuelang.org/go/cue/token"
+	cueyaml "cuelang.org/go/encoding/yaml"
+)
+
+// funcSpecSchema is the schema of a function of a function-mapping
+// file that is given as a struct rather than an expression alone.
+const funcSpecSchema = `close({
+	expr?:        string
+	nargs?:       int & >=0
+	imports?:     [...string]
+	helpers?:     close({[=~"^_"]: string})
+	passthrough?: bool
+	nonScalar?:   bool
+	cosmetic?:    bool
+})`
+
+// funcSpec is a function of a function-mapping file.
+type funcSpec struct {
+	Expr        string            `json:"expr"`
+	Nargs       int               `json:"nargs"`
+	Imports     []string          `json:"imports"`
+	Helpers     map[string]string `json:"helpers"`
+	Passthrough bool              `json:"passthrough"`
+	NonScalar   bool              `json:"nonScalar"`
+	Cosmetic    bool              `json:"cosmetic"`
+}
+
+// LoadFuncs reads a function-mapping file, which maps template function
+// names to CUE expressions, and returns the functions it declares for
+// use in Config.Funcs. The file is CUE if filename ends in .cue, and
+// YAML (or JSON) otherwise. For example:
+//
+//	myPrefix: 'strings.Join(["acme", #in], "-")'
+//	myJoin:
+//	  expr: 'strings.Join(#in, #args[0])'
+//	  nargs: 1
+//	  imports: [strings]
+//
+// In an expression, #in is the piped value and #args[i] the ith
+// explicit argument. A function given as a struct can also set:
+//
+//   - nargs: the number of explicit arguments (default 0);
+//   - imports: the CUE packages the expression and helpers use, by
+//     default encoding/base64, encoding/json, encoding/yaml, list,
+//     math, regexp, strconv and strings;
+//   - helpers: hidden helper definitions to emit when the function is
+//     used, keyed by name, such as _acmeName: '{#in: string, out: ...}';
+//   - passthrough, nonScalar and cosmetic: the PipelineFunc flags.
+//
+// A function with no expression passes its input through unchanged.
+func LoadFuncs(filename string, data []byte) (map[string]PipelineFunc, error) {
+	ctx := cuecontext.New()
+	var v cue.Value
+	if filepath.Ext(filename) == ".cue" {
+		v = ctx.CompileBytes(data, cue.Filename(filename))
+	} else {
+		f, err := cueyaml.Extract(filename, data)
+		if err != nil {
+			return nil, err
+		}
+		v = ctx.BuildFile(f)
+	}
+	iter, err := v.Fields()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	schema := ctx.CompileString(funcSpecSchema)
+	funcs := make(map[string]PipelineFunc)
+	for iter.Next() {
+		name := iter.Selector().Unquoted()
+		var spec funcSpec
+		switch fv := iter.Value(); fv.Kind() {
+		case cue.StringKind:
+			spec.Expr, _ = fv.String()
+		case cue.StructKind:
+			fv = schema.Unify(fv)
+			if err := fv.Validate(cue.Concrete(true)); err != nil {
+				return nil, funcsFileError(filename, name, err)
+			}
+			if err := fv.Decode(&spec); err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", filename, name, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s: %s: want an expression or a struct, got %v", filename, name, fv.Kind())
+		}
+		pf, err := spec.pipelineFunc()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", filename, name, err)
+		}
+		funcs[name] = pf
+	}
+	return funcs, nil
+}
+
+// funcsFileError returns the first error of err, from validating the
+// function name of a function-mapping file, positioned in the file.
+func funcsFileError(filename, name string, err error) error {
+	e := cueerrors.Errors(err)[0]
+	for _, pos := range cueerrors.Positions(e) {
+		if pos.Filename() == filename {
+			return fmt.Errorf("%s:%d:%d: %s: %v", filename, pos.Line(), pos.Column(), name, e)
+		}
+	}
+	return fmt.Errorf("%s: %s: %v", filename, name, e)
+}
+
+// defaultFuncImports are the packages available to a function of a
+// function-mapping file that does not list its imports.
+var defaultFuncImports = []string{
+	"encoding/base64",
+	"encoding/json",
+	"encoding/yaml",
+	"list",
+	"math",
+	"regexp",
+	"strconv",
+	"strings",
+}
+
+// pipelineFunc returns the PipelineFunc that spec describes.
+func (spec funcSpec) pipelineFunc() (PipelineFunc, error) {
+	pf := PipelineFunc{
+		Nargs:       spec.Nargs,
+		Passthrough: spec.Passthrough,
+		NonScalar:   spec.NonScalar,
+		Cosmetic:    spec.Cosmetic,
+	}
+	var used []string // identifiers selected from, as strings in strings.Join
+	collect := func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok {
+				used = append(used, id.Name)
+			}
+		}
+		return true
+	}
+	for _, name := range slices.Sorted(maps.Keys(spec.Helpers)) {
+		def := name + ": " + spec.Helpers[name]
+		decls, err := parseHelperDefDecls(def, nil, false)
+		if err != nil {
+			return PipelineFunc{}, fmt.Errorf("helper %s: %w", name, err)
+		}
+		for _, d := range decls {
+			ast.Walk(d, collect, nil)
+		}
+		pf.Helpers = append(pf.Helpers, HelperDef{Name: name, Def: def})
+	}
+	var expr ast.Expr
+	if spec.Expr != "" {
+		var err error
+		expr, err = parser.ParseExpr("expr", spec.Expr)
+		if err != nil {
+			return PipelineFunc{}, err
+		}
+		var argErr error
+		ast.Walk(expr, func(n ast.Node) bool {
+			if i, ok := funcArgIndex(n); ok && i >= spec.Nargs && argErr == nil {
+				argErr = fmt.Errorf("#args[%d] out of range for nargs %d", i, spec.Nargs)
+			}
+			return collect(n)
+		}, nil)
+		if argErr != nil {
+			return PipelineFunc{}, argErr
+		}
+	}
+	// Import only the packages that are used, so that the default
+	// imports do not all appear in the output.
+	imports := spec.Imports
+	if imports == nil {
+		imports = defaultFuncImports
+	}
+	for _, pkg := range imports {
+		if slices.Contains(used, path.Base(pkg)) {
+			pf.Imports = append(pf.Imports, pkg)
+		}
+	}
+	for i := range pf.Helpers {
+		pf.Helpers[i].Imports = pf.Imports
+	}
+	if expr == nil {
+		return pf, nil
+	}
+	imports = pf.Imports
+	pf.Convert = func(in ast.Expr, args []ast.Expr) ast.Expr {
+		// Parse afresh for each use, as the result becomes part of
+		// the output.
+		expr, _ := parser.ParseExpr("expr", spec.Expr)
+		tagImports(expr, imports)
+		return astutil.Apply(expr, func(c astutil.Cursor) bool {
+			if id, ok := c.Node().(*ast.Ident); ok && id.Name == "#in" {
+				if f, ok := c.Parent().Node().(*ast.Field); ok && f.Label == ast.Label(id) {
+					return true // the label of #in: #in
+				}
+				c.Replace(operandExpr(in))
+			} else if i, ok := funcArgIndex(c.Node()); ok && i < len(args) {
+				c.Replace(operandExpr(args[i]))
+			}
+			return true
+		}, nil).(ast.Expr)
+	}
+	return pf, nil
+}
+
+// funcArgIndex returns i if n is #args[i].
+func funcArgIndex(n ast.Node) (int, bool) {
+	ix, ok := n.(*ast.IndexExpr)
+	if !ok {
+		return 0, false
+	}
+	if id, ok := ix.X.(*ast.Ident); !ok || id.Name != "#args" {
+		return 0, false
+	}
+	lit, ok := ix.Index.(*ast.BasicLit)
+	if !ok || lit.Kind != token.INT {
+		return 0, false
+	}
+	i, err := strconv.Atoi(lit.Value)
+	return i, err == nil
+}
+
+// operandExpr parenthesizes x if it is a binary or unary expression,
+// so that it can replace an operand.
+func operandExpr(x ast.Expr) ast.Expr {
+	switch x.(type) {
+	case *ast.BinaryExpr, *ast.UnaryExpr:
+		return parenExpr(x)
+	}
+	return x
+}
@@ -1,4 +1,4 @@
-package main
+package helm2cue
 
-//go:generate go run . chart ./examples/simple-app/helm ./examples/simple-app/cue
-//go:generate sh -c "go run . template ./examples/standalone/_helpers.tpl ./examples/standalone/config.yaml.tmpl > ./examples/standalone/config.cue"
+//go:generate go run ./cmd/helm2cue chart ./examples/simple-app/helm ./examples/simple-app/cue
+//go:generate sh -c "go run ./cmd/helm2cue template ./examples/standalone/_helpers.tpl ./examples/standalone/config.yaml.tmpl > ./examples/standalone/config.cue"
@@ -0,0 +1,310 @@
+// Copyright 2026 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm2cue
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+	"cuelang.org/go/cue/interpreter/embed"
+	"cuelang.org/go/cue/load"
+)
+
+// GenCertsOptions configures GenCerts.
+type GenCertsOptions struct {
+	// Tags are CUE tags (key=value) used when evaluating #certs, for
+	// example release_name=myrelease when a common name depends on
+	// the release.
+	Tags []string
+
+	// Force regenerates files that already exist.
+	Force bool
+
+	// Logf, if non-nil, receives one line per file written.
+	// If nil, output goes to stderr.
+	Logf func(format string, args ...any)
+}
+
+// certSpec is an entry of the #certs definition written by the
+// converter for each genCA, genSelfSignedCert, genSignedCert and
+// genPrivateKey call.
+type certSpec struct {
+	Kind string   `json:"kind"` // "ca", "selfSigned", "signed" or "key"
+	CN   string   `json:"cn"`
+	IPs  []string `json:"ips"`
+	DNS  []string `json:"dns"`
+	Days int      `json:"days"`
+	CA   string   `json:"ca"`   // name of the signing CA, for "signed"
+	Type string   `json:"type"` // key type, for "key"
+}
+
+// GenCerts creates the certificates and keys described by the #certs
+// definition of the converted CUE module in dir, writing PEM files to
+// dir/certs where inputs.cue embeds them. Existing files are kept
+// unless opts.Force is set, so that certificates signed by a CA stay
+// valid across runs. A signed certificate is always regenerated when
+// its CA is, since the existing one would no longer verify.
+func GenCerts(dir string, opts GenCertsOptions) error {
+	logf := opts.Logf
+	if logf == nil {
+		logf = func(format string, args ...any) {
+			fmt.Fprintf(os.Stderr, format+"\n", args...)
+		}
+	}
+
+	insts := load.Instances([]string{"."}, &load.Config{Dir: dir, Tags: opts.Tags})
+	if err := insts[0].Err; err != nil {
+		return fmt.Errorf("loading %s: %w", dir, err)
+	}
+	ctx := cuecontext.New(cuecontext.Interpreter(embed.New()))
+	v := ctx.BuildInstance(insts[0])
+	certsVal := v.LookupPath(cue.MakePath(cue.Def("certs")))
+	if !certsVal.Exists() {
+		return fmt.Errorf("%s has no #certs definition; nothing to generate", dir)
+	}
+	specs := make(map[string]certSpec)
+	iter, err := certsVal.Fields()
+	if err != nil {
+		return fmt.Errorf("reading #certs: %w", err)
+	}
+	for iter.Next() {
+		var spec certSpec
+		if err := iter.Value().Decode(&spec); err != nil {
+			return fmt.Errorf("#certs.%s: %w", iter.Selector(), err)
+		}
+		specs[iter.Selector().String()] = spec
+	}
+
+	certsDir := filepath.Join(dir, "certs")
+	if err := os.MkdirAll(certsDir, 0o755); err != nil {
+		return err
+	}
+
+	// Signed certificates come last so that their CA is available.
+	names := slices.Sorted(maps.Keys(specs))
+	slices.SortStableFunc(names, func(a, b string) int {
+		return boolCmp(specs[a].Kind == "signed", specs[b].Kind == "signed")
+	})
+
+	cas := make(map[string]*issuer)
+	regenerated := make(map[string]bool) // CAs written by this run
+	for _, name := range names {
+		spec := specs[name]
+		certPath := filepath.Join(certsDir, name+".crt")
+		keyPath := filepath.Join(certsDir, name+".key")
+
+		if spec.Kind == "key" {
+			if !opts.Force && fileExists(keyPath) {
+				continue
+			}
+			keyPEM, err := genPrivateKeyPEM(spec.Type)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+				return err
+			}
+			logf("wrote %s", keyPath)
+			continue
+		}
+
+		stale := spec.Kind == "signed" && regenerated[spec.CA]
+		if !opts.Force && !stale && fileExists(certPath) && fileExists(keyPath) {
+			if spec.Kind == "ca" {
+				ca, err := loadIssuer(certPath, keyPath)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				cas[name] = ca
+			}
+			continue
+		}
+
+		var parent *issuer
+		if spec.Kind == "signed" {
+			parent = cas[spec.CA]
+			if parent == nil {
+				return fmt.Errorf("%s: unknown CA %q", name, spec.CA)
+			}
+		}
+		cert, key, err := genCert(spec, parent)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if spec.Kind == "ca" {
+			cas[name] = &issuer{cert: cert, key: key}
+			regenerated[name] = true
+		}
+		keyDER := x509.MarshalPKCS1PrivateKey(key)
+		if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o644); err != nil {
+			return err
+		}
+		if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+			return err
+		}
+		logf("wrote %s, %s", certPath, keyPath)
+	}
+	return nil
+}
+
+// issuer is a CA certificate and key used to sign other certificates.
+type issuer struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+}
+
+// genCert creates a certificate with a fresh 2048-bit RSA key, as
+// Sprig does. It is self-signed unless parent is non-nil.
+func genCert(spec certSpec, parent *issuer) (*x509.Certificate, *rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: spec.CN},
+		DNSNames:              spec.DNS,
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(24 * time.Hour * time.Duration(spec.Days)),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, s := range spec.IPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+	}
+	if spec.Kind == "ca" {
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		tmpl.IsCA = true
+	}
+	signer, signerKey := tmpl, crypto.Signer(key)
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// genPrivateKeyPEM creates a PEM-encoded private key of the given type,
+// matching Sprig's genPrivateKey.
+func genPrivateKeyPEM(typ string) ([]byte, error) {
+	var block *pem.Block
+	switch typ {
+	case "", "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, 4096)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case "ecdsa":
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", typ)
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// loadIssuer reads a CA certificate and RSA key written by GenCerts.
+func loadIssuer(certPath, keyPath string) (*issuer, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, fmt.Errorf("no PEM data in %s or %s", certPath, keyPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &issuer{cert: cert, key: key}, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+func boolCmp(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+	return -1
+}
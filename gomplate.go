@@ -0,0 +1,352 @@
+// Copyright 2026 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm2cue
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"text/template/parse"
+
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/format"
+)
+
+// GomplateConfig returns a Config for converting gomplate templates.
+// The environment, .Env, becomes #env, whose variables default to the
+// empty string, and the data of each datasource
+// read with datasource (or ds) becomes a field of #datasources. The
+// functions of gomplate's strings, conv, coll, data, env, test and tmpl
+// namespaces that have CUE equivalents are converted, along with their
+// unnamespaced aliases, such as getenv for env.Getenv.
+//
+// gomplate's include, which inserts the raw content of a datasource,
+// is not supported: include is Helm's, converted as tmpl.Exec.
+func GomplateConfig() *Config {
+	helm := HelmConfig().Funcs
+	funcs := map[string]PipelineFunc{
+		"datasource":  {ConvertContext: convertDatasource},
+		"env.Getenv":  {ConvertContext: convertGetenv},
+		"tmpl.Inline": {ConvertContext: convertTmplInline},
+
+		"strings.Contains":   helm["contains"],
+		"strings.HasPrefix":  helm["hasPrefix"],
+		"strings.HasSuffix":  helm["hasSuffix"],
+		"strings.Indent":     helm["indent"],
+		"strings.Quote":      helm["quote"],
+		"strings.ReplaceAll": helm["replace"],
+		"strings.Split":      helm["splitList"],
+		"strings.Squote":     helm["squote"],
+		"strings.Title":      helm["title"],
+		"strings.ToLower":    helm["lower"],
+		"strings.ToUpper":    helm["upper"],
+		"strings.TrimPrefix": helm["trimPrefix"],
+		"strings.TrimSpace":  helm["trim"],
+		"strings.TrimSuffix": helm["trimSuffix"],
+		"strings.Trunc":      helm["trunc"],
+		"strings.Repeat": {
+			Nargs:   1,
+			Imports: []string{"strings"},
+			Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
+				return importCall("strings", "Repeat", expr, args[0])
+			},
+		},
+		"strings.Trim": {
+			Nargs:   1,
+			Imports: []string{"strings"},
+			Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
+				return importCall("strings", "Trim", expr, args[0])
+			},
+		},
+
+		"conv.Atoi":     helm["atoi"],
+		"conv.ToString": helm["toString"],
+		"conv.ToInt": {
+			Helpers: convToIntHelpers,
+			Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+				return helperOutExpr("_convToInt", &ast.Field{Label: ast.NewIdent("#in"), Value: expr})
+			},
+		},
+		"conv.ToInts": {ConvertContext: convertToInts, Helpers: convToIntHelpers},
+		"conv.ToFloat64": {
+			Helpers: []HelperDef{convToFloat64Helper},
+			Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+				return helperOutExpr("_convToFloat64", &ast.Field{Label: ast.NewIdent("#in"), Value: expr})
+			},
+		},
+		// conv.Join takes its list first, so the piped value, which
+		// text/template passes last, is the separator.
+		"conv.Join": {
+			Nargs:     1,
+			NonScalar: true,
+			Imports:   []string{"strings"},
+			Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
+				return importCall("strings", "Join", args[0], expr)
+			},
+		},
+
+		"coll.Keys":   helm["keys"],
+		"coll.Values": helm["values"],
+
+		"data.JSON":         helm["fromJson"],
+		"data.ToJSON":       helm["toJson"],
+		"data.ToJSONPretty": helm["toPrettyJson"],
+		"data.ToYAML":       helm["toYaml"],
+		"data.YAML":         helm["fromYaml"],
+	}
+	return &Config{
+		ContextObjects: map[string]string{
+			"Env":         "#env",
+			"Datasources": "#datasources",
+		},
+		StringMapObjects: []string{"Env"},
+		Funcs:            funcs,
+		FuncAliases: map[string]string{
+			"coll.Dict":     "dict",
+			"coll.Has":      "hasKey",
+			"coll.Merge":    "merge",
+			"coll.Slice":    "list",
+			"conv.Default":  "default",
+			"test.Fail":     "fail",
+			"test.Required": "required",
+			"test.Ternary":  "ternary",
+			"tmpl.Exec":     "include",
+
+			"contains":     "strings.Contains",
+			"ds":           "datasource",
+			"getenv":       "env.Getenv",
+			"has":          "hasKey",
+			"hasPrefix":    "strings.HasPrefix",
+			"hasSuffix":    "strings.HasSuffix",
+			"indent":       "strings.Indent",
+			"join":         "conv.Join",
+			"json":         "data.JSON",
+			"keys":         "coll.Keys",
+			"quote":        "strings.Quote",
+			"slice":        "list",
+			"split":        "strings.Split",
+			"squote":       "strings.Squote",
+			"title":        "strings.Title",
+			"toJSON":       "data.ToJSON",
+			"toJSONPretty": "data.ToJSONPretty",
+			"toLower":      "strings.ToLower",
+			"toUpper":      "strings.ToUpper",
+			"toYAML":       "data.ToYAML",
+			"trimSpace":    "strings.TrimSpace",
+			"values":       "coll.Values",
+			"yaml":         "data.YAML",
+		},
+		CoreFuncs: map[string]bool{
+			"printf":   true,
+			"print":    true,
+			"eq":       true,
+			"ne":       true,
+			"lt":       true,
+			"gt":       true,
+			"le":       true,
+			"ge":       true,
+			"and":      true,
+			"or":       true,
+			"index":    true,
+			"default":  true,
+			"dict":     true,
+			"fail":     true,
+			"hasKey":   true,
+			"include":  true,
+			"list":     true,
+			"merge":    true,
+			"required": true,
+			"ternary":  true,
+		},
+	}
+}
+
+// convToFloat64Def is the CUE definition for gomplate's
+// conv.ToFloat64.
+const convToFloat64Def = `// _convToFloat64 converts a number, numeric string, bool or null to a
+// number as gomplate's conv.ToFloat64 does. Whole numbers are kept as
+// integers, as text/template prints a whole float64.
+_convToFloat64: {
+	#in: _
+	let F = [
+		if (#in & bool) != _|_ {[if #in {1}, 0][0]},
+		if (#in & null) != _|_ {0},
+		if (#in & "") != _|_ {0},
+		if (#in & string) != _|_ {strconv.ParseFloat(#in, 64)},
+		#in,
+	][0]
+	out: [if math.Trunc(F) == F {math.Trunc(F)}, F][0]
+}
+`
+
+// convToIntDef is the CUE definition for gomplate's conv.ToInt.
+const convToIntDef = `// _convToInt converts a value to an integer as gomplate's conv.ToInt
+// does, truncating a fraction.
+_convToInt: {
+	#in: _
+	let X = #in
+	out: math.Trunc((_convToFloat64 & {#in: X}).out)
+}
+`
+
+var convToFloat64Helper = HelperDef{
+	Name:    "_convToFloat64",
+	Def:     convToFloat64Def,
+	Imports: []string{"math", "strconv"},
+}
+
+// convToIntHelpers are the helpers of conv.ToInt and conv.ToInts.
+var convToIntHelpers = []HelperDef{convToFloat64Helper, {
+	Name:    "_convToInt",
+	Def:     convToIntDef,
+	Imports: []string{"math"},
+}}
+
+// convertToInts converts gomplate's conv.ToInts, which converts each of
+// its arguments as conv.ToInt does, to a list.
+func convertToInts(ctx *FuncContext, args []FuncArg) (ast.Expr, error) {
+	list := &ast.ListLit{}
+	for _, a := range args {
+		expr, _, err := ctx.Expr(a)
+		if err != nil {
+			return nil, err
+		}
+		list.Elts = append(list.Elts, helperOutExpr("_convToInt", &ast.Field{Label: ast.NewIdent("#in"), Value: expr}))
+	}
+	return list, nil
+}
+
+// convertGetenv converts gomplate's env.Getenv name [default]. The
+// variable becomes a field of #env, which, like the environment,
+// defaults to the empty string.
+func convertGetenv(ctx *FuncContext, args []FuncArg) (ast.Expr, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("%s requires 1 or 2 arguments, got %d", ctx.Name(), len(args))
+	}
+	name, ok := args[0].Node().(*parse.StringNode)
+	if !ok {
+		return nil, fmt.Errorf("%s: the variable name must be a string literal", ctx.Name())
+	}
+	expr, _, err := ctx.OptionalExpr(contextRefArg(name, "Env", name.Text))
+	if err != nil {
+		return nil, err
+	}
+	defaultVal := ast.Expr(cueString(""))
+	if len(args) == 2 {
+		if defaultVal, _, err = ctx.Expr(args[1]); err != nil {
+			return nil, err
+		}
+	}
+	return ctx.c.defaultExpr(expr, defaultVal), nil
+}
+
+// convertDatasource converts gomplate's datasource name, and its alias
+// ds, to the field of #datasources for the datasource.
+func convertDatasource(ctx *FuncContext, args []FuncArg) (ast.Expr, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s requires 1 argument, got %d (subpaths are not supported)", ctx.Name(), len(args))
+	}
+	name, ok := args[0].Node().(*parse.StringNode)
+	if !ok {
+		return nil, fmt.Errorf("%s: the datasource name must be a string literal", ctx.Name())
+	}
+	expr, ref, err := ctx.Expr(contextRefArg(name, "Datasources", name.Text))
+	if err != nil {
+		return nil, err
+	}
+	if ref != nil {
+		ctx.MarkNonScalar(*ref)
+	}
+	return expr, nil
+}
+
+// contextRefArg returns an argument referring to the field of the
+// context object with the given path, such as .Env.HOME for the path
+// Env, HOME, positioned at node.
+func contextRefArg(node parse.Node, path ...string) FuncArg {
+	return FuncArg{a: funcArg{node: &parse.FieldNode{
+		NodeType: parse.NodeField,
+		Pos:      node.Position(),
+		Ident:    path,
+	}}, i: -1}
+}
+
+// convertTmplInline converts gomplate's tmpl.Inline [name] in [context]
+// where in is a literal template, which is converted along with the
+// template that uses it. The context must be the root context.
+func convertTmplInline(ctx *FuncContext, args []FuncArg) (ast.Expr, error) {
+	var in, context FuncArg
+	switch len(args) {
+	case 1:
+		in = args[0]
+	case 2:
+		// As gomplate does, take a second string as the template,
+		// after the name, and anything else as the context.
+		if _, ok := args[1].Node().(*parse.StringNode); ok {
+			in = args[1]
+		} else {
+			in, context = args[0], args[1]
+		}
+	case 3:
+		in, context = args[1], args[2]
+	default:
+		return nil, fmt.Errorf("%s requires 1 to 3 arguments, got %d", ctx.Name(), len(args))
+	}
+	text, ok := in.Node().(*parse.StringNode)
+	if !ok {
+		return nil, fmt.Errorf("%s: the template must be a string literal", ctx.Name())
+	}
+	if context.a.node != nil || context.a.expr != nil {
+		rootDot := false
+		switch n := context.Node().(type) {
+		case *parse.DotNode:
+			rootDot = len(ctx.c.rangeVarStack) == 0
+		case *parse.VariableNode:
+			rootDot = len(n.Ident) == 1 && n.Ident[0] == "$"
+		}
+		if !rootDot {
+			return nil, fmt.Errorf("%s: only the root context is supported", ctx.Name())
+		}
+	}
+	return ctx.c.convertInlineText(text.Text, nil)
+}
+
+// EmbedDatasources returns src, the CUE of a template converted with
+// GomplateConfig, as a file of package pkgName with #datasources filled
+// by embedding the given files, keyed by datasource name. The files are
+// read as JSON, YAML or TOML by their extension, as gomplate reads
+// them, or otherwise as text, and must be in the CUE module of the
+// result.
+func EmbedDatasources(src []byte, pkgName string, files map[string]string) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "@extern(embed)\n\npackage %s\n\n", pkgName)
+	b.Write(src)
+	b.WriteString("\n#datasources: {\n")
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		file := filepath.ToSlash(files[name])
+		attr := "file=" + strconv.Quote(file)
+		switch filepath.Ext(file) {
+		case ".json", ".yaml", ".yml", ".toml":
+		default:
+			attr += ", type=text"
+		}
+		fmt.Fprintf(&b, "\t%s: _ @embed(%s)\n", cueKey(name), attr)
+	}
+	b.WriteString("}\n")
+	return format.Source(b.Bytes())
+}
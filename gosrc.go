@@ -0,0 +1,785 @@
+// Copyright 2026 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm2cue
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template/parse"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// GoTemplate is a template found in Go source by FindGoTemplates.
+type GoTemplate struct {
+	// Name is the name of the template: the name given to New, or the
+	// base name of its file for ParseFS.
+	Name string
+
+	// Pos is the position of the call that parses the template. Its
+	// file name, like File, is relative to the directory given to
+	// FindGoTemplates if it is within it.
+	Pos token.Position
+
+	// File is the file that holds the text of the template: the
+	// embedded file for //go:embed, or else the Go file. Line is the
+	// line of File on which the text starts, or 0 if the text is not a
+	// single raw string literal, so that its lines are not those of
+	// File.
+	File string
+	Line int
+
+	// Text is the text of the template.
+	Text []byte
+
+	// Helpers holds the text of the other templates parsed into the
+	// same template set, whose definitions the template may use.
+	Helpers [][]byte
+
+	// Funcs lists the names of the functions registered with Funcs, in
+	// sorted order. Sprig reports whether they include a Sprig
+	// function map, such as that of sprig.TxtFuncMap.
+	Funcs []string
+	Sprig bool
+
+	// LeftDelim and RightDelim are the delimiters set with Delims, if
+	// any.
+	LeftDelim  string
+	RightDelim string
+
+	// HTML reports whether the template is parsed with html/template,
+	// which escapes the output of actions for the HTML context they
+	// are in. The conversion does not.
+	HTML bool
+
+	// Unresolved, if not empty, says why the template set could not be
+	// followed, such as Delims being called where its effect on the
+	// template is not known, or why its text could not be found. The
+	// delimiters, functions or text of the template may then be wrong,
+	// so it must not be converted.
+	Unresolved string
+}
+
+// Config returns a Config for converting t: TemplateConfig with the
+// delimiters of t and the functions registered with it that helm2cue
+// knows, which are Go's built-in functions and those of Sprig. The
+// data the template is executed with becomes #values, so that
+// {{ .name }} refers to #values.name. The
+// names of the other functions registered are returned as unknown, in
+// sorted order; a template that uses one fails to convert unless a
+// conversion is added to Config.Funcs.
+func (t *GoTemplate) Config() (cfg *Config, unknown []string) {
+	cfg = TemplateConfig()
+	cfg.RootObject = "Values"
+	cfg.LeftDelim, cfg.RightDelim = t.LeftDelim, t.RightDelim
+	helm := HelmConfig().Funcs
+	add := func(name string) bool {
+		_, isCondition := conditionFuncs[name]
+		switch {
+		case cfg.CoreFuncs[name]:
+		case coreFuncs[name].convert != nil || isCondition || slices.Contains(conditionCoreFuncs, name):
+			cfg.CoreFuncs[name] = true
+		default:
+			f, ok := helm[name]
+			if !ok || name == "lookup" {
+				return false
+			}
+			cfg.Funcs[name] = f
+		}
+		return true
+	}
+	if t.Sprig {
+		for name := range helm {
+			if !helmOnlyFuncs[name] {
+				add(name)
+			}
+		}
+		for name := range coreFuncs {
+			if !helmOnlyFuncs[name] {
+				add(name)
+			}
+		}
+		for name := range conditionFuncs {
+			add(name)
+		}
+		for _, name := range conditionCoreFuncs {
+			add(name)
+		}
+	}
+	for _, name := range t.Funcs {
+		if !add(name) {
+			unknown = append(unknown, name)
+		}
+	}
+	return cfg, unknown
+}
+
+// conditionCoreFuncs are the core-handled functions that are converted
+// in conditions but are in neither coreFuncs nor conditionFuncs.
+var conditionCoreFuncs = []string{"empty", "hasKey", "kindIs", "semverCompare", "typeOf"}
+
+// helmOnlyFuncs are the functions that Helm adds to Sprig's, and so
+// that a Sprig function map does not register. lookup, which reads
+// from Kubernetes, is not converted even when registered by name.
+var helmOnlyFuncs = map[string]bool{
+	"fromJson":      true,
+	"fromJsonArray": true,
+	"fromYaml":      true,
+	"fromYamlArray": true,
+	"include":       true,
+	"lookup":        true,
+	"required":      true,
+	"toToml":        true,
+	"toYaml":        true,
+	"tpl":           true,
+}
+
+// FindGoTemplates loads the Go packages matching patterns, as the go
+// command does, in dir, and returns the templates they parse with
+// text/template or html/template: the text of each call of Parse that
+// is a constant string or a variable embedded with //go:embed, and of
+// each file read by ParseFS from an embed.FS. The template set is
+// followed back through calls such as New, Funcs, Delims and Must, and
+// through the variables that hold it, to find the name, functions and
+// delimiters of the template and the text parsed into the set before
+// it, which becomes its helpers.
+//
+// Text known only when the program runs, such as that read by
+// ParseFiles, is skipped. A template whose set cannot be followed, or
+// whose files ParseFS selects with a pattern that is not constant, is
+// returned with Unresolved set. Templates are returned in source order.
+func FindGoTemplates(dir string, patterns ...string) ([]GoTemplate, error) {
+	// Dependencies are type-checked from source rather than read from
+	// export data, whose format depends on the version of Go.
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedEmbedFiles |
+			packages.NeedImports | packages.NeedDeps | packages.NeedSyntax | packages.NeedTypes | packages.NeedTypesInfo,
+		Dir: dir,
+	}
+	pkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		for _, e := range pkg.Errors {
+			errs = append(errs, e)
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	var templates []GoTemplate
+	for _, pkg := range pkgs {
+		f := newGoTemplateFinder(pkg, dir)
+		ts, err := f.find()
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, ts...)
+	}
+	return templates, nil
+}
+
+// goTemplateFinder finds the templates of a Go package.
+type goTemplateFinder struct {
+	pkg *packages.Package
+	dir string // the directory that positions are relative to
+
+	inits       map[types.Object]ast.Expr        // the value each variable is declared with
+	reassigned  map[types.Object]bool            // variables assigned after their declaration
+	methodCalls map[types.Object][]*ast.CallExpr // template methods called on each variable
+	mapKeys     map[types.Object][]string        // keys assigned to function map variables
+	embeds      map[types.Object][]string        // //go:embed patterns of variables
+	parsed      map[*ast.CallExpr]bool           // Parse calls folded into a later template
+}
+
+func newGoTemplateFinder(pkg *packages.Package, dir string) *goTemplateFinder {
+	f := &goTemplateFinder{
+		pkg:         pkg,
+		dir:         dir,
+		inits:       make(map[types.Object]ast.Expr),
+		reassigned:  make(map[types.Object]bool),
+		methodCalls: make(map[types.Object][]*ast.CallExpr),
+		mapKeys:     make(map[types.Object][]string),
+		embeds:      make(map[types.Object][]string),
+		parsed:      make(map[*ast.CallExpr]bool),
+	}
+	info := pkg.TypesInfo
+	for _, file := range pkg.Syntax {
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.GenDecl:
+				for _, spec := range n.Specs {
+					vs, ok := spec.(*ast.ValueSpec)
+					if !ok {
+						continue
+					}
+					doc := vs.Doc
+					if doc == nil && len(n.Specs) == 1 {
+						doc = n.Doc
+					}
+					patterns := embedPatterns(doc)
+					for i, name := range vs.Names {
+						obj := info.Defs[name]
+						if obj == nil {
+							continue
+						}
+						if len(vs.Values) == len(vs.Names) {
+							f.inits[obj] = vs.Values[i]
+						}
+						if patterns != nil {
+							f.embeds[obj] = patterns
+						}
+					}
+				}
+			case *ast.CallExpr:
+				// t.Delims(l, r) changes the set held by t.
+				if fn, recv := f.templateFunc(n); fn != nil && recv != nil {
+					if id, ok := ast.Unparen(recv).(*ast.Ident); ok {
+						if obj := info.Uses[id]; obj != nil {
+							f.methodCalls[obj] = append(f.methodCalls[obj], n)
+						}
+					}
+				}
+			case *ast.AssignStmt:
+				for i, lhs := range n.Lhs {
+					switch lhs := ast.Unparen(lhs).(type) {
+					case *ast.Ident:
+						if obj := info.Defs[lhs]; obj != nil {
+							if len(n.Lhs) == len(n.Rhs) {
+								f.inits[obj] = n.Rhs[i]
+							}
+						} else if obj := info.Uses[lhs]; obj != nil {
+							f.reassigned[obj] = true
+						}
+					case *ast.IndexExpr:
+						// fm["name"] = fn adds to a function map.
+						x, ok := ast.Unparen(lhs.X).(*ast.Ident)
+						if !ok {
+							continue
+						}
+						if key, ok := f.constString(lhs.Index); ok {
+							obj := info.Uses[x]
+							f.mapKeys[obj] = append(f.mapKeys[obj], key)
+						}
+					}
+				}
+			}
+			return true
+		})
+	}
+	return f
+}
+
+// embedPatterns returns the patterns of the //go:embed directives in
+// doc, or nil if there are none.
+func embedPatterns(doc *ast.CommentGroup) []string {
+	if doc == nil {
+		return nil
+	}
+	var patterns []string
+	for _, c := range doc.List {
+		args, ok := strings.CutPrefix(c.Text, "//go:embed ")
+		if !ok {
+			continue
+		}
+		for args = strings.TrimSpace(args); args != ""; args = strings.TrimSpace(args) {
+			var p string
+			if args[0] == '"' || args[0] == '`' {
+				q, err := strconv.QuotedPrefix(args)
+				if err != nil {
+					break
+				}
+				p, _ = strconv.Unquote(q)
+				args = args[len(q):]
+			} else {
+				p, args, _ = strings.Cut(args, " ")
+			}
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// find returns the templates of f.pkg.
+func (f *goTemplateFinder) find() ([]GoTemplate, error) {
+	type found struct {
+		call      *ast.CallExpr
+		templates []GoTemplate
+	}
+	var all []found
+	var err error
+	for _, file := range f.pkg.Syntax {
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || err != nil {
+				return err == nil
+			}
+			fn, recv := f.templateFunc(call)
+			if fn == nil {
+				return true
+			}
+			var ts []GoTemplate
+			switch fn.Name() {
+			case "Parse":
+				if recv != nil {
+					ts, err = f.parse(call, recv)
+				}
+			case "ParseFS":
+				ts, err = f.parseFS(call, recv)
+			}
+			if fn.Pkg().Path() == "html/template" {
+				for i := range ts {
+					ts[i].HTML = true
+				}
+			}
+			all = append(all, found{call, ts})
+			return true
+		})
+	}
+	// Text parsed into a set that a later Parse call adds to is a
+	// helper of the later template, not a template of its own.
+	var templates []GoTemplate
+	for _, fd := range all {
+		if !f.parsed[fd.call] {
+			templates = append(templates, fd.templates...)
+		}
+	}
+	return templates, err
+}
+
+// templateFunc returns the function of text/template or html/template
+// that call calls, or nil if it calls another. For a method, recv is
+// the template it is called on.
+func (f *goTemplateFinder) templateFunc(call *ast.CallExpr) (fn *types.Func, recv ast.Expr) {
+	sel, ok := ast.Unparen(call.Fun).(*ast.SelectorExpr)
+	if !ok {
+		return nil, nil
+	}
+	fn, ok = f.pkg.TypesInfo.Uses[sel.Sel].(*types.Func)
+	if !ok || fn.Pkg() == nil {
+		return nil, nil
+	}
+	if p := fn.Pkg().Path(); p != "text/template" && p != "html/template" {
+		return nil, nil
+	}
+	if s := f.pkg.TypesInfo.Selections[sel]; s != nil && s.Kind() == types.MethodVal {
+		recv = sel.X
+	}
+	return fn, recv
+}
+
+// parse returns the template parsed by call, a call of Parse on recv.
+func (f *goTemplateFinder) parse(call *ast.CallExpr, recv ast.Expr) ([]GoTemplate, error) {
+	if len(call.Args) != 1 {
+		return nil, nil
+	}
+	t := f.templateSet(recv)
+	text, file, line, ok, err := f.text(call.Args[0])
+	if !ok || err != nil || onlyDefinitions(text, t.LeftDelim, t.RightDelim) {
+		return nil, err
+	}
+	t.Pos = f.position(call.Pos())
+	t.File, t.Line, t.Text = file, line, text
+	return []GoTemplate{t}, nil
+}
+
+// parseFS returns the templates parsed by call, a call of ParseFS, on
+// recv if it is a method call. Each file read is a template whose
+// helpers are the files read along with it, except that files that
+// only hold definitions are helpers and not templates.
+func (f *goTemplateFinder) parseFS(call *ast.CallExpr, recv ast.Expr) ([]GoTemplate, error) {
+	if len(call.Args) < 1 {
+		return nil, nil
+	}
+	files := f.embeddedFiles(call.Args[0])
+	if len(files) == 0 {
+		return nil, nil
+	}
+	patterns := make([]string, len(call.Args)-1)
+	for i, arg := range call.Args[1:] {
+		pattern, ok := f.constString(arg)
+		if !ok {
+			// The files parsed, and so the templates, are not known.
+			return []GoTemplate{{
+				Pos:        f.position(call.Pos()),
+				Unresolved: "the pattern of ParseFS is not a constant string",
+			}}, nil
+		}
+		patterns[i] = pattern
+	}
+	var matched []string
+	for _, file := range files {
+		rel := f.relToPackage(file)
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, rel); ok {
+				matched = append(matched, file)
+				break
+			}
+		}
+	}
+	var set GoTemplate
+	if recv != nil {
+		set = f.templateSet(recv)
+	}
+	texts := make([][]byte, len(matched))
+	var isTemplate []bool
+	for i, file := range matched {
+		text, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		texts[i] = text
+		isTemplate = append(isTemplate, !onlyDefinitions(text, set.LeftDelim, set.RightDelim))
+	}
+	var templates []GoTemplate
+	for i, file := range matched {
+		if !isTemplate[i] {
+			continue
+		}
+		t := set
+		t.Name = path.Base(filepath.ToSlash(file))
+		t.Pos = f.position(call.Pos())
+		t.File, t.Line, t.Text = f.rel(file), 1, texts[i]
+		t.Helpers = slices.Clone(set.Helpers)
+		for j, text := range texts {
+			if j != i {
+				t.Helpers = append(t.Helpers, text)
+			}
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// onlyDefinitions reports whether text holds only definitions of
+// templates, with nothing but white space between them.
+func onlyDefinitions(text []byte, leftDelim, rightDelim string) bool {
+	tree := parse.New("")
+	tree.Mode = parse.SkipFuncCheck
+	trees := make(map[string]*parse.Tree)
+	if _, err := tree.Parse(string(text), leftDelim, rightDelim, trees); err != nil {
+		return false
+	}
+	root := trees[""]
+	if root == nil {
+		return true
+	}
+	for _, n := range root.Root.Nodes {
+		if t, ok := n.(*parse.TextNode); !ok || strings.TrimSpace(string(t.Text)) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// templateSet returns the template set that expr, a *Template,
+// evaluates to, with the name, functions and delimiters given to it and
+// the text parsed into it, as far as they can be found.
+func (f *goTemplateFinder) templateSet(expr ast.Expr) GoTemplate {
+	var t GoTemplate
+	var funcs []string
+	f.followSet(expr, &t, &funcs)
+	slices.Sort(funcs)
+	t.Funcs = slices.Compact(funcs)
+	return t
+}
+
+// followSet records in t and funcs what the calls that produce expr
+// give the template set, in the order they are made. A variable is
+// followed to its declaration and then the template methods called on
+// it before expr, in the same function, as in
+//
+//	t := template.New("config")
+//	t.Delims("[[", "]]")
+//	t.Parse(text)
+//
+// If the set cannot be followed, t.Unresolved says why.
+func (f *goTemplateFinder) followSet(expr ast.Expr, t *GoTemplate, funcs *[]string) {
+	switch e := ast.Unparen(expr).(type) {
+	case *ast.Ident:
+		obj := f.pkg.TypesInfo.Uses[e]
+		init, ok := f.inits[obj]
+		switch {
+		case !ok:
+			f.unresolved(t, "the template set %s is not declared with a value", e.Name)
+		case f.reassigned[obj]:
+			f.unresolved(t, "the template set %s is assigned more than once", e.Name)
+		default:
+			f.followSet(init, t, funcs)
+			f.followMethodCalls(obj, e, t, funcs)
+		}
+	case *ast.CallExpr:
+		fn, recv := f.templateFunc(e)
+		if fn == nil {
+			f.unresolved(t, "the template set is returned by %s", types.ExprString(e.Fun))
+			return
+		}
+		if fn.Pkg().Path() == "html/template" {
+			t.HTML = true
+		}
+		if recv != nil {
+			f.followSet(recv, t, funcs)
+		}
+		f.followCall(fn, e, recv, t, funcs)
+	default:
+		f.unresolved(t, "the template set %s cannot be followed", types.ExprString(e))
+	}
+}
+
+// followMethodCalls records in t and funcs what the template methods
+// called on the variable obj give the set before use, a use of obj.
+// Calls that set its delimiters or functions elsewhere, such as in
+// another function, make the set unresolved, as whether they are made
+// before use is not known.
+func (f *goTemplateFinder) followMethodCalls(obj types.Object, use *ast.Ident, t *GoTemplate, funcs *[]string) {
+	useFunc := f.enclosingFunc(use)
+	for _, call := range f.methodCalls[obj] {
+		if call.Pos() <= use.Pos() && use.Pos() < call.End() {
+			// The call that use is the receiver of, already followed.
+			continue
+		}
+		fn, recv := f.templateFunc(call)
+		if call.End() <= use.Pos() && f.enclosingFunc(call) == useFunc {
+			f.followCall(fn, call, recv, t, funcs)
+			continue
+		}
+		switch fn.Name() {
+		case "Delims", "Funcs":
+			if f.enclosingFunc(call) != useFunc {
+				f.unresolved(t, "%s is called on the template set %s at %s", fn.Name(), use.Name, f.position(call.Pos()))
+			}
+		}
+	}
+}
+
+// followCall records in t and funcs what call, a call of the template
+// function fn on recv, gives the template set.
+func (f *goTemplateFinder) followCall(fn *types.Func, call *ast.CallExpr, recv ast.Expr, t *GoTemplate, funcs *[]string) {
+	switch fn.Name() {
+	case "Must":
+		if len(call.Args) == 1 {
+			f.followSet(call.Args[0], t, funcs)
+		}
+	case "New":
+		if len(call.Args) == 1 {
+			t.Name, _ = f.constString(call.Args[0])
+		}
+	case "Delims":
+		if len(call.Args) == 2 {
+			var okLeft, okRight bool
+			t.LeftDelim, okLeft = f.constString(call.Args[0])
+			t.RightDelim, okRight = f.constString(call.Args[1])
+			if !okLeft || !okRight {
+				f.unresolved(t, "the delimiters given to Delims are not constant strings")
+			}
+		}
+	case "Funcs":
+		if len(call.Args) == 1 {
+			f.funcMap(call.Args[0], t, funcs)
+		}
+	case "Parse":
+		if recv == nil || len(call.Args) != 1 {
+			return
+		}
+		if text, _, _, ok, _ := f.text(call.Args[0]); ok {
+			t.Helpers = append(t.Helpers, text)
+			f.parsed[call] = true
+		}
+	}
+}
+
+// unresolved records in t why its template set cannot be followed,
+// keeping the first reason found.
+func (f *goTemplateFinder) unresolved(t *GoTemplate, format string, args ...any) {
+	if t.Unresolved == "" {
+		t.Unresolved = fmt.Sprintf(format, args...)
+	}
+}
+
+// enclosingFunc returns the innermost function declaration or literal
+// that holds n, or nil if n is outside any function.
+func (f *goTemplateFinder) enclosingFunc(n ast.Node) ast.Node {
+	for _, file := range f.pkg.Syntax {
+		if n.Pos() < file.FileStart || n.End() > file.FileEnd {
+			continue
+		}
+		path, _ := astutil.PathEnclosingInterval(file, n.Pos(), n.End())
+		for _, p := range path {
+			switch p.(type) {
+			case *ast.FuncDecl, *ast.FuncLit:
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// funcMap records in t and funcs the functions of expr, a function
+// map.
+func (f *goTemplateFinder) funcMap(expr ast.Expr, t *GoTemplate, funcs *[]string) {
+	info := f.pkg.TypesInfo
+	switch e := ast.Unparen(expr).(type) {
+	case *ast.CompositeLit:
+		for _, elt := range e.Elts {
+			if kv, ok := elt.(*ast.KeyValueExpr); ok {
+				if name, ok := f.constString(kv.Key); ok {
+					*funcs = append(*funcs, name)
+				}
+			}
+		}
+	case *ast.Ident:
+		obj := info.Uses[e]
+		if init, ok := f.inits[obj]; ok {
+			f.funcMap(init, t, funcs)
+		}
+		*funcs = append(*funcs, f.mapKeys[obj]...)
+	case *ast.CallExpr:
+		if tv := info.Types[e.Fun]; tv.IsType() && len(e.Args) == 1 {
+			// A conversion, as in template.FuncMap(sprig.FuncMap()).
+			f.funcMap(e.Args[0], t, funcs)
+			return
+		}
+		sel, ok := ast.Unparen(e.Fun).(*ast.SelectorExpr)
+		if !ok {
+			return
+		}
+		fn, ok := info.Uses[sel.Sel].(*types.Func)
+		if ok && fn.Pkg() != nil && strings.HasPrefix(fn.Pkg().Path(), "github.com/Masterminds/sprig") &&
+			strings.HasSuffix(fn.Name(), "FuncMap") {
+			t.Sprig = true
+		}
+	}
+}
+
+// text returns the text of expr, an argument of Parse, with the file
+// and line it is at, as for GoTemplate.File and Line. It reports
+// whether the text could be found.
+func (f *goTemplateFinder) text(expr ast.Expr) (text []byte, file string, line int, ok bool, err error) {
+	info := f.pkg.TypesInfo
+	expr = ast.Unparen(expr)
+	if s, ok := f.constString(expr); ok {
+		pos := f.pkg.Fset.Position(expr.Pos())
+		if lit, ok := expr.(*ast.BasicLit); ok && strings.HasPrefix(lit.Value, "`") {
+			line = pos.Line
+		}
+		return []byte(s), f.rel(pos.Filename), line, true, nil
+	}
+	switch e := expr.(type) {
+	case *ast.CallExpr:
+		// A conversion, as in string(b) of an embedded []byte.
+		if tv := info.Types[e.Fun]; tv.IsType() && len(e.Args) == 1 {
+			return f.text(e.Args[0])
+		}
+	case *ast.Ident:
+		files := f.embeddedFiles(e)
+		if len(files) != 1 {
+			return nil, "", 0, false, nil
+		}
+		text, err := os.ReadFile(files[0])
+		if err != nil {
+			return nil, "", 0, false, err
+		}
+		return text, f.rel(files[0]), 1, true, nil
+	}
+	return nil, "", 0, false, nil
+}
+
+// embeddedFiles returns the files, as absolute paths, embedded in the
+// variable expr with //go:embed, in sorted order.
+func (f *goTemplateFinder) embeddedFiles(expr ast.Expr) []string {
+	id, ok := ast.Unparen(expr).(*ast.Ident)
+	if !ok {
+		return nil
+	}
+	patterns := f.embeds[f.pkg.TypesInfo.Uses[id]]
+	var files []string
+	for _, file := range f.pkg.EmbedFiles {
+		rel := f.relToPackage(file)
+		if slices.ContainsFunc(patterns, func(p string) bool { return embedMatch(p, rel) }) {
+			files = append(files, file)
+		}
+	}
+	slices.Sort(files)
+	return files
+}
+
+// embedMatch reports whether the //go:embed pattern matches rel, a
+// slash-separated path relative to the package directory, or a
+// directory that holds it.
+func embedMatch(pattern, rel string) bool {
+	pattern = strings.TrimPrefix(pattern, "all:")
+	for p := rel; p != "." && p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// constString returns the value of expr if it is a constant string.
+func (f *goTemplateFinder) constString(expr ast.Expr) (string, bool) {
+	tv, ok := f.pkg.TypesInfo.Types[expr]
+	if !ok || tv.Value == nil || tv.Value.Kind() != constant.String {
+		return "", false
+	}
+	return constant.StringVal(tv.Value), true
+}
+
+// relToPackage returns file, an absolute path, as a slash-separated
+// path relative to the directory of the package.
+func (f *goTemplateFinder) relToPackage(file string) string {
+	if len(f.pkg.GoFiles) == 0 {
+		return filepath.ToSlash(file)
+	}
+	rel, err := filepath.Rel(filepath.Dir(f.pkg.GoFiles[0]), file)
+	if err != nil {
+		return filepath.ToSlash(file)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// rel returns file relative to the directory that FindGoTemplates
+// loaded packages in, if it is within it.
+func (f *goTemplateFinder) rel(file string) string {
+	dir, err := filepath.Abs(f.dir)
+	if err != nil {
+		return file
+	}
+	rel, err := filepath.Rel(dir, file)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return file
+	}
+	return rel
+}
+
+// position returns the position of pos, its file name as by rel.
+func (f *goTemplateFinder) position(pos token.Pos) token.Position {
+	p := f.pkg.Fset.Position(pos)
+	p.Filename = f.rel(p.Filename)
+	return p
+}
@@ -12,9 +12,12 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package helm2cue
 
 import (
+	"fmt"
+	"strings"
+
 	"cuelang.org/go/cue/ast"
 	"cuelang.org/go/cue/token"
 )
@@ -67,6 +70,313 @@ _trunc: {
 }
 `
 
+// unixTimeDef is the CUE definition for converting an RFC 3339
+// timestamp to seconds since the Unix epoch, using the days-from-civil
+// calculation on the UTC date. nsec holds the sub-second remainder.
+const unixTimeDef = `// _unixTime converts an RFC 3339 timestamp to Unix seconds.
+_unixTime: {
+	#t!:  string
+	_p:   time.Split(time.Parse(time.RFC3339Nano, #t))
+	_y:   _p.year - [if _p.month <= 2 {1}, 0][0]
+	_era: div(_y, 400)
+	_yoe: _y - _era*400
+	_doy: div(153*(_p.month+[if _p.month > 2 {-3}, 9][0])+2, 5) + _p.day - 1
+	_doe: _yoe*365 + div(_yoe, 4) - div(_yoe, 100) + _doy
+	out:  (_era*146097+_doe-719468)*86400 + _p.hour*3600 + _p.minute*60 + _p.second
+	nsec: _p.nanosecond
+}
+`
+
+// dateModifyDef is the CUE definition for adding a Go duration string
+// to an RFC 3339 timestamp, matching Sprig's dateModify. The result is
+// in UTC.
+const dateModifyDef = `// _dateModify adds a Go duration to an RFC 3339 timestamp.
+_dateModify: {
+	#t!: string
+	#d!: string
+	let T = #t
+	_u:  _unixTime & {#t: T}
+	_ns: _u.out*1000000000 + _u.nsec + time.ParseDuration(#d)
+	out: time.Unix(div(_ns, 1000000000), mod(_ns, 1000000000))
+}
+`
+
+// toStringsDef is the CUE definition for Sprig's toStrings, which
+// formats each element of a list and drops nulls.
+const toStringsDef = `// _toStrings converts the non-null elements of a list to strings.
+_toStrings: {
+	#in: [...]
+	out: [for x in #in if x != null {"\(x)"}]
+}
+`
+
+// bytesDef is the CUE definition for splitting a string into its bytes,
+// which CUE cannot index directly. It goes through the hex encoding.
+const bytesDef = `// _bytes splits a string into a list of its bytes.
+_bytes: {
+	#in: string
+	let h = hex.Encode(#in)
+	out: [for i in list.Range(0, len(h), 2) {strconv.ParseUint(strings.SliceRunes(h, i, i+2), 16, 8)}]
+}
+`
+
+// adler32sumDef is the CUE definition for Sprig's adler32sum. The
+// running sums of the Adler-32 algorithm are computed in closed form.
+const adler32sumDef = `// _adler32sum computes the Adler-32 checksum of a string as a
+// decimal string.
+_adler32sum: {
+	#in: string
+	let S = #in
+	let b = (_bytes & {#in: S}).out
+	let n = len(b)
+	let s1 = mod(1+list.Sum(b), 65521)
+	let s2 = mod(n+list.Sum([for i, x in b {(n - i) * x}]), 65521)
+	out: "\(s2*65536+s1)"
+}
+`
+
+// b32encDef is the CUE definition for Sprig's b32enc: standard base32
+// with padding. Each block of five bytes becomes eight characters.
+const b32encDef = `// _b32enc encodes a string as padded standard base32.
+_b32enc: {
+	#in: string
+	let S = #in
+	let b = (_bytes & {#in: S}).out
+	let n = len(b)
+	out: strings.Join([for i in list.Range(0, n, 5) {
+		let blk = list.Slice(b, i, list.Min([i + 5, n]))
+		let v = list.Sum([for j, x in blk {x * [4294967296, 16777216, 65536, 256, 1][j]}])
+		let c = [2, 4, 5, 7, 8][len(blk)-1]
+		strings.Join([for j in list.Range(0, c, 1) {
+			let k = mod(div(v, [34359738368, 1073741824, 33554432, 1048576, 32768, 1024, 32, 1][j]), 32)
+			strings.SliceRunes("ABCDEFGHIJKLMNOPQRSTUVWXYZ234567", k, k+1)
+		}], "") + strings.Repeat("=", 8-c)
+	}], "")
+}
+`
+
+// b32decDef is the CUE definition for Sprig's b32dec. Characters
+// outside the base32 alphabet are an error.
+const b32decDef = `// _b32dec decodes padded standard base32.
+_b32dec: {
+	#in: string
+	let d = [for c in strings.Split(strings.TrimRight(#in, "="), "") {
+		strings.Index("ABCDEFGHIJKLMNOPQRSTUVWXYZ234567", c) & >=0
+	}]
+	let n = len(d)
+	let b = list.FlattenN([for i in list.Range(0, n, 8) {
+		let blk = list.Slice(d, i, list.Min([i + 8, n]))
+		let v = list.Sum([for j, x in blk {x * [34359738368, 1073741824, 33554432, 1048576, 32768, 1024, 32, 1][j]}])
+		[for k in list.Range(0, [0, 0, 1, 0, 2, 3, 0, 4, 5][len(blk)], 1) {
+			mod(div(v, [4294967296, 16777216, 65536, 256, 1][k]), 256)
+		}]
+	}], 1)
+	out: "\(hex.Decode(strings.Join([for x in b {strings.SliceRunes(strconv.FormatInt(x+256, 16), 1, 3)}], "")))"
+}
+`
+
+// regexFindAllDef is the CUE definition for Sprig's regexFindAll.
+// regexp.FindAll fails when nothing matches, where Sprig returns no
+// matches.
+const regexFindAllDef = `// _regexFindAll returns up to #n matches of #re in #s.
+_regexFindAll: {
+	#re: string
+	#s:  string
+	#n:  int
+	out: [...string]
+	if #n == 0 || !regexp.Match(#re, #s) {out: []}
+	if #n != 0 && regexp.Match(#re, #s) {out: regexp.FindAll(#re, #s, #n)}
+}
+`
+
+// regexSplitDef is the CUE definition for Sprig's regexSplit. Matches
+// are replaced by a NUL separator to split on; when #n limits the
+// parts, the last part is rebuilt from the remaining parts and matches.
+const regexSplitDef = `// _regexSplit splits #s around matches of #re into at most #n
+// parts, or all parts when #n is negative.
+_regexSplit: {
+	#re: string
+	#s:  string
+	#n:  int
+	let parts = strings.Split(regexp.ReplaceAll(#re, #s, "\u0000"), "\u0000")
+	out: [...string]
+	if #n == 0 {out: []}
+	if #n < 0 || #n >= len(parts) {out: parts}
+	if #n > 0 && #n < len(parts) {
+		let seps = list.Concat([regexp.FindAll(#re, #s, -1), [""]])
+		out: list.Concat([list.Slice(parts, 0, #n-1), [
+			strings.Join([for i, p in parts if i >= #n-1 {p + seps[i]}], ""),
+		]])
+	}
+}
+`
+
+// urlParseDef is the CUE definition for Sprig's urlParse. The URL is
+// split with the regular expression from RFC 3986, then the parts are
+// normalised the way Go's url.Parse does: the scheme is lowercased,
+// path and fragment are unescaped, and a path after a scheme that does
+// not start with a slash is opaque.
+const urlParseDef = `// _urlParse splits a URL into scheme, host, hostname, path, query,
+// opaque, fragment and userinfo.
+_urlParse: {
+	#in: string
+	let m = regexp.FindNamedSubmatch(#"^(?:(?P<scheme>[A-Za-z][A-Za-z0-9+.-]*):)?(?://(?:(?P<userinfo>[^/?#]*)@)?(?P<host>[^/?#]*))?(?P<path>[^?#]*)(?:\?(?P<query>[^#]*))?(?:#(?P<fragment>.*))?$"#, #in)
+	let isOpaque = m.scheme != "" && m.path != "" && !strings.HasPrefix(m.path, "/")
+	out: {
+		scheme:   strings.ToLower(m.scheme)
+		host:     m.host
+		hostname: regexp.ReplaceAll(#"^\[(.*)\]$"#, regexp.ReplaceAll(":[0-9]*$", m.host, ""), "${1}")
+		if isOpaque {
+			path:   ""
+			opaque: m.path
+		}
+		if !isOpaque {
+			path:   net.PathUnescape(m.path)
+			opaque: ""
+		}
+		query:    m.query
+		fragment: net.PathUnescape(m.fragment)
+		userinfo: m.userinfo
+	}
+}
+`
+
+// urlJoinDef is the CUE definition for Sprig's urlJoin, following Go's
+// url.URL.String. Missing parts are empty.
+const urlJoinDef = `// _urlJoin assembles a URL from the parts _urlParse produces.
+_urlJoin: {
+	#in: {...}
+	let u = {
+		for k in ["scheme", "host", "path", "query", "opaque", "fragment", "userinfo"] {
+			(k): *#in[k] | ""
+		}
+	}
+	// #escape percent-encodes the characters of #s that #keep does
+	// not match.
+	#escape: {
+		#s:    string
+		#keep: string
+		out: strings.Join([for c in strings.Split(#s, "") {
+			if c =~ #keep {c}
+			if c !~ #keep {net.PathEscape(c)}
+		}], "")
+	}
+	let path = (#escape & {#s: u.path, #keep: #"^[-A-Za-z0-9._~$&+,/:;=@]$"#}).out
+	let fragment = (#escape & {#s: u.fragment, #keep: #"^[-A-Za-z0-9._~$&+,/:;=?@!()*]$"#}).out
+	let authority = u.scheme != "" || u.host != "" || u.userinfo != ""
+	out: strings.Join([
+		if u.scheme != "" {u.scheme + ":"},
+		if u.opaque != "" {u.opaque},
+		if u.opaque == "" && authority && (u.host != "" || u.path != "" || u.userinfo != "") {"//"},
+		if u.opaque == "" && u.userinfo != "" {u.userinfo + "@"},
+		if u.opaque == "" {u.host},
+		if u.opaque == "" && u.host != "" && u.path != "" && !strings.HasPrefix(u.path, "/") {"/"},
+		if u.opaque == "" && !authority && strings.Contains(strings.Split(u.path, "/")[0], ":") {"./"},
+		if u.opaque == "" {path},
+		if u.query != "" {"?" + u.query},
+		if u.fragment != "" {"#" + fragment},
+	], "")
+}
+`
+
+// toTomlMaxDepth is how deeply tables may nest in values passed to
+// toToml. CUE has no recursion, so _toToml has one table definition
+// per level.
+const toTomlMaxDepth = 4
+
+// toTomlDef is the CUE definition for Helm's toToml, matching the
+// layout of the BurntSushi/toml encoder: keys sorted, plain values
+// before tables, tables after the first level indented, and null
+// values dropped. Integers are formatted as floats because Helm reads
+// all numbers in values as float64.
+var toTomlDef = func() string {
+	var b strings.Builder
+	b.WriteString(`// _toToml encodes a struct as TOML.
+_toToml: {
+	#in: {...}
+
+	#key: {
+		#k: string
+		if #k =~ "^[A-Za-z0-9_-]+$" {out: #k}
+		if #k !~ "^[A-Za-z0-9_-]+$" {out: json.Marshal(#k)}
+	}
+	#scalar: {
+		#v: _
+		let V = #v
+		if (#v & string) != _|_ {out: json.Marshal(#v)}
+		if (#v & number) != _|_ {out: (#number & {#v: V}).out}
+		if (#v & (string | number)) == _|_ {out: "\(#v)"}
+	}
+	// #number formats integers as Go does float64 values with %g.
+	#number: {
+		#v: number
+		let V = #v
+		if (#v & int) == _|_ {out: "\(V)"}
+		if (#v & int) != _|_ {
+			let d = "\([if V < 0 {-V}, V][0])"
+			let m = strings.TrimRight(d, "0")
+			let e = len(d) - 1
+			if e < 6 {out: "\(V).0"}
+			if e >= 6 {
+				out: [if V < 0 {"-"}, ""][0] + strings.SliceRunes(m, 0, 1) +
+					[if len(m) > 1 {"." + strings.SliceRunes(m, 1, len(m))}, ""][0] +
+					"e+" + [if e < 10 {"0"}, ""][0] + "\(e)"
+			}
+		}
+	}
+	#item: {
+		#v: _
+		let V = #v
+		if (#v & [...]) != _|_ {out: "[" + strings.Join([for x in #v {(#scalar & {#v: x}).out}], ", ") + "]"}
+		if (#v & [...]) == _|_ {out: (#scalar & {#v: V}).out}
+	}
+	#value: {
+		#v: _
+		let V = #v
+		if (#v & [...]) != _|_ {out: "[" + strings.Join([for x in #v {(#item & {#v: x}).out}], ", ") + "]"}
+		if (#v & [...]) == _|_ {out: (#scalar & {#v: V}).out}
+	}
+	#isTable: {
+		#v: _
+		out: (#v & {...}) != _|_ || (#v & [{...}, ...{...}]) != _|_
+	}
+`)
+	for depth := range toTomlMaxDepth {
+		// Only top-level tables are preceded by a blank line.
+		blank := ""
+		if depth == 0 {
+			blank = `"\n" + `
+		}
+		fmt.Fprintf(&b, `	#table%[1]d: {
+		#path: [...string]
+		#t: {...}
+		#header: string
+		let keys = list.SortStrings([for k, v in #t if v != null {k}])
+		let ind = %[3]q
+		out: #header + strings.Join([for k in keys if !(#isTable & {#v: #t[k]}).out {
+			ind + (#key & {#k: k}).out + " = " + (#value & {#v: #t[k]}).out + "\n"
+		}], "") + strings.Join([for k in keys if (#isTable & {#v: #t[k]}).out {
+			let V = #t[k]
+			let P = list.Concat([#path, [k]])
+			let H = strings.Join([for p in P {(#key & {#k: p}).out}], ".")
+			if (V & {...}) != _|_ {(#table%[2]d & {#path: P, #t: V, #header: %[4]sind + "[" + H + "]\n"}).out}
+			if (V & {...}) == _|_ {strings.Join([for e in V {(#table%[2]d & {#path: P, #t: e, #header: "\n" + ind + "[[" + H + "]]\n"}).out}], "")}
+		}], "")
+	}
+`, depth, depth+1, strings.Repeat("  ", depth), blank)
+	}
+	fmt.Fprintf(&b, `	#table%d: {
+		#path: [...string]
+		#t: {...}
+		#header: string
+		out: error("toToml: tables nested more than %d levels deep")
+	}
+	out: strings.TrimPrefix((#table0 & {#path: [], #t: #in, #header: ""}).out, "\n")
+}
+`, toTomlMaxDepth, toTomlMaxDepth)
+	return b.String()
+}()
+
 // semverCompareDef is the CUE definition for evaluating simple semver
 // constraints, matching the subset of Helm's semverCompare used in
 // practice (single operator + version).
@@ -143,6 +453,139 @@ const semverCompareDef = `_semverCompare: {
 }
 `
 
+// roundDef is the CUE definition for Sprig's round, which rounds to a
+// number of decimal places.
+const roundDef = `// _round rounds #in to #places decimal places as Sprig does: up
+// when the fraction left is at least one half, otherwise down.
+_round: {
+	#in!:     number
+	#places!: int
+	_pow:     math.Pow(10, #places)
+	_digit:   #in * _pow
+	out: [
+		if _digit-math.Trunc(_digit) >= 0.5 {math.Ceil(_digit) / _pow},
+		math.Floor(_digit) / _pow,
+	][0]
+}
+`
+
+// int64Expr converts expr as Sprig's toInt64 does, truncating a
+// float64 toward zero. Integer literals and the results of integer
+// arithmetic are returned unchanged.
+func int64Expr(expr ast.Expr) ast.Expr {
+	if isIntExpr(expr) {
+		return expr
+	}
+	return importCall("math", "Trunc", expr)
+}
+
+// isIntExpr reports whether expr is known to be an integer.
+func isIntExpr(expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		return e.Kind == token.INT
+	case *ast.UnaryExpr:
+		return e.Op == token.SUB && isIntExpr(e.X)
+	case *ast.ParenExpr:
+		return isIntExpr(e.X)
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case token.ADD, token.SUB, token.MUL:
+			return isIntExpr(e.X) && isIntExpr(e.Y)
+		}
+	case *ast.CallExpr:
+		if id, ok := e.Fun.(*ast.Ident); ok {
+			return id.Name == "quo" || id.Name == "rem" || id.Name == "len"
+		}
+		return isImportCall(e, "math", "Trunc")
+	}
+	return false
+}
+
+var unixTimeHelper = HelperDef{
+	Name:    "_unixTime",
+	Def:     unixTimeDef,
+	Imports: []string{"time"},
+}
+
+// toDateFunc converts toDate and mustToDate. Timestamps without a zone
+// are parsed as UTC rather than in the local zone.
+var toDateFunc = PipelineFunc{
+	Nargs:   1,
+	Imports: []string{"time"},
+	Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
+		return importCall("time", "Parse", args[0], expr)
+	},
+}
+
+// dateModifyFunc converts dateModify and mustDateModify.
+var dateModifyFunc = PipelineFunc{
+	Nargs: 1,
+	Helpers: []HelperDef{unixTimeHelper, {
+		Name:    "_dateModify",
+		Def:     dateModifyDef,
+		Imports: []string{"time"},
+	}},
+	Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
+		return helperOutExpr("_dateModify",
+			&ast.Field{Label: ast.NewIdent("#t"), Value: expr},
+			&ast.Field{Label: ast.NewIdent("#d"), Value: args[0]},
+		)
+	},
+}
+
+var bytesHelper = HelperDef{
+	Name:    "_bytes",
+	Def:     bytesDef,
+	Imports: []string{"encoding/hex", "list", "strconv", "strings"},
+}
+
+// regexReplaceAllLiteralFunc converts regexReplaceAllLiteral and
+// mustRegexReplaceAllLiteral.
+var regexReplaceAllLiteralFunc = PipelineFunc{
+	Nargs:   2,
+	Imports: []string{"regexp"},
+	Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
+		return importCall("regexp", "ReplaceAllLiteral", args[0], args[1], expr)
+	},
+}
+
+// regexFindAllFunc converts regexFindAll and mustRegexFindAll. The
+// piped value is the maximum number of matches.
+var regexFindAllFunc = PipelineFunc{
+	Nargs: 2,
+	Helpers: []HelperDef{{
+		Name:    "_regexFindAll",
+		Def:     regexFindAllDef,
+		Imports: []string{"regexp"},
+	}},
+	Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
+		return helperOutExpr("_regexFindAll",
+			&ast.Field{Label: ast.NewIdent("#re"), Value: args[0]},
+			&ast.Field{Label: ast.NewIdent("#s"), Value: args[1]},
+			&ast.Field{Label: ast.NewIdent("#n"), Value: expr},
+		)
+	},
+}
+
+// regexSplitFunc converts regexSplit and mustRegexSplit. The piped
+// value is the maximum number of parts.
+var regexSplitFunc = PipelineFunc{
+	Nargs: 2,
+	Helpers: []HelperDef{{
+		Name:    "_regexSplit",
+		Def:     regexSplitDef,
+		Imports: []string{"list", "regexp", "strings"},
+	}},
+	Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
+		return helperOutExpr("_regexSplit",
+			&ast.Field{Label: ast.NewIdent("#re"), Value: args[0]},
+			&ast.Field{Label: ast.NewIdent("#s"), Value: args[1]},
+			&ast.Field{Label: ast.NewIdent("#n"), Value: expr},
+		)
+	},
+}
+
 // HelmConfig returns a Config with Helm-specific context objects and
 // Sprig pipeline functions.
 func HelmConfig() *Config {
@@ -155,6 +598,8 @@ func HelmConfig() *Config {
 			"Template":     "#template",
 			"Files":        "#files",
 		},
+		// Helm decodes values.yaml as JSON, so its numbers are float64.
+		Float64Objects: []string{"Values"},
 		FieldRemap: map[string]map[string]string{
 			// Helm's Chart Go struct uses capitalized field names, but
 			// annotations is lowercase in Chart.yaml and in the CUE schema.
@@ -171,6 +616,10 @@ func HelmConfig() *Config {
 			"fromYaml":     {Passthrough: true},
 			"fromJson":     {Passthrough: true},
 			"toString":     {Passthrough: true},
+			// Like fromYaml and fromJson, the array forms assume their
+			// input came from toYaml or toJson of a list.
+			"fromYamlArray": {Passthrough: true},
+			"fromJsonArray": {Passthrough: true},
 
 			// Pipeline no-ops (strip whitespace manipulation — CUE handles formatting).
 			"nindent": {Cosmetic: true},
@@ -289,14 +738,18 @@ func HelmConfig() *Config {
 					return importCall("encoding/base64", "Decode", ast.NewIdent("null"), expr)
 				},
 			},
+			// Sprig's integer functions convert their arguments
+			// with toInt64, which truncates Helm's float64 values.
 			"int": {
+				Imports: []string{"math"},
 				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
-					return binOp(token.AND, ast.NewIdent("int"), expr)
+					return int64Expr(expr)
 				},
 			},
 			"int64": {
+				Imports: []string{"math"},
 				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
-					return binOp(token.AND, ast.NewIdent("int"), expr)
+					return int64Expr(expr)
 				},
 			},
 			"float64": {
@@ -323,39 +776,61 @@ func HelmConfig() *Config {
 				},
 			},
 			"round": {
-				Imports: []string{"math"},
-				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
-					return importCall("math", "Round", expr)
+				Nargs: 1,
+				Helpers: []HelperDef{{
+					Name:    "_round",
+					Def:     roundDef,
+					Imports: []string{"math"},
+				}},
+				Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
+					return helperOutExpr("_round",
+						&ast.Field{Label: ast.NewIdent("#in"), Value: args[0]},
+						&ast.Field{Label: ast.NewIdent("#places"), Value: expr},
+					)
 				},
 			},
 			"add": {
-				Nargs: 1,
+				Nargs:   1,
+				Imports: []string{"math"},
 				Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
-					return binOp(token.ADD, expr, args[0])
+					return binOp(token.ADD, int64Expr(expr), int64Expr(args[0]))
 				},
 			},
 			"sub": {
-				Nargs: 1,
+				Nargs:   1,
+				Imports: []string{"math"},
 				Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
-					return binOp(token.SUB, args[0], expr)
+					return binOp(token.SUB, int64Expr(args[0]), int64Expr(expr))
 				},
 			},
 			"mul": {
-				Nargs: 1,
+				Nargs:   1,
+				Imports: []string{"math"},
 				Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
-					return binOp(token.MUL, expr, args[0])
+					return binOp(token.MUL, int64Expr(expr), int64Expr(args[0]))
 				},
 			},
+			// Go's integer division and remainder truncate toward
+			// zero, as CUE's quo and rem do.
 			"div": {
+				Nargs:   1,
+				Imports: []string{"math"},
+				Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
+					return callExpr("quo", int64Expr(args[0]), int64Expr(expr))
+				},
+			},
+			// divf is true division, which is exact in CUE.
+			"divf": {
 				Nargs: 1,
 				Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
-					return callExpr("div", args[0], expr)
+					return binOp(token.QUO, args[0], expr)
 				},
 			},
 			"mod": {
-				Nargs: 1,
+				Nargs:   1,
+				Imports: []string{"math"},
 				Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
-					return callExpr("mod", args[0], expr)
+					return callExpr("rem", int64Expr(args[0]), int64Expr(expr))
 				},
 			},
 			"join": {
@@ -377,6 +852,10 @@ func HelmConfig() *Config {
 				NonScalar: true,
 				Imports:   []string{"list"},
 				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+					// keys already produces a sorted list.
+					if isImportCall(expr, "list", "SortStrings") {
+						return expr
+					}
 					return importCall("list", "SortStrings", expr)
 				},
 			},
@@ -401,13 +880,21 @@ func HelmConfig() *Config {
 					return importCall("regexp", "Match", args[0], expr)
 				},
 			},
+			// regexReplaceAll regex s repl: the piped value is the
+			// replacement.
 			"regexReplaceAll": {
 				Nargs:   2,
 				Imports: []string{"regexp"},
 				Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
-					return importCall("regexp", "ReplaceAll", args[0], expr, args[1])
+					return importCall("regexp", "ReplaceAll", args[0], args[1], expr)
 				},
 			},
+			"regexReplaceAllLiteral":     regexReplaceAllLiteralFunc,
+			"mustRegexReplaceAllLiteral": regexReplaceAllLiteralFunc,
+			"regexFindAll":               regexFindAllFunc,
+			"mustRegexFindAll":           regexFindAllFunc,
+			"regexSplit":                 regexSplitFunc,
+			"mustRegexSplit":             regexSplitFunc,
 			"regexFind": {
 				Nargs:   1,
 				Imports: []string{"regexp"},
@@ -440,6 +927,121 @@ func HelmConfig() *Config {
 						importCall("crypto/sha256", "Sum256", expr))
 				},
 			},
+			"sha1sum": {
+				Imports: []string{"crypto/sha1", "encoding/hex"},
+				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+					return importCall("encoding/hex", "Encode",
+						importCall("crypto/sha1", "Sum", expr))
+				},
+			},
+			"adler32sum": {
+				Helpers: []HelperDef{bytesHelper, {
+					Name:    "_adler32sum",
+					Def:     adler32sumDef,
+					Imports: []string{"list"},
+				}},
+				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+					return helperOutExpr("_adler32sum",
+						&ast.Field{Label: ast.NewIdent("#in"), Value: expr},
+					)
+				},
+			},
+			"b32enc": {
+				Helpers: []HelperDef{bytesHelper, {
+					Name:    "_b32enc",
+					Def:     b32encDef,
+					Imports: []string{"list", "strings"},
+				}},
+				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+					return helperOutExpr("_b32enc",
+						&ast.Field{Label: ast.NewIdent("#in"), Value: expr},
+					)
+				},
+			},
+			"b32dec": {
+				Helpers: []HelperDef{{
+					Name:    "_b32dec",
+					Def:     b32decDef,
+					Imports: []string{"encoding/hex", "list", "strconv", "strings"},
+				}},
+				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+					return helperOutExpr("_b32dec",
+						&ast.Field{Label: ast.NewIdent("#in"), Value: expr},
+					)
+				},
+			},
+			// urlquery is a text/template builtin. Its single argument
+			// is query-escaped as url.QueryEscape does.
+			"urlquery": {
+				Imports: []string{"net"},
+				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+					return importCall("net", "QueryEscape", expr)
+				},
+			},
+			"urlParse": {
+				Helpers: []HelperDef{{
+					Name:    "_urlParse",
+					Def:     urlParseDef,
+					Imports: []string{"net", "regexp", "strings"},
+				}},
+				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+					return helperOutExpr("_urlParse",
+						&ast.Field{Label: ast.NewIdent("#in"), Value: expr},
+					)
+				},
+			},
+			"urlJoin": {
+				NonScalar: true,
+				Helpers: []HelperDef{{
+					Name:    "_urlJoin",
+					Def:     urlJoinDef,
+					Imports: []string{"net", "strings"},
+				}},
+				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+					return helperOutExpr("_urlJoin",
+						&ast.Field{Label: ast.NewIdent("#in"), Value: expr},
+					)
+				},
+			},
+			"toToml": {
+				NonScalar: true,
+				Helpers: []HelperDef{{
+					Name:    "_toToml",
+					Def:     toTomlDef,
+					Imports: []string{"encoding/json", "list", "strings"},
+				}},
+				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+					return helperOutExpr("_toToml",
+						&ast.Field{Label: ast.NewIdent("#in"), Value: expr},
+					)
+				},
+			},
+			// toDecimal parses the value's string form as an octal
+			// number.
+			"toDecimal": {
+				Imports: []string{"strconv"},
+				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+					return importCall("strconv", "ParseInt",
+						&ast.Interpolation{Elts: []ast.Expr{
+							&ast.BasicLit{Kind: token.STRING, Value: `"\(`},
+							expr,
+							&ast.BasicLit{Kind: token.STRING, Value: `)"`},
+						}},
+						cueInt(8), cueInt(64))
+				},
+			},
+			"toStrings": {
+				NonScalar: true,
+				Helpers: []HelperDef{{
+					Name: "_toStrings",
+					Def:  toStringsDef,
+				}},
+				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+					return helperOutExpr("_toStrings",
+						&ast.Field{Label: ast.NewIdent("#in"), Value: expr},
+					)
+				},
+			},
 			"last": {
 				NonScalar: true,
 				Helpers: []HelperDef{{
@@ -492,10 +1094,13 @@ func HelmConfig() *Config {
 					)
 				},
 			},
+			// keys and values follow sorted key order, matching the
+			// order in which range visits a Go map.
 			"keys": {
 				NonScalar: true,
+				Imports:   []string{"list"},
 				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
-					return &ast.ListLit{Elts: []ast.Expr{
+					return importCall("list", "SortStrings", &ast.ListLit{Elts: []ast.Expr{
 						&ast.Comprehension{
 							Clauses: []ast.Clause{
 								&ast.ForClause{
@@ -508,26 +1113,49 @@ func HelmConfig() *Config {
 								&ast.EmbedDecl{Expr: ast.NewIdent("k")},
 							}},
 						},
-					}}
+					}})
 				},
 			},
 			"values": {
 				NonScalar: true,
+				Imports:   []string{"list"},
+				Helpers: []HelperDef{{
+					Name:    "_values",
+					Def:     valuesDef,
+					Imports: []string{"list"},
+				}},
 				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
-					return &ast.ListLit{Elts: []ast.Expr{
-						&ast.Comprehension{
-							Clauses: []ast.Clause{
-								&ast.ForClause{
-									Key:    ast.NewIdent("_"),
-									Value:  ast.NewIdent("v"),
-									Source: expr,
-								},
-							},
-							Value: &ast.StructLit{Elts: []ast.Decl{
-								&ast.EmbedDecl{Expr: ast.NewIdent("v")},
-							}},
-						},
-					}}
+					return helperOutExpr("_values",
+						&ast.Field{Label: ast.NewIdent("#arg"), Value: expr},
+					)
+				},
+			},
+			// Dates are RFC 3339 strings, as produced by now (see
+			// inputs.go) and toDate. Sprig formats in the local zone;
+			// CUE keeps each timestamp's own offset.
+			"date": {
+				Nargs:   1,
+				Imports: []string{"time"},
+				Convert: func(expr ast.Expr, args []ast.Expr) ast.Expr {
+					return importCall("time", "FormatString", args[0], expr)
+				},
+			},
+			"htmlDate": {
+				Imports: []string{"time"},
+				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+					return importCall("time", "FormatString", cueString("2006-01-02"), expr)
+				},
+			},
+			"toDate":         toDateFunc,
+			"mustToDate":     toDateFunc,
+			"dateModify":     dateModifyFunc,
+			"mustDateModify": dateModifyFunc,
+			"unixEpoch": {
+				Helpers: []HelperDef{unixTimeHelper},
+				Convert: func(expr ast.Expr, _ []ast.Expr) ast.Expr {
+					return helperOutExpr("_unixTime",
+						&ast.Field{Label: ast.NewIdent("#t"), Value: expr},
+					)
 				},
 			},
 			"set": {
@@ -0,0 +1,397 @@
+// Copyright 2026 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm2cue
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template/parse"
+
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/token"
+)
+
+// inputField is a value that a template computes non-deterministically
+// (the current time, a random string, a bcrypt hash). CUE evaluation
+// is hermetic, so each such call site is lifted into a field of the
+// generated #inputs definition, which the user supplies with
+// cue -t <name>=<value>.
+type inputField struct {
+	name  string
+	value ast.Expr // type constraint for the supplied value
+	tag   string   // @tag attribute arguments; empty when value tags its own fields
+	cert  ast.Expr // #certs entry describing how gen-certs creates the value, if any
+}
+
+// uuidPattern matches the canonical form of a version 4 UUID.
+const uuidPattern = `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`
+
+// randCharsets maps Sprig's random string functions to the characters
+// they draw from.
+var randCharsets = map[string]string{
+	"randAlphaNum": "0-9A-Za-z",
+	"randAlpha":    "A-Za-z",
+	"randNumeric":  "0-9",
+	"randAscii":    " -~",
+}
+
+// addInput lifts a non-deterministic value into #inputs and returns a
+// reference to it.
+func (c *converter) addInput(fn string, value ast.Expr) (ast.Expr, error) {
+	name, err := c.reserveInputName(fn)
+	if err != nil {
+		return nil, err
+	}
+	c.usedInputs[name] = inputField{name: name, value: value, tag: name}
+	return selExpr(ast.NewIdent("#inputs"), name), nil
+}
+
+// reserveInputName picks a name for an input lifted from a call to fn.
+// The input is named after the variable being assigned or the YAML key
+// being set, falling back to the function name, and made unique across
+// all templates of the conversion. The name now is kept for the
+// timestamp that convertNow shares between its call sites.
+//
+// A call inside a range is rejected: Helm draws a new value on each
+// iteration, but a single input would hold the same value for all.
+func (c *converter) reserveInputName(fn string) (string, error) {
+	if c.inLoop() {
+		return "", codeErrorf(CodeUnsupportedConstruct, "%s inside range: each iteration would share one #inputs value; call it outside the range", fn)
+	}
+	hint := c.inputHint
+	if hint == "" {
+		switch {
+		case c.state == statePendingKey && c.pendingKey != "":
+			hint = c.pendingKey
+		case c.inlineKey != "":
+			hint = c.inlineKey
+		case c.blockScalarKey != "":
+			hint = c.blockScalarKey
+		case c.quotedScalarKey != "":
+			hint = c.quotedScalarKey
+		}
+	}
+	var base string
+	if hint != "" {
+		base = strings.TrimLeft(sanitizeIdentifier(hint), "_")
+	}
+	if base == "" || base[0] >= '0' && base[0] <= '9' {
+		base = fn
+	}
+	name := base
+	for i := 2; c.inputNames[name] || name == "now"; i++ {
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+	c.inputNames[name] = true
+	return name, nil
+}
+
+// inputsDecls builds the #inputs definition from the lifted inputs,
+// sorted by name, followed by a #certs definition describing the
+// certificates and keys among them.
+func inputsDecls(inputs map[string]inputField) []ast.Decl {
+	var fields, certs []ast.Decl
+	for _, name := range slices.Sorted(maps.Keys(inputs)) {
+		in := inputs[name]
+		f := &ast.Field{Label: ast.NewIdent(in.name), Value: in.value}
+		if in.tag != "" {
+			f.Attrs = []*ast.Attribute{{Text: "@tag(" + in.tag + ")"}}
+		}
+		fields = append(fields, f)
+		if in.cert != nil {
+			certs = append(certs, &ast.Field{Label: ast.NewIdent(in.name), Value: in.cert})
+		}
+	}
+	decls := []ast.Decl{&ast.Field{
+		Label: ast.NewIdent("#inputs"),
+		Value: &ast.StructLit{Elts: fields},
+	}}
+	if len(certs) > 0 {
+		decls = append(decls, &ast.Field{
+			Label: ast.NewIdent("#certs"),
+			Value: &ast.StructLit{Elts: certs},
+		})
+	}
+	return decls
+}
+
+// certFileDecls builds the declarations that fill certificate and key
+// inputs from PEM files under certs/, as written by helm2cue gen-certs.
+// Missing files leave the inputs to be supplied with tags.
+func certFileDecls(inputs map[string]inputField) string {
+	var buf strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(inputs)) {
+		in := inputs[name]
+		if in.cert == nil {
+			continue
+		}
+		if _, ok := in.value.(*ast.StructLit); ok {
+			for _, f := range []struct{ field, ext string }{{"Cert", "crt"}, {"Key", "key"}} {
+				file := strconv.Quote("certs/" + name + "." + f.ext)
+				fmt.Fprintf(&buf, "\tif _certFiles[%s] != _|_ {%s: %s: _certFiles[%s]}\n", file, name, f.field, file)
+			}
+		} else {
+			file := strconv.Quote("certs/" + name + ".key")
+			fmt.Fprintf(&buf, "\tif _certFiles[%s] != _|_ {%s: _certFiles[%s]}\n", file, name, file)
+		}
+	}
+	if buf.Len() == 0 {
+		return ""
+	}
+	return "_certFiles: _ @embed(glob=certs/*, type=text, allowEmptyGlob)\n\n#inputs: {\n" + buf.String() + "}\n"
+}
+
+// convertNow handles Sprig's now. All call sites share a single
+// RFC 3339 timestamp input, which cue -T fills in with the current
+// time when no explicit value is given.
+func convertNow(c *converter, args []funcArg) (ast.Expr, string, error) {
+	if len(args) != 0 {
+		return nil, "", fmt.Errorf("now takes no arguments, got %d", len(args))
+	}
+	c.inputNames["now"] = true
+	c.usedInputs["now"] = inputField{
+		name:  "now",
+		value: importSel("time", "Time"),
+		tag:   "now,var=now",
+	}
+	return selExpr(ast.NewIdent("#inputs"), "now"), "", nil
+}
+
+// convertRandString handles randAlphaNum, randAlpha, randNumeric and
+// randAscii. The input is constrained to the function's character set
+// and, when the count is a literal, to its length.
+func convertRandString(fn string) func(c *converter, args []funcArg) (ast.Expr, string, error) {
+	return func(c *converter, args []funcArg) (ast.Expr, string, error) {
+		if len(args) != 1 {
+			return nil, "", fmt.Errorf("%s requires 1 argument, got %d", fn, len(args))
+		}
+		value := ast.Expr(binOp(token.AND, ast.NewIdent("string"),
+			&ast.UnaryExpr{Op: token.MAT, X: cueString("^[" + randCharsets[fn] + "]*$")}))
+		if n, ok := args[0].node.(*parse.NumberNode); ok && n.IsInt {
+			count := cueInt(int(n.Int64))
+			value = binOp(token.AND,
+				binOp(token.AND, value, importCall("strings", "MinRunes", count)),
+				importCall("strings", "MaxRunes", count))
+		}
+		ref, err := c.addInput(fn, value)
+		return ref, "", err
+	}
+}
+
+// convertUUIDv4 handles Sprig's uuidv4.
+func convertUUIDv4(c *converter, args []funcArg) (ast.Expr, string, error) {
+	if len(args) != 0 {
+		return nil, "", fmt.Errorf("uuidv4 takes no arguments, got %d", len(args))
+	}
+	value := binOp(token.AND, ast.NewIdent("string"),
+		&ast.UnaryExpr{Op: token.MAT, X: cueString(uuidPattern)})
+	ref, err := c.addInput("uuidv4", value)
+	return ref, "", err
+}
+
+// convertHtpasswd handles Sprig's htpasswd user password, which
+// produces "user:<bcrypt hash>". The hash is salted randomly, so it
+// becomes the input; the username is kept as an expression. The
+// password argument is not needed in CUE and is only the user's
+// guide to which hash to supply.
+func convertHtpasswd(c *converter, args []funcArg) (ast.Expr, string, error) {
+	if len(args) != 2 {
+		return nil, "", fmt.Errorf("htpasswd requires 2 arguments, got %d", len(args))
+	}
+	user, helmObj, err := c.resolveExpr(args[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("htpasswd username: %w", err)
+	}
+	value := binOp(token.AND, ast.NewIdent("string"),
+		&ast.UnaryExpr{Op: token.MAT, X: cueString(`^\$2[aby]?\$`)})
+	hash, err := c.addInput("htpasswd", value)
+	if err != nil {
+		return nil, "", err
+	}
+	return partsToExpr([]inlinePart{toInlinePart(user), {text: ":"}, toInlinePart(hash)}), helmObj, nil
+}
+
+// convertDateInZone handles dateInZone fmt time zone. Converting
+// between time zones needs a time zone database, which CUE does not
+// have, so only UTC and Local (the timestamp's own offset) are
+// supported.
+func convertDateInZone(c *converter, args []funcArg) (ast.Expr, string, error) {
+	if len(args) != 3 {
+		return nil, "", fmt.Errorf("dateInZone requires 3 arguments, got %d", len(args))
+	}
+	layout, err := c.resolveLiteral(args[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("dateInZone format: %w", err)
+	}
+	return dateInZoneExpr(c, "dateInZone", layout, args[1], args[2])
+}
+
+// convertHTMLDateInZone handles htmlDateInZone time zone.
+func convertHTMLDateInZone(c *converter, args []funcArg) (ast.Expr, string, error) {
+	if len(args) != 2 {
+		return nil, "", fmt.Errorf("htmlDateInZone requires 2 arguments, got %d", len(args))
+	}
+	return dateInZoneExpr(c, "htmlDateInZone", cueString("2006-01-02"), args[0], args[1])
+}
+
+// dateInZoneExpr formats a timestamp in the given literal zone.
+func dateInZoneExpr(c *converter, fn string, layout ast.Expr, timeArg, zoneArg funcArg) (ast.Expr, string, error) {
+	t, helmObj, err := c.resolveExpr(timeArg)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s time: %w", fn, err)
+	}
+	zoneExpr, err := c.resolveLiteral(zoneArg)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s zone: %w", fn, err)
+	}
+	lit, ok := zoneExpr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return nil, "", fmt.Errorf("%s: time zone must be a string literal", fn)
+	}
+	zone, err := strconv.Unquote(lit.Value)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", fn, err)
+	}
+	switch zone {
+	case "Local":
+	case "", "UTC", "Etc/UTC":
+		// time.Parse normalizes a timestamp to UTC.
+		t = importCall("time", "Parse", importSel("time", "RFC3339Nano"), t)
+	default:
+		return nil, "", fmt.Errorf("%s: time zone %q cannot be converted; only UTC and Local are supported", fn, zone)
+	}
+	return importCall("time", "FormatString", layout, t), helmObj, nil
+}
+
+// certKinds maps Sprig's certificate functions to the kind recorded in
+// #certs for helm2cue gen-certs.
+var certKinds = map[string]string{
+	"genCA":             "ca",
+	"genSelfSignedCert": "selfSigned",
+	"genSignedCert":     "signed",
+}
+
+// convertGenCert handles genCA cn days, genSelfSignedCert cn ips dns
+// days and genSignedCert cn ips dns days ca. The result is lifted into
+// a {Cert, Key} input, and the arguments are recorded in #certs so
+// that helm2cue gen-certs can create matching PEM files.
+func convertGenCert(fn string) func(c *converter, args []funcArg) (ast.Expr, string, error) {
+	argNames := map[string][]string{
+		"genCA":             {"cn", "days"},
+		"genSelfSignedCert": {"cn", "ips", "dns", "days"},
+		"genSignedCert":     {"cn", "ips", "dns", "days", "ca"},
+	}[fn]
+	return func(c *converter, args []funcArg) (ast.Expr, string, error) {
+		if len(args) != len(argNames) {
+			return nil, "", fmt.Errorf("%s requires %d arguments, got %d", fn, len(argNames), len(args))
+		}
+		spec := []ast.Decl{&ast.Field{Label: ast.NewIdent("kind"), Value: cueString(certKinds[fn])}}
+		for i, argName := range argNames {
+			var value ast.Expr
+			if _, ok := args[i].node.(*parse.NilNode); ok {
+				value = &ast.ListLit{}
+			} else {
+				e, obj, err := c.resolveExpr(args[i])
+				if err != nil {
+					return nil, "", fmt.Errorf("%s %s argument: %w", fn, argName, err)
+				}
+				if obj != "" {
+					c.usedContextObjects[obj] = true
+					// The ips and dns arguments are lists.
+					if refs := c.fieldRefs[obj]; len(refs) > 0 && (argName == "ips" || argName == "dns") {
+						c.trackNonScalarRef(obj, refs[len(refs)-1])
+					}
+				}
+				value = e
+			}
+			if argName == "ca" {
+				caName, ok := inputRefName(value)
+				if !ok || c.usedInputs[caName].cert == nil {
+					return nil, "", fmt.Errorf("%s: the CA argument must be the result of genCA", fn)
+				}
+				value = cueString(caName)
+			}
+			spec = append(spec, &ast.Field{Label: ast.NewIdent(argName), Value: value})
+		}
+		name, err := c.reserveInputName(fn)
+		if err != nil {
+			return nil, "", err
+		}
+		c.usedInputs[name] = inputField{
+			name: name,
+			value: &ast.StructLit{Elts: []ast.Decl{
+				&ast.Field{
+					Label: ast.NewIdent("Cert"),
+					Value: ast.NewIdent("string"),
+					Attrs: []*ast.Attribute{{Text: "@tag(" + name + "_cert)"}},
+				},
+				&ast.Field{
+					Label: ast.NewIdent("Key"),
+					Value: ast.NewIdent("string"),
+					Attrs: []*ast.Attribute{{Text: "@tag(" + name + "_key)"}},
+				},
+			}},
+			cert: &ast.StructLit{Elts: spec},
+		}
+		return selExpr(ast.NewIdent("#inputs"), name), "", nil
+	}
+}
+
+// convertGenPrivateKey handles genPrivateKey type, lifting the PEM
+// encoded key into a string input.
+func convertGenPrivateKey(c *converter, args []funcArg) (ast.Expr, string, error) {
+	if len(args) != 1 {
+		return nil, "", fmt.Errorf("genPrivateKey requires 1 argument, got %d", len(args))
+	}
+	keyType, err := c.resolveLiteral(args[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("genPrivateKey type argument: %w", err)
+	}
+	name, err := c.reserveInputName("genPrivateKey")
+	if err != nil {
+		return nil, "", err
+	}
+	c.usedInputs[name] = inputField{
+		name:  name,
+		value: ast.NewIdent("string"),
+		tag:   name,
+		cert: &ast.StructLit{Elts: []ast.Decl{
+			&ast.Field{Label: ast.NewIdent("kind"), Value: cueString("key")},
+			&ast.Field{Label: ast.NewIdent("type"), Value: keyType},
+		}},
+	}
+	return selExpr(ast.NewIdent("#inputs"), name), "", nil
+}
+
+// inputRefName reports the input name referenced by an expression of
+// the form #inputs.name.
+func inputRefName(e ast.Expr) (string, bool) {
+	sel, ok := e.(*ast.SelectorExpr)
+	if !ok {
+		return "", false
+	}
+	x, ok := sel.X.(*ast.Ident)
+	if !ok || x.Name != "#inputs" {
+		return "", false
+	}
+	name, ok := sel.Sel.(*ast.Ident)
+	if !ok {
+		return "", false
+	}
+	return name.Name, true
+}
@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package helm2cue
 
 import (
 	"fmt"
@@ -89,7 +89,7 @@ func TestConvertChartIntegration(t *testing.T) {
 				fmt.Fprintf(&log, format, args...)
 			}
 
-			if err := ConvertChart(chartDir, outDir, ChartOptions{Logf: logf}); err != nil {
+			if _, err := ConvertChart(chartDir, outDir, ChartOptions{Logf: logf}); err != nil {
 				log.WriteString(fmt.Sprintf("ConvertChart error: %v\n", err))
 			}
 
@@ -0,0 +1,1477 @@
+// Copyright 2026 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm2cue
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/format"
+	"cuelang.org/go/cue/parser"
+	"cuelang.org/go/cue/token"
+)
+
+// Jinja2 templates are converted by translating them to text/template
+// templates that use Sprig's functions, which the converter then turns
+// into CUE as it does any other template: {% if %} becomes {{ if }},
+// {% for x in xs %} becomes {{ range $x := xs }}, a macro becomes a
+// define called with include, and a filter becomes a pipeline function.
+// Variables become fields of the root context, as $.name, or of
+// Config.RootObject if set. The translation keeps each line of the
+// template on its own line, so that diagnostics refer to the lines of
+// the Jinja template.
+
+// JinjaConfig returns a Config for converting Jinja2 templates, such as
+// those of Ansible roles, with ConvertJinja. The variables of the
+// template become the fields of #values, and the Jinja2 and Ansible
+// filters that have CUE equivalents are converted.
+func JinjaConfig() *Config {
+	cfg := HelmConfig()
+	cfg.ContextObjects = map[string]string{"Values": "#values"}
+	cfg.FieldRemap = nil
+	cfg.Float64Objects = nil
+	// The root context holds the variables. RootExpr stays empty, as
+	// in HelmConfig, so that a macro refers to its parameters through
+	// #arg, the argument of its include.
+	cfg.RootObject = "Values"
+	// Ansible's lookup reads files and other sources, not Kubernetes.
+	delete(cfg.Funcs, "lookup")
+	return cfg
+}
+
+// ConvertJinja is like ConvertTemplate for input, a Jinja2 template
+// that produces YAML. The helpers are Jinja2 files whose macros input
+// calls, such as those it imports with {% import %} or {% from %}.
+//
+// Templates are rendered with Ansible's defaults: the first newline
+// after a block tag is removed (trim_blocks), unless a first line such
+// as "#jinja2: trim_blocks: False" says otherwise, as it does for
+// Ansible.
+func ConvertJinja(cfg *Config, input []byte, helpers ...[]byte) (*Result, error) {
+	files := append([][]byte{input}, helpers...)
+	tr := &jinjaTranslator{root: cfg.RootObject, macros: make(map[string][]jinjaParam)}
+	tr.left, tr.right = cfg.delims()
+	scanned := make([]*jinjaFile, len(files))
+	for i, src := range files {
+		var err error
+		if scanned[i], err = scanJinja(string(src)); err != nil {
+			return jinjaFail(cfg, i, err)
+		}
+		if err := tr.collectMacros(scanned[i].items); err != nil {
+			return jinjaFail(cfg, i, err)
+		}
+	}
+	texts := make([][]byte, len(files))
+	for i := range files {
+		text, err := tr.translate(scanned[i])
+		if err != nil {
+			return jinjaFail(cfg, i, err)
+		}
+		texts[i] = []byte(text)
+	}
+	return ConvertTemplate(cfg, texts[0], texts[1:]...)
+}
+
+// ConvertAnsibleDefaults is like ConvertJinja for input, the
+// defaults/main.yml of an Ansible role, but the CUE of its result gives
+// the fields of #values the defaults, rather than producing output:
+// app_port: 8080 becomes app_port: *8080 | _ in #values. The defaults
+// may use Jinja2 expressions, as in "http://{{ app_host }}", which
+// refer to the fields of #values. The result unifies with the CUE that
+// ConvertJinja produces for the role's templates.
+func ConvertAnsibleDefaults(cfg *Config, input []byte) (*Result, error) {
+	res, err := ConvertJinja(cfg, input)
+	if err != nil {
+		return res, err
+	}
+	f, err := parser.ParseFile("", res.CUE, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("parsing converted defaults: %w", err)
+	}
+	found := false
+	for i, decl := range f.Decls {
+		field, ok := decl.(*ast.Field)
+		if !ok {
+			continue
+		}
+		if name, _, _ := ast.LabelName(field.Label); name != "output" {
+			continue
+		}
+		list, ok := field.Value.(*ast.ListLit)
+		if !ok || len(list.Elts) != 1 {
+			return nil, fmt.Errorf("defaults must be a single YAML document")
+		}
+		body, ok := list.Elts[0].(*ast.StructLit)
+		if !ok {
+			return nil, fmt.Errorf("defaults must be a YAML mapping")
+		}
+		for _, elt := range body.Elts {
+			if def, ok := elt.(*ast.Field); ok {
+				def.Value = &ast.BinaryExpr{
+					X:  &ast.UnaryExpr{Op: token.MUL, X: def.Value},
+					Op: token.OR,
+					Y:  ast.NewIdent("_"),
+				}
+			}
+		}
+		f.Decls[i] = &ast.Field{Label: ast.NewIdent("#values"), Value: &ast.StructLit{Elts: body.Elts}}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("defaults must be a YAML mapping")
+	}
+	if res.CUE, err = format.Node(f, format.Simplify()); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// jinjaFail returns the result and error of ConvertJinja for err, an
+// error translating the ith file given to it.
+func jinjaFail(cfg *Config, i int, err error) (*Result, error) {
+	d := newDiagnostic(cfg, SeverityError, err.Error(), err)
+	if je, ok := err.(*jinjaError); ok {
+		d.Code = je.code
+		d.Hint = codeHints[je.code]
+		d.Line = je.line
+		d.Construct = je.construct
+	}
+	if i > 0 {
+		d.File = fmt.Sprintf("helper%d", i-1)
+	}
+	return &Result{Diagnostics: []Diagnostic{d}}, err
+}
+
+// jinjaError is an error translating a Jinja2 template.
+type jinjaError struct {
+	code      string // CodeParseError or CodeUnsupportedConstruct
+	line      int
+	construct string // the tag, as written
+	msg       string
+}
+
+func (e *jinjaError) Error() string {
+	return fmt.Sprintf("jinja: line %d: %s", e.line, e.msg)
+}
+
+// jinjaItem is the text between tags of a Jinja2 template, or a tag.
+type jinjaItem struct {
+	kind      byte   // 0 for text, or '{', '%' or '#' for the kinds of tag
+	text      string // the text, or the body of the tag, trimmed
+	raw       string // the tag as written
+	trimLeft  bool   // the tag starts with {{-, {%- or {#-
+	trimRight bool   // the tag ends with -}}, -%} or -#}
+	noLstrip  bool   // the tag starts with {%+
+	literal   bool   // text of a {% raw %} block
+	line      int    // the line of the start of the item
+}
+
+// jinjaHeaderRe matches Ansible's first line of Jinja2 settings.
+var jinjaHeaderRe = regexp.MustCompile(`^#jinja2:([^\n]*)\n`)
+
+// jinjaRawEndRe matches the tag ending a {% raw %} block.
+var jinjaRawEndRe = regexp.MustCompile(`\{%-?\s*endraw\s*[-+]?%\}`)
+
+// jinjaTranslator translates Jinja2 templates to text/template.
+type jinjaTranslator struct {
+	root        string                  // Config.RootObject
+	macros      map[string][]jinjaParam // the parameters of each macro
+	left, right string                  // the action delimiters of Config
+
+	// Per template state.
+	file    *jinjaFile
+	pos     int               // the index in file.items of the current tag
+	aliases map[string]string // names of imported macros and modules
+	out     strings.Builder
+	blocks  []jinjaBlock
+	scopes  []map[string]string // Jinja variables to text/template expressions
+	macro   string              // the macro being translated, if any
+	loops   int                 // the number of loop index variables declared
+}
+
+// jinjaFile is a scanned Jinja2 template.
+type jinjaFile struct {
+	items        []jinjaItem
+	trimBlocks   bool
+	lstripBlocks bool
+}
+
+// jinjaParam is a parameter of a macro.
+type jinjaParam struct {
+	name string
+	def  jexpr // the default, or nil
+}
+
+// jinjaBlock is a block tag that is open during translation.
+type jinjaBlock struct {
+	kind string // if, for or macro
+	ends int    // the number of {{end}} actions that close it
+	loop string // for a for block, its loop index variable, if any
+	line int    // the line of the tag that opened it
+}
+
+// scanJinja splits src into text and tags.
+func scanJinja(src string) (*jinjaFile, error) {
+	f := &jinjaFile{trimBlocks: true}
+	line := 1
+	var items []jinjaItem
+	if m := jinjaHeaderRe.FindStringSubmatch(src); m != nil {
+		for setting := range strings.SplitSeq(m[1], ",") {
+			name, value, _ := strings.Cut(setting, ":")
+			on := strings.EqualFold(strings.TrimSpace(value), "true")
+			switch strings.TrimSpace(name) {
+			case "trim_blocks":
+				f.trimBlocks = on
+			case "lstrip_blocks":
+				f.lstripBlocks = on
+			}
+		}
+		// Keep the line as an empty comment, so that lines are
+		// unchanged.
+		items = append(items, jinjaItem{kind: '#', text: "\n", raw: m[0], line: 1})
+		src = src[len(m[0]):]
+		line = 2
+	}
+	for src != "" {
+		i := jinjaTagStart(src)
+		if i < 0 {
+			items = append(items, jinjaItem{text: src, line: line})
+			break
+		}
+		if i > 0 {
+			items = append(items, jinjaItem{text: src[:i], line: line})
+			line += strings.Count(src[:i], "\n")
+			src = src[i:]
+		}
+		kind := src[1]
+		end := jinjaTagEnd(src, kind)
+		if end < 0 {
+			return nil, &jinjaError{code: CodeParseError, line: line, construct: firstLine(src), msg: "unclosed tag"}
+		}
+		it := jinjaItem{kind: kind, raw: src[:end], line: line}
+		body := src[2 : end-2]
+		if strings.HasPrefix(body, "-") {
+			it.trimLeft, body = true, body[1:]
+		} else if strings.HasPrefix(body, "+") {
+			it.noLstrip, body = true, body[1:]
+		}
+		if strings.HasSuffix(body, "-") {
+			it.trimRight, body = true, body[:len(body)-1]
+		} else if strings.HasSuffix(body, "+") {
+			body = body[:len(body)-1]
+		}
+		it.text = strings.TrimSpace(body)
+		line += strings.Count(it.raw, "\n")
+		src = src[end:]
+		items = append(items, it)
+		if kind == '%' && it.text == "raw" {
+			loc := jinjaRawEndRe.FindStringIndex(src)
+			if loc == nil {
+				return nil, &jinjaError{code: CodeParseError, line: it.line, construct: it.raw, msg: "raw block without endraw"}
+			}
+			items = append(items, jinjaItem{text: src[:loc[0]], literal: true, line: line})
+			line += strings.Count(src[:loc[0]], "\n")
+			end := src[loc[0]:loc[1]]
+			items = append(items, jinjaItem{kind: '%', text: "endraw", raw: end, line: line,
+				trimLeft: strings.HasPrefix(end, "{%-"), trimRight: strings.HasSuffix(end, "-%}")})
+			src = src[loc[1]:]
+		}
+	}
+	f.items = items
+	return f, nil
+}
+
+// jinjaTagStart returns the index of the first tag in s, or -1.
+func jinjaTagStart(s string) int {
+	for i := 0; i+1 < len(s); i++ {
+		if s[i] == '{' && (s[i+1] == '{' || s[i+1] == '%' || s[i+1] == '#') {
+			return i
+		}
+	}
+	return -1
+}
+
+// jinjaTagEnd returns the index just past the end of the tag of the
+// given kind that s starts with, or -1. The end of a tag within one of
+// its string literals does not end it.
+func jinjaTagEnd(s string, kind byte) int {
+	closer := string(kind) + "}"
+	if kind == '{' {
+		closer = "}}"
+	}
+	if kind == '#' {
+		if i := strings.Index(s[2:], closer); i >= 0 {
+			return i + 4
+		}
+		return -1
+	}
+	var quote byte
+	for i := 2; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case strings.HasPrefix(s[i:], closer):
+			return i + 2
+		}
+	}
+	return -1
+}
+
+// firstLine returns the first line of s.
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
+
+// jinjaMacroRe matches the start of a macro tag.
+var jinjaMacroRe = regexp.MustCompile(`^macro\s+([A-Za-z_]\w*)\s*\(`)
+
+// collectMacros records the parameters of the macros of items, so that
+// calls can be translated before the macro is.
+func (tr *jinjaTranslator) collectMacros(items []jinjaItem) error {
+	for _, it := range items {
+		if it.kind != '%' || !jinjaMacroRe.MatchString(it.text) {
+			continue
+		}
+		p, err := newJinjaParser(it, strings.TrimPrefix(it.text, "macro"))
+		if err != nil {
+			return err
+		}
+		name, params, err := p.macroSignature()
+		if err != nil {
+			return err
+		}
+		tr.macros[name] = params
+	}
+	return nil
+}
+
+// translate returns the text/template translation of the template of
+// items.
+func (tr *jinjaTranslator) translate(f *jinjaFile) (string, error) {
+	items := f.items
+	tr.out.Reset()
+	tr.blocks = nil
+	tr.scopes = []map[string]string{{}}
+	tr.aliases = make(map[string]string)
+	tr.macro = ""
+	tr.loops = 0
+	tr.file = f
+	for i := 0; i < len(items); i++ {
+		tr.pos = i
+		it := items[i]
+		if it.kind == 0 {
+			// Text that looks like an action, as in a raw block or
+			// with other delimiters, is written as a string.
+			text := strings.ReplaceAll(it.text, tr.left, tr.left+strconv.Quote(tr.left)+tr.right)
+			tr.out.WriteString(text)
+			continue
+		}
+		// A newline that trim_blocks removes after a block tag is
+		// written within the action, to keep the lines of the template.
+		trailing := ""
+		if it.kind != '{' && f.trimBlocks && !it.trimRight && i+1 < len(items) && items[i+1].kind == 0 {
+			next := &items[i+1]
+			if rest, ok := strings.CutPrefix(next.text, "\n"); ok {
+				trailing, next.text = "\n", rest
+			} else if rest, ok := strings.CutPrefix(next.text, "\r\n"); ok {
+				trailing, next.text = "\n", rest
+			}
+		}
+		if it.kind != '{' && f.lstripBlocks && !it.noLstrip && !it.trimLeft {
+			tr.lstrip()
+		}
+		action, err := tr.tag(it)
+		if err != nil {
+			return "", err
+		}
+		if action == "" && it.kind != '#' && trailing == "" && !it.trimLeft && !it.trimRight {
+			continue
+		}
+		tr.writeAction(it, action, trailing)
+	}
+	if len(tr.blocks) > 0 {
+		b := tr.blocks[len(tr.blocks)-1]
+		return "", &jinjaError{code: CodeParseError, line: b.line, msg: fmt.Sprintf("unclosed %s block", b.kind)}
+	}
+	return tr.out.String(), nil
+}
+
+// lstrip removes the spaces and tabs that start the current line of
+// the output, as lstrip_blocks does before a block tag.
+func (tr *jinjaTranslator) lstrip() {
+	s := tr.out.String()
+	trimmed := strings.TrimRight(s, " \t")
+	if len(trimmed) == len(s) || (trimmed != "" && !strings.HasSuffix(trimmed, "\n")) {
+		return
+	}
+	tr.out.Reset()
+	tr.out.WriteString(trimmed)
+}
+
+// writeAction writes action as the translation of the tag it, with the
+// whitespace control of the tag and the newlines within it, followed
+// by trailing.
+func (tr *jinjaTranslator) writeAction(it jinjaItem, action, trailing string) {
+	newlines := strings.Repeat("\n", strings.Count(it.raw, "\n")) + trailing
+	left, right := tr.left, tr.right
+	if it.trimLeft {
+		left += "- "
+	}
+	if it.trimRight {
+		right = " -" + right
+	}
+	if it.kind == '#' || action == "" {
+		// A comment, with the text of a Jinja comment or with none
+		// for a tag that translates to nothing.
+		text := ""
+		if it.kind == '#' {
+			text = strings.ReplaceAll(it.text, "*/", "* /")
+			newlines = trailing
+		}
+		tr.out.WriteString(left + "/*" + text + newlines + "*/" + right)
+		return
+	}
+	tr.out.WriteString(left + action + newlines + right)
+}
+
+// tag returns the text of the action that a tag translates to, or ""
+// for a tag that translates to none.
+func (tr *jinjaTranslator) tag(it jinjaItem) (string, error) {
+	switch it.kind {
+	case '#':
+		return "", nil
+	case '{':
+		p, err := newJinjaParser(it, it.text)
+		if err != nil {
+			return "", err
+		}
+		e, err := p.parseExpr()
+		if err == nil {
+			err = p.expectEnd()
+		}
+		if err != nil {
+			return "", err
+		}
+		if f, ok := e.(*jFilter); ok && f.name == "indent" && !it.trimLeft {
+			return tr.indentLine(p, f)
+		}
+		return tr.pipeline(p, e)
+	}
+	keyword, rest, _ := strings.Cut(it.text, " ")
+	rest = strings.TrimSpace(rest)
+	if i := strings.IndexAny(keyword, "(\t\n"); i >= 0 {
+		keyword, rest = keyword[:i], strings.TrimSpace(it.text[i:])
+	}
+	p, err := newJinjaParser(it, rest)
+	if err != nil {
+		return "", err
+	}
+	switch keyword {
+	case "if", "elif":
+		if keyword == "elif" && !tr.inBlock("if") {
+			return "", p.errorf("elif outside if")
+		}
+		cond, err := p.parseExpr()
+		if err == nil {
+			err = p.expectEnd()
+		}
+		if err != nil {
+			return "", err
+		}
+		s, err := tr.pipeline(p, cond)
+		if err != nil {
+			return "", err
+		}
+		if keyword == "elif" {
+			return "else if " + s, nil
+		}
+		tr.blocks = append(tr.blocks, jinjaBlock{kind: "if", ends: 1, line: p.it.line})
+		return "if " + s, nil
+	case "else":
+		if len(tr.blocks) == 0 || tr.blocks[len(tr.blocks)-1].kind == "macro" {
+			return "", p.errorf("else outside if or for")
+		}
+		b := tr.blocks[len(tr.blocks)-1]
+		if b.ends > 1 {
+			return "", p.unsupported("else of a for loop with an if filter")
+		}
+		if b.kind == "for" {
+			// The else branch of a loop is outside the loop's scope.
+			tr.scopes = tr.scopes[:len(tr.scopes)-1]
+			tr.scopes = append(tr.scopes, map[string]string{})
+		}
+		return "else", nil
+	case "endif", "endfor", "endmacro":
+		kind := strings.TrimPrefix(keyword, "end")
+		if !tr.inBlock(kind) || tr.blocks[len(tr.blocks)-1].kind != kind {
+			return "", p.errorf("unexpected %s", keyword)
+		}
+		b := tr.blocks[len(tr.blocks)-1]
+		tr.blocks = tr.blocks[:len(tr.blocks)-1]
+		switch kind {
+		case "for":
+			tr.scopes = tr.scopes[:len(tr.scopes)-1]
+		case "macro":
+			tr.scopes = tr.scopes[:len(tr.scopes)-1]
+			tr.macro = ""
+		}
+		return strings.TrimSuffix(strings.Repeat("end"+tr.right+tr.left, b.ends), tr.right+tr.left), nil
+	case "for":
+		return tr.forTag(p)
+	case "set":
+		return tr.setTag(p)
+	case "macro":
+		if len(tr.blocks) > 0 {
+			return "", p.unsupported("macro within a block")
+		}
+		name, params, err := p.macroSignature()
+		if err != nil {
+			return "", err
+		}
+		scope := make(map[string]string)
+		for _, param := range params {
+			scope[param.name] = "$." + param.name
+		}
+		tr.scopes = append(tr.scopes, scope)
+		tr.blocks = append(tr.blocks, jinjaBlock{kind: "macro", ends: 1, line: p.it.line})
+		tr.macro = name
+		return "define " + strconv.Quote(name), nil
+	case "import":
+		// {% import "file" as name %}: macros are called as name.macro.
+		if _, err := p.parseExpr(); err != nil {
+			return "", err
+		}
+		if !p.acceptName("as") {
+			return "", p.errorf("import without as")
+		}
+		alias, err := p.expectName()
+		if err != nil {
+			return "", err
+		}
+		tr.aliases[alias] = ""
+		p.acceptName("with")
+		p.acceptName("without")
+		p.acceptName("context")
+		return "", p.expectEnd()
+	case "from":
+		// {% from "file" import a, b as c %}.
+		if _, err := p.parseExpr(); err != nil {
+			return "", err
+		}
+		if !p.acceptName("import") {
+			return "", p.errorf("from without import")
+		}
+		for {
+			name, err := p.expectName()
+			if err != nil {
+				return "", err
+			}
+			alias := name
+			if p.acceptName("as") {
+				if alias, err = p.expectName(); err != nil {
+					return "", err
+				}
+			}
+			tr.aliases[alias] = name
+			if !p.accept(",") {
+				break
+			}
+		}
+		return "", p.expectEnd()
+	case "raw", "endraw":
+		return "", nil
+	case "break", "continue":
+		if !tr.inBlock("for") {
+			return "", p.errorf("%s outside for", keyword)
+		}
+		return keyword, nil
+	}
+	return "", p.unsupported(fmt.Sprintf("{%% %s %%}", keyword))
+}
+
+// inBlock reports whether a block of the given kind is open.
+func (tr *jinjaTranslator) inBlock(kind string) bool {
+	return slices.ContainsFunc(tr.blocks, func(b jinjaBlock) bool { return b.kind == kind })
+}
+
+// forTag translates {% for target in iterable [if cond] %}.
+func (tr *jinjaTranslator) forTag(p *jinjaParser) (string, error) {
+	var targets []string
+	for {
+		name, err := p.expectName()
+		if err != nil {
+			return "", err
+		}
+		targets = append(targets, name)
+		if !p.accept(",") {
+			break
+		}
+	}
+	if !p.acceptName("in") {
+		return "", p.errorf("for without in")
+	}
+	iter, err := p.parseOr()
+	if err != nil {
+		return "", err
+	}
+	var cond jexpr
+	if p.acceptName("if") {
+		if cond, err = p.parseOr(); err != nil {
+			return "", err
+		}
+	}
+	if p.acceptName("recursive") {
+		return "", p.unsupported("recursive for loop")
+	}
+	if err := p.expectEnd(); err != nil {
+		return "", err
+	}
+	// for k, v in d.items() ranges over the keys and values of d.
+	if call, ok := iter.(*jCall); ok && len(call.args.pos)+len(call.args.names) == 0 {
+		if attr, ok := call.fn.(*jAttr); ok && attr.name == "items" {
+			if len(targets) != 2 {
+				return "", p.errorf("items() needs two loop variables")
+			}
+			iter = attr.x
+		}
+	} else if len(targets) == 2 {
+		return "", p.unsupported("two loop variables without items()")
+	}
+	if len(targets) > 2 {
+		return "", p.unsupported("more than two loop variables")
+	}
+	s, err := tr.operand(p, iter)
+	if err != nil {
+		return "", err
+	}
+	scope := make(map[string]string)
+	block := jinjaBlock{kind: "for", ends: 1, line: p.it.line}
+	var decl string
+	if len(targets) == 2 {
+		decl = "$" + targets[0] + ", $" + targets[1]
+	} else {
+		if tr.bodyUsesLoop() {
+			block.loop = fmt.Sprintf("$loop%d", tr.loops)
+			tr.loops++
+			decl = block.loop + ", "
+		}
+		decl += "$" + targets[0]
+	}
+	for _, t := range targets {
+		scope[t] = "$" + t
+	}
+	tr.scopes = append(tr.scopes, scope)
+	action := "range " + decl + " := " + s
+	if cond != nil {
+		c, err := tr.pipeline(p, cond)
+		if err != nil {
+			return "", err
+		}
+		action += tr.right + tr.left + "if " + c
+		block.ends = 2
+	}
+	tr.blocks = append(tr.blocks, block)
+	return action, nil
+}
+
+// setTag translates {% set name = expr %}.
+func (tr *jinjaTranslator) setTag(p *jinjaParser) (string, error) {
+	name, err := p.expectName()
+	if err != nil {
+		return "", err
+	}
+	if !p.accept("=") {
+		return "", p.unsupported("set block or multiple targets")
+	}
+	e, err := p.parseExpr()
+	if err == nil {
+		err = p.expectEnd()
+	}
+	if err != nil {
+		return "", err
+	}
+	s, err := tr.pipeline(p, e)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := tr.lookup(name); ok {
+		return "$" + name + " = " + s, nil
+	}
+	tr.scopes[len(tr.scopes)-1][name] = "$" + name
+	return "$" + name + " := " + s, nil
+}
+
+// lookup returns the translation of the variable name, if it is local.
+func (tr *jinjaTranslator) lookup(name string) (string, bool) {
+	for i := len(tr.scopes) - 1; i >= 0; i-- {
+		if s, ok := tr.scopes[i][name]; ok {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// loopVar returns the loop index variable of the innermost for loop.
+func (tr *jinjaTranslator) loopVar() string {
+	for i := len(tr.blocks) - 1; i >= 0; i-- {
+		if tr.blocks[i].kind == "for" {
+			return tr.blocks[i].loop
+		}
+	}
+	return ""
+}
+
+// jinjaLoopRe matches a use of the loop variable of a for loop.
+var jinjaLoopRe = regexp.MustCompile(`\bloop\.`)
+
+// bodyUsesLoop reports whether the body of the for loop whose tag is
+// the current item uses its loop variable, outside any nested loop.
+func (tr *jinjaTranslator) bodyUsesLoop() bool {
+	depth := 0
+	for _, it := range tr.file.items[tr.pos+1:] {
+		if it.kind == 0 || it.kind == '#' {
+			continue
+		}
+		keyword, _, _ := strings.Cut(it.text, " ")
+		switch {
+		case it.kind == '%' && keyword == "for":
+			depth++
+		case it.kind == '%' && keyword == "endfor":
+			if depth == 0 {
+				return false
+			}
+			depth--
+		case depth == 0 && jinjaLoopRe.MatchString(it.text):
+			return true
+		}
+	}
+	return false
+}
+
+// pipeline returns the text/template pipeline that e translates to.
+func (tr *jinjaTranslator) pipeline(p *jinjaParser, e jexpr) (string, error) {
+	s, _, err := tr.expr(p, e)
+	return s, err
+}
+
+// operand returns the text/template operand that e translates to,
+// parenthesized if it is a function call.
+func (tr *jinjaTranslator) operand(p *jinjaParser, e jexpr) (string, error) {
+	s, call, err := tr.expr(p, e)
+	if call {
+		s = "(" + s + ")"
+	}
+	return s, err
+}
+
+// operands returns the operands that es translate to, separated by
+// spaces.
+func (tr *jinjaTranslator) operands(p *jinjaParser, es ...jexpr) (string, error) {
+	ss := make([]string, len(es))
+	for i, e := range es {
+		var err error
+		if ss[i], err = tr.operand(p, e); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(ss, " "), nil
+}
+
+// call returns the text/template call of fn with the operands that
+// args translate to.
+func (tr *jinjaTranslator) call(p *jinjaParser, fn string, args ...jexpr) (string, bool, error) {
+	s, err := tr.operands(p, args...)
+	if s != "" {
+		fn += " " + s
+	}
+	return fn, true, err
+}
+
+// pipe returns the text/template pipeline that passes x to the call
+// of fn with the operands that args translate to.
+func (tr *jinjaTranslator) pipe(p *jinjaParser, x jexpr, fn string, args ...jexpr) (string, bool, error) {
+	s, err := tr.pipeline(p, x)
+	if err != nil {
+		return "", false, err
+	}
+	call, _, err := tr.call(p, fn, args...)
+	return s + " | " + call, true, err
+}
+
+// jinjaFieldRe matches the names that text/template allows as fields.
+var jinjaFieldRe = regexp.MustCompile(`^[A-Za-z_]\w*$`)
+
+// expr returns the text/template translation of e, and whether it is a
+// function call.
+func (tr *jinjaTranslator) expr(p *jinjaParser, e jexpr) (string, bool, error) {
+	switch e := e.(type) {
+	case *jLit:
+		return e.text, false, nil
+	case *jName:
+		if s, ok := tr.lookup(e.name); ok {
+			return s, false, nil
+		}
+		if e.name == "loop" {
+			return "", false, p.unsupported("use of loop other than loop.index, loop.index0 or loop.first")
+		}
+		if _, ok := tr.aliases[e.name]; ok {
+			return "", false, p.unsupported(fmt.Sprintf("use of %s other than a macro call", e.name))
+		}
+		if tr.macro != "" {
+			return "", false, p.unsupported(fmt.Sprintf("variable %s in macro %s, which is not one of its parameters", e.name, tr.macro))
+		}
+		if tr.root != "" {
+			return "$." + tr.root + "." + e.name, false, nil
+		}
+		return "$." + e.name, false, nil
+	case *jAttr:
+		if n, ok := e.x.(*jName); ok && n.name == "loop" {
+			if _, ok := tr.lookup("loop"); !ok {
+				return tr.loopAttr(p, e.name)
+			}
+		}
+		return tr.field(p, e.x, e.name)
+	case *jIndex:
+		if lit, ok := e.index.(*jLit); ok && lit.str {
+			if name, _ := strconv.Unquote(lit.text); jinjaFieldRe.MatchString(name) {
+				return tr.field(p, e.x, name)
+			}
+		}
+		return tr.call(p, "index", e.x, e.index)
+	case *jList:
+		return tr.call(p, "list", e.elems...)
+	case *jDict:
+		var args []jexpr
+		for i, k := range e.keys {
+			args = append(args, k, e.values[i])
+		}
+		return tr.call(p, "dict", args...)
+	case *jUnary:
+		switch e.op {
+		case "not":
+			return tr.call(p, "not", e.x)
+		case "-":
+			if lit, ok := e.x.(*jLit); ok && !lit.str && lit.text != "nil" && lit.text != "true" && lit.text != "false" {
+				return "-" + lit.text, false, nil
+			}
+			return tr.call(p, "sub", &jLit{text: "0"}, e.x)
+		}
+	case *jCond:
+		els := e.els
+		if els == nil {
+			els = &jLit{text: `""`, str: true}
+		}
+		return tr.call(p, "ternary", e.then, els, e.cond)
+	case *jBinary:
+		return tr.binary(p, e)
+	case *jFilter:
+		return tr.filter(p, e)
+	case *jTest:
+		return tr.test(p, e)
+	case *jCall:
+		return tr.callExpr(p, e)
+	}
+	return "", false, p.unsupported(fmt.Sprintf("expression %T", e))
+}
+
+// field returns the translation of x.name.
+func (tr *jinjaTranslator) field(p *jinjaParser, x jexpr, name string) (string, bool, error) {
+	s, call, err := tr.expr(p, x)
+	if err != nil {
+		return "", false, err
+	}
+	if !call && strings.HasPrefix(s, "$") {
+		return s + "." + name, false, nil
+	}
+	if call {
+		s = "(" + s + ")"
+	}
+	return "index " + s + " " + strconv.Quote(name), true, nil
+}
+
+// loopAttr returns the translation of loop.name.
+func (tr *jinjaTranslator) loopAttr(p *jinjaParser, name string) (string, bool, error) {
+	v := tr.loopVar()
+	if v == "" {
+		return "", false, p.errorf("loop.%s outside for", name)
+	}
+	switch name {
+	case "index0":
+		return v, false, nil
+	case "index":
+		return "add " + v + " 1", true, nil
+	case "first":
+		return "eq " + v + " 0", true, nil
+	}
+	return "", false, p.unsupported("loop." + name)
+}
+
+// jinjaComparisons maps Jinja2 comparison operators to text/template
+// functions.
+var jinjaComparisons = map[string]string{
+	"==": "eq", "!=": "ne", "<": "lt", ">": "gt", "<=": "le", ">=": "ge",
+	"and": "and", "or": "or",
+	"-": "sub", "*": "mul", "/": "divf", "//": "div",
+}
+
+// binary returns the translation of a binary expression.
+func (tr *jinjaTranslator) binary(p *jinjaParser, e *jBinary) (string, bool, error) {
+	if fn, ok := jinjaComparisons[e.op]; ok {
+		return tr.call(p, fn, e.x, e.y)
+	}
+	switch e.op {
+	case "in":
+		switch y := e.y.(type) {
+		case *jLit:
+			if y.str {
+				return tr.call(p, "contains", e.x, e.y)
+			}
+		case *jList:
+			// x in [a, b] is x == a or x == b.
+			if len(y.elems) == 0 {
+				return "false", false, nil
+			}
+			var eqs []string
+			for _, elem := range y.elems {
+				s, _, err := tr.call(p, "eq", e.x, elem)
+				if err != nil {
+					return "", false, err
+				}
+				eqs = append(eqs, "("+s+")")
+			}
+			if len(eqs) == 1 {
+				return strings.Trim(eqs[0], "()"), true, nil
+			}
+			return "or " + strings.Join(eqs, " "), true, nil
+		}
+		return tr.call(p, "has", e.x, e.y)
+	case "not in":
+		return tr.call(p, "not", &jBinary{op: "in", x: e.x, y: e.y})
+	case "~":
+		return tr.concat(p, e)
+	case "+":
+		if isJinjaString(e.x) || isJinjaString(e.y) {
+			return tr.concat(p, e)
+		}
+		_, xl := e.x.(*jList)
+		_, yl := e.y.(*jList)
+		if xl || yl {
+			return tr.call(p, "concat", e.x, e.y)
+		}
+		return tr.call(p, "add", e.x, e.y)
+	case "%":
+		// "format" % args formats args with printf.
+		if lit, ok := e.x.(*jLit); ok && lit.str {
+			args := []jexpr{e.x}
+			if l, ok := e.y.(*jList); ok {
+				args = append(args, l.elems...)
+			} else {
+				args = append(args, e.y)
+			}
+			return tr.call(p, "printf", args...)
+		}
+		return tr.call(p, "mod", e.x, e.y)
+	}
+	return "", false, p.unsupported("operator " + e.op)
+}
+
+// isJinjaString reports whether e is a string literal or a string
+// concatenation.
+func isJinjaString(e jexpr) bool {
+	switch e := e.(type) {
+	case *jLit:
+		return e.str
+	case *jBinary:
+		return e.op == "~" || e.op == "+" && (isJinjaString(e.x) || isJinjaString(e.y))
+	}
+	return false
+}
+
+// concat returns the translation of the string concatenation e, as a
+// printf call formatting each of its operands with %v.
+func (tr *jinjaTranslator) concat(p *jinjaParser, e *jBinary) (string, bool, error) {
+	var operands []jexpr
+	var flatten func(e jexpr)
+	flatten = func(x jexpr) {
+		if b, ok := x.(*jBinary); ok && (b.op == "~" || b.op == "+" && isJinjaString(b)) {
+			flatten(b.x)
+			flatten(b.y)
+			return
+		}
+		operands = append(operands, x)
+	}
+	flatten(e)
+	var format strings.Builder
+	var args []jexpr
+	for _, x := range operands {
+		if lit, ok := x.(*jLit); ok && lit.str {
+			s, _ := strconv.Unquote(lit.text)
+			format.WriteString(strings.ReplaceAll(s, "%", "%%"))
+			continue
+		}
+		format.WriteString("%v")
+		args = append(args, x)
+	}
+	return tr.call(p, "printf", append([]jexpr{&jLit{text: strconv.Quote(format.String()), str: true}}, args...)...)
+}
+
+// jinjaFilters maps the Jinja2 and Ansible filters that take no
+// arguments to the functions that convert them.
+var jinjaFilters = map[string]string{
+	"b64decode":    "b64dec",
+	"b64encode":    "b64enc",
+	"basename":     "base",
+	"dirname":      "dir",
+	"first":        "first",
+	"float":        "float64",
+	"from_json":    "fromJson",
+	"from_yaml":    "fromYaml",
+	"int":          "int",
+	"last":         "last",
+	"lower":        "lower",
+	"quote":        "quote",
+	"string":       "toString",
+	"title":        "title",
+	"to_json":      "toJson",
+	"to_nice_json": "toPrettyJson",
+	"to_nice_yaml": "toYaml",
+	"to_yaml":      "toYaml",
+	"trim":         "trim",
+	"unique":       "uniq",
+	"upper":        "upper",
+}
+
+// filter returns the translation of x | name(args), which pipes x to
+// the function for the filter with the arguments. Filters
+// without a translation call the function of the same name, which
+// Config.Funcs can provide.
+func (tr *jinjaTranslator) filter(p *jinjaParser, e *jFilter) (string, bool, error) {
+	args := e.args.pos
+	arg := func(i int, def jexpr) jexpr {
+		if i < len(args) {
+			return args[i]
+		}
+		return def
+	}
+	empty := &jLit{text: `""`, str: true}
+	switch e.name {
+	case "default", "d":
+		return tr.defaultFilter(p, e)
+	case "mandatory":
+		msg := arg(0, e.args.keyword("msg"))
+		if msg == nil {
+			msg = &jLit{text: strconv.Quote(jinjaDescribe(e.x) + " is mandatory"), str: true}
+		}
+		return tr.pipe(p, e.x, "required", msg)
+	case "ternary":
+		if len(args) < 2 {
+			return "", false, p.errorf("ternary filter requires two arguments")
+		}
+		return tr.pipe(p, e.x, "ternary", args[0], args[1])
+	case "regex_replace":
+		if len(args) < 1 {
+			return "", false, p.errorf("regex_replace filter requires a pattern")
+		}
+		if len(e.args.names) > 0 {
+			return "", false, p.unsupported("regex_replace with keyword arguments")
+		}
+		repl := arg(1, empty)
+		lit, ok := repl.(*jLit)
+		if !ok || !lit.str {
+			return "", false, p.unsupported("regex_replace with a replacement other than a string")
+		}
+		text, _ := strconv.Unquote(lit.text)
+		return tr.call(p, "regexReplaceAll", args[0], e.x, &jLit{text: strconv.Quote(goReplacement(text)), str: true})
+	case "join":
+		return tr.pipe(p, e.x, "join", arg(0, empty))
+	case "replace":
+		if len(args) < 2 {
+			return "", false, p.errorf("replace filter requires two arguments")
+		}
+		return tr.pipe(p, e.x, "replace", args[0], args[1])
+	case "indent":
+		return tr.indent(p, e)
+	case "combine":
+		return tr.call(p, "mergeOverwrite", append([]jexpr{e.x}, args...)...)
+	}
+	fn := e.name
+	if name, ok := jinjaFilters[fn]; ok {
+		fn, args = name, nil
+	}
+	return tr.pipe(p, e.x, fn, args...)
+}
+
+// jinjaDescribe returns the Jinja2 source of the variable e, or
+// "value".
+func jinjaDescribe(e jexpr) string {
+	switch e := e.(type) {
+	case *jName:
+		return e.name
+	case *jAttr:
+		return jinjaDescribe(e.x) + "." + e.name
+	}
+	return "value"
+}
+
+// defaultFilter returns the translation of x | default(value, boolean).
+// The default replaces x only if x is undefined, as the defined test
+// finds, or, if boolean is true, also if x is empty, as Sprig's default
+// does.
+func (tr *jinjaTranslator) defaultFilter(p *jinjaParser, e *jFilter) (string, bool, error) {
+	param := func(i int, name string) jexpr {
+		if i < len(e.args.pos) {
+			return e.args.pos[i]
+		}
+		return e.args.keyword(name)
+	}
+	def := param(0, "default_value")
+	if def == nil {
+		def = &jLit{text: `""`, str: true}
+	}
+	if boolean := param(1, "boolean"); boolean != nil {
+		lit, ok := boolean.(*jLit)
+		if !ok || (lit.text != "true" && lit.text != "false") {
+			return "", false, p.unsupported("default with a boolean other than true or false")
+		}
+		if lit.text == "true" {
+			return tr.pipe(p, e.x, "default", def)
+		}
+	}
+	defined, ok, err := tr.defined(p, e.x)
+	if err != nil {
+		return "", false, err
+	}
+	if !ok {
+		return "", false, p.unsupported("default of an expression other than a variable")
+	}
+	if defined == "true" {
+		return tr.expr(p, e.x)
+	}
+	s, err := tr.operands(p, e.x, def)
+	return "ternary " + s + " (" + defined + ")", true, err
+}
+
+// indent returns the translation of x | indent(width, first, blank),
+// which indents the lines of x after the first by width spaces, or by
+// width if it is a string: the first line too if first is true, and
+// lines that are empty if blank is true.
+func (tr *jinjaTranslator) indent(p *jinjaParser, e *jFilter) (string, bool, error) {
+	pad, first, blank, err := indentArgs(p, e)
+	if err != nil {
+		return "", false, err
+	}
+	if first && blank && strings.Trim(pad, " ") == "" {
+		return tr.pipe(p, e.x, "indent", &jLit{text: strconv.Itoa(len(pad))})
+	}
+	var s string
+	if blank {
+		s, _, err = tr.pipe(p, e.x, "replace", &jLit{text: `"\n"`, str: true}, &jLit{text: strconv.Quote("\n" + pad), str: true})
+	} else {
+		repl := "\n" + strings.ReplaceAll(pad, "$", "$$") + "${1}"
+		s, _, err = tr.call(p, "regexReplaceAll", &jLit{text: `"\n(.)"`, str: true}, e.x, &jLit{text: strconv.Quote(repl), str: true})
+	}
+	if err != nil || !first {
+		return s, true, err
+	}
+	return "printf " + strconv.Quote("%s%s") + " " + strconv.Quote(pad) + " (" + s + ")", true, nil
+}
+
+// indentLine returns the translation of a tag {{ x | indent(width) }}.
+// If the tag starts its line after the indentation of width spaces, as
+// in a YAML block, it becomes {{ x | indent width }} in place of that
+// indentation, so that the converter can place a helper's YAML fields.
+// That differs from Jinja only in the spaces of blank lines, which YAML
+// ignores. After a key, as in key: {{ x | to_nice_yaml | indent(4) }},
+// the YAML of to_nice_yaml or to_yaml becomes {{ x | toYaml | indent 4 }}
+// too, which the converter places as the value of the key.
+func (tr *jinjaTranslator) indentLine(p *jinjaParser, f *jFilter) (string, error) {
+	pad, first, _, err := indentArgs(p, f)
+	if err != nil {
+		return "", err
+	}
+	out := tr.out.String()
+	line := out[strings.LastIndex(out, "\n")+1:]
+	if x, ok := f.x.(*jFilter); ok && (x.name == "to_nice_yaml" || x.name == "to_yaml") &&
+		pad != "" && strings.Trim(pad, " ") == "" && strings.HasSuffix(line, ": ") {
+		s, _, err := tr.pipe(p, f.x, "indent", &jLit{text: strconv.Itoa(len(pad))})
+		return s, err
+	}
+	if first || pad == "" || line != pad || strings.Trim(pad, " ") != "" {
+		s, _, err := tr.indent(p, f)
+		return s, err
+	}
+	tr.out.Reset()
+	tr.out.WriteString(strings.TrimSuffix(out, pad))
+	s, _, err := tr.pipe(p, f.x, "indent", &jLit{text: strconv.Itoa(len(pad))})
+	return s, err
+}
+
+// indentArgs returns the indentation of x | indent(width, first, blank)
+// and its first and blank arguments, which must be literals.
+func indentArgs(p *jinjaParser, e *jFilter) (pad string, first, blank bool, err error) {
+	param := func(i int, name string) jexpr {
+		if i < len(e.args.pos) {
+			return e.args.pos[i]
+		}
+		return e.args.keyword(name)
+	}
+	pad = "    "
+	if w := param(0, "width"); w != nil {
+		lit, ok := w.(*jLit)
+		if !ok {
+			return "", false, false, p.unsupported("indent with a width other than a number or string")
+		}
+		n, err := strconv.Atoi(lit.text)
+		switch {
+		case lit.str:
+			pad, _ = strconv.Unquote(lit.text)
+		case err == nil && n >= 0:
+			pad = strings.Repeat(" ", n)
+		default:
+			return "", false, false, p.unsupported("indent with a width other than a number or string")
+		}
+	}
+	flag := func(i int, name string) (bool, error) {
+		x := param(i, name)
+		if x == nil {
+			return false, nil
+		}
+		if lit, ok := x.(*jLit); ok && (lit.text == "true" || lit.text == "false") {
+			return lit.text == "true", nil
+		}
+		return false, p.unsupported("indent with " + name + " other than true or false")
+	}
+	if first, err = flag(1, "first"); err != nil {
+		return "", false, false, err
+	}
+	if blank, err = flag(2, "blank"); err != nil {
+		return "", false, false, err
+	}
+	return pad, first, blank, nil
+}
+
+// goReplacement returns the Go regexp replacement for repl, a Python
+// re.sub replacement: \1 and \g<name> become ${1} and ${name}, and a
+// literal $ becomes $$.
+func goReplacement(repl string) string {
+	var b strings.Builder
+	for i := 0; i < len(repl); i++ {
+		c := repl[i]
+		switch {
+		case c == '$':
+			b.WriteString("$$")
+		case c != '\\' || i+1 == len(repl):
+			b.WriteByte(c)
+		case repl[i+1] >= '0' && repl[i+1] <= '9':
+			j := i + 1
+			for j < len(repl) && j < i+3 && repl[j] >= '0' && repl[j] <= '9' {
+				j++
+			}
+			b.WriteString("${" + repl[i+1:j] + "}")
+			i = j - 1
+		case repl[i+1] == 'g' && strings.HasPrefix(repl[i+2:], "<") && strings.Contains(repl[i+2:], ">"):
+			name, _, _ := strings.Cut(repl[i+3:], ">")
+			b.WriteString("${" + name + "}")
+			i += 3 + len(name)
+		default:
+			switch repl[i+1] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '\\':
+				b.WriteByte('\\')
+			default:
+				b.WriteString(repl[i : i+2])
+			}
+			i++
+		}
+	}
+	return b.String()
+}
+
+// test returns the translation of x is name, for the defined and
+// undefined tests, which become hasKey on the object holding x.
+func (tr *jinjaTranslator) test(p *jinjaParser, e *jTest) (string, bool, error) {
+	not := e.not
+	switch e.name {
+	case "undefined":
+		not = !not
+	case "defined":
+	default:
+		return "", false, p.unsupported("test " + e.name)
+	}
+	s, ok, err := tr.defined(p, e.x)
+	if err != nil {
+		return "", false, err
+	}
+	if !ok {
+		return "", false, p.unsupported("defined test of an expression")
+	}
+	if s == "true" {
+		return strconv.FormatBool(!not), false, nil
+	}
+	if not {
+		s = "not (" + s + ")"
+	}
+	return s, true, nil
+}
+
+// defined returns the condition that the variable x is defined: hasKey
+// on the object holding it, or true for a loop variable or macro
+// parameter. It reports false if x is not a variable.
+func (tr *jinjaTranslator) defined(p *jinjaParser, x jexpr) (string, bool, error) {
+	var parent, key string
+	switch x := x.(type) {
+	case *jName:
+		if _, ok := tr.lookup(x.name); ok || tr.macro != "" {
+			return "true", true, nil
+		}
+		parent, key = "$", strconv.Quote(x.name)
+		if tr.root != "" {
+			parent += "." + tr.root
+		}
+	case *jAttr:
+		s, err := tr.operand(p, x.x)
+		if err != nil {
+			return "", false, err
+		}
+		parent, key = s, strconv.Quote(x.name)
+	case *jIndex:
+		var err error
+		if parent, err = tr.operand(p, x.x); err != nil {
+			return "", false, err
+		}
+		if key, err = tr.operand(p, x.index); err != nil {
+			return "", false, err
+		}
+	default:
+		return "", false, nil
+	}
+	return "hasKey " + parent + " " + key, true, nil
+}
+
+// jinjaMethods maps methods of strings, lists and dicts that take no
+// arguments to the functions that convert them.
+var jinjaMethods = map[string]string{
+	"keys":   "keys",
+	"lower":  "lower",
+	"strip":  "trim",
+	"upper":  "upper",
+	"values": "values",
+}
+
+// callExpr returns the translation of a call: of a macro, which
+// becomes an include, of a method, or of a global function.
+func (tr *jinjaTranslator) callExpr(p *jinjaParser, e *jCall) (string, bool, error) {
+	switch fn := e.fn.(type) {
+	case *jName:
+		if _, ok := tr.lookup(fn.name); !ok {
+			if name := tr.macroName(fn.name); name != "" {
+				return tr.macroCall(p, name, e.args)
+			}
+			if fn.name == "dict" {
+				var args []jexpr
+				for i, name := range e.args.names {
+					args = append(args, &jLit{text: strconv.Quote(name), str: true}, e.args.values[i])
+				}
+				return tr.call(p, "dict", args...)
+			}
+			return tr.call(p, fn.name, e.args.pos...)
+		}
+	case *jAttr:
+		if n, ok := fn.x.(*jName); ok {
+			if module, ok := tr.aliases[n.name]; ok && module == "" {
+				if _, ok := tr.macros[fn.name]; !ok {
+					return "", false, p.errorf("undefined macro %s.%s", n.name, fn.name)
+				}
+				return tr.macroCall(p, fn.name, e.args)
+			}
+		}
+		args := e.args.pos
+		if name, ok := jinjaMethods[fn.name]; ok && len(args) == 0 {
+			return tr.call(p, name, fn.x)
+		}
+		switch {
+		case fn.name == "startswith" && len(args) == 1:
+			return tr.call(p, "hasPrefix", args[0], fn.x)
+		case fn.name == "endswith" && len(args) == 1:
+			return tr.call(p, "hasSuffix", args[0], fn.x)
+		case fn.name == "replace" && len(args) == 2:
+			return tr.call(p, "replace", args[0], args[1], fn.x)
+		case fn.name == "split" && len(args) == 1:
+			return tr.call(p, "splitList", args[0], fn.x)
+		case fn.name == "join" && len(args) == 1:
+			return tr.call(p, "join", fn.x, args[0])
+		}
+		return "", false, p.unsupported("method " + fn.name)
+	}
+	return "", false, p.unsupported("call of an expression")
+}
+
+// macroName returns the name of the macro that name calls, or "".
+func (tr *jinjaTranslator) macroName(name string) string {
+	if imported, ok := tr.aliases[name]; ok && imported != "" {
+		name = imported
+	}
+	if _, ok := tr.macros[name]; ok {
+		return name
+	}
+	return ""
+}
+
+// macroCall returns the translation of a call of the named macro, an
+// include of its define with a dict of its arguments. Parameters that
+// the call omits take their defaults.
+func (tr *jinjaTranslator) macroCall(p *jinjaParser, name string, args jargs) (string, bool, error) {
+	params := tr.macros[name]
+	if len(args.pos) > len(params) {
+		return "", false, p.errorf("too many arguments to macro %s", name)
+	}
+	for _, kw := range args.names {
+		if !slices.ContainsFunc(params, func(param jinjaParam) bool { return param.name == kw }) {
+			return "", false, p.errorf("macro %s has no parameter %s", name, kw)
+		}
+	}
+	dict := &jDict{}
+	for i, param := range params {
+		v := param.def
+		if i < len(args.pos) {
+			v = args.pos[i]
+		} else if kw := args.keyword(param.name); kw != nil {
+			v = kw
+		}
+		if v != nil {
+			dict.keys = append(dict.keys, &jLit{text: strconv.Quote(param.name), str: true})
+			dict.values = append(dict.values, v)
+		}
+	}
+	s, err := tr.operand(p, dict)
+	if err != nil {
+		return "", false, err
+	}
+	return "include " + strconv.Quote(name) + " " + s, true, nil
+}
@@ -0,0 +1,660 @@
+// Copyright 2026 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm2cue
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jexpr is a Jinja2 expression.
+type jexpr interface{ jexpr() }
+
+type (
+	// jName is a variable.
+	jName struct{ name string }
+
+	// jLit is a literal, as text/template writes it.
+	jLit struct {
+		text string
+		str  bool // a string literal
+	}
+
+	// jList is a list or tuple literal.
+	jList struct{ elems []jexpr }
+
+	// jDict is a dict literal.
+	jDict struct{ keys, values []jexpr }
+
+	// jAttr is x.name.
+	jAttr struct {
+		x    jexpr
+		name string
+	}
+
+	// jIndex is x[index].
+	jIndex struct{ x, index jexpr }
+
+	// jCall is fn(args).
+	jCall struct {
+		fn   jexpr
+		args jargs
+	}
+
+	// jFilter is x | name(args).
+	jFilter struct {
+		x    jexpr
+		name string
+		args jargs
+	}
+
+	// jTest is x is name(args), or x is not name(args).
+	jTest struct {
+		x    jexpr
+		name string
+		args jargs
+		not  bool
+	}
+
+	// jBinary is x op y, for operators including and, or, in and
+	// not in.
+	jBinary struct {
+		op   string
+		x, y jexpr
+	}
+
+	// jUnary is op x, for not, - and +.
+	jUnary struct {
+		op string
+		x  jexpr
+	}
+
+	// jCond is then if cond else els.
+	jCond struct{ then, cond, els jexpr }
+)
+
+func (*jName) jexpr()   {}
+func (*jLit) jexpr()    {}
+func (*jList) jexpr()   {}
+func (*jDict) jexpr()   {}
+func (*jAttr) jexpr()   {}
+func (*jIndex) jexpr()  {}
+func (*jCall) jexpr()   {}
+func (*jFilter) jexpr() {}
+func (*jTest) jexpr()   {}
+func (*jBinary) jexpr() {}
+func (*jUnary) jexpr()  {}
+func (*jCond) jexpr()   {}
+
+// jargs are the arguments of a call, filter or test.
+type jargs struct {
+	pos    []jexpr
+	names  []string // the names of the keyword arguments
+	values []jexpr  // the values of the keyword arguments
+}
+
+// keyword returns the keyword argument name, or nil.
+func (a jargs) keyword(name string) jexpr {
+	for i, n := range a.names {
+		if n == name {
+			return a.values[i]
+		}
+	}
+	return nil
+}
+
+// jtok is a token of a Jinja2 expression.
+type jtok struct {
+	kind byte   // 'n' for a name, 's' for a string, '0' for a number, 'o' for an operator
+	text string // the name, operator or number, or the value of the string
+}
+
+// jinjaOperators lists the operators of Jinja2 expressions, longest
+// first.
+var jinjaOperators = []string{
+	"//", "**", "==", "!=", "<=", ">=",
+	"(", ")", "[", "]", "{", "}", ",", ".", ":", "|", "~",
+	"+", "-", "*", "/", "%", "<", ">", "=",
+}
+
+// jinjaKeywords are the names that cannot be variables.
+var jinjaKeywords = map[string]bool{
+	"and": true, "or": true, "not": true, "in": true, "is": true,
+	"if": true, "else": true,
+}
+
+// jinjaParser parses the expressions of a tag.
+type jinjaParser struct {
+	it   jinjaItem
+	toks []jtok
+	pos  int
+}
+
+// newJinjaParser returns a parser for src, text of the tag it.
+func newJinjaParser(it jinjaItem, src string) (*jinjaParser, error) {
+	p := &jinjaParser{it: it}
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || isAlnum(src[j])) {
+				j++
+			}
+			p.toks = append(p.toks, jtok{'n', src[i:j]})
+			i = j
+		case '0' <= c && c <= '9':
+			j := i + 1
+			for j < len(src) && (isAlnum(src[j]) || src[j] == '_' ||
+				src[j] == '.' && j+1 < len(src) && '0' <= src[j+1] && src[j+1] <= '9') {
+				j++
+			}
+			p.toks = append(p.toks, jtok{'0', strings.ReplaceAll(src[i:j], "_", "")})
+			i = j
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+					switch src[j] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					case 'r':
+						b.WriteByte('\r')
+					default:
+						b.WriteByte(src[j])
+					}
+					continue
+				}
+				b.WriteByte(src[j])
+			}
+			if j == len(src) {
+				return nil, p.errorf("unterminated string")
+			}
+			p.toks = append(p.toks, jtok{'s', b.String()})
+			i = j + 1
+		default:
+			op := ""
+			for _, o := range jinjaOperators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, p.errorf("unexpected character %q", c)
+			}
+			p.toks = append(p.toks, jtok{'o', op})
+			i += len(op)
+		}
+	}
+	return p, nil
+}
+
+func isAlnum(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// errorf returns a parse error in the tag.
+func (p *jinjaParser) errorf(format string, args ...any) error {
+	return &jinjaError{code: CodeParseError, line: p.it.line, construct: p.it.raw, msg: fmt.Sprintf(format, args...)}
+}
+
+// unsupported returns an error for a construct that cannot be
+// converted.
+func (p *jinjaParser) unsupported(what string) error {
+	return &jinjaError{code: CodeUnsupportedConstruct, line: p.it.line, construct: p.it.raw, msg: "unsupported " + what}
+}
+
+// peek returns the next token, which has kind 0 at the end.
+func (p *jinjaParser) peek() jtok {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return jtok{}
+}
+
+// accept consumes the operator op if it is next.
+func (p *jinjaParser) accept(op string) bool {
+	if t := p.peek(); t.kind == 'o' && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// acceptName consumes the name if it is next.
+func (p *jinjaParser) acceptName(name string) bool {
+	if t := p.peek(); t.kind == 'n' && t.text == name {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// expect consumes the operator op, which must be next.
+func (p *jinjaParser) expect(op string) error {
+	if !p.accept(op) {
+		return p.errorf("expected %s, found %s", op, p.describe())
+	}
+	return nil
+}
+
+// expectName consumes a name, which must be next, and returns it.
+func (p *jinjaParser) expectName() (string, error) {
+	t := p.peek()
+	if t.kind != 'n' || jinjaKeywords[t.text] {
+		return "", p.errorf("expected a name, found %s", p.describe())
+	}
+	p.pos++
+	return t.text, nil
+}
+
+// expectEnd reports an error unless all tokens have been consumed.
+func (p *jinjaParser) expectEnd() error {
+	if p.pos < len(p.toks) {
+		return p.errorf("unexpected %s", p.describe())
+	}
+	return nil
+}
+
+// describe describes the next token for errors.
+func (p *jinjaParser) describe() string {
+	t := p.peek()
+	if t.kind == 0 {
+		return "end of tag"
+	}
+	return strconv.Quote(t.text)
+}
+
+// macroSignature parses name(param, param=default, ...).
+func (p *jinjaParser) macroSignature() (string, []jinjaParam, error) {
+	name, err := p.expectName()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return "", nil, err
+	}
+	var params []jinjaParam
+	for !p.accept(")") {
+		if len(params) > 0 {
+			if err := p.expect(","); err != nil {
+				return "", nil, err
+			}
+		}
+		pname, err := p.expectName()
+		if err != nil {
+			return "", nil, err
+		}
+		param := jinjaParam{name: pname}
+		if p.accept("=") {
+			if param.def, err = p.parseExpr(); err != nil {
+				return "", nil, err
+			}
+		}
+		params = append(params, param)
+	}
+	return name, params, p.expectEnd()
+}
+
+// parseExpr parses an expression, including a conditional expression.
+func (p *jinjaParser) parseExpr() (jexpr, error) {
+	x, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.acceptName("if") {
+		return x, nil
+	}
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	e := &jCond{then: x, cond: cond}
+	if p.acceptName("else") {
+		if e.els, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// parseOr parses an expression without a conditional expression.
+func (p *jinjaParser) parseOr() (jexpr, error) {
+	return p.parseBinary(0)
+}
+
+// jinjaPrecedence lists the binary operators by increasing precedence.
+var jinjaPrecedence = [][]string{
+	{"or"},
+	{"and"},
+	nil, // not
+	{"==", "!=", "<", ">", "<=", ">=", "in", "not in"},
+	{"~"},
+	{"+", "-"},
+	{"*", "/", "//", "%"},
+	{"**"},
+}
+
+// parseBinary parses the binary operators of the given precedence and
+// higher.
+func (p *jinjaParser) parseBinary(level int) (jexpr, error) {
+	if level == len(jinjaPrecedence) {
+		return p.parseUnary()
+	}
+	if jinjaPrecedence[level] == nil {
+		if p.acceptName("not") {
+			x, err := p.parseBinary(level)
+			if err != nil {
+				return nil, err
+			}
+			return &jUnary{op: "not", x: x}, nil
+		}
+		return p.parseBinary(level + 1)
+	}
+	x, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.binaryOp(jinjaPrecedence[level])
+		if op == "" {
+			return x, nil
+		}
+		y, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = &jBinary{op: op, x: x, y: y}
+	}
+}
+
+// binaryOp consumes and returns the next token if it is one of ops.
+func (p *jinjaParser) binaryOp(ops []string) string {
+	t := p.peek()
+	for _, op := range ops {
+		switch {
+		case op == "not in":
+			if t.kind == 'n' && t.text == "not" && p.pos+1 < len(p.toks) &&
+				p.toks[p.pos+1] == (jtok{'n', "in"}) {
+				p.pos += 2
+				return op
+			}
+		case op == "and" || op == "or" || op == "in":
+			if t.kind == 'n' && t.text == op {
+				p.pos++
+				return op
+			}
+		case t.kind == 'o' && t.text == op:
+			p.pos++
+			return op
+		}
+	}
+	return ""
+}
+
+// parseUnary parses a unary expression and the filters and tests that
+// follow it.
+func (p *jinjaParser) parseUnary() (jexpr, error) {
+	var x jexpr
+	var err error
+	switch {
+	case p.accept("-"):
+		x, err = p.parseUnary()
+		if err == nil {
+			x = &jUnary{op: "-", x: x}
+		}
+	case p.accept("+"):
+		x, err = p.parseUnary()
+	default:
+		x, err = p.parsePostfix()
+	}
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("|"):
+			name, err := p.expectName()
+			if err != nil {
+				return nil, err
+			}
+			// Ansible's filters may be namespaced, as in
+			// ansible.builtin.to_yaml.
+			for p.accept(".") {
+				if name, err = p.expectName(); err != nil {
+					return nil, err
+				}
+			}
+			f := &jFilter{x: x, name: name}
+			if p.accept("(") {
+				if f.args, err = p.parseArgs(); err != nil {
+					return nil, err
+				}
+			}
+			x = f
+		case p.acceptName("is"):
+			t := &jTest{x: x, not: p.acceptName("not")}
+			if t.name, err = p.expectName(); err != nil {
+				// Tests such as none and true are keywords elsewhere.
+				if tok := p.peek(); tok.kind == 'n' {
+					t.name, err = tok.text, nil
+					p.pos++
+				} else {
+					return nil, err
+				}
+			}
+			if p.accept("(") {
+				if t.args, err = p.parseArgs(); err != nil {
+					return nil, err
+				}
+			}
+			x = t
+		default:
+			return x, nil
+		}
+	}
+}
+
+// parsePostfix parses a primary expression and the attributes,
+// subscripts and calls that follow it.
+func (p *jinjaParser) parsePostfix() (jexpr, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			t := p.peek()
+			if t.kind != 'n' && t.kind != '0' {
+				return nil, p.errorf("expected an attribute, found %s", p.describe())
+			}
+			p.pos++
+			if t.kind == '0' {
+				x = &jIndex{x: x, index: &jLit{text: t.text}}
+			} else {
+				x = &jAttr{x: x, name: t.text}
+			}
+		case p.accept("["):
+			if p.peek() == (jtok{'o', ":"}) {
+				return nil, p.unsupported("slice")
+			}
+			index, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if p.accept(":") {
+				return nil, p.unsupported("slice")
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &jIndex{x: x, index: index}
+		case p.accept("("):
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			x = &jCall{fn: x, args: args}
+		default:
+			return x, nil
+		}
+	}
+}
+
+// parseArgs parses the arguments of a call, after its (.
+func (p *jinjaParser) parseArgs() (jargs, error) {
+	var args jargs
+	for !p.accept(")") {
+		if len(args.pos)+len(args.names) > 0 {
+			if err := p.expect(","); err != nil {
+				return args, err
+			}
+			if p.accept(")") {
+				break
+			}
+		}
+		if t := p.peek(); t.kind == 'n' && p.pos+1 < len(p.toks) && p.toks[p.pos+1] == (jtok{'o', "="}) {
+			p.pos += 2
+			v, err := p.parseExpr()
+			if err != nil {
+				return args, err
+			}
+			args.names = append(args.names, t.text)
+			args.values = append(args.values, v)
+			continue
+		}
+		if len(args.names) > 0 {
+			return args, p.errorf("positional argument after keyword argument")
+		}
+		v, err := p.parseExpr()
+		if err != nil {
+			return args, err
+		}
+		args.pos = append(args.pos, v)
+	}
+	return args, nil
+}
+
+// parsePrimary parses a name, literal or parenthesized expression.
+func (p *jinjaParser) parsePrimary() (jexpr, error) {
+	t := p.peek()
+	switch t.kind {
+	case 0:
+		return nil, p.errorf("unexpected end of tag")
+	case 'n':
+		p.pos++
+		switch t.text {
+		case "true", "True":
+			return &jLit{text: "true"}, nil
+		case "false", "False":
+			return &jLit{text: "false"}, nil
+		case "none", "None":
+			return &jLit{text: "nil"}, nil
+		}
+		if jinjaKeywords[t.text] {
+			return nil, p.errorf("unexpected %s", strconv.Quote(t.text))
+		}
+		return &jName{name: t.text}, nil
+	case '0':
+		p.pos++
+		return &jLit{text: t.text}, nil
+	case 's':
+		// Adjacent string literals are concatenated.
+		s := t.text
+		for p.pos++; p.peek().kind == 's'; p.pos++ {
+			s += p.peek().text
+		}
+		return &jLit{text: strconv.Quote(s), str: true}, nil
+	}
+	switch {
+	case p.accept("("):
+		if p.accept(")") {
+			return &jList{}, nil
+		}
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(",") {
+			return x, p.expect(")")
+		}
+		// A tuple.
+		l := &jList{elems: []jexpr{x}}
+		for !p.accept(")") {
+			x, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			l.elems = append(l.elems, x)
+			if !p.accept(",") {
+				if err := p.expect(")"); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		return l, nil
+	case p.accept("["):
+		l := &jList{}
+		for !p.accept("]") {
+			x, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			l.elems = append(l.elems, x)
+			if !p.accept(",") {
+				if err := p.expect("]"); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		return l, nil
+	case p.accept("{"):
+		d := &jDict{}
+		for !p.accept("}") {
+			k, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			v, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			d.keys = append(d.keys, k)
+			d.values = append(d.values, v)
+			if !p.accept(",") {
+				if err := p.expect("}"); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		return d, nil
+	}
+	return nil, p.errorf("unexpected %s", p.describe())
+}
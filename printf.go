@@ -0,0 +1,489 @@
+// Copyright 2026 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm2cue
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/token"
+)
+
+// fmtPadDef is the CUE definition for padding a formatted value to a
+// minimum width, matching the width and flag handling of Go's fmt
+// package: '-' pads on the right, '0' pads with zeros after any sign,
+// and #sign is prepended to non-negative numbers for the '+' and ' '
+// flags.
+const fmtPadDef = `// _fmtPad pads a formatted value to a minimum width in runes,
+// matching Go's fmt width and flag handling.
+_fmtPad: {
+	#in!:   string
+	#width: *0 | int
+	#left:  *false | bool
+	#zero:  *false | bool
+	#sign:  *"" | string
+	_s: [if #sign != "" && !strings.HasPrefix(#in, "-") {#sign + #in}, #in][0]
+	_n:      len(strings.Runes(_s))
+	_signed: strings.HasPrefix(_s, "-") || (#sign != "" && strings.HasPrefix(_s, #sign))
+	out:     string
+	if _n >= #width {out: _s}
+	if _n < #width && #left {out: _s + strings.Repeat(" ", #width-_n)}
+	if _n < #width && !#left && #zero && _signed {
+		out: strings.SliceRunes(_s, 0, 1) + strings.Repeat("0", #width-_n) + strings.SliceRunes(_s, 1, _n)
+	}
+	if _n < #width && !#left && #zero && !_signed {out: strings.Repeat("0", #width-_n) + _s}
+	if _n < #width && !#left && !#zero {out: strings.Repeat(" ", #width-_n) + _s}
+}
+`
+
+// fmtRadixDef is the CUE definition for Go's integer radix verbs
+// (%b, %o, %O, %x, %X). Strings formatted with %x or %X are
+// hex-encoded byte by byte, as in Go.
+const fmtRadixDef = `// _fmtRadix formats an integer in the given base, or hex-encodes
+// a string, matching Go's %b, %o, %O, %x and %X verbs.
+_fmtRadix: {
+	#arg!:   _
+	#base!:  int
+	#upper:  *false | bool
+	#prefix: *"" | string
+	_digits: [
+		if (#arg & string) != _|_ {hex.Encode(#arg)},
+		strconv.FormatInt(#arg, #base),
+	][0]
+	_s: [if strings.HasPrefix(_digits, "-") {"-"}, ""][0] + #prefix + strings.TrimPrefix(_digits, "-")
+	out: [if #upper {strings.ToUpper(_s)}, _s][0]
+}
+`
+
+// fmtDirective is a single parsed %-directive of a printf format string.
+type fmtDirective struct {
+	verb  rune
+	minus bool // '-': pad on the right
+	plus  bool // '+': always print a sign
+	sharp bool // '#': alternate format
+	space bool // ' ': leave a space for an elided sign
+	zero  bool // '0': pad with leading zeros
+
+	// argNum is the index of the operand for the verb.
+	argNum int
+
+	// width and prec are -1 when absent. widthArg and precArg are
+	// operand indexes for '*', or -1.
+	width, widthArg int
+	prec, precArg   int
+}
+
+// fmtSegment is either literal text or a directive.
+type fmtSegment struct {
+	text string
+	dir  *fmtDirective
+}
+
+// parsePrintfFormat splits a Go fmt format string into text segments
+// and directives, following the grammar of the fmt package: flags,
+// explicit argument indexes ([n]), width and precision (either
+// decimal or '*'), and a verb. Operand indexes are assigned in the
+// same way as fmt.Sprintf.
+func parsePrintfFormat(format string) ([]fmtSegment, error) {
+	var segs []fmtSegment
+	var text strings.Builder
+	argNum := 0
+	end := len(format)
+	for i := 0; i < end; {
+		if format[i] != '%' {
+			text.WriteByte(format[i])
+			i++
+			continue
+		}
+		i++
+		if i >= end {
+			return nil, fmt.Errorf("printf: format %q ends with %%", format)
+		}
+		if format[i] == '%' {
+			text.WriteByte('%')
+			i++
+			continue
+		}
+		d := &fmtDirective{width: -1, widthArg: -1, prec: -1, precArg: -1}
+	flags:
+		for ; i < end; i++ {
+			switch format[i] {
+			case '#':
+				d.sharp = true
+			case '0':
+				d.zero = true
+			case '+':
+				d.plus = true
+			case '-':
+				d.minus = true
+			case ' ':
+				d.space = true
+			default:
+				break flags
+			}
+		}
+
+		var afterIndex bool
+		var err error
+		argNum, i, afterIndex, err = fmtArgNumber(format, i, argNum)
+		if err != nil {
+			return nil, err
+		}
+		if i < end && format[i] == '*' {
+			i++
+			d.widthArg = argNum
+			argNum++
+			afterIndex = false
+		} else {
+			d.width, i = fmtParseNum(format, i)
+			if afterIndex && d.width >= 0 {
+				return nil, fmt.Errorf("printf: bad argument index in %q", format)
+			}
+		}
+
+		if i < end && format[i] == '.' {
+			i++
+			if afterIndex {
+				return nil, fmt.Errorf("printf: bad argument index in %q", format)
+			}
+			argNum, i, afterIndex, err = fmtArgNumber(format, i, argNum)
+			if err != nil {
+				return nil, err
+			}
+			if i < end && format[i] == '*' {
+				i++
+				d.precArg = argNum
+				argNum++
+				afterIndex = false
+			} else {
+				d.prec, i = fmtParseNum(format, i)
+				if d.prec < 0 {
+					d.prec = 0
+				}
+			}
+		}
+
+		if !afterIndex {
+			argNum, i, _, err = fmtArgNumber(format, i, argNum)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if i >= end {
+			return nil, fmt.Errorf("printf: format %q is missing a verb", format)
+		}
+		verb, size := utf8.DecodeRuneInString(format[i:])
+		i += size
+		d.verb = verb
+		d.argNum = argNum
+		argNum++
+
+		if text.Len() > 0 {
+			segs = append(segs, fmtSegment{text: text.String()})
+			text.Reset()
+		}
+		segs = append(segs, fmtSegment{dir: d})
+	}
+	if text.Len() > 0 {
+		segs = append(segs, fmtSegment{text: text.String()})
+	}
+	return segs, nil
+}
+
+// fmtArgNumber parses an optional explicit argument index "[n]" at
+// format[i:], returning the zero-based operand index to use next.
+func fmtArgNumber(format string, i, argNum int) (newArgNum, newi int, found bool, err error) {
+	if i >= len(format) || format[i] != '[' {
+		return argNum, i, false, nil
+	}
+	closing := strings.IndexByte(format[i:], ']')
+	if closing < 0 {
+		return 0, 0, false, fmt.Errorf("printf: unterminated argument index in %q", format)
+	}
+	n, err := strconv.Atoi(format[i+1 : i+closing])
+	if err != nil || n < 1 {
+		return 0, 0, false, fmt.Errorf("printf: bad argument index %q", format[i:i+closing+1])
+	}
+	return n - 1, i + closing + 1, true, nil
+}
+
+// fmtParseNum parses a decimal number at format[i:], returning -1 if
+// there is none.
+func fmtParseNum(format string, i int) (int, int) {
+	start := i
+	for i < len(format) && '0' <= format[i] && format[i] <= '9' {
+		i++
+	}
+	if i == start {
+		return -1, i
+	}
+	n, _ := strconv.Atoi(format[start:i])
+	return n, i
+}
+
+// isPlain reports whether the directive can be rendered by plain CUE
+// string interpolation of its operand.
+func (d *fmtDirective) isPlain() bool {
+	switch d.verb {
+	case 's', 'v', 'd', 't':
+	default:
+		return false
+	}
+	return !d.minus && !d.plus && !d.sharp && !d.space && !d.zero &&
+		d.width < 0 && d.widthArg < 0 && d.prec < 0 && d.precArg < 0
+}
+
+// badVerbExpr converts the integer verb of d applied to arg, when arg
+// is of kind, a float64 number or a string, which Go prints in another
+// form: a float64 for %b, %x and %X in binary or hexadecimal exponent
+// form, a string for %x and %X in hexadecimal, and otherwise an error
+// text such as %!d(float64=8080). Helm decodes the numbers of
+// values.yaml as float64. It returns nil if Go prints arg as an
+// integer verb would.
+func (c *converter) badVerbExpr(d *fmtDirective, kind string, arg, width, prec ast.Expr) (ast.Expr, error) {
+	if d.sharp {
+		return nil, fmt.Errorf("printf: unsupported format %%#%c of a %s", d.verb, kind)
+	}
+	if d.width >= 0 {
+		width = cueInt(d.width)
+	}
+	if d.prec >= 0 {
+		prec = cueInt(d.prec)
+	}
+	var s ast.Expr
+	switch {
+	case kind == "string" && (d.verb == 'x' || d.verb == 'X'):
+		return nil, nil
+	case kind == "string":
+		s = partsToExpr([]inlinePart{toInlinePart(arg)})
+		if prec != nil {
+			c.addImport("strings")
+			c.usedHelpers["_trunc"] = HelperDef{Name: "_trunc", Def: truncDef, Imports: []string{"strings"}}
+			s = helperOutExpr("_trunc",
+				&ast.Field{Label: ast.NewIdent("#in"), Value: s},
+				&ast.Field{Label: ast.NewIdent("#n"), Value: prec},
+			)
+		}
+	default:
+		verb := 'g'
+		if isRadixVerb(d.verb) && d.verb != 'o' && d.verb != 'O' {
+			verb = d.verb
+		}
+		if prec == nil {
+			prec = cueInt(-1)
+		}
+		c.addImport("strconv")
+		s = importCall("strconv", "FormatFloat", arg, cueInt(int(verb)), prec, cueInt(64))
+	}
+	// Go formats the value with the flags and width of the verb.
+	var sign string
+	if kind != "string" {
+		switch {
+		case d.plus:
+			sign = "+"
+		case d.space:
+			sign = " "
+		}
+	}
+	if width != nil || sign != "" {
+		if width == nil {
+			width = cueInt(0)
+		}
+		s = c.fmtPadExpr(s, width, d.minus, d.zero && !d.minus, sign)
+	}
+	if isRadixVerb(d.verb) && d.verb != 'o' && d.verb != 'O' && kind != "string" {
+		return s, nil
+	}
+	return partsToExpr([]inlinePart{
+		{text: escapePrintfText(fmt.Sprintf("%%!%c(%s=", d.verb, kind))},
+		toInlinePart(s),
+		{text: ")"},
+	}), nil
+}
+
+// isIntVerb reports whether verb is one that Go applies to integers
+// only, or to floats in another form.
+func isIntVerb(verb rune) bool {
+	return strings.ContainsRune("dbcoOxXU", verb)
+}
+
+// printfDirectiveExpr converts a single printf directive applied to arg
+// into a CUE string expression. width and prec are the operand
+// expressions for '*' width and precision, or nil.
+func (c *converter) printfDirectiveExpr(d *fmtDirective, arg, width, prec ast.Expr) (ast.Expr, error) {
+	if d.width >= 0 {
+		width = cueInt(d.width)
+	}
+	if d.prec >= 0 {
+		prec = cueInt(d.prec)
+	}
+	interp := func(x ast.Expr) ast.Expr {
+		return partsToExpr([]inlinePart{toInlinePart(x)})
+	}
+	numeric := false
+	var s ast.Expr
+	switch d.verb {
+	case 's', 'v':
+		if d.sharp {
+			return nil, fmt.Errorf("printf: unsupported format %%#%c", d.verb)
+		}
+		s = interp(arg)
+		if prec != nil {
+			c.addImport("strings")
+			c.usedHelpers["_trunc"] = HelperDef{Name: "_trunc", Def: truncDef, Imports: []string{"strings"}}
+			s = helperOutExpr("_trunc",
+				&ast.Field{Label: ast.NewIdent("#in"), Value: s},
+				&ast.Field{Label: ast.NewIdent("#n"), Value: prec},
+			)
+		}
+	case 't':
+		s = interp(arg)
+	case 'd':
+		numeric = true
+		s = interp(arg)
+		if prec != nil {
+			// Precision is the minimum number of digits.
+			s = c.fmtPadExpr(s, prec, false, true, "")
+		}
+	case 'b', 'o', 'O', 'x', 'X':
+		numeric = true
+		base := map[rune]int{'b': 2, 'o': 8, 'O': 8, 'x': 16, 'X': 16}[d.verb]
+		var prefix string
+		switch {
+		case d.verb == 'O':
+			prefix = "0o"
+		case d.sharp && d.verb == 'b':
+			prefix = "0b"
+		case d.sharp && d.verb == 'o':
+			prefix = "0"
+		case d.sharp:
+			prefix = "0x"
+		}
+		c.addImport("strconv")
+		c.addImport("strings")
+		c.addImport("encoding/hex")
+		c.usedHelpers["_fmtRadix"] = HelperDef{
+			Name: "_fmtRadix", Def: fmtRadixDef,
+			Imports: []string{"strconv", "strings", "encoding/hex"},
+		}
+		fields := []ast.Decl{
+			&ast.Field{Label: ast.NewIdent("#arg"), Value: arg},
+			&ast.Field{Label: ast.NewIdent("#base"), Value: cueInt(base)},
+		}
+		if d.verb == 'X' {
+			fields = append(fields, &ast.Field{Label: ast.NewIdent("#upper"), Value: ast.NewIdent("true")})
+		}
+		if prefix != "" {
+			fields = append(fields, &ast.Field{Label: ast.NewIdent("#prefix"), Value: cueString(prefix)})
+		}
+		s = helperOutExpr("_fmtRadix", fields...)
+	case 'c':
+		c.addImport("strconv")
+		s = importCall("strconv", "Unquote", importCall("strconv", "QuoteRune", arg))
+	case 'q':
+		if d.sharp {
+			return nil, fmt.Errorf("printf: unsupported format %%#q")
+		}
+		c.addImport("strconv")
+		fn := "Quote"
+		if d.plus {
+			fn = "QuoteToASCII"
+		}
+		s = importCall("strconv", fn, interp(arg))
+	case 'U':
+		if d.sharp {
+			return nil, fmt.Errorf("printf: unsupported format %%#U")
+		}
+		c.addImport("strconv")
+		c.addImport("strings")
+		hexDigits := importCall("strings", "ToUpper", importCall("strconv", "FormatInt", arg, cueInt(16)))
+		s = binOp(token.ADD, cueString("U+"), c.fmtPadExpr(hexDigits, cueInt(4), false, true, ""))
+	case 'e', 'E', 'f', 'F', 'g', 'G':
+		if d.sharp {
+			return nil, fmt.Errorf("printf: unsupported format %%#%c", d.verb)
+		}
+		numeric = true
+		verb := d.verb
+		if verb == 'F' {
+			verb = 'f'
+		}
+		if prec == nil {
+			prec = cueInt(6)
+			if verb == 'g' || verb == 'G' {
+				prec = cueInt(-1)
+			}
+		}
+		c.addImport("strconv")
+		s = importCall("strconv", "FormatFloat", arg, cueInt(int(verb)), prec, cueInt(64))
+	case 'T':
+		c.usedHelpers["_typeof"] = HelperDef{Name: "_typeof", Def: typeofDef}
+		s = parenExpr(binOp(token.AND, ast.NewIdent("_typeof"),
+			compactStruct(
+				&ast.Field{Label: ast.NewIdent("#arg"), Value: arg},
+				&ast.EmbedDecl{Expr: ast.NewIdent("_")},
+			)))
+	default:
+		return nil, fmt.Errorf("printf: unsupported format verb %%%c", d.verb)
+	}
+
+	var sign string
+	if numeric {
+		switch {
+		case d.plus:
+			sign = "+"
+		case d.space:
+			sign = " "
+		}
+	}
+	// Go ignores '0' when padding on the right, and for integers
+	// when a precision is given.
+	zero := d.zero && !d.minus && !(prec != nil && (d.verb == 'd' || isRadixVerb(d.verb)))
+	if width != nil || sign != "" {
+		if width == nil {
+			width = cueInt(0)
+		}
+		s = c.fmtPadExpr(s, width, d.minus, zero, sign)
+	}
+	return s, nil
+}
+
+// isRadixVerb reports whether verb is one of the integer radix verbs.
+func isRadixVerb(verb rune) bool {
+	return strings.ContainsRune("boOxX", verb)
+}
+
+// fmtPadExpr builds (_fmtPad & {#in: s, #width: width, ...}).out,
+// omitting fields that have their default value.
+func (c *converter) fmtPadExpr(s, width ast.Expr, left, zero bool, sign string) ast.Expr {
+	c.addImport("strings")
+	c.usedHelpers["_fmtPad"] = HelperDef{Name: "_fmtPad", Def: fmtPadDef, Imports: []string{"strings"}}
+	fields := []ast.Decl{
+		&ast.Field{Label: ast.NewIdent("#in"), Value: s},
+		&ast.Field{Label: ast.NewIdent("#width"), Value: width},
+	}
+	if left {
+		fields = append(fields, &ast.Field{Label: ast.NewIdent("#left"), Value: ast.NewIdent("true")})
+	}
+	if zero {
+		fields = append(fields, &ast.Field{Label: ast.NewIdent("#zero"), Value: ast.NewIdent("true")})
+	}
+	if sign != "" {
+		fields = append(fields, &ast.Field{Label: ast.NewIdent("#sign"), Value: cueString(sign)})
+	}
+	return helperOutExpr("_fmtPad", fields...)
+}
@@ -12,45 +12,20 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package helm2cue
 
 import (
 	"flag"
 	"fmt"
 	"io/fs"
 	"os"
-	"os/exec"
 	"sort"
 	"sync"
 	"testing"
 
-	"github.com/rogpeppe/go-internal/testscript"
 	"golang.org/x/tools/txtar"
 )
 
-// runCue provides a "cue" command for testscript CLI tests.
-// It reads the GOTEST_CUE_PATH env var (set by Setup) to find
-// the cue binary resolved from "go tool -n cue".
-func runCue() int {
-	cuePath := os.Getenv("GOTEST_CUE_PATH")
-	if cuePath == "" {
-		fmt.Fprintln(os.Stderr, "GOTEST_CUE_PATH not set")
-		return 1
-	}
-	cmd := exec.Command(cuePath, os.Args[1:]...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return exitErr.ExitCode()
-		}
-		fmt.Fprintln(os.Stderr, err)
-		return 1
-	}
-	return 0
-}
-
 var testdataFS = newTrackingFS(os.DirFS("testdata"))
 
 // trackingFS wraps an fs.FS, recording every file that is opened
@@ -133,8 +108,7 @@ func parseTxtarFS(fsys fs.FS, name string) (*txtar.Archive, error) {
 }
 
 // testMainWrapper wraps *testing.M so we can run the testdata
-// coverage check after all tests complete but before testscript.Main
-// calls os.Exit.
+// coverage check after all tests complete.
 type testMainWrapper struct {
 	m *testing.M
 }
@@ -163,8 +137,5 @@ func (w *testMainWrapper) Run() int {
 }
 
 func TestMain(m *testing.M) {
-	testscript.Main(&testMainWrapper{m}, map[string]func(){
-		"helm2cue": func() { os.Exit(main1()) },
-		"cue":      func() { os.Exit(runCue()) },
-	})
+	os.Exit((&testMainWrapper{m}).Run())
 }
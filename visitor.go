@@ -0,0 +1,192 @@
+// Copyright 2026 The CUE Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm2cue
+
+import (
+	"maps"
+	"slices"
+	"text/template/parse"
+
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/ast/astutil"
+)
+
+// Visitor holds callbacks that rewrite the CUE the converter emits,
+// given the template node each part was converted from. Each callback
+// may modify the CUE node it is given, for example to add a comment or
+// attribute, and returns the node to emit in its place: the node itself
+// to keep it. A nil callback leaves its nodes unchanged.
+//
+// Fields and ranges are visited once a document or helper is complete,
+// innermost first, so that a callback sees the final CUE of the node's
+// contents, including any nodes that callbacks replaced.
+type Visitor struct {
+	// Document is called with the body of each non-empty document of a
+	// template, as a struct. If it returns another expression, such as
+	// #Resource & doc, the document is that expression. For a template
+	// whose document is a top-level range, doc is the body emitted per
+	// iteration.
+	Document func(root *parse.ListNode, doc *ast.StructLit) ast.Expr
+
+	// Field is called for each field converted from a YAML key. node is
+	// the innermost template node being converted when the field was
+	// emitted: usually the text node holding the key, but for a key
+	// whose value is complete only at the end of its block, the last
+	// node of the block, and for a key in a range body, the range.
+	Field func(node parse.Node, f *ast.Field) ast.Decl
+
+	// Helper is called with the value of each helper converted from a
+	// define, such as _mychart_labels, once it is complete. name is the
+	// template name, such as mychart.labels. A helper used both as
+	// text and as YAML fields has a second form, such as
+	// _mychart_labels_text, for which Helper is called again with the
+	// same name. The unrolled levels of a helper that includes itself
+	// are copies of the value Helper returned.
+	Helper func(name string, body []parse.Node, expr ast.Expr) ast.Expr
+
+	// Range is called for each comprehension converted from a range,
+	// including the comprehensions of ranges that build a string, as
+	// in strings.Join([for v in #values.xs {...}], ""). It is not
+	// called for a range that makes up a whole document.
+	Range func(n *parse.RangeNode, comp *ast.Comprehension) *ast.Comprehension
+}
+
+// recordEmitted records n as the template node that the field or range
+// comprehension x was converted from, for Config.Visitor.
+func (c *converter) recordEmitted(x ast.Node, n parse.Node) {
+	if c.config.Visitor == nil {
+		return
+	}
+	c.emitted[x] = n
+}
+
+// fieldNode returns the template node to record for a field emitted
+// now: the innermost node being converted, or, for a field emitted as
+// a block closes, the node converted last.
+func (c *converter) fieldNode() parse.Node {
+	if c.node != nil {
+		return c.node
+	}
+	return c.lastNode
+}
+
+// visitEmitted applies the Field and Range callbacks of Config.Visitor
+// to the fields and range comprehensions in x, returning the result.
+func (c *converter) visitEmitted(x ast.Node) ast.Node {
+	v := c.config.Visitor
+	return astutil.Apply(x, nil, func(cur astutil.Cursor) bool {
+		n, ok := c.emitted[cur.Node()]
+		if !ok {
+			return true
+		}
+		delete(c.emitted, cur.Node())
+		switch x := cur.Node().(type) {
+		case *ast.Field:
+			if v.Field != nil {
+				cur.Replace(v.Field(n, x))
+			}
+		case *ast.Comprehension:
+			if v.Range != nil {
+				cur.Replace(v.Range(n.(*parse.RangeNode), x))
+			}
+		}
+		return true
+	})
+}
+
+// visitDecls applies visitEmitted to each of decls.
+func (c *converter) visitDecls(decls []ast.Decl) []ast.Decl {
+	for i, d := range decls {
+		decls[i] = c.visitEmitted(d).(ast.Decl)
+	}
+	return decls
+}
+
+// visitDocument applies Config.Visitor to the document that c has
+// converted from root.
+func (c *converter) visitDocument(root *parse.ListNode) {
+	v := c.config.Visitor
+	if v == nil {
+		return
+	}
+	body := &c.rootDecls
+	if len(c.topLevelRange) > 0 && len(c.topLevelRangeBody) > 0 {
+		body = &c.topLevelRangeBody
+	}
+	*body = c.visitDecls(*body)
+	if v.Document == nil || len(*body) == 0 {
+		return
+	}
+	doc := &ast.StructLit{Elts: *body}
+	if x := v.Document(root, doc); x != doc {
+		*body = []ast.Decl{&ast.EmbedDecl{Expr: x}}
+	} else {
+		*body = doc.Elts
+	}
+}
+
+// visitHelper applies the Field and Range callbacks of Config.Visitor
+// to the converted value of the helper cueName. The Helper callback is
+// applied by visitHelperValue once conversion is complete, since
+// converting later call sites inspects the converted value.
+func (c *converter) visitHelper(cueName string, nodes []parse.Node) {
+	if c.config.Visitor == nil {
+		return
+	}
+	c.helperCUE[cueName] = c.visitEmitted(c.helperCUE[cueName]).(ast.Expr)
+}
+
+// visitHelperValues applies visitHelperValue to each converted helper
+// value and form, in name order.
+func (c *converter) visitHelperValues() {
+	if c.config.Visitor == nil || c.config.Visitor.Helper == nil {
+		return
+	}
+	for _, cueName := range slices.Sorted(maps.Keys(c.helperCUE)) {
+		c.visitHelperValue(cueName)
+	}
+}
+
+// visitHelperValue applies the Helper callback of Config.Visitor to
+// the helper value or form cueName.
+func (c *converter) visitHelperValue(cueName string) {
+	v := c.config.Visitor
+	if v == nil || v.Helper == nil {
+		return
+	}
+	name, ok := c.helperTemplateName(cueName)
+	if !ok {
+		return
+	}
+	var nodes []parse.Node
+	if tree := c.treeSet[name]; tree != nil && tree.Root != nil {
+		nodes = tree.Root.Nodes
+	}
+	c.helperCUE[cueName] = v.Helper(name, nodes, c.helperCUE[cueName])
+}
+
+// helperTemplateName returns the template name of the helper whose
+// value, or other-typed form (see helperForm), is the CUE field
+// cueName.
+func (c *converter) helperTemplateName(cueName string) (string, bool) {
+	for name, cn := range c.helperExprs {
+		if cn == cueName ||
+			helperFormName(cn, "scalar", c.helperExprs) == cueName ||
+			helperFormName(cn, "struct", c.helperExprs) == cueName {
+			return name, true
+		}
+	}
+	return "", false
+}